@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 )
 
@@ -19,20 +20,44 @@ var (
 	localAddr        string
 	upstreamDns      string
 	filterDomainFile string
+	categoryFiles    string
+	allowlistFile    string
+	adminAddr        string
+	hostsFile        string
+	zoneFile         string
+	dnstapOutput     string
+	logTarget        string
+	cacheHandoffFile string
+	fixturesDir      string
+	configFile       string
+	maxEntries       int
+	recursive        bool
 	filterList       *filter.FilterList
+	filterOptions    filter.FilterOptions // limits of the filter lists, from the config
 )
 
 func init() {
 	flag.BoolVar(&start, "s", false, "Start the Server")
 	flag.StringVar(&localAddr, "a", "0.0.0.0", "Address that the DNS server will listen")
-	flag.StringVar(&upstreamDns, "d", "1.1.1.1,8.8.8.8", "Upstream DNS to consult ips")
+	flag.StringVar(&upstreamDns, "d", "1.1.1.1,8.8.8.8", "Upstream DNS to consult, plain ips or udp://, tcp://, tls:// and https:// urls")
 	flag.StringVar(&filterDomainFile, "f", "", "Path to file with domains to be filtered")
+	flag.StringVar(&categoryFiles, "c", "", "Filter lists whose rules can be disabled by category from the admin API, e.g. ads=ads.txt,social=social.txt")
+	flag.IntVar(&maxEntries, "n", 0, "Most filter rules loaded from the lists, the rest is left out with a warning (0 is no limit)")
+	flag.StringVar(&allowlistFile, "w", "", "Path to file with domains that are never filtered")
+	flag.StringVar(&adminAddr, "m", "", "Address of the admin API (e.g. 127.0.0.1:8053), disabled when empty")
+	flag.StringVar(&hostsFile, "l", "", "Path to a hosts file with local names answered without upstream")
+	flag.StringVar(&zoneFile, "z", "", "Path to a zone file with local records (A, AAAA, HTTPS, SVCB)")
+	flag.BoolVar(&recursive, "r", false, "Resolve from the root servers instead of forwarding to the upstream DNS")
+	flag.StringVar(&dnstapOutput, "t", "", "Dnstap output for query logs, a file or unix:/path/to/socket")
+	flag.StringVar(&logTarget, "o", "file", "Where the logs go: file ("+logger.DefaultPath+"), stderr or syslog")
+	flag.StringVar(&fixturesDir, "x", "", "Directory of wire format responses named after the query (e.g. example.com:1) answered instead of the upstream DNS, for offline use")
+	flag.StringVar(&configFile, "j", "", "Json config file read on top of the flags, read again on SIGHUP to swap the upstreams, filter mode, min TTL and sinkhole host")
+	flag.StringVar(&cacheHandoffFile, "k", "", "File the cache is saved to on shutdown and loaded from on start, for restarts with a warm cache")
 }
 
 func main() {
 	flag.Parse()
 	verifications()
-	getFilterList()
 	startServer()
 }
 
@@ -48,21 +73,125 @@ func verifications() {
 	}
 }
 
-func getFilterList() {
-	if filterDomainFile == "" {
-		return
+// points the global logger at the target of the config, once before the server starts
+func setupLogger(config server.Config) {
+	if err = logger.UseTarget(config.LogTarget, config.LogFacility, config.LogTag); err != nil {
+		logger.Error(fmt.Sprintf("failed to set the log target: %v", err))
+	}
+	logger.SetDebug(config.LogDebug)
+}
+
+func getFilterList(config server.Config) {
+	filterOptions = listOptions(config)
+	filterList = loadFilterList()
+}
+
+func listOptions(config server.Config) filter.FilterOptions {
+	return filter.FilterOptions{MaxEntries: config.MaxBlocklistEntries, MaxLineLength: config.MaxBlocklistLineLength}
+}
+
+// nil when no filter file was given
+func loadFilterList() *filter.FilterList {
+	if filterDomainFile == "" && categoryFiles == "" {
+		return nil
 	}
 
+	var (
+		list     *filter.FilterList = filter.NewFilterListWithOptions(filterOptions)
+		category string
+		file     string
+		found    bool
+	)
+	if filterDomainFile != "" {
+		loadFilterFile(list, filterDomainFile, "")
+	}
+	for _, entry := range strings.Split(categoryFiles, ",") {
+		category, file, found = strings.Cut(strings.TrimSpace(entry), "=")
+		if !found || category == "" || file == "" {
+			if entry != "" {
+				logger.Error("Skipping category list " + entry + ", expected category=file")
+			}
+			continue
+		}
+		loadFilterFile(list, file, category)
+	}
+	return list
+}
+
+func loadFilterFile(list *filter.FilterList, filename string, category string) {
 	var (
 		absolutePath string
+		metadata     filter.ListMetadata
 		err          error
 	)
-	absolutePath, err = filepath.Abs(filterDomainFile)
+	absolutePath, err = filepath.Abs(filename)
 	if err != nil {
 		logger.Error("File path to the filter list returned an error.")
 	}
-	filterList = filter.NewFilterList()
-	filterList.LoadFromFile(absolutePath)
+	if metadata, err = list.LoadFromFileCategory(absolutePath, category); err != nil {
+		logger.Error(fmt.Sprintf("Failed to load the filter list: %v", err))
+	}
+	if metadata.Title != "" {
+		logger.Info(fmt.Sprintf("Filter list: %s (version %s, expires %s)", metadata.Title, metadata.Version, metadata.Expires))
+	}
+}
+
+// the config from the flags, with the -j file on top when given
+// localhost is answered locally unless the file sets answer_localhost to false
+func loadConfig() (server.Config, error) {
+	var config server.Config = server.Config{LocalAddr: localAddr + ":53", UpstreamDns: upstreamDns, FilterMode: "nxdomain", AllowlistFile: allowlistFile, AdminAddr: adminAddr, AnswerLocalhost: true, HostsFile: hostsFile, ZoneFile: zoneFile, LogTarget: logTarget, CacheHandoffFile: cacheHandoffFile, MaxBlocklistEntries: maxEntries}
+	if configFile == "" {
+		return config, nil
+	}
+	return server.LoadConfig(configFile, config)
+}
+
+// reloads the config file and the filter file on SIGHUP until the context is cancelled
+// a config that fails to load or validate keeps the current one
+func reloadOnHangup(ctx context.Context, dnsServer *server.DNSServer) {
+	var (
+		hupChan chan os.Signal = make(chan os.Signal, 1)
+		err     error
+	)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+
+	for {
+		select {
+		case <-hupChan:
+			logger.Info("Reloading the config and the filter list, received SIGHUP")
+			if configFile != "" {
+				reloadConfig(dnsServer)
+			}
+			dnsServer.ReloadFilter(loadFilterList())
+			if err = dnsServer.ReloadLeases(); err != nil {
+				logger.Error(err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func reloadConfig(dnsServer *server.DNSServer) {
+	var (
+		config   server.Config
+		resolver server.Resolver
+		err      error
+	)
+	if config, err = loadConfig(); err != nil {
+		logger.Error("Failed to read the config file, keeping the current config: " + err.Error())
+		return
+	}
+	if resolver, err = newResolver(config); err != nil {
+		logger.Error("Invalid upstream DNS, keeping the current config: " + err.Error())
+		return
+	}
+	if err = dnsServer.ReloadConfig(config, resolver); err != nil {
+		logger.Error("Invalid config, keeping the current one: " + err.Error())
+		return
+	}
+	filterOptions = listOptions(config)
 }
 
 func startServer() {
@@ -84,13 +213,49 @@ func startServer() {
 	}()
 
 	if start {
-
 		var (
-			dnsPort  string                   = ":53"
-			config   server.Config            = server.Config{LocalAddr: localAddr + dnsPort, UpstreamDns: upstreamDns, FilterMode: "nxdomain"}
-			resolver *server.UpstreamResolver = server.NewUpstreamResolver(config.UpstreamDns)
-			server   *server.DNSServer        = server.NewDNSServer(config, resolver, filterList)
+			config   server.Config
+			resolver server.Resolver
+			dnstap   *server.DnstapLogger
 		)
+		if config, err = loadConfig(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to read the config file: "+err.Error())
+			os.Exit(1)
+		}
+		setupLogger(config)
+		if config.StartupBehavior == "" {
+			getFilterList(config)
+		} else {
+			filterOptions = listOptions(config)
+		}
+		if dnstapOutput != "" {
+			if dnstap, err = openDnstap(dnstapOutput); err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to open the dnstap output: "+err.Error())
+				os.Exit(1)
+			}
+		}
+
+		if resolver, err = newResolver(config); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid upstream DNS: "+err.Error())
+			os.Exit(1)
+		}
+
+		var server *server.DNSServer = server.NewDNSServer(config, resolver, filterList)
+		if dnstap != nil {
+			defer dnstap.Close()
+			server.SetQueryLogger(dnstap)
+		}
+
+		if config.StartupBehavior != "" {
+			// answer right away, filtering starts once the list is loaded
+			go func() {
+				server.ReloadFilter(loadFilterList())
+				server.MarkReady()
+			}()
+		}
+
+		go reloadOnHangup(ctx, server)
+
 		if err = server.Start(ctx); err != nil {
 			logger.Error("Server gave an error: " + err.Error())
 			fmt.Fprintln(os.Stderr, "Server had an error while starting, is port 53 free?")
@@ -98,3 +263,21 @@ func startServer() {
 		}
 	}
 }
+
+// unix: prefixed outputs go to a dnstap collector socket, anything else is a file
+func openDnstap(output string) (*server.DnstapLogger, error) {
+	if strings.HasPrefix(output, "unix:") {
+		return server.NewDnstapSocketLogger(strings.TrimPrefix(output, "unix:"))
+	}
+	return server.NewDnstapFileLogger(output)
+}
+
+func newResolver(config server.Config) (server.Resolver, error) {
+	if fixturesDir != "" {
+		return server.NewFileResolver(fixturesDir)
+	}
+	if recursive {
+		return server.NewRecursiveResolver(), nil
+	}
+	return server.NewResolver(config)
+}
@@ -1,3 +1,5 @@
 module flash-dns
 
 go 1.24.6
+
+require golang.org/x/net v0.38.0
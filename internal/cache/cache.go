@@ -1,23 +1,54 @@
 package cache
 
 import (
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// rough size of a CacheEntry plus its map slot, used by MemoryBytes
+const ENTRY_OVERHEAD_BYTES int64 = 128
+
+// reasons passed to the OnEvict callback
+const (
+	EVICT_SIZE    string = "size"    // the cache was full, the least valuable entry made room
+	EVICT_EXPIRED string = "expired" // past the grace period, dropped by Get or Clean
 )
 
 var (
 	CACHE_MAX_SIZE       int           = 1024
-	GRACE_PERIOD         time.Duration = 5 * time.Minute // How long to accept expired entries
-	POPULARITY_THRESHOLD int64         = 5               // lower than that triggers eviction
-	PREFETCH_THRESHOLD   float64       = 0.8             // 80%
+	CACHE_SHARDS         int           = 16               // lock shards, a power of two
+	GRACE_PERIOD         time.Duration = 5 * time.Minute  // How long to accept expired entries
+	POPULARITY_THRESHOLD int64         = 5                // lower than that triggers eviction
+	PREFETCH_THRESHOLD   float64       = 0.8              // 80%, refresh with the last 20% of the TTL left...
+	PREFETCH_MIN_LEAD    time.Duration = 10 * time.Second // ...but at least this long before expiry
+	PREFETCH_MAX_LEAD    time.Duration = 30 * time.Second // ...and at most this long
 )
 
+// CLOCK
+// lets tests move time forward instead of sleeping
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
 // CACHE ENTRY
 type CacheEntry struct {
+	Key         string // the full key, Get checks it when the map is indexed by a hash of it
 	CreatedAt   time.Time
 	ExpiresAt   time.Time
 	Response    []byte
+	Source      string // upstream that produced the answer, empty when unknown
 	LastAccess  atomic.Int64
 	popularity  atomic.Int64 // internal metric
 	originalTTL uint32
@@ -31,23 +62,44 @@ func (ce *CacheEntry) IsStale(now time.Time) bool {
 	return now.After(ce.ExpiresAt) && now.Before(ce.ExpiresAt.Add(GRACE_PERIOD))
 }
 
-func (ce *CacheEntry) IsCompletelyExpired() bool {
-	var now time.Time = time.Now()
+func (ce *CacheEntry) IsCompletelyExpired(now time.Time) bool {
 	return now.After(ce.ExpiresAt.Add(GRACE_PERIOD))
 }
 
-func (ce *CacheEntry) ShouldPrefetch() bool {
+func (ce *CacheEntry) ShouldPrefetch(now time.Time) bool {
+	return ce.prefetchDue(now, PREFETCH_MIN_LEAD, PREFETCH_MAX_LEAD)
+}
+
+// popular entries are refreshed once they are within the lead time of expiry
+func (ce *CacheEntry) prefetchDue(now time.Time, minLead time.Duration, maxLead time.Duration) bool {
 	if !ce.IsPopular() {
 		return false
 	}
 
 	var (
-		now time.Time     = time.Now()
-		age time.Duration = now.Sub(ce.CreatedAt)
-		ttl time.Duration = time.Duration(ce.originalTTL) * time.Second
+		ttl       time.Duration = time.Duration(ce.originalTTL) * time.Second
+		remaining time.Duration = ce.CreatedAt.Add(ttl).Sub(now)
 	)
 
-	return age >= time.Duration(float64(ttl)*PREFETCH_THRESHOLD)
+	return remaining <= prefetchLead(ttl, minLead, maxLead)
+}
+
+// (1 - PREFETCH_THRESHOLD) of the TTL kept between minLead and maxLead, so a 30s
+// TTL still gets its runway and a 1 day TTL isn't refreshed hours early
+// never more than half the TTL, tiny TTLs would be refreshed on every hit
+func prefetchLead(ttl time.Duration, minLead time.Duration, maxLead time.Duration) time.Duration {
+	var lead time.Duration = ttl - time.Duration(float64(ttl)*PREFETCH_THRESHOLD)
+	if lead < minLead {
+		lead = minLead
+	}
+	if maxLead > 0 && lead > maxLead {
+		lead = maxLead
+	}
+	if lead > ttl/2 {
+		lead = ttl / 2
+	}
+
+	return lead
 }
 
 func (ce *CacheEntry) increasePopularity() {
@@ -58,50 +110,192 @@ func (ce *CacheEntry) decreasePopularity() {
 	_ = ce.popularity.Add(-1)
 }
 
-func (ce *CacheEntry) TimeSinceLastAccess() time.Duration {
+func (ce *CacheEntry) TimeSinceLastAccess(now time.Time) time.Duration {
 	var lastAccess time.Time = time.Unix(ce.LastAccess.Load(), 0)
-	return time.Since(lastAccess)
+	return now.Sub(lastAccess)
 }
 
 // DNS CACHE
+// entries are spread over shards by a hash of the key, each with its own lock,
+// so queries for different names don't wait on each other
 type DNSCache struct {
+	shards      []*cacheShard
+	mask        uint32 // len(shards) - 1, the shard count is a power of two
+	maxSize     int
+	count       atomic.Int64 // entries across all shards
+	memoryBytes atomic.Int64 // kept up to date on every insert and delete
+	clock       Clock
+	onEvict     func(key string, reason string) // nil when nobody listens
+	minLead     time.Duration                   // prefetch lead bounds, see SetPrefetchLead
+	maxLead     time.Duration
+	slotKey     func(key string) string // map index of a key, nil for the key itself, see SetKeyHasher
+	collisions  atomic.Uint64           // lookups that found the entry of another key in the slot
+	keepExpired bool                    // Get leaves entries past the grace period to Clean, see GetExpired
+
+	// refreshes of the entries Get flagged, counted by whoever runs them
+	prefetchAttempts  atomic.Uint64
+	prefetchSuccesses atomic.Uint64
+	prefetchFailures  atomic.Uint64
+}
+
+// counters of the cache, see DNSCache.Stats
+type CacheStats struct {
+	Entries           int    `json:"entries"`
+	MemoryBytes       int64  `json:"memory_bytes"`
+	PrefetchAttempts  uint64 `json:"prefetch_attempts"`
+	PrefetchSuccesses uint64 `json:"prefetch_successes"`
+	PrefetchFailures  uint64 `json:"prefetch_failures"`
+	KeyCollisions     uint64 `json:"key_collisions"`
+}
+
+type cacheShard struct {
 	mu      sync.RWMutex
 	entries map[string]*CacheEntry
-	maxSize int
+	domains map[string]map[string]struct{} // slots by registered domain of the key, for InvalidateDomain
 }
 
 func NewDNSCache() *DNSCache {
-	return &DNSCache{
-		entries: make(map[string]*CacheEntry, CACHE_MAX_SIZE),
+	return NewDNSCacheWithClock(realClock{})
+}
+
+func NewDNSCacheWithClock(clock Clock) *DNSCache {
+	return newDNSCache(CACHE_SHARDS, clock)
+}
+
+// cache split in the given number of shards, rounded up to a power of two
+// values <= 0 use CACHE_SHARDS
+func NewShardedDNSCache(shards int) *DNSCache {
+	return newDNSCache(shards, realClock{})
+}
+
+func newDNSCache(shards int, clock Clock) *DNSCache {
+	var (
+		count int = 1
+		cache *DNSCache
+		i     int
+	)
+	if shards <= 0 {
+		shards = CACHE_SHARDS
+	}
+	for count < shards {
+		count <<= 1
+	}
+
+	cache = &DNSCache{
+		shards:  make([]*cacheShard, count),
+		mask:    uint32(count - 1),
 		maxSize: CACHE_MAX_SIZE,
+		clock:   clock,
+		minLead: PREFETCH_MIN_LEAD,
+		maxLead: PREFETCH_MAX_LEAD,
+	}
+	for i = range cache.shards {
+		cache.shards[i] = &cacheShard{entries: make(map[string]*CacheEntry, CACHE_MAX_SIZE/count), domains: make(map[string]map[string]struct{})}
+	}
+
+	return cache
+}
+
+// calls fn for every entry evicted, with EVICT_SIZE or EVICT_EXPIRED as the reason
+// no lock is held during the call, so fn can use the cache; set it before the cache is in use
+func (c *DNSCache) SetOnEvict(fn func(key string, reason string)) {
+	c.onEvict = fn
+}
+
+// popular entries ask for a refresh when (1 - PREFETCH_THRESHOLD) of their TTL is
+// left, bounded by minLead and maxLead; zero values keep the defaults
+// set it before the cache is in use
+func (c *DNSCache) SetPrefetchLead(minLead time.Duration, maxLead time.Duration) {
+	if minLead > 0 {
+		c.minLead = minLead
+	}
+	if maxLead > 0 {
+		c.maxLead = maxLead
 	}
 }
 
+// with keep set, Get misses on entries past the grace period without removing
+// them, GetExpired still returns them until Clean runs; set it before the cache is in use
+func (c *DNSCache) SetKeepExpired(keep bool) {
+	c.keepExpired = keep
+}
+
+// indexes the entries by fn(key) instead of the key, e.g. a hash of a long subnet key
+// keys sharing a slot replace each other and Get never serves the entry of another
+// key, it's a miss counted in KeyCollisions; set it before the cache is in use
+func (c *DNSCache) SetKeyHasher(fn func(key string) string) {
+	c.slotKey = fn
+}
+
+func (c *DNSCache) slot(key string) string {
+	if c.slotKey == nil {
+		return key
+	}
+	return c.slotKey(key)
+}
+
+func (c *DNSCache) notifyEvict(key string, reason string) {
+	if c.onEvict != nil {
+		c.onEvict(key, reason)
+	}
+}
+
+// FNV-1a of the key, inlined so picking a shard doesn't allocate
+func (c *DNSCache) shardFor(key string) *cacheShard {
+	var (
+		hash uint32 = 2166136261
+		i    int
+	)
+	for i = 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+
+	return c.shards[hash&c.mask]
+}
+
 func (c *DNSCache) Get(key string) ([]byte, bool, bool) {
 	var (
+		slot         string      = c.slot(key)
+		shard        *cacheShard = c.shardFor(slot)
 		entry        *CacheEntry = nil
 		found        bool        = false
 		needsRefresh bool        = false
-		now          time.Time   = time.Now()
+		removed      bool
+		now          time.Time = c.clock.Now()
 	)
-	c.mu.RLock()
-	entry, found = c.entries[key]
-	c.mu.RUnlock()
+	shard.mu.RLock()
+	entry, found = shard.entries[slot]
+	shard.mu.RUnlock()
 
 	if !found {
 		return nil, found, needsRefresh
 	}
+	if entry.Key != key {
+		_ = c.collisions.Add(1)
+		return nil, false, needsRefresh
+	}
 
 	// update statistics
 	entry.increasePopularity()
 	entry.LastAccess.Store(now.Unix())
 
-	if entry.IsCompletelyExpired() {
-		c.mu.Lock()
-		delete(c.entries, key)
+	if entry.IsCompletelyExpired(now) {
+		if c.keepExpired { // left for GetExpired until Clean
+			return nil, false, needsRefresh
+		}
+
+		shard.mu.Lock()
+		if shard.entries[slot] == entry { // it may have been replaced meanwhile
+			c.removeLocked(shard, slot, entry)
+			removed = true
+		}
 		found = false
-		c.mu.Unlock()
+		shard.mu.Unlock()
 
+		if removed {
+			c.notifyEvict(key, EVICT_EXPIRED)
+		}
 		return nil, found, needsRefresh
 	}
 
@@ -109,7 +303,7 @@ func (c *DNSCache) Get(key string) ([]byte, bool, bool) {
 		needsRefresh = true
 	}
 
-	if entry.ShouldPrefetch() {
+	if entry.prefetchDue(now, c.minLead, c.maxLead) {
 		needsRefresh = true
 	}
 
@@ -117,61 +311,363 @@ func (c *DNSCache) Get(key string) ([]byte, bool, bool) {
 }
 
 func (c *DNSCache) Set(key string, response []byte, ttl uint32) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if len(c.entries) >= c.maxSize {
-		var exists bool
-		if _, exists = c.entries[key]; !exists {
-			c.evictOne()
-		}
-	}
+	c.SetWithSource(key, response, ttl, "")
+}
 
+// like Set, remembering which upstream the answer came from
+// a full cache evicts before taking the shard lock, so concurrent sets
+// of new keys may go a few entries over maxSize
+func (c *DNSCache) SetWithSource(key string, response []byte, ttl uint32, source string) {
 	var (
-		now time.Time = time.Now()
+		slot     string      = c.slot(key)
+		shard    *cacheShard = c.shardFor(slot)
+		now      time.Time   = c.clock.Now()
+		previous *CacheEntry
+		entry    *CacheEntry
+		exists   bool
 	)
-	c.entries[key] = &CacheEntry{
+	shard.mu.RLock()
+	_, exists = shard.entries[slot]
+	shard.mu.RUnlock()
+
+	if !exists && int(c.count.Load()) >= c.maxSize {
+		c.evictOne(shard)
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if previous, exists = shard.entries[slot]; exists {
+		c.removeLocked(shard, slot, previous)
+	}
+
+	entry = &CacheEntry{
+		Key:         key,
 		Response:    response,
+		Source:      source,
 		CreatedAt:   now,
 		ExpiresAt:   now.Add(time.Duration(ttl) * time.Second),
 		originalTTL: ttl,
 	}
+	entry.LastAccess.Store(now.Unix())
+	entry.popularity.Store(1)
 
-	c.entries[key].LastAccess.Store(now.Unix())
-	c.entries[key].popularity.Store(1)
+	shard.entries[slot] = entry
+	shard.index(slot, key)
+	c.count.Add(1)
+	c.memoryBytes.Add(entrySize(key, response))
 }
 
 func (c *DNSCache) Clean() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	var (
+		now     time.Time = c.clock.Now()
+		expired []string
+	)
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for slot, entry := range shard.entries {
+			if entry.IsCompletelyExpired(now) {
+				c.removeLocked(shard, slot, entry)
+				expired = append(expired, entry.Key)
+			}
+		}
+		shard.mu.Unlock()
+	}
 
-	for key, entry := range c.entries {
-		if entry.IsCompletelyExpired() {
-			delete(c.entries, key)
+	for _, key := range expired {
+		c.notifyEvict(key, EVICT_EXPIRED)
+	}
+}
+
+// the response of the entry however old it is, for a last resort answer when the
+// upstream is unreachable; entries past the grace period only stay with SetKeepExpired
+func (c *DNSCache) GetExpired(key string) ([]byte, bool) {
+	var (
+		slot  string      = c.slot(key)
+		shard *cacheShard = c.shardFor(slot)
+		entry *CacheEntry
+		found bool
+	)
+	shard.mu.RLock()
+	entry, found = shard.entries[slot]
+	shard.mu.RUnlock()
+
+	if !found || entry.Key != key {
+		return nil, false
+	}
+	return entry.Response, true
+}
+
+// true when the entry expired but is still within the grace period
+func (c *DNSCache) IsStale(key string) bool {
+	var (
+		slot  string      = c.slot(key)
+		shard *cacheShard = c.shardFor(slot)
+		entry *CacheEntry
+		found bool
+	)
+	shard.mu.RLock()
+	entry, found = shard.entries[slot]
+	shard.mu.RUnlock()
+
+	return found && entry.Key == key && entry.IsStale(c.clock.Now())
+}
+
+// point in time copy of an entry, for dumps and debugging
+type EntrySnapshot struct {
+	Key       string
+	Source    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	Size      int
+}
+
+// copies the metadata of every entry, sorted by key
+func (c *DNSCache) Snapshot() []EntrySnapshot {
+	var snapshot []EntrySnapshot = make([]EntrySnapshot, 0, c.Len())
+	for _, shard := range c.shards {
+		shard.mu.RLock()
+		for _, entry := range shard.entries {
+			snapshot = append(snapshot, EntrySnapshot{
+				Key:       entry.Key,
+				Source:    entry.Source,
+				CreatedAt: entry.CreatedAt,
+				ExpiresAt: entry.ExpiresAt,
+				Size:      len(entry.Response),
+			})
+		}
+		shard.mu.RUnlock()
+	}
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].Key < snapshot[j].Key
+	})
+
+	return snapshot
+}
+
+// removes the entries of the domain and its subdomains for every query type,
+// returns how many were removed
+// the types of a domain hash to different shards, so every shard is checked but
+// only through the entries indexed under the registered domain; a public suffix
+// like "com" or "co.uk" has no registered domain and scans every entry
+func (c *DNSCache) InvalidateDomain(domain string) int {
+	var (
+		registered string
+		entry      *CacheEntry
+		ok         bool
+		removed    int
+	)
+	if registered, ok = registeredDomain(domain); !ok {
+		return c.invalidateScan(domain)
+	}
+
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for slot := range shard.domains[registered] {
+			if entry = shard.entries[slot]; inDomain(KeyDomain(entry.Key), domain) {
+				c.removeLocked(shard, slot, entry)
+				removed++
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	return removed
+}
+
+func (c *DNSCache) invalidateScan(domain string) int {
+	var removed int
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for slot, entry := range shard.entries {
+			if inDomain(KeyDomain(entry.Key), domain) {
+				c.removeLocked(shard, slot, entry)
+				removed++
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	return removed
+}
+
+// true for the domain itself and its subdomains
+func inDomain(name string, domain string) bool {
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// the public suffix plus one label, e.g. example.co.uk for a.b.example.co.uk
+// false for names that are a public suffix themselves
+func registeredDomain(name string) (string, bool) {
+	var (
+		registered string
+		err        error
+	)
+	if registered, err = publicsuffix.EffectiveTLDPlusOne(name); err != nil {
+		return "", false
+	}
+	return registered, true
+}
+
+// the bucket of the domain index a key goes to, names without a registered
+// domain get their own
+func indexDomain(key string) string {
+	var (
+		domain     string = KeyDomain(key)
+		registered string
+		ok         bool
+	)
+	if registered, ok = registeredDomain(domain); ok {
+		return registered
+	}
+	return domain
+}
+
+// must be called with the shard's write lock held
+func (s *cacheShard) index(slot string, key string) {
+	var (
+		bucket string = indexDomain(key)
+		slots  map[string]struct{}
+		found  bool
+	)
+	if slots, found = s.domains[bucket]; !found {
+		slots = make(map[string]struct{})
+		s.domains[bucket] = slots
+	}
+	slots[slot] = struct{}{}
+}
+
+// must be called with the shard's write lock held
+func (s *cacheShard) unindex(slot string, key string) {
+	var bucket string = indexDomain(key)
+	delete(s.domains[bucket], slot)
+	if len(s.domains[bucket]) == 0 {
+		delete(s.domains, bucket)
+	}
+}
+
+// domain part of a cache key, keys look like domain:qtype or domain:qtype:do
+func KeyDomain(key string) string {
+	var domain string
+	domain, _, _ = strings.Cut(key, ":")
+	return domain
+}
+
+// query type of a cache key, zero when the key doesn't have one
+func KeyType(key string) uint16 {
+	var (
+		rest  string
+		qtype uint64
+	)
+	_, rest, _ = strings.Cut(key, ":")
+	rest, _, _ = strings.Cut(rest, ":")
+	qtype, _ = strconv.ParseUint(rest, 10, 16)
+	return uint16(qtype)
+}
+
+// number of entries, expired ones not cleaned yet included
+func (c *DNSCache) Len() int {
+	return int(c.count.Load())
+}
+
+// estimated memory used by the cache: keys, responses and ENTRY_OVERHEAD_BYTES per entry
+func (c *DNSCache) MemoryBytes() int64 {
+	return c.memoryBytes.Load()
+}
+
+// called when a refresh of an entry flagged by Get starts
+func (c *DNSCache) RecordPrefetchAttempt() {
+	_ = c.prefetchAttempts.Add(1)
+}
+
+// called when that refresh stored a new answer (true) or gave up (false)
+// refreshes abandoned on shutdown are neither, attempts can exceed the sum
+func (c *DNSCache) RecordPrefetchResult(success bool) {
+	if success {
+		_ = c.prefetchSuccesses.Add(1)
+		return
+	}
+	_ = c.prefetchFailures.Add(1)
+}
+
+func (c *DNSCache) Stats() CacheStats {
+	return CacheStats{
+		Entries:           c.Len(),
+		MemoryBytes:       c.MemoryBytes(),
+		PrefetchAttempts:  c.prefetchAttempts.Load(),
+		PrefetchSuccesses: c.prefetchSuccesses.Load(),
+		PrefetchFailures:  c.prefetchFailures.Load(),
+		KeyCollisions:     c.collisions.Load(),
+	}
+}
+
+// must be called with the shard's write lock held
+func (c *DNSCache) removeLocked(shard *cacheShard, slot string, entry *CacheEntry) {
+	delete(shard.entries, slot)
+	shard.unindex(slot, entry.Key)
+	c.count.Add(-1)
+	c.memoryBytes.Add(-entrySize(entry.Key, entry.Response))
+}
+
+func entrySize(key string, response []byte) int64 {
+	return int64(len(key)+len(response)) + ENTRY_OVERHEAD_BYTES
+}
+
+// evicts from the shard the new key goes to, or the first other shard with entries
+// when that one is empty, only one shard lock is held at a time
+func (c *DNSCache) evictOne(preferred *cacheShard) {
+	var (
+		key     string
+		evicted bool
+	)
+	if key, evicted = c.evictFrom(preferred); !evicted {
+		for _, shard := range c.shards {
+			if shard == preferred {
+				continue
+			}
+			if key, evicted = c.evictFrom(shard); evicted {
+				break
+			}
 		}
 	}
+
+	if evicted {
+		c.notifyEvict(key, EVICT_SIZE)
+	}
 }
 
-func (c *DNSCache) evictOne() {
+// removes the least valuable entry of the shard and returns its key, false when it's empty
+// ties go to the less popular entry
+func (c *DNSCache) evictFrom(shard *cacheShard) (string, bool) {
 	var (
 		worstKey        string
+		worstEntry      *CacheEntry
 		worstScore      float64 = -1
 		timeSinceAccess float64
 		popularity      float64
 		score           float64
+		now             time.Time = c.clock.Now()
 	)
-	for k, v := range c.entries {
-		timeSinceAccess = v.TimeSinceLastAccess().Seconds()
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	for k, v := range shard.entries {
+		timeSinceAccess = v.TimeSinceLastAccess(now).Seconds()
 		popularity = float64(v.popularity.Load())
 		score = timeSinceAccess / (popularity + 1)
 
-		if score > worstScore {
+		if score > worstScore || (score == worstScore && v.popularity.Load() < worstEntry.popularity.Load()) {
 			worstScore = score
 			worstKey = k
+			worstEntry = v
 		}
 	}
 
-	if worstKey != "" {
-		delete(c.entries, worstKey)
+	if worstEntry == nil {
+		return "", false
 	}
+
+	c.removeLocked(shard, worstKey, worstEntry)
+	return worstEntry.Key, true
 }
@@ -1,10 +1,49 @@
 package cache
 
 import (
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// fakeClock only moves when Advance is called
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// reads an entry straight from its shard, without Get's side effects
+func lookupEntry(c *DNSCache, key string) (*CacheEntry, bool) {
+	var (
+		shard *cacheShard = c.shardFor(c.slot(key))
+		entry *CacheEntry
+		found bool
+	)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	entry, found = shard.entries[c.slot(key)]
+	return entry, found
+}
+
 // TEST 1: Basic Get/Set operations
 // Tests that we can store and retrieve data from cache
 func TestDNSCache_BasicGetSet(t *testing.T) {
@@ -82,9 +121,8 @@ func TestCacheEntry_PopularityTracking(t *testing.T) {
 	}
 
 	// Get entry to check popularity
-	cache.mu.RLock()
-	var entry *CacheEntry = cache.entries[key]
-	cache.mu.RUnlock()
+	var entry *CacheEntry
+	entry, _ = lookupEntry(cache, key)
 
 	if !entry.IsPopular() {
 		t.Errorf("Entry should be popular after %d accesses", i)
@@ -106,7 +144,7 @@ func TestCacheEntry_StaleDetection(t *testing.T) {
 	if !entry.IsStale(now) {
 		t.Error("Entry should be stale")
 	}
-	if entry.IsCompletelyExpired() {
+	if entry.IsCompletelyExpired(now) {
 		t.Error("Entry should not be completely expired yet")
 	}
 }
@@ -115,7 +153,8 @@ func TestCacheEntry_StaleDetection(t *testing.T) {
 // Tests that entries beyond grace period are deleted
 func TestDNSCache_CompleteExpiration(t *testing.T) {
 	var (
-		cache          *DNSCache     = NewDNSCache()
+		clock          *fakeClock    = newFakeClock()
+		cache          *DNSCache     = NewDNSCacheWithClock(clock)
 		key            string        = "expired.com"
 		response       []byte        = []byte("5.6.7.8")
 		ttl            uint32        = 1 // 1 second TTL
@@ -129,8 +168,8 @@ func TestDNSCache_CompleteExpiration(t *testing.T) {
 	}()
 
 	GRACE_PERIOD = 1 * time.Millisecond
-	// Wait for complete expiration (TTL + grace period)
-	time.Sleep(time.Duration(ttl)*time.Second + GRACE_PERIOD + 10*time.Millisecond)
+	// Move past complete expiration (TTL + grace period)
+	clock.Advance(time.Duration(ttl)*time.Second + GRACE_PERIOD + 10*time.Millisecond)
 
 	var (
 		result []byte
@@ -146,10 +185,8 @@ func TestDNSCache_CompleteExpiration(t *testing.T) {
 	}
 
 	// Verify it's removed from cache
-	cache.mu.RLock()
 	var exists bool
-	_, exists = cache.entries[key]
-	cache.mu.RUnlock()
+	_, exists = lookupEntry(cache, key)
 
 	if exists {
 		t.Error("Expired entry should be deleted from cache")
@@ -176,7 +213,7 @@ func TestCacheEntry_PrefetchThreshold(t *testing.T) {
 		entry.increasePopularity()
 	}
 
-	if !entry.ShouldPrefetch() {
+	if !entry.ShouldPrefetch(now) {
 		t.Error("Popular entry past threshold should trigger prefetch")
 	}
 }
@@ -208,9 +245,7 @@ func TestDNSCache_Eviction(t *testing.T) {
 	cache.Set(newKey, []byte("newdata"), ttl)
 
 	// Verify cache size is still at max
-	cache.mu.RLock()
-	var size int = len(cache.entries)
-	cache.mu.RUnlock()
+	var size int = cache.Len()
 
 	if size > CACHE_MAX_SIZE {
 		t.Errorf("Cache size %d exceeds max %d", size, CACHE_MAX_SIZE)
@@ -232,7 +267,8 @@ func TestDNSCache_Eviction(t *testing.T) {
 // Tests the Clean method removes entries beyond grace period
 func TestDNSCache_Clean(t *testing.T) {
 	var (
-		c              *DNSCache     = NewDNSCache()
+		clock          *fakeClock    = newFakeClock()
+		c              *DNSCache     = NewDNSCacheWithClock(clock)
 		ttl            uint32        = 1
 		oldGracePeriod time.Duration = GRACE_PERIOD
 	)
@@ -246,22 +282,19 @@ func TestDNSCache_Clean(t *testing.T) {
 	}()
 
 	GRACE_PERIOD = 1 * time.Millisecond
-	// Wait for expiration
-	time.Sleep(time.Duration(ttl)*time.Second + GRACE_PERIOD + 50*time.Millisecond)
+	// Move past expiration
+	clock.Advance(time.Duration(ttl)*time.Second + GRACE_PERIOD + 50*time.Millisecond)
 
 	// Run cleanup
 	c.Clean()
 
 	// Check results
-	c.mu.RLock()
 	var (
-		_            *CacheEntry
 		keepExists   bool
 		expireExists bool
 	)
-	_, keepExists = c.entries["keep.com"]
-	_, expireExists = c.entries["expire.com"]
-	c.mu.RUnlock()
+	_, keepExists = lookupEntry(c, "keep.com")
+	_, expireExists = lookupEntry(c, "expire.com")
 
 	if !keepExists {
 		t.Error("Non-expired entry should be kept")
@@ -275,16 +308,17 @@ func TestDNSCache_Clean(t *testing.T) {
 // Tests that Get returns needsRefresh=true for stale entries
 func TestDNSCache_StaleRefreshFlag(t *testing.T) {
 	var (
-		cache    *DNSCache = NewDNSCache()
-		key      string    = "stale.com"
-		response []byte    = []byte("3.3.3.3")
-		ttl      uint32    = 1
+		clock    *fakeClock = newFakeClock()
+		cache    *DNSCache  = NewDNSCacheWithClock(clock)
+		key      string     = "stale.com"
+		response []byte     = []byte("3.3.3.3")
+		ttl      uint32     = 1
 	)
 
 	cache.Set(key, response, ttl)
 
-	// Wait for entry to become stale (expired but within grace period)
-	time.Sleep(time.Duration(ttl)*time.Second + 10*time.Millisecond)
+	// Move the entry into staleness (expired but within grace period)
+	clock.Advance(time.Duration(ttl)*time.Second + 10*time.Millisecond)
 
 	var (
 		result       []byte
@@ -319,16 +353,12 @@ func TestDNSCache_UpdateExistingKey(t *testing.T) {
 
 	cache.Set(key, response1, ttl)
 
-	cache.mu.RLock()
-	initialCount = len(cache.entries)
-	cache.mu.RUnlock()
+	initialCount = cache.Len()
 
 	// Update the same key
 	cache.Set(key, response2, ttl)
 
-	cache.mu.RLock()
-	finalCount = len(cache.entries)
-	cache.mu.RUnlock()
+	finalCount = cache.Len()
 
 	if finalCount != initialCount {
 		t.Error("Updating existing key should not change cache size")
@@ -344,3 +374,613 @@ func TestDNSCache_UpdateExistingKey(t *testing.T) {
 		t.Error("Should retrieve updated value")
 	}
 }
+
+// TEST 11: Memory footprint follows inserts and evictions
+// Tests that MemoryBytes grows with new entries and shrinks when one is evicted
+func TestDNSCache_MemoryBytes(t *testing.T) {
+	var (
+		cache    *DNSCache = NewDNSCache()
+		response []byte    = make([]byte, 100)
+		before   int64
+		after    int64
+	)
+	cache.maxSize = 2
+
+	if cache.MemoryBytes() != 0 {
+		t.Errorf("Empty cache should report 0 bytes, got %d", cache.MemoryBytes())
+	}
+
+	cache.Set("a.com:1", response, 300)
+	before = cache.MemoryBytes()
+	if before != int64(len("a.com:1")+len(response))+ENTRY_OVERHEAD_BYTES {
+		t.Errorf("Unexpected footprint for one entry: %d", before)
+	}
+
+	cache.Set("b.com:1", make([]byte, 400), 300)
+	after = cache.MemoryBytes()
+	if after <= before {
+		t.Errorf("Footprint should grow after adding an entry: %d -> %d", before, after)
+	}
+
+	// replacing an entry doesn't count it twice
+	cache.Set("b.com:1", make([]byte, 400), 300)
+	if cache.MemoryBytes() != after {
+		t.Errorf("Replacing an entry should keep the footprint at %d, got %d", after, cache.MemoryBytes())
+	}
+
+	// full cache, a small entry evicts one of the others
+	cache.Set("c.com:1", make([]byte, 10), 300)
+	if cache.MemoryBytes() >= after {
+		t.Errorf("Footprint should shrink after evicting an entry: %d -> %d", after, cache.MemoryBytes())
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", cache.Len())
+	}
+}
+
+// TEST 12: Expiry transitions with a fake clock
+// Tests fresh -> stale -> completely expired without sleeping
+func TestDNSCache_ExpiryTransitions_FakeClock(t *testing.T) {
+	var (
+		clock        *fakeClock = newFakeClock()
+		cache        *DNSCache  = NewDNSCacheWithClock(clock)
+		key          string     = "clock.com:1"
+		found        bool
+		needsRefresh bool
+	)
+
+	cache.Set(key, []byte("1.2.3.4"), 60)
+
+	clock.Advance(30 * time.Second)
+	_, found, needsRefresh = cache.Get(key)
+	if !found || needsRefresh {
+		t.Errorf("Entry should be fresh after 30s (found=%v, refresh=%v)", found, needsRefresh)
+	}
+	if cache.IsStale(key) {
+		t.Error("Fresh entry should not be stale")
+	}
+
+	clock.Advance(31 * time.Second)
+	_, found, needsRefresh = cache.Get(key)
+	if !found || !needsRefresh {
+		t.Errorf("Entry should be stale after 61s (found=%v, refresh=%v)", found, needsRefresh)
+	}
+	if !cache.IsStale(key) {
+		t.Error("Expired entry within grace should be stale")
+	}
+
+	clock.Advance(GRACE_PERIOD)
+	_, found, _ = cache.Get(key)
+	if found {
+		t.Error("Entry should be gone after TTL + grace period")
+	}
+}
+
+// TEST 13: Prefetch fires at the threshold with a fake clock
+// Tests that a popular entry asks for a refresh once 80% of its TTL has passed
+func TestDNSCache_PrefetchTransition_FakeClock(t *testing.T) {
+	var (
+		clock        *fakeClock = newFakeClock()
+		cache        *DNSCache  = NewDNSCacheWithClock(clock)
+		key          string     = "hot.com:1"
+		needsRefresh bool
+		i            int
+	)
+
+	cache.Set(key, []byte("1.2.3.4"), 100)
+	for i = 0; i < int(POPULARITY_THRESHOLD); i++ {
+		_, _, _ = cache.Get(key)
+	}
+
+	clock.Advance(79 * time.Second)
+	_, _, needsRefresh = cache.Get(key)
+	if needsRefresh {
+		t.Error("Popular entry should not be prefetched before the threshold")
+	}
+
+	clock.Advance(time.Second)
+	_, _, needsRefresh = cache.Get(key)
+	if !needsRefresh {
+		t.Error("Popular entry should be prefetched at the threshold")
+	}
+}
+
+// TEST 14: Snapshot exposes the source upstream
+// Tests that SetWithSource is recorded and Set leaves the source empty
+func TestDNSCache_Snapshot_Source(t *testing.T) {
+	var (
+		cache    *DNSCache = NewDNSCache()
+		snapshot []EntrySnapshot
+	)
+
+	cache.SetWithSource("b.com:1", []byte("1.2.3.4"), 300, "9.9.9.9:53")
+	cache.Set("a.com:1", []byte("5.6.7.8"), 300)
+
+	snapshot = cache.Snapshot()
+	if len(snapshot) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(snapshot))
+	}
+	if snapshot[0].Key != "a.com:1" || snapshot[0].Source != "" {
+		t.Errorf("Expected a.com:1 without source first, got %+v", snapshot[0])
+	}
+	if snapshot[1].Key != "b.com:1" || snapshot[1].Source != "9.9.9.9:53" {
+		t.Errorf("Expected b.com:1 from 9.9.9.9:53, got %+v", snapshot[1])
+	}
+	if snapshot[1].Size != 7 {
+		t.Errorf("Expected size 7, got %d", snapshot[1].Size)
+	}
+}
+
+// TEST 15: InvalidateDomain removes every type of the domain and its subdomains
+// Tests that all keys of the domain and its subdomains go away and other domains stay
+func TestDNSCache_InvalidateDomain(t *testing.T) {
+	var (
+		cache   *DNSCache = NewDNSCache()
+		removed int
+		found   bool
+	)
+
+	cache.Set("ads.com:1", []byte("1.2.3.4"), 300)
+	cache.Set("ads.com:28", []byte("::1"), 300)
+	cache.Set("ads.com:1:do", []byte("1.2.3.4"), 300)
+	cache.Set("sub.ads.com:1", []byte("1.2.3.4"), 300)
+	cache.Set("badads.com:1", []byte("1.2.3.4"), 300)
+	cache.Set("example.com:1", []byte("5.6.7.8"), 300)
+
+	removed = cache.InvalidateDomain("ads.com")
+	if removed != 4 {
+		t.Errorf("Expected 4 entries removed, got %d", removed)
+	}
+	if _, found, _ = cache.Get("ads.com:28"); found {
+		t.Error("Expected ads.com:28 to be removed")
+	}
+	if _, found, _ = cache.Get("sub.ads.com:1"); found {
+		t.Error("Expected sub.ads.com:1 to be removed")
+	}
+	if _, found, _ = cache.Get("badads.com:1"); !found {
+		t.Error("Expected badads.com:1 to stay, it only shares a suffix")
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Expected 2 entries left, got %d", cache.Len())
+	}
+	if cache.MemoryBytes() != entrySize("badads.com:1", []byte("1.2.3.4"))+entrySize("example.com:1", []byte("5.6.7.8")) {
+		t.Errorf("Expected memory accounting to drop the removed entries, got %d", cache.MemoryBytes())
+	}
+}
+
+// TEST 16: Entries are spread over the shards and the size limit stays global
+// Tests the power of two rounding, that keys land in several shards and that
+// a full cache evicts from another shard when the key's own shard is empty
+func TestDNSCache_Shards(t *testing.T) {
+	var (
+		cache *DNSCache = NewShardedDNSCache(5)
+		used  int
+		found bool
+		i     int
+	)
+	if len(cache.shards) != 8 {
+		t.Fatalf("Expected 5 shards to round up to 8, got %d", len(cache.shards))
+	}
+	if len(NewShardedDNSCache(0).shards) != CACHE_SHARDS {
+		t.Errorf("Expected 0 shards to use CACHE_SHARDS (%d)", CACHE_SHARDS)
+	}
+
+	for i = 0; i < 64; i++ {
+		cache.Set(fmt.Sprintf("host%d.example.com:1", i), []byte("1.2.3.4"), 300)
+	}
+	for _, shard := range cache.shards {
+		if len(shard.entries) > 0 {
+			used++
+		}
+	}
+	if used < 4 {
+		t.Errorf("Expected keys to spread over the shards, only %d of 8 used", used)
+	}
+
+	// two entries in a cache of two, the third key goes to an empty shard
+	cache = NewShardedDNSCache(8)
+	cache.maxSize = 2
+	cache.Set("a.com:1", []byte("1.1.1.1"), 300)
+	cache.Set("b.com:1", []byte("2.2.2.2"), 300)
+	for i = 0; cache.shardFor(fmt.Sprintf("c%d.com:1", i)) == cache.shardFor("a.com:1") ||
+		cache.shardFor(fmt.Sprintf("c%d.com:1", i)) == cache.shardFor("b.com:1"); i++ {
+	}
+	cache.Set(fmt.Sprintf("c%d.com:1", i), []byte("3.3.3.3"), 300)
+
+	if cache.Len() != 2 {
+		t.Errorf("Expected the cache to stay at 2 entries, got %d", cache.Len())
+	}
+	if _, found = lookupEntry(cache, fmt.Sprintf("c%d.com:1", i)); !found {
+		t.Error("Expected the new entry to be stored")
+	}
+}
+
+// TEST 17: The eviction callback gets the key and the reason
+// Tests that OnEvict fires for size evictions and expired entries, and can use the cache
+func TestDNSCache_OnEvict(t *testing.T) {
+	type eviction struct {
+		key    string
+		reason string
+	}
+	var (
+		clock     *fakeClock = newFakeClock()
+		cache     *DNSCache  = newDNSCache(1, clock)
+		evictions []eviction
+	)
+	cache.maxSize = 2
+	cache.SetOnEvict(func(key string, reason string) {
+		evictions = append(evictions, eviction{key: key, reason: reason})
+		cache.Len() // no lock is held, cache calls don't deadlock
+		cache.IsStale(key)
+	})
+
+	cache.Set("a.com:1", []byte("1.1.1.1"), 300)
+	cache.Set("b.com:1", []byte("2.2.2.2"), 300)
+	clock.Advance(time.Second)
+	cache.Get("b.com:1") // a.com is now the least valuable
+	cache.Set("c.com:1", []byte("3.3.3.3"), 300)
+
+	if len(evictions) != 1 || evictions[0] != (eviction{"a.com:1", EVICT_SIZE}) {
+		t.Fatalf("Expected a.com:1 evicted for size, got %v", evictions)
+	}
+
+	// past the grace period, one dropped by Get and the other by Clean
+	clock.Advance(300*time.Second + GRACE_PERIOD + time.Second)
+	cache.Get("b.com:1")
+	cache.Clean()
+
+	if len(evictions) != 3 ||
+		evictions[1] != (eviction{"b.com:1", EVICT_EXPIRED}) ||
+		evictions[2] != (eviction{"c.com:1", EVICT_EXPIRED}) {
+		t.Errorf("Expected b.com:1 and c.com:1 evicted as expired, got %v", evictions)
+	}
+}
+
+// TEST 18: Prefetch lead time follows the TTL within bounds
+// Tests that short TTLs get the minimum lead and long TTLs the maximum, not 20% of the TTL
+func TestDNSCache_PrefetchLead(t *testing.T) {
+	var (
+		clock        *fakeClock
+		cache        *DNSCache
+		needsRefresh bool
+		i            int
+		tests        = []struct {
+			ttl       uint32
+			remaining time.Duration // time left when the prefetch should fire
+		}{
+			{30, 10 * time.Second},    // 20% would be 6s, raised to PREFETCH_MIN_LEAD
+			{100, 20 * time.Second},   // plain 20%
+			{86400, 30 * time.Second}, // 20% would be almost 5 hours, cut to PREFETCH_MAX_LEAD
+			{10, 5 * time.Second},     // never more than half the TTL
+		}
+	)
+
+	for _, test := range tests {
+		clock = newFakeClock()
+		cache = NewDNSCacheWithClock(clock)
+		cache.Set("hot.com:1", []byte("1.2.3.4"), test.ttl)
+		for i = 0; i < int(POPULARITY_THRESHOLD); i++ {
+			_, _, _ = cache.Get("hot.com:1")
+		}
+
+		clock.Advance(time.Duration(test.ttl)*time.Second - test.remaining - time.Second)
+		if _, _, needsRefresh = cache.Get("hot.com:1"); needsRefresh {
+			t.Errorf("TTL %d: prefetch fired with more than %v left", test.ttl, test.remaining)
+		}
+
+		clock.Advance(time.Second)
+		if _, _, needsRefresh = cache.Get("hot.com:1"); !needsRefresh {
+			t.Errorf("TTL %d: prefetch didn't fire with %v left", test.ttl, test.remaining)
+		}
+	}
+}
+
+// TEST 19: Prefetch lead bounds are configurable
+// Tests that SetPrefetchLead moves the point where a long TTL is refreshed
+func TestDNSCache_SetPrefetchLead(t *testing.T) {
+	var (
+		clock        *fakeClock = newFakeClock()
+		cache        *DNSCache  = NewDNSCacheWithClock(clock)
+		needsRefresh bool
+		i            int
+	)
+	cache.SetPrefetchLead(0, 10*time.Minute)
+
+	cache.Set("hot.com:1", []byte("1.2.3.4"), 3600)
+	for i = 0; i < int(POPULARITY_THRESHOLD); i++ {
+		_, _, _ = cache.Get("hot.com:1")
+	}
+
+	clock.Advance(49 * time.Minute)
+	if _, _, needsRefresh = cache.Get("hot.com:1"); needsRefresh {
+		t.Error("Prefetch should not fire with 11 minutes left")
+	}
+
+	clock.Advance(time.Minute)
+	if _, _, needsRefresh = cache.Get("hot.com:1"); !needsRefresh {
+		t.Error("Prefetch should fire with 10 minutes left")
+	}
+}
+
+// TEST 20: Stats reports the size and the prefetch counters
+// Tests that the recorded prefetch attempts and results show up in Stats
+func TestDNSCache_Stats(t *testing.T) {
+	var (
+		cache *DNSCache = NewDNSCache()
+		stats CacheStats
+	)
+
+	cache.Set("a.com:1", []byte("1.2.3.4"), 300)
+	cache.RecordPrefetchAttempt()
+	cache.RecordPrefetchAttempt()
+	cache.RecordPrefetchAttempt()
+	cache.RecordPrefetchResult(true)
+	cache.RecordPrefetchResult(false)
+
+	stats = cache.Stats()
+	if stats.Entries != 1 || stats.MemoryBytes != cache.MemoryBytes() {
+		t.Errorf("Expected 1 entry of %d bytes, got %+v", cache.MemoryBytes(), stats)
+	}
+	if stats.PrefetchAttempts != 3 || stats.PrefetchSuccesses != 1 || stats.PrefetchFailures != 1 {
+		t.Errorf("Expected 3 attempts, 1 success and 1 failure, got %+v", stats)
+	}
+}
+
+// TEST 21: Keys sharing a slot are never served for each other
+// Tests that with every key hashed to the same slot Get misses on the other key and counts the collision
+func TestDNSCache_KeyCollision(t *testing.T) {
+	var (
+		cache    *DNSCache = NewShardedDNSCache(1)
+		response []byte
+		found    bool
+	)
+	cache.SetKeyHasher(func(key string) string { return "same-slot" })
+
+	cache.Set("a.com:1", []byte("1.1.1.1"), 300)
+	if response, found, _ = cache.Get("a.com:1"); !found || string(response) != "1.1.1.1" {
+		t.Fatalf("Expected a.com:1 to be served, got %q (found %v)", response, found)
+	}
+
+	cache.Set("b.com:1", []byte("2.2.2.2"), 300)
+	if response, found, _ = cache.Get("a.com:1"); found {
+		t.Errorf("Expected a miss for a.com:1, got the answer of b.com:1 %q", response)
+	}
+	if response, found, _ = cache.Get("b.com:1"); !found || string(response) != "2.2.2.2" {
+		t.Errorf("Expected b.com:1 to be served, got %q (found %v)", response, found)
+	}
+	if cache.IsStale("a.com:1") {
+		t.Error("IsStale should not look at the entry of another key")
+	}
+
+	if cache.Stats().KeyCollisions != 1 {
+		t.Errorf("Expected 1 collision, got %d", cache.Stats().KeyCollisions)
+	}
+	if cache.Len() != 1 || cache.Snapshot()[0].Key != "b.com:1" {
+		t.Errorf("Expected only b.com:1 left under its full key, got %+v", cache.Snapshot())
+	}
+}
+
+// TEST 22: Zipf keys are reproducible and skewed
+// Tests that the same seed gives the same keys and the most popular name dominates
+func TestZipfKeys(t *testing.T) {
+	var (
+		keys   []string       = ZipfKeys(10000, 1000, 42)
+		again  []string       = ZipfKeys(10000, 1000, 42)
+		counts map[string]int = make(map[string]int)
+		i      int
+	)
+	for i = range keys {
+		if keys[i] != again[i] {
+			t.Fatalf("Key %d differs between runs with the same seed: %s vs %s", i, keys[i], again[i])
+		}
+		counts[KeyDomain(keys[i])]++
+	}
+
+	if len(counts) > 1000 {
+		t.Errorf("Expected at most 1000 distinct names, got %d", len(counts))
+	}
+	if counts["host0.example.com"] < counts["host10.example.com"]*5 {
+		t.Errorf("Expected host0 to be far more popular than host10, got %d and %d", counts["host0.example.com"], counts["host10.example.com"])
+	}
+}
+
+// TEST 23: The domain index follows sets, replacements and evictions
+// Tests that InvalidateDomain only visits the indexed slots of the registered domain
+// and that removed entries leave the index
+func TestDNSCache_DomainIndex(t *testing.T) {
+	var (
+		cache   *DNSCache        = NewShardedDNSCache(4)
+		indexed func(string) int = func(bucket string) int {
+			var count int
+			for _, shard := range cache.shards {
+				shard.mu.RLock()
+				count += len(shard.domains[bucket])
+				shard.mu.RUnlock()
+			}
+			return count
+		}
+		removed int
+		i       int
+	)
+	for i = 0; i < 50; i++ {
+		cache.Set(fmt.Sprintf("host%d.example.com:1", i), []byte("1.2.3.4"), 300)
+		cache.Set(fmt.Sprintf("host%d.other.org:1", i), []byte("1.2.3.4"), 300)
+	}
+	cache.Set("www.example.co.uk:1", []byte("1.2.3.4"), 300)
+	cache.Set("host0.example.com:1", []byte("5.6.7.8"), 300) // replaced, indexed once
+
+	if indexed("example.com") != 50 || indexed("other.org") != 50 || indexed("example.co.uk") != 1 {
+		t.Fatalf("Expected keys indexed by registered domain, got %d, %d and %d", indexed("example.com"), indexed("other.org"), indexed("example.co.uk"))
+	}
+
+	// entries the index doesn't list are never looked at
+	for _, shard := range cache.shards {
+		for slot := range shard.domains["other.org"] {
+			shard.entries[slot].Key = "host.example.com:1"
+		}
+	}
+	if removed = cache.InvalidateDomain("example.com"); removed != 50 {
+		t.Errorf("Expected the 50 indexed example.com entries removed, got %d", removed)
+	}
+	if indexed("example.com") != 0 || cache.Len() != 51 {
+		t.Errorf("Expected the example.com bucket gone and 51 entries left, got %d and %d", indexed("example.com"), cache.Len())
+	}
+
+	if removed = cache.InvalidateDomain("co.uk"); removed != 1 || indexed("example.co.uk") != 0 {
+		t.Errorf("Expected a public suffix to fall back to a scan, removed %d", removed)
+	}
+}
+
+// TEST 24: Kept expired entries are only served by GetExpired
+// Tests that with SetKeepExpired an entry past the grace period misses in Get but stays
+// for GetExpired until Clean removes it
+func TestDNSCache_KeepExpired(t *testing.T) {
+	var (
+		clock    *fakeClock = newFakeClock()
+		cache    *DNSCache  = NewDNSCacheWithClock(clock)
+		response []byte
+		found    bool
+	)
+	cache.SetKeepExpired(true)
+	cache.Set("old.com:1", []byte("1.2.3.4"), 1)
+	clock.Advance(time.Second + GRACE_PERIOD + time.Minute)
+
+	if _, found, _ = cache.Get("old.com:1"); found {
+		t.Error("Expected Get to miss on an entry past the grace period")
+	}
+	if response, found = cache.GetExpired("old.com:1"); !found || string(response) != "1.2.3.4" {
+		t.Errorf("Expected GetExpired to return the kept entry, got %q", response)
+	}
+	if _, found = cache.GetExpired("other.com:1"); found {
+		t.Error("Expected GetExpired to miss on an unknown key")
+	}
+
+	cache.Clean()
+	if _, found = cache.GetExpired("old.com:1"); found || cache.Len() != 0 {
+		t.Errorf("Expected Clean to drop the expired entry, %d left", cache.Len())
+	}
+}
+
+// BENCHMARK 1: Concurrent gets and sets, one lock vs sharded
+// go test -bench DNSCache_Parallel -cpu 8 ./internal/cache
+func BenchmarkDNSCache_Parallel(b *testing.B) {
+	var (
+		keys []string = make([]string, 512)
+		i    int
+	)
+	for i = range keys {
+		keys[i] = fmt.Sprintf("host%d.example.com:1", i)
+	}
+
+	for _, shards := range []int{1, CACHE_SHARDS} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			var (
+				cache   *DNSCache = NewShardedDNSCache(shards)
+				counter atomic.Uint64
+			)
+			for _, key := range keys {
+				cache.Set(key, []byte("1.2.3.4"), 300)
+			}
+
+			b.RunParallel(func(pb *testing.PB) {
+				var (
+					n   uint64 = counter.Add(1) * 7919
+					key string
+				)
+				for pb.Next() {
+					n++
+					key = keys[n%uint64(len(keys))]
+					if n%10 == 0 { // roughly the miss rate of a warm cache
+						cache.Set(key, []byte("1.2.3.4"), 300)
+					} else {
+						_, _, _ = cache.Get(key)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BENCHMARK 2: Get with a Set on every miss, Zipf keys, by cache size
+// go test -bench CacheGetSet ./internal/cache
+func BenchmarkCacheGetSet(b *testing.B) {
+	var keys []string = ZipfKeys(1<<16, 50000, 1)
+
+	for _, size := range []int{1024, 8192, 65536} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			var (
+				cache *DNSCache = NewDNSCache()
+				key   string
+				found bool
+				i     int
+			)
+			cache.maxSize = size
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i = 0; i < b.N; i++ {
+				key = keys[i%len(keys)]
+				if _, found, _ = cache.Get(key); !found {
+					cache.Set(key, []byte("1.2.3.4"), 300)
+				}
+			}
+		})
+	}
+}
+
+// BENCHMARK 3: Concurrent gets on a warm cache, Zipf keys, by shard count
+// go test -bench CacheConcurrentGet -cpu 8 ./internal/cache
+func BenchmarkCacheConcurrentGet(b *testing.B) {
+	var keys []string = ZipfKeys(1<<16, 5000, 2)
+
+	for _, shards := range []int{1, CACHE_SHARDS, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			var (
+				cache   *DNSCache = NewShardedDNSCache(shards)
+				counter atomic.Uint64
+			)
+			cache.maxSize = 8192
+			for _, key := range keys {
+				cache.Set(key, []byte("1.2.3.4"), 300)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var n uint64 = counter.Add(1) * 7919
+				for pb.Next() {
+					n++
+					_, _, _ = cache.Get(keys[n%uint64(len(keys))])
+				}
+			})
+		})
+	}
+}
+
+// BENCHMARK 4: Sets of new keys into a full cache, every one evicts
+// go test -bench Eviction ./internal/cache
+func BenchmarkEviction(b *testing.B) {
+	for _, size := range []int{1024, 8192} {
+		for _, shards := range []int{1, CACHE_SHARDS} {
+			b.Run(fmt.Sprintf("size=%d/shards=%d", size, shards), func(b *testing.B) {
+				var (
+					cache *DNSCache = NewShardedDNSCache(shards)
+					keys  []string  = make([]string, size+b.N)
+					i     int
+				)
+				cache.maxSize = size
+				for i = range keys {
+					keys[i] = fmt.Sprintf("host%d.example.com:1", i)
+				}
+				for i = 0; i < size; i++ {
+					cache.Set(keys[i], []byte("1.2.3.4"), 300)
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i = 0; i < b.N; i++ {
+					cache.Set(keys[size+i], []byte("1.2.3.4"), 300)
+				}
+			})
+		}
+	}
+}
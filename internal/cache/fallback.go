@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// read only "last known good" answers loaded from disk
+// only used when the live cache misses and the upstream fails
+type FallbackCache struct {
+	entries map[string][]byte
+}
+
+// one line of the snapshot file, the response is base64 in the json
+// snapshots written before expires_at existed can't be loaded back by LoadSnapshot
+type snapshotEntry struct {
+	Key       string    `json:"key"`
+	Response  []byte    `json:"response"`
+	Source    string    `json:"source,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// reads a snapshot written by DNSCache.SaveSnapshot
+func LoadFallbackCache(filename string) (*FallbackCache, error) {
+	var (
+		file     *os.File
+		decoder  *json.Decoder
+		entry    snapshotEntry
+		fallback *FallbackCache = &FallbackCache{entries: make(map[string][]byte)}
+		err      error
+	)
+	file, err = os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder = json.NewDecoder(file)
+	for decoder.More() {
+		entry = snapshotEntry{}
+		if err = decoder.Decode(&entry); err != nil {
+			return nil, err
+		}
+
+		if entry.Key != "" && len(entry.Response) >= 12 {
+			fallback.entries[entry.Key] = entry.Response
+		}
+	}
+
+	return fallback, nil
+}
+
+func (f *FallbackCache) Get(key string) ([]byte, bool) {
+	var (
+		response []byte
+		found    bool
+	)
+	response, found = f.entries[key]
+	return response, found
+}
+
+func (f *FallbackCache) Len() int {
+	return len(f.entries)
+}
+
+// writes every entry that isn't completely expired, one json object per line
+// the file is written next to the target and renamed over it, so a crash or a
+// concurrent reader never sees half a snapshot
+func (c *DNSCache) SaveSnapshot(filename string) error {
+	var (
+		file    *os.File
+		encoder *json.Encoder
+		now     time.Time = c.clock.Now()
+		err     error
+	)
+	file, err = os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // fails harmlessly once renamed
+
+	encoder = json.NewEncoder(file)
+	for _, shard := range c.shards {
+		if err = saveShard(encoder, shard, now); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filename)
+}
+
+// puts the entries of a snapshot back in the live cache with the expiry they
+// had, e.g. the snapshot a previous process wrote on shutdown
+// completely expired entries are skipped, returns how many were loaded
+func (c *DNSCache) LoadSnapshot(filename string) (int, error) {
+	var (
+		file    *os.File
+		decoder *json.Decoder
+		entry   snapshotEntry
+		now     time.Time = c.clock.Now()
+		ttl     time.Duration
+		loaded  int
+		err     error
+	)
+	file, err = os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	decoder = json.NewDecoder(file)
+	for decoder.More() {
+		entry = snapshotEntry{}
+		if err = decoder.Decode(&entry); err != nil {
+			return loaded, err
+		}
+
+		if entry.Key == "" || len(entry.Response) < 12 || entry.ExpiresAt.IsZero() || now.After(entry.ExpiresAt.Add(GRACE_PERIOD)) {
+			continue
+		}
+
+		// stale entries come back expired now, still within their grace period
+		ttl = max(0, entry.ExpiresAt.Sub(now))
+		c.SetWithSource(entry.Key, entry.Response, uint32(ttl/time.Second), entry.Source)
+		loaded++
+	}
+
+	return loaded, nil
+}
+
+func saveShard(encoder *json.Encoder, shard *cacheShard, now time.Time) error {
+	var err error
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	for _, entry := range shard.entries {
+		if entry.IsCompletelyExpired(now) {
+			continue
+		}
+
+		if err = encoder.Encode(snapshotEntry{Key: entry.Key, Response: entry.Response, Source: entry.Source, ExpiresAt: entry.ExpiresAt}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
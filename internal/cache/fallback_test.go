@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TEST 1: Snapshot round trip
+// Tests that SaveSnapshot keeps live entries and LoadFallbackCache reads them back
+func TestFallbackCache_SaveAndLoad(t *testing.T) {
+	var (
+		clock    *fakeClock = newFakeClock()
+		cache    *DNSCache  = NewDNSCacheWithClock(clock)
+		filename string     = filepath.Join(t.TempDir(), "snapshot.json")
+		fallback *FallbackCache
+		response []byte
+		found    bool
+		err      error
+	)
+
+	cache.Set("live.com:1", []byte("live-response-bytes"), 300)
+	cache.Set("dead.com:1", []byte("dead-response-bytes"), 1)
+	clock.Advance(GRACE_PERIOD + 2*time.Second)
+
+	if err = cache.SaveSnapshot(filename); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+
+	fallback, err = LoadFallbackCache(filename)
+	if err != nil {
+		t.Fatalf("LoadFallbackCache failed: %v", err)
+	}
+
+	if response, found = fallback.Get("live.com:1"); !found || string(response) != "live-response-bytes" {
+		t.Errorf("Expected the live entry in the snapshot, got %q (found=%v)", response, found)
+	}
+	if _, found = fallback.Get("dead.com:1"); found {
+		t.Error("Completely expired entries should not be saved")
+	}
+}
+
+// TEST 2: Broken snapshot files are rejected
+// Tests that invalid json gives an error instead of a half loaded cache
+func TestFallbackCache_LoadInvalid(t *testing.T) {
+	var (
+		filename string = filepath.Join(t.TempDir(), "snapshot.json")
+		err      error
+	)
+
+	if err = os.WriteFile(filename, []byte("{not json"), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if _, err = LoadFallbackCache(filename); err == nil {
+		t.Error("Expected an error for an invalid snapshot")
+	}
+	if _, err = LoadFallbackCache(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Expected an error for a missing snapshot")
+	}
+}
+
+// TEST 3: Snapshots load back into a live cache
+// Tests that LoadSnapshot restores the remaining TTL and source, skips dead entries and SaveSnapshot leaves no temp file
+func TestDNSCache_LoadSnapshot(t *testing.T) {
+	var (
+		clock    *fakeClock = newFakeClock()
+		old      *DNSCache  = NewDNSCacheWithClock(clock)
+		fresh    *DNSCache
+		dir      string = t.TempDir()
+		filename string = filepath.Join(dir, "handoff.json")
+		files    []os.DirEntry
+		loaded   int
+		response []byte
+		found    bool
+		err      error
+	)
+
+	old.SetWithSource("live.com:1", []byte("live-response-bytes"), 3600, "9.9.9.9:53")
+	old.Set("dead.com:1", []byte("dead-response-bytes"), 1)
+	clock.Advance(GRACE_PERIOD + 2*time.Second)
+
+	if err = old.SaveSnapshot(filename); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	if files, err = os.ReadDir(dir); err != nil || len(files) != 1 {
+		t.Fatalf("Expected only the snapshot in the directory, got %v (%v)", files, err)
+	}
+
+	fresh = NewDNSCacheWithClock(clock)
+	if loaded, err = fresh.LoadSnapshot(filename); err != nil || loaded != 1 {
+		t.Fatalf("Expected 1 entry loaded, got %d (%v)", loaded, err)
+	}
+	if response, found, _ = fresh.Get("live.com:1"); !found || string(response) != "live-response-bytes" {
+		t.Errorf("Expected the live entry, got %q (found=%v)", response, found)
+	}
+	if _, found, _ = fresh.Get("dead.com:1"); found {
+		t.Error("Completely expired entries should not be loaded")
+	}
+	if fresh.Snapshot()[0].Source != "9.9.9.9:53" {
+		t.Errorf("Expected the source to survive, got %+v", fresh.Snapshot()[0])
+	}
+
+	// the entry keeps its original expiry, not a new hour
+	clock.Advance(3600*time.Second - GRACE_PERIOD - 2*time.Second - time.Second)
+	if fresh.IsStale("live.com:1") {
+		t.Error("Expected the loaded entry to be fresh before the original expiry")
+	}
+	clock.Advance(2 * time.Second)
+	if !fresh.IsStale("live.com:1") {
+		t.Error("Expected the loaded entry to expire when the original did")
+	}
+}
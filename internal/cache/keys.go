@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"fmt"
+	"math/rand/v2"
+)
+
+// skew of ZipfKeys, a few names get most of the queries like in real traffic
+const ZIPF_SKEW float64 = 1.1
+
+// n cache keys drawn from distinct names with a Zipf distribution, for
+// benchmarks that should hit the cache like real DNS traffic does: host0 is
+// the most queried name, roughly a third of the queries are AAAA
+// the same seed always gives the same keys
+func ZipfKeys(n int, distinct int, seed uint64) []string {
+	var (
+		random *rand.Rand = rand.New(rand.NewPCG(seed, seed))
+		zipf   *rand.Zipf
+		keys   []string = make([]string, n)
+		qtype  int
+		i      int
+	)
+	if distinct < 1 {
+		distinct = 1
+	}
+	zipf = rand.NewZipf(random, ZIPF_SKEW, 1, uint64(distinct-1))
+
+	for i = range keys {
+		qtype = 1
+		if random.IntN(3) == 0 {
+			qtype = 28
+		}
+		keys[i] = fmt.Sprintf("host%d.example.com:%d", zipf.Uint64(), qtype)
+	}
+
+	return keys
+}
@@ -0,0 +1,148 @@
+package filter
+
+import (
+	"regexp"
+	"strings"
+)
+
+// rules loaded with a category can be turned off at runtime, e.g. stop blocking
+// "social" for a while and keep "ads"; rules without a category are always on
+// the categories live in the list, a reloaded list starts with all of them on
+
+// like Add, tagging the rule with the category
+func (f *FilterList) AddCategory(domain string, category string) {
+	f.AddBatch([]string{domain}, category)
+}
+
+// like AddRegex, tagging the rule with the category
+func (f *FilterList) AddRegexCategory(pattern string, category string) error {
+	var (
+		regex   *regexp.Regexp
+		existed bool
+		err     error
+	)
+	regex, err = regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, known := range f.regexes {
+		existed = existed || known.String() == pattern
+	}
+	f.regexes = append(f.regexes, regex)
+	f.tagLocked(regexKey(pattern), category, existed)
+	return nil
+}
+
+// the rules of a disabled category are skipped by IsBlocked and friends until enabled again
+func (f *FilterList) SetCategoryEnabled(category string, enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if enabled {
+		delete(f.disabled, category)
+		return
+	}
+	f.disabled[category] = true
+}
+
+// every category with rules and whether it's enabled
+func (f *FilterList) Categories() map[string]bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var categories map[string]bool = make(map[string]bool)
+	for _, set := range f.categories {
+		for category := range set {
+			if category != "" {
+				categories[category] = !f.disabled[category]
+			}
+		}
+	}
+
+	return categories
+}
+
+// key of a rule in categories: the domain, "*." plus the domain for wildcards
+// (Add gets them with the prefix) or the pattern between slashes for regexes
+// a rule listed by several sources keeps all their categories, "" standing for the
+// ones without, so it only stops blocking once every source of it is disabled;
+// rules only ever added without a category have no entry. must be called with the
+// write lock held, existed says whether the rule was there before this source added it
+func (f *FilterList) tagLocked(key string, category string, existed bool) {
+	var set map[string]bool = f.categories[key]
+	if set == nil {
+		if category == "" { // uncategorized so far, and it stays that way
+			return
+		}
+		set = make(map[string]bool)
+		if existed { // added before without a category
+			set[""] = true
+		}
+		f.categories[key] = set
+	}
+
+	set[category] = true
+}
+
+// must be called with the lock held and a normalized domain
+func (f *FilterList) hasRuleLocked(key string) bool {
+	var found bool
+	if strings.HasPrefix(key, "*.") {
+		return f.wildcards[key[2:]]
+	}
+	_, found = f.typed[key]
+
+	return f.domains[key] || found
+}
+
+func regexKey(pattern string) string {
+	return "/" + pattern + "/"
+}
+
+// must be called with the read lock held
+func (f *FilterList) ruleEnabled(key string) bool {
+	if len(f.disabled) == 0 || len(f.categories[key]) == 0 {
+		return true
+	}
+
+	for category := range f.categories[key] {
+		if category == "" || !f.disabled[category] {
+			return true
+		}
+	}
+	return false
+}
+
+// like matchedSuffix, skipping the rules of disabled categories
+// prefix turns a set entry into its ruleKey
+func (f *FilterList) matchedEnabledSuffix(set map[string]bool, domain string, prefix string) (string, bool) {
+	if len(f.disabled) == 0 {
+		return matchedSuffix(set, domain)
+	}
+
+	var dotIndex int
+	for {
+		if set[domain] && f.ruleEnabled(prefix+domain) {
+			return domain, true
+		}
+
+		if dotIndex = strings.IndexRune(domain, '.'); dotIndex == -1 {
+			return "", false
+		}
+		domain = domain[dotIndex+1:]
+	}
+}
+
+// like matchedEnabledSuffix but the domain itself doesn't count
+func (f *FilterList) matchedEnabledParent(set map[string]bool, domain string, prefix string) (string, bool) {
+	var dotIndex int = strings.IndexRune(domain, '.')
+	if dotIndex == -1 {
+		return "", false
+	}
+
+	return f.matchedEnabledSuffix(set, domain[dotIndex+1:], prefix)
+}
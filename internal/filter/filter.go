@@ -3,45 +3,262 @@ package filter
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"flash-dns/internal/logger"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"regexp"
 	"strings"
 	"sync"
 )
 
+const DEFAULT_MAX_LINE_LENGTH int = 4096 // longest list line read when FilterOptions.MaxLineLength is zero
+
+const DEFAULT_LOAD_BATCH_SIZE int = 1024 // domains the loaders buffer before AddBatch when FilterOptions.LoadBatchSize is zero
+
+// returned (wrapped) by the loaders when FilterOptions.MaxEntries stopped them,
+// the rules read until then stay in the list
+var ErrTooManyEntries error = errors.New("too many filter entries")
+
+type FilterOptions struct {
+	ExactMatchOnly bool // only block the listed domain itself, not its subdomains
+
+	// blocking rules the list holds at most, the loaders stop there; zero means no limit
+	MaxEntries int
+
+	// longer lines are skipped without being kept in memory, zero uses DEFAULT_MAX_LINE_LENGTH
+	MaxLineLength int
+
+	// domains LoadFromFile buffers before adding them under one lock, so the memory
+	// used while loading depends on this and not on the file size
+	// zero uses DEFAULT_LOAD_BATCH_SIZE
+	LoadBatchSize int
+}
+
+// domains, wildcards and regexes that block, and the allowlist and allow regexes
+// that override them; see RuleKind for the precedence when several match
 type FilterList struct {
-	mu      sync.RWMutex
-	domains map[string]bool
+	mu           sync.RWMutex
+	domains      map[string]bool
+	wildcards    map[string]bool // "*.ads.com" rules, only the subdomains match
+	regexes      []*regexp.Regexp
+	typed        map[string]typeRule // $dnstype rules, only checked by IsBlockedType
+	allowlist    map[string]bool
+	allowRegexes []*regexp.Regexp           // exceptions to the blocking rules, only checked for blocked domains
+	passthrough  map[string]bool            // allowlisted domains that also skip the cache, see AddPassthrough
+	categories   map[string]map[string]bool // categories of the block rules loaded with one, by ruleKey, see tagLocked
+	disabled     map[string]bool            // categories whose rules are skipped, see SetCategoryEnabled
+	options      FilterOptions
+	flushed      func(size int) // called after every batch the loaders add, nil in production
+}
+
+// number of rules of each kind, see FilterList.Stats
+type FilterStats struct {
+	Exact      int `json:"exact"`
+	Wildcard   int `json:"wildcard"`
+	Regex      int `json:"regex"`
+	Typed      int `json:"typed"`
+	Allowlist  int `json:"allowlist"`
+	AllowRegex int `json:"allow_regex"`
 }
 
 func NewFilterList() *FilterList {
+	return NewFilterListWithOptions(FilterOptions{})
+}
+
+func NewFilterListWithOptions(options FilterOptions) *FilterList {
 	const defaultSize int = 8192 // 2^13 = 8192
-	return &FilterList{domains: make(map[string]bool, defaultSize)}
+	return &FilterList{
+		domains:     make(map[string]bool, defaultSize),
+		wildcards:   make(map[string]bool),
+		typed:       make(map[string]typeRule),
+		allowlist:   make(map[string]bool),
+		passthrough: make(map[string]bool),
+		categories:  make(map[string]map[string]bool),
+		disabled:    make(map[string]bool),
+		options:     options,
+	}
 }
 
+// a "*." prefix makes it a wildcard rule, blocking the subdomains but not the domain itself
 func (f *FilterList) Add(domain string) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	domain = normalizeDomain(domain)
-	f.domains[domain] = true
+	f.addLocked(domain)
+	f.tagLocked(domain, "", true)
+}
+
+// like AddCategory for every domain, taking the lock once for the whole batch
+func (f *FilterList) AddBatch(domains []string, category string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var existed bool
+	for _, domain := range domains {
+		domain = normalizeDomain(domain)
+		existed = f.hasRuleLocked(domain)
+		f.addLocked(domain)
+		f.tagLocked(domain, category, existed)
+	}
+}
+
+// blocks the domain and its subdomains only for the query types of the rule
+func (f *FilterList) addTyped(domain string, rule typeRule, category string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var (
+		existing typeRule
+		found    bool
+		existed  bool
+	)
+	domain = normalizeDomain(domain)
+	existed = f.hasRuleLocked(domain)
+	if existing, found = f.typed[domain]; found {
+		rule = existing.union(rule)
+	}
+	f.typed[domain] = rule
+	f.tagLocked(domain, category, existed)
+}
+
+// allowed domains always win over the blocklist, also with wildcard
+func (f *FilterList) AddAllowed(domain string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	domain = normalizeDomain(domain)
+	f.allowlist[domain] = true
+}
+
+// domains matching the pattern are never blocked, e.g. ^cdn\d+\.blocked\.net$
+// even when a parent is; only checked once a blocking rule matched
+func (f *FilterList) AddAllowRegex(pattern string) error {
+	var (
+		regex *regexp.Regexp
+		err   error
+	)
+	regex, err = regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.allowRegexes = append(f.allowRegexes, regex)
+	return nil
+}
+
+// true when the domain or one of its parents is allowlisted, or it matches an allow regex
+func (f *FilterList) IsAllowed(domain string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	domain = normalizeDomain(domain)
+	return matchesSuffix(f.allowlist, domain) || f.matchesAllowRegex(domain)
+}
+
+// must be called with the read lock held
+func (f *FilterList) matchesAllowRegex(domain string) bool {
+	var found bool
+	_, found = f.matchedAllowRegex(domain)
+	return found
+}
+
+// like matchesAllowRegex, also returning the pattern that matched
+func (f *FilterList) matchedAllowRegex(domain string) (string, bool) {
+	for _, regex := range f.allowRegexes {
+		if regex.MatchString(domain) {
+			return regex.String(), true
+		}
+	}
+
+	return "", false
 }
 
 // match wildcard, if googleads.com is blocked, ads.googleads.com is also blocked
+// unless the list was created with ExactMatchOnly
 func (f *FilterList) IsBlocked(domain string) bool {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
+
+	return f.isBlockedLocked(domain)
+}
+
+// like IsBlocked, also applying the $dnstype rules for the query type
+func (f *FilterList) IsBlockedType(domain string, qtype uint16) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.isBlockedLocked(domain) {
+		return true
+	}
+	if len(f.typed) == 0 {
+		return false
+	}
+
+	domain = normalizeDomain(domain)
+	if matchesSuffix(f.allowlist, domain) {
+		return false
+	}
+
+	var (
+		name     string = domain
+		rule     typeRule
+		found    bool
+		dotIndex int
+	)
+	for {
+		if rule, found = f.typed[name]; found && rule.matches(qtype) && f.ruleEnabled(name) {
+			return !f.matchesAllowRegex(domain)
+		}
+
+		if dotIndex = strings.IndexRune(name, '.'); dotIndex == -1 {
+			return false
+		}
+		name = name[dotIndex+1:]
+	}
+}
+
+// checks all the domains under a single read lock, results are in the same order
+func (f *FilterList) AreBlocked(domains []string) []bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var results []bool = make([]bool, len(domains))
+	for i, domain := range domains {
+		results[i] = f.isBlockedLocked(domain)
+	}
+
+	return results
+}
+
+// must be called with the read lock held
+func (f *FilterList) isBlockedLocked(domain string) bool {
+	return f.matchRuleLocked(normalizeDomain(domain)).Blocked()
+}
+
+// checks the domain and all of its parents against the set
+func matchesSuffix(set map[string]bool, domain string) bool {
+	var found bool
+	_, found = matchedSuffix(set, domain)
+	return found
+}
+
+// like matchesSuffix, also returning the entry of the set that matched
+func matchedSuffix(set map[string]bool, domain string) (string, bool) {
 	var (
 		found    bool
 		dotIndex int
 	)
-	domain = normalizeDomain(domain)
 
 	for {
-		if _, found = f.domains[domain]; found {
-			return true
+		if _, found = set[domain]; found {
+			return domain, true
 		}
 
 		dotIndex = strings.IndexRune(domain, '.')
@@ -52,10 +269,128 @@ func (f *FilterList) IsBlocked(domain string) bool {
 		domain = strings.Clone(domain[dotIndex+1:])
 	}
 
-	return false
+	return "", false
+}
+
+// the header comments of the list (! Title:, ! Version:, ! Expires:...) come back in the metadata
+func (f *FilterList) LoadFromFile(filename string) (ListMetadata, error) {
+	return f.LoadFromFileCategory(filename, "")
+}
+
+// like LoadFromFile, tagging every rule of the file with the category (e.g. "ads",
+// "social") so SetCategoryEnabled can turn them off; empty means no category
+func (f *FilterList) LoadFromFileCategory(filename string, category string) (ListMetadata, error) {
+	var (
+		metadata  ListMetadata
+		file      *os.File
+		err       error
+		scanner   *bufio.Scanner
+		count     int
+		line      string
+		modifiers string
+		pattern   string
+		ok        bool
+		domain    []string
+		host      string
+		regex     *regexp.Regexp
+		hostPort  *regexp.Regexp
+		rule      *typeRule
+		skipped   int
+		batch     []string = make([]string, 0, f.loadBatchSize())
+	)
+	file, err = os.Open(filename)
+	if err != nil {
+		return metadata, err
+	}
+	defer file.Close()
+	scanner = f.newLineScanner(file, &skipped)
+
+	// the plain domains are buffered and added a batch at a time, the rest right away
+	var flush = func() {
+		if len(batch) == 0 {
+			return
+		}
+		f.AddBatch(batch, category)
+		if f.flushed != nil {
+			f.flushed(len(batch))
+		}
+		batch = batch[:0]
+	}
+
+	regex, err = regexp.Compile(`\|\|(.*)\^$`) // take string from ||<some string>^
+	if err != nil {
+		return metadata, err
+	}
+
+	hostPort, err = regexp.Compile(`^[A-Za-z0-9.-]+:[0-9]+(/.*)?$`) // ads.example.com:8080[/path]
+	if err != nil {
+		return metadata, err
+	}
+
+	for scanner.Scan() {
+		line = strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "!") {
+			metadata.parseComment(line)
+			continue
+		}
+
+		if f.options.MaxEntries > 0 && f.Count()+len(batch) >= f.options.MaxEntries {
+			flush() // the batch may repeat domains, only the list knows the real count
+		}
+		if f.options.MaxEntries > 0 && f.Count() >= f.options.MaxEntries {
+			logger.Warn(fmt.Sprintf("Stopped loading %s after %d domains, the filter holds the maximum of %d entries", filename, count, f.options.MaxEntries))
+			return metadata, fmt.Errorf("%w: %s stopped at %d entries", ErrTooManyEntries, filename, f.options.MaxEntries)
+		}
+
+		if line == "" ||
+			strings.HasPrefix(line, "[") ||
+			strings.HasPrefix(line, "@@") {
+			continue
+		}
+
+		if pattern, ok = regexRule(line); ok {
+			if err = f.AddRegexCategory(pattern, category); err != nil {
+				logger.Error(fmt.Sprintf("Skipping invalid regex rule %s: %v", line, err))
+				continue
+			}
+			count++
+			continue
+		}
+
+		line, modifiers, _ = strings.Cut(line, "$") // ||<domain>^$third-party,dnstype=AAAA
+		if domain = regex.FindStringSubmatch(line); len(domain) > 0 {
+			host = hostOfURL(domain[1]) // the output is like [complete_line matched_group]
+		} else if strings.Contains(line, "://") || hostPort.MatchString(line) { // urls pasted as rules
+			host = hostOfURL(line)
+		} else {
+			continue
+		}
+		if host == "" || strings.ContainsAny(host, " \t") {
+			continue
+		}
+
+		if rule, err = parseModifiers(modifiers); err != nil {
+			logger.Error(fmt.Sprintf("Skipping rule %s: %v", host, err))
+			continue
+		}
+
+		if rule != nil {
+			f.addTyped(host, *rule, category)
+		} else if batch = append(batch, host); len(batch) == cap(batch) {
+			flush()
+		}
+		count++
+	}
+	flush()
+
+	logSkippedLines(filename, skipped, f.maxLineLength())
+	logger.Info(fmt.Sprintf("Loaded %d domains to Filter from %s", count, filename))
+	return metadata, scanner.Err()
 }
 
-func (f *FilterList) LoadFromFile(filename string) error {
+// loads the allowlist, lines can be plain domains or @@||<domain>^
+func (f *FilterList) LoadAllowlistFromFile(filename string) error {
 	var (
 		file    *os.File
 		err     error
@@ -64,15 +399,16 @@ func (f *FilterList) LoadFromFile(filename string) error {
 		line    string
 		domain  []string
 		regex   *regexp.Regexp
+		skipped int
 	)
 	file, err = os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	scanner = bufio.NewScanner(file)
+	scanner = f.newLineScanner(file, &skipped)
 
-	regex, err = regexp.Compile(`\|\|(.*)\^$`) // take string from ||<some string>^
+	regex, err = regexp.Compile(`^@@\|\|(.*)\^$`) // take string from @@||<some string>^
 	if err != nil {
 		return err
 	}
@@ -82,29 +418,138 @@ func (f *FilterList) LoadFromFile(filename string) error {
 
 		if line == "" ||
 			strings.HasPrefix(line, "!") ||
-			strings.HasPrefix(line, "[") ||
-			strings.HasPrefix(line, "@@") {
+			strings.HasPrefix(line, "#") ||
+			strings.HasPrefix(line, "[") {
 			continue
 		}
 
-		domain = regex.FindStringSubmatch(line)
-		if len(domain) == 0 { // if it is 0, no match was found :)
+		if strings.HasPrefix(line, "@@") {
+			domain = regex.FindStringSubmatch(line)
+			if len(domain) == 0 {
+				continue
+			}
+			line = domain[1]
+		}
+
+		if strings.ContainsAny(line, " \t|^$/") { // not a plain domain
 			continue
 		}
 
-		f.Add(domain[1]) // the output is like [complete_line matched_group]
+		f.AddAllowed(line)
 		count++
 	}
 
-	logger.Info(fmt.Sprintf("Loaded %d domains to Filter from %s", count, filename))
+	logSkippedLines(filename, skipped, f.maxLineLength())
+	logger.Info(fmt.Sprintf("Loaded %d domains to Allowlist from %s", count, filename))
 	return scanner.Err()
 }
 
-// returns the count of blocked domains
+func (f *FilterList) loadBatchSize() int {
+	if f.options.LoadBatchSize > 0 {
+		return f.options.LoadBatchSize
+	}
+	return DEFAULT_LOAD_BATCH_SIZE
+}
+
+func (f *FilterList) maxLineLength() int {
+	if f.options.MaxLineLength > 0 {
+		return f.options.MaxLineLength
+	}
+	return DEFAULT_MAX_LINE_LENGTH
+}
+
+// scanner over the lines of a list that skips the ones longer than the max
+// line length, counting them in skipped, instead of failing on them
+func (f *FilterList) newLineScanner(r io.Reader, skipped *int) *bufio.Scanner {
+	var (
+		scanner   *bufio.Scanner = bufio.NewScanner(r)
+		maxLength int            = f.maxLineLength()
+		skipping  bool           // inside a long line, dropping it until its end
+	)
+	scanner.Buffer(make([]byte, 0, min(maxLength+1, 4096)), maxLength+1)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		var (
+			advance int
+			token   []byte
+			err     error
+		)
+		advance, token, err = bufio.ScanLines(data, atEOF)
+		switch {
+		case err != nil:
+			return advance, token, err
+		case advance == 0 && len(data) > maxLength: // no line end within the max, drop what's buffered
+			if !skipping {
+				*skipped++
+			}
+			skipping = true
+			return len(data), nil, nil
+		case advance > 0 && skipping: // the end of the long line
+			skipping = false
+			return advance, nil, nil
+		case advance > 0 && len(token) > maxLength:
+			*skipped++
+			return advance, nil, nil
+		}
+		return advance, token, nil
+	})
+
+	return scanner
+}
+
+func logSkippedLines(filename string, skipped int, maxLength int) {
+	if skipped > 0 {
+		logger.Warn(fmt.Sprintf("Skipped %d lines of %s longer than %d bytes", skipped, filename, maxLength))
+	}
+}
+
+// returns the count of blocking rules, see Stats for the split
 func (f *FilterList) Count() int {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
-	return len(f.domains)
+	return len(f.domains) + len(f.wildcards) + len(f.regexes) + len(f.typed)
+}
+
+func (f *FilterList) Stats() FilterStats {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return FilterStats{
+		Exact:      len(f.domains),
+		Wildcard:   len(f.wildcards),
+		Regex:      len(f.regexes),
+		Typed:      len(f.typed),
+		Allowlist:  len(f.allowlist),
+		AllowRegex: len(f.allowRegexes),
+	}
+}
+
+// https://ads.example.com:8080/path -> ads.example.com, plain domains come back unchanged
+func hostOfURL(line string) string {
+	var (
+		rest  string
+		port  string
+		index int
+		found bool
+	)
+	if _, rest, found = strings.Cut(line, "://"); found {
+		line = rest
+	}
+	if index = strings.IndexAny(line, "/?#"); index != -1 {
+		line = line[:index]
+	}
+	if index = strings.LastIndex(line, "@"); index != -1 { // user:password@
+		line = line[index+1:]
+	}
+
+	if strings.HasPrefix(line, "[") { // [::1]:8080
+		line, _, _ = strings.Cut(line[1:], "]")
+		return line
+	}
+	if rest, port, found = strings.Cut(line, ":"); found && port != "" && strings.Trim(port, "0123456789") == "" {
+		line = rest
+	}
+
+	return line
 }
 
 func normalizeDomain(domain string) string {
@@ -119,63 +564,144 @@ func CreateBlockedResponse(query []byte) []byte {
 		return query
 	}
 
+	return AppendBlockedResponse(make([]byte, 0, len(query)), query)
+}
+
+// same as CreateBlockedResponse but appends to dst
+// nothing is allocated when dst has room, so the caller can pool its buffers
+func AppendBlockedResponse(dst []byte, query []byte) []byte {
+	if len(query) < 12 {
+		return append(dst, query...)
+	}
+
 	var (
-		response []byte = make([]byte, len(query))
-		flags    uint16 = 0x8183
-		ancount  uint16 = 0
+		start   int    = len(dst)
+		flags   uint16 = answerFlags(query, 3)
+		ancount uint16 = 0
 	)
-	copy(response, query)
+	dst = append(dst, query...)
 
-	// QR = 1 (response) OPCODE = 0 (standard query)
-	// AA=1 (authoritative) and RCODE = 3 (domain not found)
-	// result, flags = 0x8183
-	binary.BigEndian.PutUint16(response[2:4], flags)
-	binary.BigEndian.PutUint16(response[6:8], ancount)
+	// QR = 1 (response) OPCODE = 0 (standard query), RD as asked,
+	// RA = 1 and RCODE = 3 (domain not found), 0x8183 for a query with RD
+	binary.BigEndian.PutUint16(dst[start+2:start+4], flags)
+	binary.BigEndian.PutUint16(dst[start+6:start+8], ancount)
 
-	return response
+	return dst
 }
 
-func CreateNullResponse(query []byte) []byte {
+// QR and RA set, RD copied from the query, we always recurse for the client
+func answerFlags(query []byte, rcode uint8) uint16 {
+	return 0x8080 | (binary.BigEndian.Uint16(query[2:4]) & 0x0100) | uint16(rcode&0x0F)
+}
+
+// response with the given RCODE, e.g. 1 FORMERR, 2 SERVFAIL, 4 NOTIMP
+// keeps the id, opcode, RD bit and question of the query, with no answers
+func CreateErrorResponse(query []byte, rcode uint8) []byte {
 	if len(query) < 12 {
 		return query
 	}
 
 	var (
-		response []byte = make([]byte, len(query)+16)
-		flags    uint16 = 0x8180
-		ancount  uint16 = 1
-		position int    = len(query)
+		response []byte = make([]byte, len(query))
+		flags    uint16 = binary.BigEndian.Uint16(query[2:4])
 	)
 	copy(response, query)
 
+	// QR = 1, RA = 1, opcode and RD as asked, RCODE in the low 4 bits
+	flags = 0x8080 | (flags & 0x7900) | uint16(rcode&0x0F)
 	binary.BigEndian.PutUint16(response[2:4], flags)
-	binary.BigEndian.PutUint16(response[6:8], ancount)
+	binary.BigEndian.PutUint16(response[6:8], 0)  // answers
+	binary.BigEndian.PutUint16(response[8:10], 0) // authority
 
-	response[position] = 0xC0
-	response[position+1] = 0x0C
+	return response
+}
+
+// answer record CreateNullResponse puts after the query, it never changes
+// so it's built once: pointer to the question name, A, IN, TTL, 0.0.0.0
+var nullAnswer []byte = buildNullAnswer()
+
+func buildNullAnswer() []byte {
+	var (
+		answer   []byte = make([]byte, 16)
+		position int
+	)
+	answer[position] = 0xC0
+	answer[position+1] = 0x0C
 	position += 2
 
 	// Type: A (0x0001)
-	binary.BigEndian.PutUint16(response[position:position+2], 1)
+	binary.BigEndian.PutUint16(answer[position:position+2], 1)
 	position += 2
 
 	// Type: IN (0x0001)
-	binary.BigEndian.PutUint16(response[position:position+2], 1)
+	binary.BigEndian.PutUint16(answer[position:position+2], 1)
 	position += 2
 
 	// TTL: 60 seconds
-	binary.BigEndian.PutUint16(response[position:position+4], 60)
+	binary.BigEndian.PutUint16(answer[position:position+4], 60)
 	position += 4
 
 	// RDLENGTH: 4 bytes (IPv4 address)
-	binary.BigEndian.PutUint16(response[position:position+2], 4)
+	binary.BigEndian.PutUint16(answer[position:position+2], 4)
 	position += 2
 
-	response[position] = 0
-	response[position+1] = 0
-	response[position+2] = 0
-	response[position+3] = 0
-	position += 4
+	// RDATA 0.0.0.0, already zeroed
+
+	return answer
+}
+
+func CreateNullResponse(query []byte) []byte {
+	if len(query) < 12 {
+		return query
+	}
+
+	return AppendNullResponse(make([]byte, 0, len(query)+len(nullAnswer)), query)
+}
 
-	return response[:position]
+// same as CreateNullResponse but appends to dst, see AppendBlockedResponse
+func AppendNullResponse(dst []byte, query []byte) []byte {
+	if len(query) < 12 {
+		return append(dst, query...)
+	}
+
+	var (
+		start   int    = len(dst)
+		flags   uint16 = answerFlags(query, 0)
+		ancount uint16 = 1
+	)
+	dst = append(dst, query...)
+
+	binary.BigEndian.PutUint16(dst[start+2:start+4], flags)
+	binary.BigEndian.PutUint16(dst[start+6:start+8], ancount)
+
+	return append(dst, nullAnswer...)
+}
+
+// null response pointing at ip instead of 0.0.0.0, an A record for ipv4
+// addresses and an AAAA record for ipv6 ones, nil behaves like AppendNullResponse
+func AppendSinkholeResponse(dst []byte, query []byte, ip net.IP) []byte {
+	if ip == nil || len(query) < 12 {
+		return AppendNullResponse(dst, query)
+	}
+
+	var (
+		start int    = len(dst)
+		rtype uint16 = 28 // AAAA
+		rdata []byte = ip.To16()
+	)
+	if ip.To4() != nil {
+		rtype, rdata = 1, ip.To4()
+	}
+	dst = append(dst, query...)
+
+	binary.BigEndian.PutUint16(dst[start+2:start+4], answerFlags(query, 0))
+	binary.BigEndian.PutUint16(dst[start+6:start+8], 1)
+
+	// pointer to the question name, 60 seconds TTL
+	dst = append(dst, 0xC0, 0x0C)
+	dst = binary.BigEndian.AppendUint16(dst, rtype)
+	dst = binary.BigEndian.AppendUint16(dst, 1) // IN
+	dst = binary.BigEndian.AppendUint32(dst, 60)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(rdata)))
+	return append(dst, rdata...)
 }
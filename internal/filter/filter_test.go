@@ -1,9 +1,15 @@
 package filter
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 // TEST 1: Basic Add and IsBlocked
@@ -136,7 +142,7 @@ invalid line without format
 	defer os.Remove(filename)
 
 	// Load the file
-	err = f.LoadFromFile(filename)
+	_, err = f.LoadFromFile(filename)
 	if err != nil {
 		t.Fatalf("Failed to load file: %v", err)
 	}
@@ -182,7 +188,7 @@ func TestFilterList_LoadFromNonExistentFile(t *testing.T) {
 		err      error
 	)
 
-	err = f.LoadFromFile(filename)
+	_, err = f.LoadFromFile(filename)
 	if err == nil {
 		t.Error("Should return error for non-existent file")
 	}
@@ -200,6 +206,7 @@ func TestCreateBlockedResponse(t *testing.T) {
 
 	// Set up a minimal DNS query
 	binary.BigEndian.PutUint16(query[0:2], 0x1234) // Transaction ID
+	binary.BigEndian.PutUint16(query[2:4], 0x0100) // RD
 
 	response = CreateBlockedResponse(query)
 
@@ -208,7 +215,7 @@ func TestCreateBlockedResponse(t *testing.T) {
 		t.Errorf("Response length should equal query length")
 	}
 
-	// Check flags (should be 0x8183: QR=1, RCODE=3)
+	// Check flags (should be 0x8183: QR=1, RD=1, RA=1, RCODE=3)
 	flags = binary.BigEndian.Uint16(response[2:4])
 	if flags != 0x8183 {
 		t.Errorf("Expected flags 0x8183, got 0x%04X", flags)
@@ -255,6 +262,7 @@ func TestCreateNullResponse(t *testing.T) {
 
 	// Set up a minimal DNS query
 	binary.BigEndian.PutUint16(query[0:2], 0x5678) // Transaction ID
+	binary.BigEndian.PutUint16(query[2:4], 0x0100) // RD
 
 	response = CreateNullResponse(query)
 
@@ -263,7 +271,7 @@ func TestCreateNullResponse(t *testing.T) {
 		t.Error("Null response should be longer than query")
 	}
 
-	// Check flags (should be 0x8180: QR=1, RCODE=0)
+	// Check flags (should be 0x8180: QR=1, RD=1, RA=1, RCODE=0)
 	flags = binary.BigEndian.Uint16(response[2:4])
 	if flags != 0x8180 {
 		t.Errorf("Expected flags 0x8180, got 0x%04X", flags)
@@ -368,3 +376,826 @@ func TestNormalizeDomain(t *testing.T) {
 		}
 	}
 }
+
+// TEST 14: Allowlist file overrides blocklist file
+// Tests that an allowed subdomain is not blocked even if its parent is
+func TestFilterList_LoadAllowlistFromFile(t *testing.T) {
+	var (
+		f             *FilterList = NewFilterList()
+		blockFilename string      = "test_blocklist_parent.txt"
+		allowFilename string      = "test_allowlist.txt"
+		blockContent  string      = `! Blocklist
+||example.com^
+`
+		allowContent string = `! Allowlist
+# comments are ignored
+good.example.com
+@@||cdn.example.com^
+`
+		err error
+	)
+
+	err = os.WriteFile(blockFilename, []byte(blockContent), 0o644)
+	if err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	defer os.Remove(blockFilename)
+
+	err = os.WriteFile(allowFilename, []byte(allowContent), 0o644)
+	if err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	defer os.Remove(allowFilename)
+
+	if _, err = f.LoadFromFile(blockFilename); err != nil {
+		t.Fatalf("Failed to load blocklist: %v", err)
+	}
+	if err = f.LoadAllowlistFromFile(allowFilename); err != nil {
+		t.Fatalf("Failed to load allowlist: %v", err)
+	}
+
+	if !f.IsBlocked("ads.example.com") {
+		t.Error("ads.example.com should still be blocked by its parent")
+	}
+	if f.IsBlocked("good.example.com") {
+		t.Error("good.example.com should be allowed by the plain allowlist entry")
+	}
+	if f.IsBlocked("img.cdn.example.com") {
+		t.Error("img.cdn.example.com should be allowed by the @@ allowlist entry")
+	}
+	if f.Count() != 1 {
+		t.Errorf("Allowlist should not change the blocked count, got %d", f.Count())
+	}
+}
+
+// TEST 15: Exact match only mode
+// Tests that subdomains of a blocked domain are not blocked in exact mode
+func TestFilterList_ExactMatchOnly(t *testing.T) {
+	var (
+		exact    *FilterList = NewFilterListWithOptions(FilterOptions{ExactMatchOnly: true})
+		wildcard *FilterList = NewFilterList()
+	)
+
+	exact.Add("example.com")
+	wildcard.Add("example.com")
+
+	if !exact.IsBlocked("example.com") {
+		t.Error("Exact domain should be blocked in exact mode")
+	}
+	if !exact.IsBlocked("EXAMPLE.com.") {
+		t.Error("Exact domain should be normalized in exact mode")
+	}
+	if exact.IsBlocked("mail.example.com") {
+		t.Error("Subdomain should not be blocked in exact mode")
+	}
+	if !wildcard.IsBlocked("mail.example.com") {
+		t.Error("Subdomain should still be blocked in default mode")
+	}
+}
+
+// TEST 16: IsAllowed matches allowlisted parents
+// Tests that allowlist lookups use the same suffix matching as blocking
+func TestFilterList_IsAllowed(t *testing.T) {
+	var f *FilterList = NewFilterList()
+
+	f.AddAllowed("example.com")
+	f.Add("ads.net")
+
+	if !f.IsAllowed("www.example.com") {
+		t.Error("Subdomain of an allowlisted domain should be allowed")
+	}
+	if f.IsAllowed("ads.net") {
+		t.Error("Blocklisted domain should not be reported as allowlisted")
+	}
+}
+
+// TEST 17: AreBlocked matches IsBlocked
+// Tests that the bulk check gives the same answers, in order, as single calls
+func TestFilterList_AreBlocked(t *testing.T) {
+	var (
+		f       *FilterList = NewFilterList()
+		domains []string    = []string{"ads.com", "www.ads.com", "example.com", "safe.ads.com", "ADS.COM.", "other.net"}
+		results []bool
+	)
+
+	f.Add("ads.com")
+	f.AddAllowed("safe.ads.com")
+
+	results = f.AreBlocked(domains)
+	if len(results) != len(domains) {
+		t.Fatalf("Expected %d results, got %d", len(domains), len(results))
+	}
+	for i, domain := range domains {
+		if results[i] != f.IsBlocked(domain) {
+			t.Errorf("%s: AreBlocked=%v, IsBlocked=%v", domain, results[i], f.IsBlocked(domain))
+		}
+	}
+	if !results[0] || results[2] || results[3] {
+		t.Errorf("Unexpected results: %v", results)
+	}
+}
+
+// TEST 18: CreateErrorResponse sets the RCODE
+// Tests SERVFAIL, FORMERR and NOTIMP keep the id and question with no answers
+func TestCreateErrorResponse(t *testing.T) {
+	var (
+		query    []byte  = append(make([]byte, 12), 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1)
+		rcodes   []uint8 = []uint8{2, 1, 4}
+		response []byte
+		flags    uint16
+	)
+	binary.BigEndian.PutUint16(query[0:2], 0x4242)
+	binary.BigEndian.PutUint16(query[2:4], 0x0100) // RD
+	binary.BigEndian.PutUint16(query[6:8], 1)      // bogus answer count to be cleared
+
+	for _, rcode := range rcodes {
+		response = CreateErrorResponse(query, rcode)
+
+		if binary.BigEndian.Uint16(response[0:2]) != 0x4242 {
+			t.Errorf("rcode %d: transaction ID should be preserved", rcode)
+		}
+
+		flags = binary.BigEndian.Uint16(response[2:4])
+		if flags&0x8000 == 0 {
+			t.Errorf("rcode %d: QR bit should be set", rcode)
+		}
+		if flags&0x0100 == 0 {
+			t.Errorf("rcode %d: RD bit should be copied from the query", rcode)
+		}
+		if uint8(flags&0x000F) != rcode {
+			t.Errorf("Expected rcode %d, got %d", rcode, flags&0x000F)
+		}
+		if binary.BigEndian.Uint16(response[6:8]) != 0 {
+			t.Errorf("rcode %d: expected no answers", rcode)
+		}
+		if !bytes.Equal(response[12:], query[12:]) {
+			t.Errorf("rcode %d: question should be preserved", rcode)
+		}
+	}
+
+	if len(CreateErrorResponse(make([]byte, 8), 2)) != 8 {
+		t.Error("Short query should be returned unchanged")
+	}
+}
+
+// TEST 19: Stats breaks the rules down by kind
+// Tests exact, wildcard, regex and allowlist counts, and that each kind blocks
+func TestFilterList_Stats(t *testing.T) {
+	var (
+		f     *FilterList = NewFilterList()
+		stats FilterStats
+		err   error
+	)
+
+	f.Add("ads.com")
+	f.Add("tracker.net")
+	f.Add("*.cdn-ads.org")
+	if err = f.AddRegex(`^ad[0-9]+\.`); err != nil {
+		t.Fatalf("AddRegex failed: %v", err)
+	}
+	f.AddAllowed("safe.ads.com")
+
+	stats = f.Stats()
+	if stats != (FilterStats{Exact: 2, Wildcard: 1, Regex: 1, Allowlist: 1}) {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if f.Count() != 4 {
+		t.Errorf("Expected 4 blocking rules, got %d", f.Count())
+	}
+
+	if !f.IsBlocked("x.cdn-ads.org") || f.IsBlocked("cdn-ads.org") {
+		t.Error("Wildcard rule should block subdomains only")
+	}
+	if !f.IsBlocked("ad42.example.com") || f.IsBlocked("bad42.example.com") {
+		t.Error("Regex rule should match on the pattern")
+	}
+	if f.IsBlocked("safe.ads.com") {
+		t.Error("Allowlist should still win")
+	}
+}
+
+// TEST 20: Blocked answers echo RD and always set RA
+// Tests that a query without RD gets a blocked answer with RA but no RD
+func TestCreateBlockedResponse_RecursionFlags(t *testing.T) {
+	var (
+		query []byte = make([]byte, 12)
+		flags uint16
+	)
+	binary.BigEndian.PutUint16(query[0:2], 0x1234)
+
+	flags = binary.BigEndian.Uint16(CreateBlockedResponse(query)[2:4])
+	if flags != 0x8083 {
+		t.Errorf("Expected NXDOMAIN flags 0x8083 without RD, got 0x%04X", flags)
+	}
+
+	flags = binary.BigEndian.Uint16(CreateNullResponse(query)[2:4])
+	if flags != 0x8080 {
+		t.Errorf("Expected null flags 0x8080 without RD, got 0x%04X", flags)
+	}
+}
+
+// TEST 21: AdGuard modifiers are stripped from the rule
+// Tests that ||domain^$third-party blocks the domain and client only rules are skipped
+func TestLoadFromFile_IgnoredModifiers(t *testing.T) {
+	var (
+		filter   *FilterList = NewFilterList()
+		filename string      = "test_adguard_modifiers.txt"
+		content  string      = "||tracker.com^$third-party\n||ads.com^$important,third-party\n||lan.com^$client=192.168.1.5\n"
+		err      error
+	)
+
+	if err = os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write list: %v", err)
+	}
+	defer os.Remove(filename)
+	if _, err = filter.LoadFromFile(filename); err != nil {
+		t.Fatalf("LoadFromFile failed: %v", err)
+	}
+
+	if !filter.IsBlocked("tracker.com") || !filter.IsBlocked("cdn.ads.com") {
+		t.Error("Expected the domains of rules with ignored modifiers to be blocked")
+	}
+	if filter.IsBlocked("lan.com") {
+		t.Error("Expected the $client rule to be skipped instead of blocking every client")
+	}
+	if filter.Count() != 2 {
+		t.Errorf("Expected 2 rules, got %d", filter.Count())
+	}
+}
+
+// TEST 22: $dnstype rules only block the listed types
+// Tests that ||domain^$dnstype=AAAA blocks AAAA but not A, and ~ negates the list
+func TestLoadFromFile_DNSTypeModifier(t *testing.T) {
+	var (
+		filter   *FilterList = NewFilterList()
+		filename string      = "test_adguard_dnstype.txt"
+		content  string      = "||v6.com^$dnstype=AAAA\n||only-a.com^$dnstype=~A\n||bad.com^$dnstype=BOGUS\n"
+		err      error
+	)
+
+	if err = os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write list: %v", err)
+	}
+	defer os.Remove(filename)
+	if _, err = filter.LoadFromFile(filename); err != nil {
+		t.Fatalf("LoadFromFile failed: %v", err)
+	}
+
+	if !filter.IsBlockedType("v6.com", 28) || !filter.IsBlockedType("www.v6.com", 28) {
+		t.Error("Expected AAAA for v6.com and its subdomains to be blocked")
+	}
+	if filter.IsBlockedType("v6.com", 1) || filter.IsBlocked("v6.com") {
+		t.Error("Expected A for v6.com to be allowed")
+	}
+	if filter.IsBlockedType("only-a.com", 1) || !filter.IsBlockedType("only-a.com", 28) {
+		t.Error("Expected ~A to block everything but A")
+	}
+	if filter.Stats().Typed != 2 {
+		t.Errorf("Expected 2 typed rules, got %d", filter.Stats().Typed)
+	}
+}
+
+// TEST 23: Sinkhole responses point at the given address
+// Tests that ipv4 sinkholes answer with an A record, ipv6 ones with AAAA and nil with 0.0.0.0
+func TestAppendSinkholeResponse(t *testing.T) {
+	var tests = []struct {
+		name  string
+		ip    net.IP
+		rtype uint16
+		rdata []byte
+	}{
+		{"ipv4", net.ParseIP("192.0.2.10"), 1, []byte{192, 0, 2, 10}},
+		{"ipv6", net.ParseIP("2001:db8::10"), 28, net.ParseIP("2001:db8::10")},
+		{"nil", nil, 1, []byte{0, 0, 0, 0}},
+	}
+
+	for _, test := range tests {
+		var (
+			query    []byte = make([]byte, 12)
+			response []byte
+			answer   []byte
+			flags    uint16
+			ancount  uint16
+			rtype    uint16
+			rdlength int
+		)
+		binary.BigEndian.PutUint16(query[0:2], 0x5678)
+		binary.BigEndian.PutUint16(query[2:4], 0x0100) // RD
+
+		response = AppendSinkholeResponse(nil, query, test.ip)
+		if flags = binary.BigEndian.Uint16(response[2:4]); flags != 0x8180 {
+			t.Errorf("%s: expected flags 0x8180, got 0x%04X", test.name, flags)
+		}
+		if ancount = binary.BigEndian.Uint16(response[6:8]); ancount != 1 {
+			t.Errorf("%s: expected 1 answer, got %d", test.name, ancount)
+		}
+
+		answer = response[len(query):]
+		if rtype = binary.BigEndian.Uint16(answer[2:4]); rtype != test.rtype {
+			t.Errorf("%s: expected type %d, got %d", test.name, test.rtype, rtype)
+		}
+		if rdlength = int(binary.BigEndian.Uint16(answer[10:12])); rdlength != len(test.rdata) {
+			t.Fatalf("%s: expected rdlength %d, got %d", test.name, len(test.rdata), rdlength)
+		}
+		if !bytes.Equal(answer[12:], test.rdata) {
+			t.Errorf("%s: expected rdata %v, got %v", test.name, test.rdata, answer[12:])
+		}
+	}
+}
+
+// TEST 24: Metadata header of a list
+// Tests that LoadFromFile returns the title, version and expires headers and ignores other comments
+func TestLoadFromFile_Metadata(t *testing.T) {
+	var (
+		filter      *FilterList = NewFilterList()
+		filename    string      = "test_metadata.txt"
+		fileContent string      = `[Adblock Plus 2.0]
+! Title: Flash test list
+! Version: 2.1.45
+! Expires: 4 days (update frequency)
+! Last modified: 2024-05-01T10:00:00Z
+! Note: this comment is not metadata
+! Title: Included list
+||ads.example.com^
+`
+		metadata ListMetadata
+		err      error
+	)
+	if err = os.WriteFile(filename, []byte(fileContent), 0o644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+	defer os.Remove(filename)
+
+	if metadata, err = filter.LoadFromFile(filename); err != nil {
+		t.Fatalf("LoadFromFile failed: %v", err)
+	}
+
+	if metadata.Title != "Flash test list" {
+		t.Errorf("Expected the first title, got %q", metadata.Title)
+	}
+	if metadata.Version != "2.1.45" {
+		t.Errorf("Expected version 2.1.45, got %q", metadata.Version)
+	}
+	if metadata.Expires != 4*24*time.Hour {
+		t.Errorf("Expected expires of 4 days, got %v", metadata.Expires)
+	}
+	if metadata.LastModified != "2024-05-01T10:00:00Z" {
+		t.Errorf("Expected the last modified header, got %q", metadata.LastModified)
+	}
+	if filter.Count() != 1 || !filter.IsBlocked("ads.example.com") {
+		t.Errorf("Expected the rule after the header to be loaded, got %d rules", filter.Count())
+	}
+}
+
+// TEST 25: URL and host:port lines block the bare domain
+// Tests that the scheme, path and port of URL-style lines are stripped when loading
+func TestLoadFromFile_URLStyleLines(t *testing.T) {
+	var tests = []struct {
+		name   string
+		line   string
+		domain string
+	}{
+		{"url with a path", "https://ads.example.com/path/banner.js", "ads.example.com"},
+		{"host and port", "tracker.example.net:8080", "tracker.example.net"},
+		{"url with a port", "http://metrics.example.org:8443/collect?id=1", "metrics.example.org"},
+		{"rule with a port", "||cdn.example.io:443^", "cdn.example.io"},
+	}
+
+	for _, test := range tests {
+		var (
+			filter   *FilterList = NewFilterList()
+			filename string      = "test_url_lines.txt"
+			err      error
+		)
+		if err = os.WriteFile(filename, []byte(test.line+"\n"), 0o644); err != nil {
+			t.Fatalf("Failed to write list: %v", err)
+		}
+
+		_, err = filter.LoadFromFile(filename)
+		os.Remove(filename)
+		if err != nil {
+			t.Fatalf("%s: LoadFromFile failed: %v", test.name, err)
+		}
+
+		if !filter.IsBlocked(test.domain) {
+			t.Errorf("%s: expected %s to be blocked", test.name, test.domain)
+		}
+		if filter.Count() != 1 {
+			t.Errorf("%s: expected 1 rule, got %d", test.name, filter.Count())
+		}
+	}
+}
+
+// TEST 26: Allow regexes override blocks of a parent
+// Tests that a subdomain matching an allow regex isn't blocked while its siblings still are
+func TestFilterList_AddAllowRegex(t *testing.T) {
+	var (
+		f   *FilterList = NewFilterList()
+		err error
+	)
+	f.Add("blocked.net")
+	if err = f.AddAllowRegex(`^cdn\d+\.blocked\.net$`); err != nil {
+		t.Fatalf("AddAllowRegex failed: %v", err)
+	}
+
+	var tests = []struct {
+		domain  string
+		blocked bool
+	}{
+		{"cdn1.blocked.net", false},
+		{"CDN42.blocked.net.", false},
+		{"cdn.blocked.net", true},
+		{"ads.blocked.net", true},
+		{"blocked.net", true},
+	}
+	for _, test := range tests {
+		if f.IsBlocked(test.domain) != test.blocked {
+			t.Errorf("%s: expected blocked %v, got %v", test.domain, test.blocked, !test.blocked)
+		}
+	}
+
+	if !f.IsAllowed("cdn7.blocked.net") {
+		t.Error("Expected a domain matching an allow regex to be allowed")
+	}
+	if f.Stats().AllowRegex != 1 {
+		t.Errorf("Expected 1 allow regex in the stats, got %d", f.Stats().AllowRegex)
+	}
+	if err = f.AddAllowRegex(`^cdn(`); err == nil {
+		t.Error("Expected an invalid pattern to fail")
+	}
+}
+
+// TEST 27: Conflicting rules follow the documented precedence
+// Tests that allow exact > allow regex > block exact > block wildcard > block regex
+func TestFilterList_MatchRule_Precedence(t *testing.T) {
+	var (
+		filterList *FilterList = NewFilterList()
+		match      RuleMatch
+		err        error
+		tests      = []struct {
+			domain  string
+			kind    RuleKind
+			rule    string
+			blocked bool
+		}{
+			// allowlisted parent beats the allow regex and every block rule
+			{"cdn1.ads.example.com", RULE_ALLOW_EXACT, "ads.example.com", false},
+			// allow regex beats an exact block of a parent, a wildcard and a regex
+			{"cdn1.tracker.net", RULE_ALLOW_REGEX, `^cdn\d+\.`, false},
+			// exact block beats the wildcard and the regex
+			{"x.tracker.net", RULE_BLOCK_EXACT, "tracker.net", true},
+			// wildcard beats the regex
+			{"x.wild.org", RULE_BLOCK_WILDCARD, "*.wild.org", true},
+			{"x.regex.io", RULE_BLOCK_REGEX, `\.(wild\.org|regex\.io|tracker\.net)$`, true},
+			{"clean.com", RULE_NONE, "", false},
+		}
+	)
+	filterList.Add("ads.example.com")
+	filterList.Add("tracker.net")
+	filterList.Add("*.tracker.net")
+	filterList.Add("*.wild.org")
+	filterList.Add("*.ads.example.com")
+	filterList.AddAllowed("ads.example.com")
+	if err = filterList.AddRegex(`\.(wild\.org|regex\.io|tracker\.net)$`); err != nil {
+		t.Fatalf("AddRegex failed: %v", err)
+	}
+	if err = filterList.AddAllowRegex(`^cdn\d+\.`); err != nil {
+		t.Fatalf("AddAllowRegex failed: %v", err)
+	}
+
+	for _, test := range tests {
+		match = filterList.MatchRule(test.domain)
+		if match.Kind != test.kind || match.Rule != test.rule {
+			t.Errorf("%s: expected %s rule %q, got %s rule %q", test.domain, test.kind, test.rule, match.Kind, match.Rule)
+		}
+		if match.Blocked() != test.blocked || filterList.IsBlocked(test.domain) != test.blocked {
+			t.Errorf("%s: expected blocked=%v", test.domain, test.blocked)
+		}
+	}
+}
+
+// TEST 28: Disabled categories stop blocking
+// Tests that disabling "social" unblocks its domains while the "ads" rules keep blocking
+func TestFilterList_SetCategoryEnabled(t *testing.T) {
+	var (
+		filterList *FilterList = NewFilterList()
+		filename   string      = "test_social_list.txt"
+		content    string      = "||facebook.com^\n||*.tiktok.com^\n/^(www\\.)?instagram\\.com$/\n"
+		categories map[string]bool
+		err        error
+	)
+
+	if err = os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write list: %v", err)
+	}
+	defer os.Remove(filename)
+	if _, err = filterList.LoadFromFileCategory(filename, "social"); err != nil {
+		t.Fatalf("LoadFromFileCategory failed: %v", err)
+	}
+	filterList.AddCategory("doubleclick.net", "ads")
+	filterList.Add("malware.org")
+
+	var social = []string{"facebook.com", "www.facebook.com", "cdn.tiktok.com", "instagram.com"}
+	var always = []string{"doubleclick.net", "ad.doubleclick.net", "malware.org"}
+
+	for _, domain := range append(social, always...) {
+		if !filterList.IsBlocked(domain) {
+			t.Errorf("Expected %s to be blocked before disabling", domain)
+		}
+	}
+
+	filterList.SetCategoryEnabled("social", false)
+	for _, domain := range social {
+		if filterList.IsBlocked(domain) {
+			t.Errorf("Expected %s to be unblocked with social disabled", domain)
+		}
+	}
+	for _, domain := range always {
+		if !filterList.IsBlocked(domain) {
+			t.Errorf("Expected %s to stay blocked with social disabled", domain)
+		}
+	}
+	if categories = filterList.Categories(); categories["social"] || !categories["ads"] || len(categories) != 2 {
+		t.Errorf("Expected social disabled and ads enabled, got %v", categories)
+	}
+
+	filterList.SetCategoryEnabled("social", true)
+	for _, domain := range social {
+		if !filterList.IsBlocked(domain) {
+			t.Errorf("Expected %s to be blocked again after enabling", domain)
+		}
+	}
+}
+
+// TEST 29: Loading stops at the entry cap and skips overlong lines
+// Tests that a list over MaxEntries keeps the first rules and reports ErrTooManyEntries,
+// and that a line over MaxLineLength is skipped while the following ones still load
+func TestFilterList_LoadLimits(t *testing.T) {
+	var (
+		filterList *FilterList = NewFilterListWithOptions(FilterOptions{MaxEntries: 5, MaxLineLength: 64})
+		filename   string      = "test_limits_list.txt"
+		content    strings.Builder
+		err        error
+		i          int
+	)
+	for i = 0; i < 10; i++ {
+		if i == 2 {
+			content.WriteString("||" + strings.Repeat("a", 200) + ".com^\n") // over the line length
+		}
+		fmt.Fprintf(&content, "||ads%d.com^\n", i)
+	}
+
+	if err = os.WriteFile(filename, []byte(content.String()), 0o644); err != nil {
+		t.Fatalf("Failed to write list: %v", err)
+	}
+	defer os.Remove(filename)
+
+	if _, err = filterList.LoadFromFile(filename); !errors.Is(err, ErrTooManyEntries) {
+		t.Errorf("Expected ErrTooManyEntries, got %v", err)
+	}
+	if filterList.Count() != 5 {
+		t.Errorf("Expected loading to stop at 5 entries, got %d", filterList.Count())
+	}
+	if !filterList.IsBlocked("ads4.com") || filterList.IsBlocked("ads5.com") {
+		t.Error("Expected the first 5 rules loaded and the rest left out")
+	}
+	if filterList.IsBlocked(strings.Repeat("a", 200) + ".com") {
+		t.Error("Expected the overlong line to be skipped")
+	}
+
+	// a second list adds nothing to a full filter
+	if _, err = filterList.LoadFromFile(filename); !errors.Is(err, ErrTooManyEntries) || filterList.Count() != 5 {
+		t.Errorf("Expected a full filter to refuse more rules, got %v with %d", err, filterList.Count())
+	}
+}
+
+// TEST 30: Merging two lists combines their rules once
+// Tests that Merge copies every rule kind of the other list, keeps the shared rules
+// once and that the merged list blocks and allows like both did
+func TestFilterList_Merge(t *testing.T) {
+	var (
+		first  *FilterList = NewFilterList()
+		second *FilterList = NewFilterList()
+		stats  FilterStats
+		err    error
+	)
+	first.Add("ads.com")
+	first.Add("*.track.net")
+	first.AddAllowed("ok.ads.com")
+	if err = first.AddRegex(`^ad\d+\.`); err != nil {
+		t.Fatalf("AddRegex failed: %v", err)
+	}
+
+	second.Add("ads.com") // in both
+	second.Add("spam.org")
+	second.addTyped("v6.com", typeRule{types: map[uint16]bool{28: true}}, "")
+	second.AddAllowed("fine.spam.org")
+	second.AddPassthrough("api.spam.org")
+	if err = second.AddRegex(`^ad\d+\.`); err != nil { // same pattern
+		t.Fatalf("AddRegex failed: %v", err)
+	}
+	if err = second.AddAllowRegex(`^cdn\d+\.spam\.org$`); err != nil {
+		t.Fatalf("AddAllowRegex failed: %v", err)
+	}
+
+	first.Merge(second)
+	first.Merge(first) // no-op
+
+	stats = first.Stats()
+	if stats != (FilterStats{Exact: 2, Wildcard: 1, Regex: 1, Typed: 1, Allowlist: 3, AllowRegex: 1}) {
+		t.Errorf("Unexpected merged stats: %+v", stats)
+	}
+	if !first.IsBlocked("spam.org") || !first.IsBlocked("x.track.net") || !first.IsBlocked("ad1.example.com") || !first.IsBlockedType("v6.com", 28) {
+		t.Error("Expected the rules of both lists to block")
+	}
+	if first.IsBlocked("ok.ads.com") || first.IsBlocked("fine.spam.org") || first.IsBlocked("cdn1.spam.org") || !first.IsPassthrough("api.spam.org") {
+		t.Error("Expected the allow rules of both lists to apply")
+	}
+	if second.Stats() != (FilterStats{Exact: 2, Typed: 1, Regex: 1, Allowlist: 2, AllowRegex: 1}) {
+		t.Errorf("Expected the merged list to be left alone, got %+v", second.Stats())
+	}
+}
+
+// TEST 31: Big lists are loaded in bounded batches
+// Tests that LoadFromFile streams a large list into AddBatch calls of at most
+// LoadBatchSize domains each, the last one holding the rest, and loses no rule
+func TestFilterList_LoadBatches(t *testing.T) {
+	var (
+		filterList *FilterList = NewFilterListWithOptions(FilterOptions{LoadBatchSize: 100})
+		filename   string      = "test_batched_list.txt"
+		content    strings.Builder
+		batches    []int
+		total      int
+		err        error
+		i          int
+	)
+	for i = 0; i < 10050; i++ {
+		fmt.Fprintf(&content, "||ads%d.example.com^\n", i)
+	}
+	content.WriteString("/^tracker\\d+\\./\n") // regexes aren't batched
+	if err = os.WriteFile(filename, []byte(content.String()), 0o644); err != nil {
+		t.Fatalf("Failed to write list: %v", err)
+	}
+	defer os.Remove(filename)
+
+	filterList.flushed = func(size int) {
+		batches = append(batches, size)
+	}
+	if _, err = filterList.LoadFromFile(filename); err != nil {
+		t.Fatalf("LoadFromFile failed: %v", err)
+	}
+
+	if len(batches) != 101 || batches[len(batches)-1] != 50 {
+		t.Errorf("Expected 100 full batches and one of 50, got %d batches", len(batches))
+	}
+	for _, size := range batches {
+		if size > 100 {
+			t.Errorf("Expected batches of at most 100 domains, got %d", size)
+		}
+		total += size
+	}
+	if total != 10050 || filterList.Count() != 10051 {
+		t.Errorf("Expected every rule loaded, got %d batched and %d rules", total, filterList.Count())
+	}
+	if !filterList.IsBlocked("ads0.example.com") || !filterList.IsBlocked("ads10049.example.com") || !filterList.IsBlocked("tracker7.net") {
+		t.Error("Expected the first, last and regex rules to block")
+	}
+}
+
+// TEST 32: $dnstype rules for the same domain add up
+// Tests that a second $dnstype line for a domain blocks its types on top of the
+// first one instead of replacing it, also when it's negated or comes from a merge
+func TestLoadFromFile_DNSTypeRulesCombine(t *testing.T) {
+	var (
+		filter   *FilterList = NewFilterList()
+		other    *FilterList = NewFilterList()
+		filename string      = "test_adguard_dnstype_combine.txt"
+		content  string      = "||x.com^$dnstype=A\n||x.com^$dnstype=AAAA\n||y.com^$dnstype=~A|~MX\n||y.com^$dnstype=MX\n"
+		err      error
+	)
+
+	if err = os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write list: %v", err)
+	}
+	defer os.Remove(filename)
+	if _, err = filter.LoadFromFile(filename); err != nil {
+		t.Fatalf("LoadFromFile failed: %v", err)
+	}
+
+	if !filter.IsBlockedType("x.com", 1) || !filter.IsBlockedType("x.com", 28) || filter.IsBlockedType("x.com", 16) {
+		t.Error("Expected A and AAAA for x.com to be blocked, and only them")
+	}
+	if filter.IsBlockedType("y.com", 1) || !filter.IsBlockedType("y.com", 15) || !filter.IsBlockedType("y.com", 16) {
+		t.Error("Expected everything but A to be blocked for y.com")
+	}
+	if filter.Stats().Typed != 2 {
+		t.Errorf("Expected 2 typed rules, got %d", filter.Stats().Typed)
+	}
+
+	other.addTyped("x.com", typeRule{types: map[uint16]bool{16: true}}, "")
+	filter.Merge(other)
+	if !filter.IsBlockedType("x.com", 1) || !filter.IsBlockedType("x.com", 16) {
+		t.Error("Expected the merged TXT rule to add to the A and AAAA ones")
+	}
+}
+
+// TEST 33: A rule on several lists blocks while any of them is enabled
+// Tests that a domain in "ads" and "social" stays blocked with one of them disabled
+// and that a rule also added without a category never stops blocking
+func TestFilterList_SetCategoryEnabled_SharedRules(t *testing.T) {
+	var (
+		filterList *FilterList = NewFilterList()
+		categories map[string]bool
+		err        error
+	)
+	filterList.AddCategory("tracker.com", "ads")
+	filterList.AddCategory("tracker.com", "social")
+	filterList.Add("malware.org")
+	filterList.AddCategory("malware.org", "social")
+	filterList.AddBatch([]string{"pixel.net"}, "social")
+	filterList.Add("pixel.net")
+	if err = filterList.AddRegexCategory(`^ads\d+\.`, "ads"); err != nil {
+		t.Fatalf("AddRegexCategory failed: %v", err)
+	}
+	if err = filterList.AddRegexCategory(`^ads\d+\.`, "social"); err != nil {
+		t.Fatalf("AddRegexCategory failed: %v", err)
+	}
+
+	filterList.SetCategoryEnabled("social", false)
+	for _, domain := range []string{"tracker.com", "malware.org", "pixel.net", "ads1.example.com"} {
+		if !filterList.IsBlocked(domain) {
+			t.Errorf("Expected %s to stay blocked by its other source", domain)
+		}
+	}
+
+	filterList.SetCategoryEnabled("ads", false)
+	if filterList.IsBlocked("tracker.com") || filterList.IsBlocked("ads1.example.com") {
+		t.Error("Expected the rules to stop blocking once all their categories are disabled")
+	}
+	if !filterList.IsBlocked("malware.org") || !filterList.IsBlocked("pixel.net") {
+		t.Error("Expected the rules also added without a category to keep blocking")
+	}
+	if categories = filterList.Categories(); len(categories) != 2 || categories["ads"] || categories["social"] {
+		t.Errorf("Expected ads and social, both disabled, got %v", categories)
+	}
+}
+
+// TEST 34: Merging keeps the categories of both lists
+// Tests that a rule uncategorized on either side of a merge keeps blocking with the
+// other side's category disabled, and that a new rule keeps the category it came with
+func TestFilterList_Merge_Categories(t *testing.T) {
+	var (
+		first  *FilterList = NewFilterList()
+		second *FilterList = NewFilterList()
+	)
+	first.Add("x.com")
+	second.AddCategory("x.com", "social")
+	first.AddCategory("y.com", "social")
+	second.Add("y.com")
+	first.AddCategory("z.com", "ads")
+	second.AddCategory("z.com", "social")
+	second.AddCategory("new.com", "social")
+
+	first.Merge(second)
+	first.SetCategoryEnabled("social", false)
+
+	for _, domain := range []string{"x.com", "y.com", "z.com"} {
+		if !first.IsBlocked(domain) {
+			t.Errorf("Expected %s to stay blocked by its other source", domain)
+		}
+	}
+	if first.IsBlocked("new.com") {
+		t.Error("Expected the merged social rule to follow its category")
+	}
+
+	first.SetCategoryEnabled("ads", false)
+	if first.IsBlocked("z.com") {
+		t.Error("Expected z.com to stop blocking with both its categories disabled")
+	}
+	if second.categories["x.com"]["ads"] || len(second.categories["y.com"]) != 0 {
+		t.Error("Expected the merged list to be left alone")
+	}
+}
+
+// BENCHMARK 1: Blocked responses, allocating vs appending to a reused buffer
+// go test -bench BlockedResponse -benchmem ./internal/filter
+func BenchmarkCreateBlockedResponse(b *testing.B) {
+	var query []byte = append(make([]byte, 12), 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		_ = CreateNullResponse(query)
+	}
+}
+
+func BenchmarkAppendBlockedResponse(b *testing.B) {
+	var (
+		query  []byte = append(make([]byte, 12), 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1)
+		buffer []byte = make([]byte, 0, 512)
+	)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		buffer = AppendNullResponse(buffer[:0], query)
+	}
+}
@@ -0,0 +1,110 @@
+package filter
+
+// kind of the rule that decided about a domain, in precedence order: when rules
+// of several kinds match a domain, the earliest kind in this list wins
+//
+//	allowlisted domain or parent > allow regex > blocked domain or parent > wildcard > block regex
+//
+// any allow rule beats any block rule, and among the block rules the most
+// specific one is reported; $dnstype rules are only checked by IsBlockedType
+type RuleKind int
+
+const (
+	RULE_NONE           RuleKind = iota // nothing matched, the domain isn't blocked
+	RULE_ALLOW_EXACT                    // the domain or a parent is allowlisted
+	RULE_ALLOW_REGEX                    // an allow regex matched a blocked domain
+	RULE_BLOCK_EXACT                    // the domain or a parent is listed (only the domain with ExactMatchOnly)
+	RULE_BLOCK_WILDCARD                 // a "*." rule of a parent
+	RULE_BLOCK_REGEX                    // a block regex
+)
+
+func (k RuleKind) String() string {
+	switch k {
+	case RULE_ALLOW_EXACT:
+		return "allow"
+	case RULE_ALLOW_REGEX:
+		return "allow-regex"
+	case RULE_BLOCK_EXACT:
+		return "block"
+	case RULE_BLOCK_WILDCARD:
+		return "block-wildcard"
+	case RULE_BLOCK_REGEX:
+		return "block-regex"
+	}
+
+	return "none"
+}
+
+// the winning rule for a domain, see FilterList.MatchRule
+type RuleMatch struct {
+	Kind RuleKind
+	Rule string // the listed domain, the parent of a wildcard as *.parent, or the pattern
+}
+
+func (m RuleMatch) Blocked() bool {
+	return m.Kind >= RULE_BLOCK_EXACT
+}
+
+// the rule deciding whether the domain is blocked, following the RuleKind precedence
+// allow regexes are only reported for domains a block rule matched
+func (f *FilterList) MatchRule(domain string) RuleMatch {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.matchRuleLocked(normalizeDomain(domain))
+}
+
+// must be called with the read lock held, domain already normalized
+func (f *FilterList) matchRuleLocked(domain string) RuleMatch {
+	var (
+		block RuleMatch
+		rule  string
+		found bool
+	)
+	if rule, found = matchedSuffix(f.allowlist, domain); found {
+		return RuleMatch{Kind: RULE_ALLOW_EXACT, Rule: rule}
+	}
+
+	if block = f.matchBlockRule(domain); block.Kind == RULE_NONE {
+		return block
+	}
+
+	// the allow regexes are slow, only blocked domains go through them
+	if rule, found = f.matchedAllowRegex(domain); found {
+		return RuleMatch{Kind: RULE_ALLOW_REGEX, Rule: rule}
+	}
+
+	return block
+}
+
+// the most specific block rule matching the domain, RULE_NONE without one
+// must be called with the read lock held, domain already normalized
+func (f *FilterList) matchBlockRule(domain string) RuleMatch {
+	var (
+		rule  string
+		found bool
+	)
+	if f.options.ExactMatchOnly && f.domains[domain] && f.ruleEnabled(domain) {
+		return RuleMatch{Kind: RULE_BLOCK_EXACT, Rule: domain}
+	}
+
+	if !f.options.ExactMatchOnly {
+		if rule, found = f.matchedEnabledSuffix(f.domains, domain, ""); found {
+			return RuleMatch{Kind: RULE_BLOCK_EXACT, Rule: rule}
+		}
+	}
+
+	if len(f.wildcards) > 0 {
+		if rule, found = f.matchedEnabledParent(f.wildcards, domain, "*."); found {
+			return RuleMatch{Kind: RULE_BLOCK_WILDCARD, Rule: "*." + rule}
+		}
+	}
+
+	for _, regex := range f.regexes {
+		if regex.MatchString(domain) && f.ruleEnabled(regexKey(regex.String())) {
+			return RuleMatch{Kind: RULE_BLOCK_REGEX, Rule: regex.String()}
+		}
+	}
+
+	return RuleMatch{}
+}
@@ -0,0 +1,125 @@
+package filter
+
+import (
+	"maps"
+	"regexp"
+)
+
+// copies the rules of other into f: domains, wildcards, $dnstype rules, regexes,
+// the allowlist, allow regexes, passthrough domains and rule categories
+// rules f already has are kept once, a regex counts as the same when its pattern is
+// and $dnstype rules for a domain of both lists block the types of either; a rule of
+// both lists gets the categories of both, see tagLocked
+// other is read under its own lock before f is locked, so two lists can merge into
+// each other concurrently; MaxEntries isn't checked and disabled categories stay as they are in f
+func (f *FilterList) Merge(other *FilterList) {
+	if other == nil || other == f {
+		return
+	}
+
+	var (
+		domains      map[string]bool
+		wildcards    map[string]bool
+		typed        map[string]typeRule
+		allowlist    map[string]bool
+		passthrough  map[string]bool
+		categories   map[string]map[string]bool // copied set by set, they're modified in place
+		regexes      []*regexp.Regexp
+		allowRegexes []*regexp.Regexp
+		existing     typeRule
+		exists       bool
+		known        map[string]bool
+	)
+	other.mu.RLock()
+	domains, wildcards, typed = maps.Clone(other.domains), maps.Clone(other.wildcards), maps.Clone(other.typed)
+	allowlist, passthrough, categories = maps.Clone(other.allowlist), maps.Clone(other.passthrough), cloneCategories(other.categories)
+	regexes = append(regexes, other.regexes...)
+	allowRegexes = append(allowRegexes, other.allowRegexes...)
+	other.mu.RUnlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// before the rules are copied, to know which ones f already had
+	for domain := range domains {
+		f.mergeCategoriesLocked(domain, categories[domain], f.hasRuleLocked(domain))
+	}
+	for domain := range wildcards {
+		f.mergeCategoriesLocked("*."+domain, categories["*."+domain], f.wildcards[domain])
+	}
+	for domain := range typed {
+		f.mergeCategoriesLocked(domain, categories[domain], f.hasRuleLocked(domain))
+	}
+	known = make(map[string]bool, len(f.regexes))
+	for _, regex := range f.regexes {
+		known[regex.String()] = true
+	}
+	for _, regex := range regexes {
+		f.mergeCategoriesLocked(regexKey(regex.String()), categories[regexKey(regex.String())], known[regex.String()])
+	}
+
+	maps.Copy(f.domains, domains)
+	maps.Copy(f.wildcards, wildcards)
+	for domain, rule := range typed {
+		if existing, exists = f.typed[domain]; exists {
+			rule = existing.union(rule)
+		}
+		f.typed[domain] = rule
+	}
+	maps.Copy(f.allowlist, allowlist)
+	maps.Copy(f.passthrough, passthrough)
+	f.regexes = appendNewRegexes(f.regexes, regexes)
+	f.allowRegexes = appendNewRegexes(f.allowRegexes, allowRegexes)
+}
+
+// the regexes of add whose pattern isn't in list yet
+func appendNewRegexes(list []*regexp.Regexp, add []*regexp.Regexp) []*regexp.Regexp {
+	var known map[string]bool = make(map[string]bool, len(list)+len(add))
+	for _, regex := range list {
+		known[regex.String()] = true
+	}
+
+	for _, regex := range add {
+		if known[regex.String()] {
+			continue
+		}
+		known[regex.String()] = true
+		list = append(list, regex)
+	}
+
+	return list
+}
+
+// adds the categories other has for the rule, set is nil when other has it without one
+// existed says whether f had the rule before the merge, must be called with the write lock held
+func (f *FilterList) mergeCategoriesLocked(key string, set map[string]bool, existed bool) {
+	var current map[string]bool = f.categories[key]
+	if !existed {
+		if set != nil {
+			f.categories[key] = maps.Clone(set)
+		}
+		return
+	}
+	if current == nil && set == nil {
+		return
+	}
+
+	if current == nil { // uncategorized in f, it stays on
+		current = map[string]bool{"": true}
+		f.categories[key] = current
+	}
+	if set == nil {
+		current[""] = true
+		return
+	}
+	maps.Copy(current, set)
+}
+
+func cloneCategories(categories map[string]map[string]bool) map[string]map[string]bool {
+	var clone map[string]map[string]bool = make(map[string]map[string]bool, len(categories))
+	for key, set := range categories {
+		clone[key] = maps.Clone(set)
+	}
+
+	return clone
+}
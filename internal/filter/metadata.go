@@ -0,0 +1,95 @@
+package filter
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// header comments of a blocklist, like
+//
+//	! Title: AdGuard DNS filter
+//	! Version: 2.1.45
+//	! Expires: 4 days (update frequency)
+//
+// the fields missing from the list stay empty
+type ListMetadata struct {
+	Title        string        `json:"title,omitempty"`
+	Description  string        `json:"description,omitempty"`
+	Homepage     string        `json:"homepage,omitempty"`
+	Version      string        `json:"version,omitempty"`
+	LastModified string        `json:"last_modified,omitempty"`
+	Expires      time.Duration `json:"expires,omitempty"` // how often the list should be downloaded again, zero when unknown
+}
+
+// fills the field of a "! Key: value" comment, false for any other comment
+// the first value of each key wins, lists sometimes repeat the header of the lists they include
+func (m *ListMetadata) parseComment(line string) bool {
+	var (
+		key   string
+		value string
+		found bool
+	)
+	if key, value, found = strings.Cut(strings.TrimPrefix(line, "!"), ":"); !found {
+		return false
+	}
+	value = strings.TrimSpace(value)
+
+	switch strings.ToLower(strings.TrimSpace(key)) {
+	case "title":
+		setOnce(&m.Title, value)
+	case "description":
+		setOnce(&m.Description, value)
+	case "homepage":
+		setOnce(&m.Homepage, value)
+	case "version":
+		setOnce(&m.Version, value)
+	case "last modified", "timeupdated":
+		setOnce(&m.LastModified, value)
+	case "expires":
+		if m.Expires == 0 {
+			m.Expires = parseExpires(value)
+		}
+	default:
+		return false
+	}
+
+	return true
+}
+
+func setOnce(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
+
+// "4 days (update frequency)", "12 hours" or a bare number of days, zero when unreadable
+func parseExpires(value string) time.Duration {
+	var (
+		fields []string
+		amount int
+		unit   time.Duration = 24 * time.Hour
+		err    error
+	)
+	value, _, _ = strings.Cut(value, "(")
+	if fields = strings.Fields(value); len(fields) == 0 || len(fields) > 2 {
+		return 0
+	}
+
+	if amount, err = strconv.Atoi(fields[0]); err != nil || amount <= 0 {
+		return 0
+	}
+
+	if len(fields) == 2 {
+		switch strings.TrimSuffix(strings.ToLower(fields[1]), "s") {
+		case "day":
+			unit = 24 * time.Hour
+		case "hour":
+			unit = time.Hour
+		default:
+			return 0
+		}
+	}
+
+	return time.Duration(amount) * unit
+}
@@ -0,0 +1,103 @@
+package filter
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// query types a $dnstype modifier can name
+var dnsTypes map[string]uint16 = map[string]uint16{
+	"A":     1,
+	"NS":    2,
+	"CNAME": 5,
+	"SOA":   6,
+	"PTR":   12,
+	"MX":    15,
+	"TXT":   16,
+	"AAAA":  28,
+	"SRV":   33,
+	"SVCB":  64,
+	"HTTPS": 65,
+}
+
+// modifiers that narrow the rule in ways a dns filter can't check,
+// ignoring them would block more than the list author meant, so the rule is skipped
+var unsupportedModifiers map[string]bool = map[string]bool{
+	"badfilter":  true,
+	"client":     true,
+	"ctag":       true,
+	"denyallow":  true,
+	"dnsrewrite": true,
+}
+
+// rule limited to some query types by $dnstype=AAAA or $dnstype=~A
+type typeRule struct {
+	types   map[uint16]bool
+	negated bool // blocks every type but the listed ones
+}
+
+func (r typeRule) matches(qtype uint16) bool {
+	return r.types[qtype] != r.negated
+}
+
+// rule blocking the types either of them blocks, e.g. two lines for the same domain
+func (r typeRule) union(other typeRule) typeRule {
+	var union typeRule = typeRule{types: make(map[uint16]bool), negated: r.negated || other.negated}
+	if !union.negated {
+		maps.Copy(union.types, r.types)
+		maps.Copy(union.types, other.types)
+		return union
+	}
+
+	// a negated rule allows only its listed types, those neither of them blocks stay listed
+	for _, rule := range []typeRule{r, other} {
+		for qtype := range rule.types {
+			if !r.matches(qtype) && !other.matches(qtype) {
+				union.types[qtype] = true
+			}
+		}
+	}
+	return union
+}
+
+// reads the modifiers after the $ of an adguard rule
+// returns nil when the rule applies to every type, modifiers like $third-party
+// don't mean anything for dns and are ignored
+func parseModifiers(modifiers string) (*typeRule, error) {
+	var (
+		rule  *typeRule
+		name  string
+		value string
+	)
+	for _, modifier := range strings.Split(modifiers, ",") {
+		name, value, _ = strings.Cut(strings.TrimSpace(modifier), "=")
+		name = strings.ToLower(name)
+
+		if unsupportedModifiers[name] {
+			return nil, fmt.Errorf("unsupported modifier $%s", name)
+		}
+		if name != "dnstype" {
+			continue
+		}
+
+		rule = &typeRule{types: make(map[uint16]bool)}
+		for _, typeName := range strings.Split(value, "|") {
+			var (
+				qtype   uint16
+				negated bool = strings.HasPrefix(typeName, "~")
+				found   bool
+			)
+			if qtype, found = dnsTypes[strings.ToUpper(strings.TrimPrefix(typeName, "~"))]; !found {
+				return nil, fmt.Errorf("unknown dnstype %q", typeName)
+			}
+			if len(rule.types) > 0 && negated != rule.negated {
+				return nil, fmt.Errorf("dnstype can't mix negated and plain types")
+			}
+			rule.negated = negated
+			rule.types[qtype] = true
+		}
+	}
+
+	return rule, nil
+}
@@ -0,0 +1,22 @@
+package filter
+
+// passthrough domains are allowlisted and never cached, for dynamic endpoints
+// that must always resolve fresh; like the allowlist they cover the subdomains
+
+// allowlists the domain and marks it to skip the cache
+func (f *FilterList) AddPassthrough(domain string) {
+	f.AddAllowed(domain)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.passthrough[normalizeDomain(domain)] = true
+}
+
+// true when the domain or one of its parents was added with AddPassthrough
+func (f *FilterList) IsPassthrough(domain string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return matchesSuffix(f.passthrough, normalizeDomain(domain))
+}
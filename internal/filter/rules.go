@@ -0,0 +1,42 @@
+package filter
+
+import "strings"
+
+// besides the plain domains, which also block their subdomains, the list takes
+// two more kinds of block rules:
+//
+//	*.ads.com      wildcard, blocks the subdomains of ads.com but not ads.com itself
+//	/^ads\d+\./    regex, blocks every domain matching it, one per line in the list files
+
+// must be called with the write lock held and a normalized domain
+func (f *FilterList) addLocked(domain string) {
+	if strings.HasPrefix(domain, "*.") {
+		f.wildcards[domain[2:]] = true
+		return
+	}
+	f.domains[domain] = true
+}
+
+// blocks every domain matching the pattern, checked after the domain rules
+func (f *FilterList) AddRegex(pattern string) error {
+	return f.AddRegexCategory(pattern, "")
+}
+
+// like matchedSuffix but the domain itself doesn't count
+func matchedParent(set map[string]bool, domain string) (string, bool) {
+	var dotIndex int = strings.IndexRune(domain, '.')
+	if dotIndex == -1 {
+		return "", false
+	}
+
+	return matchedSuffix(set, domain[dotIndex+1:])
+}
+
+// the pattern of a /regex/ list line, false for every other line
+func regexRule(line string) (string, bool) {
+	if len(line) <= 2 || !strings.HasPrefix(line, "/") || !strings.HasSuffix(line, "/") {
+		return "", false
+	}
+
+	return line[1 : len(line)-1], true
+}
@@ -0,0 +1,58 @@
+package filter
+
+import (
+	"strings"
+	"time"
+)
+
+// blocks a domain (and its subdomains) only inside a time window
+// e.g. youtube.com on weekdays from 14:00 to 18:00
+type TimedRule struct {
+	Domain string         // "*." prefix is accepted and ignored, subdomains always match
+	Days   []time.Weekday // empty means every day
+	Start  time.Duration  // since midnight, local time of the clock used
+	End    time.Duration  // when End <= Start the window goes past midnight
+}
+
+// true when the rule matches the domain and now is inside the window
+func (r TimedRule) IsActive(domain string, now time.Time) bool {
+	return r.matchesDomain(domain) && r.inWindow(now)
+}
+
+func (r TimedRule) matchesDomain(domain string) bool {
+	var ruleDomain string = normalizeDomain(strings.TrimPrefix(strings.TrimSpace(r.Domain), "*."))
+	domain = normalizeDomain(domain)
+
+	return domain == ruleDomain || strings.HasSuffix(domain, "."+ruleDomain)
+}
+
+func (r TimedRule) inWindow(now time.Time) bool {
+	var (
+		midnight  time.Time     = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		sinceZero time.Duration = now.Sub(midnight)
+		day       time.Weekday  = now.Weekday()
+	)
+
+	if r.End <= r.Start { // overnight, the part after midnight belongs to the previous day
+		if sinceZero < r.End {
+			return r.onDay((day + 6) % 7)
+		}
+		return sinceZero >= r.Start && r.onDay(day)
+	}
+
+	return sinceZero >= r.Start && sinceZero < r.End && r.onDay(day)
+}
+
+func (r TimedRule) onDay(day time.Weekday) bool {
+	if len(r.Days) == 0 {
+		return true
+	}
+
+	for _, d := range r.Days {
+		if d == day {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,68 @@
+package filter
+
+import (
+	"testing"
+	"time"
+)
+
+// TEST 1: Rule inside its window blocks the domain and subdomains
+// Tests that a weekday afternoon rule is active at the right time
+func TestTimedRule_IsActive(t *testing.T) {
+	var (
+		rule TimedRule = TimedRule{
+			Domain: "*.games.com",
+			Days:   []time.Weekday{time.Monday, time.Tuesday},
+			Start:  14 * time.Hour,
+			End:    18 * time.Hour,
+		}
+		monday15h time.Time = time.Date(2024, time.January, 15, 15, 0, 0, 0, time.UTC) // a Monday
+		monday19h time.Time = time.Date(2024, time.January, 15, 19, 0, 0, 0, time.UTC)
+		sunday15h time.Time = time.Date(2024, time.January, 14, 15, 0, 0, 0, time.UTC)
+	)
+
+	if !rule.IsActive("games.com", monday15h) {
+		t.Error("Rule should be active on Monday at 15:00")
+	}
+	if !rule.IsActive("play.games.com", monday15h) {
+		t.Error("Rule should match subdomains")
+	}
+	if rule.IsActive("othergames.com", monday15h) {
+		t.Error("Rule should not match unrelated domains")
+	}
+	if rule.IsActive("games.com", monday19h) {
+		t.Error("Rule should not be active after the window")
+	}
+	if rule.IsActive("games.com", sunday15h) {
+		t.Error("Rule should not be active on other days")
+	}
+}
+
+// TEST 2: Overnight window wraps past midnight
+// Tests that a 22:00-06:00 rule is active late at night and early morning
+func TestTimedRule_Overnight(t *testing.T) {
+	var (
+		rule TimedRule = TimedRule{
+			Domain: "social.com",
+			Days:   []time.Weekday{time.Sunday},
+			Start:  22 * time.Hour,
+			End:    6 * time.Hour,
+		}
+		sunday23h time.Time = time.Date(2024, time.January, 14, 23, 0, 0, 0, time.UTC)
+		monday05h time.Time = time.Date(2024, time.January, 15, 5, 0, 0, 0, time.UTC)
+		monday07h time.Time = time.Date(2024, time.January, 15, 7, 0, 0, 0, time.UTC)
+		monday23h time.Time = time.Date(2024, time.January, 15, 23, 0, 0, 0, time.UTC)
+	)
+
+	if !rule.IsActive("social.com", sunday23h) {
+		t.Error("Rule should be active Sunday night")
+	}
+	if !rule.IsActive("social.com", monday05h) {
+		t.Error("Rule started on Sunday should still be active Monday early morning")
+	}
+	if rule.IsActive("social.com", monday07h) {
+		t.Error("Rule should not be active after the window ends")
+	}
+	if rule.IsActive("social.com", monday23h) {
+		t.Error("Rule should not start on a day that isn't listed")
+	}
+}
@@ -1,12 +1,11 @@
 package logger
 
 import (
+	"fmt"
+	"io"
 	"log"
 	"os"
-)
-
-var (
-	logger *log.Logger
+	"sync/atomic"
 )
 
 const (
@@ -17,6 +16,27 @@ const (
 	DefaultPath string = "/var/log/dnsServer.log"
 )
 
+// destination of the log lines, Info, Warn and Error write to the current one
+type Logger interface {
+	Info(msg string)
+	Warn(msg string)
+	Error(msg string)
+}
+
+// wraps the interface so loggers of different types can share the atomic
+type loggerHolder struct {
+	Logger
+}
+
+var current atomic.Pointer[loggerHolder] // nil logs nothing
+
+var debug atomic.Bool // Debug lines are dropped until SetDebug(true)
+
+// loggers with their own debug level, the others get the Debug lines through Info
+type debugLogger interface {
+	Debug(msg string)
+}
+
 func Init(logFile string) error {
 	var (
 		err error
@@ -27,24 +47,114 @@ func Init(logFile string) error {
 		return err
 	}
 
-	logger = log.New(f, "", log.LstdFlags|log.Lmicroseconds)
+	SetLogger(NewWriterLogger(f))
 	return nil
 }
 
+// replaces the current logger, nil stops logging
+func SetLogger(l Logger) {
+	if l == nil {
+		current.Store(nil)
+		return
+	}
+	current.Store(&loggerHolder{Logger: l})
+}
+
+// switches to the log target: "file" (or empty) keeps the Init logger, "stderr",
+// or "syslog" with the facility (e.g. daemon, local0) and tag
+// when syslog is unavailable the logs go to stderr and the error is returned
+func UseTarget(target string, facility string, tag string) error {
+	var (
+		syslogger Logger
+		err       error
+	)
+	switch target {
+	case "", "file":
+		return nil
+
+	case "stderr":
+		SetLogger(NewWriterLogger(os.Stderr))
+		return nil
+
+	case "syslog":
+		if syslogger, err = NewSyslogLogger(facility, tag); err != nil {
+			SetLogger(NewWriterLogger(os.Stderr))
+			return fmt.Errorf("syslog unavailable, logging to stderr: %w", err)
+		}
+		SetLogger(syslogger)
+		return nil
+	}
+
+	return fmt.Errorf("unknown log target %q", target)
+}
+
+// colored lines with a timestamp, for files and terminals
+type writerLogger struct {
+	logger *log.Logger
+}
+
+func NewWriterLogger(w io.Writer) Logger {
+	return &writerLogger{logger: log.New(w, "", log.LstdFlags|log.Lmicroseconds)}
+}
+
+func (w *writerLogger) Debug(msg string) {
+	w.logger.Printf("[DEBUG]%s\n", msg)
+}
+
+func (w *writerLogger) Info(msg string) {
+	w.logger.Printf("%s[INFO]%s%s\n", Green, msg, Reset)
+}
+
+func (w *writerLogger) Warn(msg string) {
+	w.logger.Printf("%s[Warn]%s%s\n", Yellow, msg, Reset)
+}
+
+func (w *writerLogger) Error(msg string) {
+	w.logger.Printf("%s[ERROR]%s%s\n", Red, msg, Reset)
+}
+
+// turns the Debug lines on or off, off by default since they can be frequent
+func SetDebug(enabled bool) {
+	debug.Store(enabled)
+}
+
+func Debug(msg string) {
+	if !debug.Load() {
+		return
+	}
+
+	var (
+		holder   *loggerHolder = current.Load()
+		debugger debugLogger
+		ok       bool
+	)
+	if holder == nil {
+		return
+	}
+	if debugger, ok = holder.Logger.(debugLogger); ok {
+		debugger.Debug(msg)
+		return
+	}
+	holder.Info(msg)
+}
+
 func Info(msg string) {
-	if logger != nil {
-		logger.Printf("%s[INFO]%s%s\n", Green, msg, Reset)
+	var holder *loggerHolder = current.Load()
+	if holder != nil {
+		holder.Info(msg)
 	}
 }
 
 func Warn(msg string) {
-	if logger != nil {
-		logger.Printf("%s[Warn]%s%s\n", Yellow, msg, Reset)
+	var holder *loggerHolder = current.Load()
+	if holder != nil {
+		holder.Warn(msg)
 	}
 }
 
 func Error(msg string) {
-	if logger != nil {
-		logger.Printf("%s[ERROR]%s%s\n", Red, msg, Reset)
+	var holder *loggerHolder = current.Load()
+	if holder != nil {
+		holder.Error(msg)
 	}
 }
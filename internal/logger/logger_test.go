@@ -2,10 +2,12 @@ package logger
 
 import (
 	"bufio"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func retrieveFileContents(path string) (string, error) {
@@ -114,3 +116,68 @@ func TestError(t *testing.T) {
 		t.Error("Info() didn't log the correct message")
 	}
 }
+
+func TestDebug(t *testing.T) {
+	var (
+		tempDir  string = t.TempDir()
+		tempFile string = filepath.Join(tempDir, "test.log")
+		content  string
+		err      error
+	)
+	defer SetDebug(false)
+
+	_ = Init(tempFile)
+	Debug("Hidden")
+	SetDebug(true)
+	Debug("Shown")
+
+	content, err = retrieveFileContents(tempFile)
+	if err != nil {
+		t.Fatalf("Failed to read the log contents: %v", err.Error())
+	}
+
+	if strings.Contains(content, "Hidden") {
+		t.Error("Debug() logged while debug was off")
+	}
+	if !strings.Contains(content, "[DEBUG]Shown") {
+		t.Error("Debug() didn't log the correct message")
+	}
+}
+
+func TestErrorLimited(t *testing.T) {
+	var (
+		tempDir  string    = t.TempDir()
+		tempFile string    = filepath.Join(tempDir, "test.log")
+		now      time.Time = time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+		content  string
+		i        int
+		err      error
+	)
+	errorLimiter = newRepeatLimiter()
+	errorLimiter.now = func() time.Time { return now }
+	defer func() { errorLimiter = newRepeatLimiter() }()
+
+	_ = Init(tempFile)
+	for i = 0; i < 100; i++ {
+		ErrorLimited("resolve", fmt.Sprintf("Failed to Resolve: host%d.com - timeout", i))
+	}
+	ErrorLimited("parse", "failed to parse query") // other keys aren't held back
+
+	now = now.Add(ERROR_REPEAT_INTERVAL)
+	ErrorLimited("resolve", "Failed to Resolve: late.com - timeout")
+
+	content, err = retrieveFileContents(tempFile)
+	if err != nil {
+		t.Fatalf("Failed to read the log contents: %v", err.Error())
+	}
+
+	if strings.Count(content, "Failed to Resolve") != 2 {
+		t.Errorf("Expected 2 resolve lines out of 101, got:\n%s", content)
+	}
+	if !strings.Contains(content, "host0.com") || !strings.Contains(content, "late.com - timeout (99 similar errors suppressed)") {
+		t.Errorf("Expected the first line and the suppressed count, got:\n%s", content)
+	}
+	if !strings.Contains(content, "failed to parse query") {
+		t.Error("ErrorLimited() dropped a line of another key")
+	}
+}
@@ -0,0 +1,68 @@
+package logger
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ERROR_REPEAT_INTERVAL time.Duration = 10 * time.Second // ErrorLimited logs each key at most this often
+
+// drops the repeats of a log line within the interval and counts them
+type repeatLimiter struct {
+	mu         sync.Mutex
+	last       map[string]time.Time // when each key was last logged
+	suppressed map[string]int       // lines dropped since then
+	now        func() time.Time
+}
+
+var errorLimiter *repeatLimiter = newRepeatLimiter()
+
+func newRepeatLimiter() *repeatLimiter {
+	return &repeatLimiter{
+		last:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+		now:        time.Now,
+	}
+}
+
+// true when the key can be logged now, with how many of its lines were dropped before
+func (r *repeatLimiter) allow(key string, interval time.Duration) (bool, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var (
+		now        time.Time = r.now()
+		last       time.Time
+		found      bool
+		suppressed int
+	)
+	if last, found = r.last[key]; found && now.Sub(last) < interval {
+		r.suppressed[key]++
+		return false, 0
+	}
+
+	suppressed = r.suppressed[key]
+	r.last[key] = now
+	delete(r.suppressed, key)
+	return true, suppressed
+}
+
+// like Error, logging the lines of the same key at most once per ERROR_REPEAT_INTERVAL,
+// e.g. the failure of every query while the upstream is down; the key is the kind
+// of error (the message usually carries the domain), the count of the dropped
+// lines goes with the next one logged
+func ErrorLimited(key string, msg string) {
+	var (
+		allowed    bool
+		suppressed int
+	)
+	if allowed, suppressed = errorLimiter.allow(key, ERROR_REPEAT_INTERVAL); !allowed {
+		return
+	}
+
+	if suppressed > 0 {
+		msg = fmt.Sprintf("%s (%d similar errors suppressed)", msg, suppressed)
+	}
+	Error(msg)
+}
@@ -0,0 +1,71 @@
+//go:build !windows && !plan9
+
+package logger
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+// the part of *syslog.Writer we use, swapped in tests
+type syslogWriter interface {
+	Info(m string) error
+	Warning(m string) error
+	Err(m string) error
+}
+
+// sends the lines to the local syslog daemon, which adds the time and tag
+// the level goes in the priority, the text keeps the [LEVEL] prefix without colors
+type SyslogLogger struct {
+	writer syslogWriter
+}
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":   syslog.LOG_KERN,
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// facility defaults to daemon and tag to flash-dns
+func NewSyslogLogger(facility string, tag string) (Logger, error) {
+	var (
+		priority syslog.Priority = syslog.LOG_DAEMON
+		writer   *syslog.Writer
+		ok       bool
+		err      error
+	)
+	if facility != "" {
+		if priority, ok = syslogFacilities[facility]; !ok {
+			return nil, fmt.Errorf("unknown syslog facility %q", facility)
+		}
+	}
+	if tag == "" {
+		tag = "flash-dns"
+	}
+
+	if writer, err = syslog.New(priority|syslog.LOG_INFO, tag); err != nil {
+		return nil, err
+	}
+
+	return &SyslogLogger{writer: writer}, nil
+}
+
+func (s *SyslogLogger) Info(msg string) {
+	_ = s.writer.Info("[INFO]" + msg)
+}
+
+func (s *SyslogLogger) Warn(msg string) {
+	_ = s.writer.Warning("[Warn]" + msg)
+}
+
+func (s *SyslogLogger) Error(msg string) {
+	_ = s.writer.Err("[ERROR]" + msg)
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package logger
+
+import "fmt"
+
+// log/syslog doesn't exist here, UseTarget falls back to stderr
+func NewSyslogLogger(facility string, tag string) (Logger, error) {
+	return nil, fmt.Errorf("syslog is not supported on this platform")
+}
@@ -0,0 +1,65 @@
+//go:build !windows && !plan9
+
+package logger
+
+import (
+	"testing"
+)
+
+// mockSyslogWriter records the lines by priority
+type mockSyslogWriter struct {
+	lines []string
+}
+
+func (m *mockSyslogWriter) Info(msg string) error {
+	m.lines = append(m.lines, "info "+msg)
+	return nil
+}
+
+func (m *mockSyslogWriter) Warning(msg string) error {
+	m.lines = append(m.lines, "warning "+msg)
+	return nil
+}
+
+func (m *mockSyslogWriter) Err(msg string) error {
+	m.lines = append(m.lines, "err "+msg)
+	return nil
+}
+
+func TestSyslogLogger(t *testing.T) {
+	var (
+		writer   *mockSyslogWriter = &mockSyslogWriter{}
+		l        Logger            = &SyslogLogger{writer: writer}
+		expected []string          = []string{"info [INFO]Hello", "warning [Warn]Do not panic", "err [ERROR]You died"}
+		i        int
+	)
+	SetLogger(l)
+	defer SetLogger(nil)
+
+	Info("Hello")
+	Warn("Do not panic")
+	Error("You died")
+
+	if len(writer.lines) != len(expected) {
+		t.Fatalf("Expected %d syslog lines, got %v", len(expected), writer.lines)
+	}
+	for i = range expected {
+		if writer.lines[i] != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], writer.lines[i])
+		}
+	}
+}
+
+func TestNewSyslogLoggerUnknownFacility(t *testing.T) {
+	var err error
+	if _, err = NewSyslogLogger("mail2", "flash-dns"); err == nil {
+		t.Fatal("Unknown facility didn't fail as expected")
+	}
+}
+
+func TestUseTargetUnknown(t *testing.T) {
+	var err error
+	if err = UseTarget("journald", "", ""); err == nil {
+		t.Fatal("Unknown log target didn't fail as expected")
+	}
+}
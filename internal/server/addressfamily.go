@@ -0,0 +1,37 @@
+package server
+
+import (
+	"flash-dns/internal/utils"
+)
+
+// values of Config.AddressFamilyPreference
+const (
+	ADDRESS_FAMILY_BOTH string = "both"
+	ADDRESS_FAMILY_IPV4 string = "ipv4"
+	ADDRESS_FAMILY_IPV6 string = "ipv6"
+)
+
+// record type Config.AddressFamilyPreference strips from the answers, 0 for none
+func (s *DNSServer) strippedAddressType() uint16 {
+	switch s.config.AddressFamilyPreference {
+	case ADDRESS_FAMILY_IPV4:
+		return utils.TYPE_AAAA
+	case ADDRESS_FAMILY_IPV6:
+		return utils.TYPE_A
+	}
+	return 0
+}
+
+// drops the answer records of the family the config doesn't want, from every
+// answer we send (forwarded, cached or local); the cache keeps them all so
+// changing the preference doesn't need a flush. a name left without records is NODATA
+func (s *DNSServer) preferAddressFamily(response []byte) []byte {
+	var stripped uint16 = s.strippedAddressType()
+	if stripped == 0 {
+		return response
+	}
+
+	return utils.RewriteAddresses(response, func(rtype uint16, rdata []byte) ([]byte, bool) {
+		return rdata, rtype != stripped
+	})
+}
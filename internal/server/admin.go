@@ -0,0 +1,379 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flash-dns/internal/cache"
+	"flash-dns/internal/filter"
+	"flash-dns/internal/logger"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ADMIN_SHUTDOWN_TIME time.Duration = 5 * time.Second // how long requests get to finish on shutdown
+
+// caches that can report their size to the admin api
+type cacheReporter interface {
+	Len() int
+	MemoryBytes() int64
+}
+
+// caches that count the refreshes of their entries
+type prefetchReporter interface {
+	Stats() cache.CacheStats
+}
+
+// filters that can break their rules down by kind
+type filterReporter interface {
+	Stats() filter.FilterStats
+}
+
+// filters whose rules can be turned off by category
+type categoryToggler interface {
+	SetCategoryEnabled(category string, enabled bool)
+	Categories() map[string]bool
+}
+
+// caches that can list their entries
+type cacheDumper interface {
+	Snapshot() []cache.EntrySnapshot
+}
+
+type statsReport struct {
+	Total           uint64             `json:"total"`
+	Allowed         uint64             `json:"allowed"`
+	Blocked         uint64             `json:"blocked"`
+	BlockedByList   uint64             `json:"blocked_by_list"`
+	BlockedByPolicy uint64             `json:"blocked_by_policy"`
+	CacheHits       uint64             `json:"cache_hits"`
+	CacheMisses     uint64             `json:"cache_misses"`
+	InFlight        int64              `json:"in_flight"`
+	RateLimited     uint64             `json:"rate_limited"`
+	NonRecursive    uint64             `json:"non_recursive"`
+	Amplified       uint64             `json:"amplification_limited"`
+	WriteErrors     uint64             `json:"write_errors"`
+	NotImplemented  uint64             `json:"not_implemented"`
+	ServedExpired   uint64             `json:"served_expired"`
+	Duplicates      uint64             `json:"duplicate_queries"`
+	NxdomainLimited uint64             `json:"nxdomain_throttled"`
+	ResponseSizes   responseSizeReport `json:"response_sizes"`
+	PausedSeconds   float64            `json:"blocking_paused_seconds"` // zero while blocking
+}
+
+// answers sent per size, in bytes
+type responseSizeReport struct {
+	UpTo512  uint64 `json:"le_512"`
+	UpTo1232 uint64 `json:"le_1232"`
+	UpTo4096 uint64 `json:"le_4096"`
+	Larger   uint64 `json:"gt_4096"`
+}
+
+func newResponseSizeReport(sizes [RESPONSE_SIZE_BUCKETS]uint64) responseSizeReport {
+	return responseSizeReport{UpTo512: sizes[0], UpTo1232: sizes[1], UpTo4096: sizes[2], Larger: sizes[3]}
+}
+
+type pauseReport struct {
+	PausedSeconds float64 `json:"blocking_paused_seconds"`
+}
+
+type cacheReport struct {
+	Entries           int    `json:"entries"`
+	MemoryBytes       int64  `json:"memory_bytes"`
+	PrefetchAttempts  uint64 `json:"prefetch_attempts"`
+	PrefetchSuccesses uint64 `json:"prefetch_successes"`
+	PrefetchFailures  uint64 `json:"prefetch_failures"`
+	KeyCollisions     uint64 `json:"key_collisions"`
+}
+
+type cacheEntryReport struct {
+	Key       string    `json:"key"`
+	Source    string    `json:"source"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Size      int       `json:"size"`
+}
+
+// http api with the server state, enabled with Config.AdminAddr
+// the only actions are pausing and resuming blocking and toggling filter categories,
+// they go through adminAuthorized
+func (s *DNSServer) adminHandler() http.Handler {
+	var mux *http.ServeMux = http.NewServeMux()
+	mux.HandleFunc("GET /stats", s.handleAdminStats)
+	mux.HandleFunc("GET /cache", s.handleAdminCache)
+	mux.HandleFunc("GET /cache/entries", s.handleAdminCacheEntries)
+	mux.HandleFunc("GET /filter", s.handleAdminFilter)
+	mux.HandleFunc("GET /filter/categories", s.handleAdminCategories)
+	mux.HandleFunc("POST /filter/categories/{category}", s.adminAuthorized(s.handleAdminSetCategory))
+	mux.HandleFunc("POST /blocking/pause", s.adminAuthorized(s.handleAdminPause))
+	mux.HandleFunc("POST /blocking/resume", s.adminAuthorized(s.handleAdminResume))
+	return mux
+}
+
+// lets the request through when it came over a unix socket, the file permissions
+// guard those. over tcp it needs the Config.AdminToken bearer token, which a web page
+// can't add to a cross-site request, and requests a browser marks cross-site are refused
+func (s *DNSServer) adminAuthorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			token string
+			found bool
+		)
+		if unixAdminRequest(r) {
+			next(w, r)
+			return
+		}
+
+		if s.config.AdminToken == "" {
+			http.Error(w, "set AdminToken to change the server over tcp", http.StatusForbidden)
+			return
+		}
+		if crossSiteRequest(r) {
+			http.Error(w, "cross-site requests can't change the server", http.StatusForbidden)
+			return
+		}
+		token, found = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or wrong admin token", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+func unixAdminRequest(r *http.Request) bool {
+	var (
+		local net.Addr
+		ok    bool
+	)
+	local, ok = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && local.Network() == "unix"
+}
+
+// true when the browser says the request comes from another site, or its Origin
+// isn't the admin api itself; tools like curl send neither header
+func crossSiteRequest(r *http.Request) bool {
+	var (
+		site   string = r.Header.Get("Sec-Fetch-Site")
+		origin string = r.Header.Get("Origin")
+		parsed *url.URL
+		err    error
+	)
+	if site != "" && site != "same-origin" && site != "none" {
+		return true
+	}
+	if origin == "" {
+		return false
+	}
+	if parsed, err = url.Parse(origin); err != nil {
+		return true
+	}
+
+	return parsed.Host != r.Host
+}
+
+func (s *DNSServer) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	var report statsReport
+
+	report.Blocked, report.Allowed, report.CacheHits, report.CacheMisses = s.statistics.GetStats()
+	report.BlockedByList, report.BlockedByPolicy = s.statistics.GetBlockedStats()
+	report.Total = report.Blocked + report.Allowed
+	report.InFlight = s.statistics.InFlight()
+	report.RateLimited = s.statistics.RateLimited()
+	report.NonRecursive = s.statistics.NonRecursive()
+	report.Amplified = s.statistics.AmplificationLimited()
+	report.WriteErrors = s.statistics.WriteErrors()
+	report.NotImplemented = s.statistics.NotImplemented()
+	report.ServedExpired = s.statistics.ServedExpired()
+	report.Duplicates = s.statistics.Duplicates()
+	report.NxdomainLimited = s.statistics.NxdomainThrottled()
+	report.ResponseSizes = newResponseSizeReport(s.statistics.ResponseSizes())
+	report.PausedSeconds = s.PauseRemaining().Seconds()
+
+	writeJSON(w, report)
+}
+
+func (s *DNSServer) handleAdminCache(w http.ResponseWriter, r *http.Request) {
+	var (
+		report     cacheReport
+		reporter   cacheReporter
+		prefetches prefetchReporter
+		stats      cache.CacheStats
+		ok         bool
+	)
+	if reporter, ok = s.cache.(cacheReporter); ok {
+		report.Entries = reporter.Len()
+		report.MemoryBytes = reporter.MemoryBytes()
+	}
+	if prefetches, ok = s.cache.(prefetchReporter); ok {
+		stats = prefetches.Stats()
+		report.PrefetchAttempts = stats.PrefetchAttempts
+		report.PrefetchSuccesses = stats.PrefetchSuccesses
+		report.PrefetchFailures = stats.PrefetchFailures
+		report.KeyCollisions = stats.KeyCollisions
+	}
+
+	writeJSON(w, report)
+}
+
+func (s *DNSServer) handleAdminCacheEntries(w http.ResponseWriter, r *http.Request) {
+	var (
+		report []cacheEntryReport = []cacheEntryReport{}
+		dumper cacheDumper
+		ok     bool
+	)
+	if dumper, ok = s.cache.(cacheDumper); ok {
+		for _, entry := range dumper.Snapshot() {
+			report = append(report, cacheEntryReport{
+				Key:       entry.Key,
+				Source:    entry.Source,
+				CreatedAt: entry.CreatedAt,
+				ExpiresAt: entry.ExpiresAt,
+				Size:      entry.Size,
+			})
+		}
+	}
+
+	writeJSON(w, report)
+}
+
+// rule counts of the main filter, all zero without one
+func (s *DNSServer) handleAdminFilter(w http.ResponseWriter, r *http.Request) {
+	var (
+		report   filter.FilterStats
+		reporter filterReporter
+		ok       bool
+	)
+	if reporter, ok = s.currentFilter().(filterReporter); ok {
+		report = reporter.Stats()
+	}
+
+	writeJSON(w, report)
+}
+
+// categories of the main filter and whether they're enabled, empty without one
+func (s *DNSServer) handleAdminCategories(w http.ResponseWriter, r *http.Request) {
+	var (
+		report  map[string]bool = map[string]bool{}
+		toggler categoryToggler
+		ok      bool
+	)
+	if toggler, ok = s.currentFilter().(categoryToggler); ok {
+		report = toggler.Categories()
+	}
+
+	writeJSON(w, report)
+}
+
+// enables or disables a category with ?enabled=true|false
+func (s *DNSServer) handleAdminSetCategory(w http.ResponseWriter, r *http.Request) {
+	var (
+		category string = r.PathValue("category")
+		toggler  categoryToggler
+		enabled  bool
+		ok       bool
+		err      error
+	)
+	if enabled, err = strconv.ParseBool(r.URL.Query().Get("enabled")); err != nil {
+		http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+		return
+	}
+	if toggler, ok = s.currentFilter().(categoryToggler); !ok {
+		http.Error(w, "the filter has no categories", http.StatusNotFound)
+		return
+	}
+	if _, ok = toggler.Categories()[category]; !ok {
+		http.Error(w, "unknown category "+category, http.StatusNotFound)
+		return
+	}
+
+	toggler.SetCategoryEnabled(category, enabled)
+	logger.Info(fmt.Sprintf("admin: filter category %s enabled=%v", category, enabled))
+	writeJSON(w, toggler.Categories())
+}
+
+// pauses blocking for ?duration= (e.g. 5m, 1h30m)
+func (s *DNSServer) handleAdminPause(w http.ResponseWriter, r *http.Request) {
+	var (
+		duration time.Duration
+		err      error
+	)
+	if duration, err = time.ParseDuration(r.URL.Query().Get("duration")); err != nil || duration <= 0 {
+		http.Error(w, "duration must be a positive duration, e.g. 5m", http.StatusBadRequest)
+		return
+	}
+
+	s.PauseBlocking(duration)
+	writeJSON(w, pauseReport{PausedSeconds: s.PauseRemaining().Seconds()})
+}
+
+func (s *DNSServer) handleAdminResume(w http.ResponseWriter, r *http.Request) {
+	s.PauseBlocking(0)
+	writeJSON(w, pauseReport{})
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	var err error
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(value); err != nil {
+		logger.Error(fmt.Sprintf("admin: failed to write response: %v", err))
+	}
+}
+
+// tcp host:port, or unix:/path/to.sock for a unix socket guarded by the file permissions
+// a socket file left by a crash is replaced, the listener removes it when closed
+func listenAdmin(address string) (net.Listener, error) {
+	var (
+		path   string
+		isUnix bool
+		info   os.FileInfo
+		err    error
+	)
+	if path, isUnix = strings.CutPrefix(address, "unix:"); !isUnix {
+		return net.Listen("tcp", address)
+	}
+
+	if info, err = os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove the stale admin socket: %w", err)
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// serves the admin api until the context is cancelled
+func (s *DNSServer) startAdmin(ctx context.Context, listener net.Listener) {
+	var (
+		server *http.Server = &http.Server{
+			Handler:           s.adminHandler(),
+			ReadHeaderTimeout: CLIENT_REQUEST_TIME,
+		}
+		err error
+	)
+
+	go func() {
+		<-ctx.Done()
+		var (
+			shutdownCtx context.Context
+			cancel      context.CancelFunc
+		)
+		shutdownCtx, cancel = context.WithTimeout(context.Background(), ADMIN_SHUTDOWN_TIME)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info(fmt.Sprintf("Admin API is Listening on: %s", listener.Addr()))
+	if err = server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error(fmt.Sprintf("admin: server stopped: %v", err))
+	}
+}
@@ -0,0 +1,414 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"flash-dns/internal/filter"
+	"flash-dns/internal/utils"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TEST 1: /cache reports entries and memory footprint
+// Tests that the admin api exposes the cache size
+func TestAdmin_Cache(t *testing.T) {
+	var (
+		config Config = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		server   *DNSServer = NewDNSServer(config, &MockResolver{}, nil)
+		recorder *httptest.ResponseRecorder
+		report   cacheReport
+		err      error
+	)
+
+	server.cache.Set("example.com:1", make([]byte, 64), 300)
+
+	recorder = httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/cache", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", recorder.Code)
+	}
+	if err = json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if report.Entries != 1 {
+		t.Errorf("Expected 1 entry, got %d", report.Entries)
+	}
+	if report.MemoryBytes <= 64 {
+		t.Errorf("Expected memory footprint above the response size, got %d", report.MemoryBytes)
+	}
+}
+
+// TEST 2: /stats reports the counters
+// Tests that the admin api exposes the statistics
+func TestAdmin_Stats(t *testing.T) {
+	var (
+		config Config = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		server   *DNSServer = NewDNSServer(config, &MockResolver{}, nil)
+		recorder *httptest.ResponseRecorder
+		report   statsReport
+		err      error
+	)
+
+	server.statistics.incrementAllowed()
+	server.statistics.incrementBlocked()
+	server.statistics.incrementBlockedByPolicy()
+
+	recorder = httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/stats", nil))
+
+	if err = json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if report.Total != 3 || report.Blocked != 2 || report.BlockedByList != 1 || report.BlockedByPolicy != 1 {
+		t.Errorf("Unexpected stats report: %+v", report)
+	}
+}
+
+// TEST 3: /cache/entries shows which upstream produced each answer
+// Tests that the winning upstream is recorded from queryUpstream to the dump
+func TestAdmin_CacheEntries_Source(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		upstream *mockDNSServer
+		server   *DNSServer
+		resolver *UpstreamResolver
+		info     *utils.QueryInfo
+		recorder *httptest.ResponseRecorder
+		report   []cacheEntryReport
+		err      error
+	)
+
+	upstream, err = startMockDNSServer(buildDNSResponse("source.com", 1, 1, 300, []byte{1, 2, 3, 4}), 0)
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer upstream.close()
+
+	resolver = &UpstreamResolver{upstreamAddrs: []string{upstream.addr}, timeout: 2 * time.Second}
+	server = NewDNSServer(Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}, resolver, nil)
+
+	info, err = utils.ParseQuery(buildDNSQuery("source.com", 1, 1))
+	if err != nil {
+		t.Fatalf("Failed to parse query: %v", err)
+	}
+	if _, err = server.queryUpstream(ctx, buildDNSQuery("source.com", 1, 1), info); err != nil {
+		t.Fatalf("queryUpstream failed: %v", err)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/cache/entries", nil))
+
+	if err = json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if len(report) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(report))
+	}
+	if report[0].Key != "source.com:1" || report[0].Source != upstream.addr {
+		t.Errorf("Expected source.com:1 from %s, got %+v", upstream.addr, report[0])
+	}
+}
+
+// TEST 4: /filter reports the rule breakdown
+// Tests that the admin api exposes FilterList.Stats
+func TestAdmin_Filter(t *testing.T) {
+	var (
+		config Config = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		list     *filter.FilterList = filter.NewFilterList()
+		server   *DNSServer
+		recorder *httptest.ResponseRecorder
+		report   filter.FilterStats
+		err      error
+	)
+
+	list.Add("ads.com")
+	list.Add("*.ads.net")
+	list.AddAllowed("ok.ads.com")
+	server = NewDNSServer(config, &MockResolver{}, list)
+
+	recorder = httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/filter", nil))
+
+	if err = json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if report != (filter.FilterStats{Exact: 1, Wildcard: 1, Allowlist: 1}) {
+		t.Errorf("Unexpected filter report: %+v", report)
+	}
+}
+
+// TEST 5: Blocking can be paused and resumed over the api
+// Tests that /blocking/pause sets the pause shown in /stats and /blocking/resume clears it
+func TestAdmin_PauseBlocking(t *testing.T) {
+	var (
+		config Config = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		server   *DNSServer = NewDNSServer(config, &MockResolver{}, nil)
+		now      time.Time  = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		recorder *httptest.ResponseRecorder
+		report   statsReport
+		err      error
+	)
+	server.now = func() time.Time { return now }
+
+	recorder = httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(recorder, unixSocketRequest(http.MethodPost, "/blocking/pause?duration=forever"))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid duration, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(recorder, unixSocketRequest(http.MethodPost, "/blocking/pause?duration=5m"))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", recorder.Code)
+	}
+
+	now = now.Add(time.Minute)
+	recorder = httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if err = json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if report.PausedSeconds != 240 {
+		t.Errorf("Expected 240 seconds of pause left, got %v", report.PausedSeconds)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(recorder, unixSocketRequest(http.MethodPost, "/blocking/resume"))
+	if server.PauseRemaining() != 0 {
+		t.Errorf("Expected blocking to resume, %v left", server.PauseRemaining())
+	}
+}
+
+// TEST 6: The admin api can listen on a unix socket
+// Tests that /stats answers over unix:/path and the socket file is removed on shutdown
+func TestAdmin_UnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("no unix sockets on " + runtime.GOOS)
+	}
+
+	var (
+		config Config = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		server   *DNSServer = NewDNSServer(config, &MockResolver{}, nil)
+		path     string     = filepath.Join(t.TempDir(), "admin.sock")
+		ctx      context.Context
+		cancel   context.CancelFunc
+		listener net.Listener
+		client   *http.Client
+		response *http.Response
+		report   statsReport
+		done     chan struct{} = make(chan struct{})
+		err      error
+	)
+	server.statistics.incrementAllowed()
+
+	if listener, err = listenAdmin("unix:" + path); err != nil {
+		t.Fatalf("Failed to listen on the socket: %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		server.startAdmin(ctx, listener)
+		close(done)
+	}()
+
+	client = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}}
+	if response, err = client.Get("http://admin/stats"); err != nil {
+		t.Fatalf("Failed to query /stats: %v", err)
+	}
+	err = json.NewDecoder(response.Body).Decode(&report)
+	response.Body.Close()
+	if err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if report.Allowed != 1 {
+		t.Errorf("Expected 1 allowed query, got %+v", report)
+	}
+
+	// the socket file permissions guard the changes, no token is needed
+	if response, err = client.Post("http://admin/blocking/resume", "", nil); err != nil {
+		t.Fatalf("Failed to post /blocking/resume: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 over the unix socket, got %d", response.StatusCode)
+	}
+
+	client.CloseIdleConnections()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(ADMIN_SHUTDOWN_TIME + time.Second):
+		t.Fatal("admin api didn't stop")
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket file to be removed, got %v", err)
+	}
+}
+
+// TEST 7: Filter categories are toggled through the admin api
+// Tests that disabling a category unblocks its domains, other categories keep blocking and unknown ones are rejected
+func TestAdmin_SetCategory(t *testing.T) {
+	var (
+		config Config = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		recorder   *httptest.ResponseRecorder
+		report     map[string]bool
+		err        error
+	)
+	filterList.AddCategory("facebook.com", "social")
+	filterList.AddCategory("doubleclick.net", "ads")
+	server = NewDNSServer(config, &MockResolver{}, filterList)
+
+	recorder = httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(recorder, unixSocketRequest(http.MethodPost, "/filter/categories/social?enabled=false"))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", recorder.Code)
+	}
+	if err = json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if report["social"] || !report["ads"] {
+		t.Errorf("Expected social disabled and ads enabled, got %v", report)
+	}
+	if server.currentFilter().IsBlocked("facebook.com") || !server.currentFilter().IsBlocked("doubleclick.net") {
+		t.Error("Expected only the social domains to be unblocked")
+	}
+
+	var tests = []struct {
+		target string
+		code   int
+	}{
+		{"/filter/categories/social?enabled=maybe", http.StatusBadRequest},
+		{"/filter/categories/gaming?enabled=false", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		recorder = httptest.NewRecorder()
+		server.adminHandler().ServeHTTP(recorder, unixSocketRequest(http.MethodPost, test.target))
+		if recorder.Code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.target, test.code, recorder.Code)
+		}
+	}
+
+	// a reloaded list keeps the category disabled
+	filterList = filter.NewFilterList()
+	filterList.AddCategory("facebook.com", "social")
+	server.ReloadFilter(filterList)
+	if server.currentFilter().IsBlocked("facebook.com") {
+		t.Error("Expected social to stay disabled after a reload")
+	}
+}
+
+// TEST 8: Changes over tcp need the admin token
+// Tests that without AdminToken the POST routes refuse every tcp client, loopback
+// included, that with one they need the bearer token and refuse cross-site requests,
+// and that the unix socket and the GETs stay open
+func TestAdmin_Authorization(t *testing.T) {
+	var (
+		config Config = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		server   *DNSServer = NewDNSServer(config, &MockResolver{}, nil)
+		recorder *httptest.ResponseRecorder
+		request  *http.Request
+	)
+
+	// e.g. a web page posting to the admin api on the operator's machine
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest(http.MethodPost, "http://127.0.0.1:8053/blocking/pause?duration=5m", nil)
+	request.RemoteAddr = "127.0.0.1:40000"
+	request.Header.Set("Origin", "https://evil.example")
+	server.adminHandler().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden || server.PauseRemaining() != 0 {
+		t.Errorf("Expected a loopback pause without a token to be refused, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(recorder, unixSocketRequest(http.MethodPost, "/blocking/pause?duration=5m"))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected 200 over the unix socket, got %d", recorder.Code)
+	}
+	server.PauseBlocking(0)
+
+	server.config.AdminToken = "secret"
+	var tests = []struct {
+		name          string
+		authorization string
+		headers       map[string]string
+		code          int
+	}{
+		{"loopback without token", "", nil, http.StatusUnauthorized},
+		{"wrong token", "Bearer wrong", nil, http.StatusUnauthorized},
+		{"basic auth", "Basic c2VjcmV0", nil, http.StatusUnauthorized},
+		{"foreign origin", "Bearer secret", map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{"cross-site fetch", "Bearer secret", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"same origin", "Bearer secret", map[string]string{"Origin": "http://127.0.0.1:8053", "Sec-Fetch-Site": "same-origin"}, http.StatusOK},
+		{"right token", "Bearer secret", nil, http.StatusOK},
+	}
+	for _, test := range tests {
+		server.PauseBlocking(0)
+		recorder = httptest.NewRecorder()
+		request = httptest.NewRequest(http.MethodPost, "http://127.0.0.1:8053/blocking/pause?duration=5m", nil)
+		request.RemoteAddr = "127.0.0.1:40000"
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+		for name, value := range test.headers {
+			request.Header.Set(name, value)
+		}
+		server.adminHandler().ServeHTTP(recorder, request)
+		if recorder.Code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, recorder.Code)
+		}
+		if (server.PauseRemaining() > 0) != (test.code == http.StatusOK) {
+			t.Errorf("%s: expected the pause to apply only with a 200", test.name)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	server.adminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected /stats to stay readable, got %d", recorder.Code)
+	}
+}
+
+// ============================================================================
+// HELPER FUNCTIONS
+// ============================================================================
+
+// request as it arrives over the admin unix socket, which needs no AdminToken
+func unixSocketRequest(method string, target string) *http.Request {
+	var request *http.Request = httptest.NewRequest(method, target, nil)
+	return request.WithContext(context.WithValue(request.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "admin.sock", Net: "unix"}))
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AMPLIFICATION_DEFAULT_LIMIT int           = 5 // amplified answers per client per window when the config leaves it at zero
+	AMPLIFICATION_WINDOW        time.Duration = 1 * time.Second
+	AMPLIFICATION_MAX_CLIENTS   int           = 4096 // clients tracked, the least recently seen is forgotten past it
+)
+
+// limits the udp answers that are much bigger than their query (ANY, large TXT...)
+// per client, so spoofed queries can't turn us into a reflector
+type amplificationLimiter struct {
+	mu        sync.Mutex
+	factor    int // answers over factor times the query size count
+	limit     int
+	allowlist []*net.IPNet
+	clients   map[string]*amplificationClient
+	order     *list.List // keys of clients, the most recently seen first
+}
+
+type amplificationClient struct {
+	limiter *rollingLimiter
+	element *list.Element // in order
+}
+
+// allowlist entries are ips or CIDRs, e.g. 192.168.0.0/16, the invalid ones are returned
+func newAmplificationLimiter(factor int, limit int, allowlist []string) (*amplificationLimiter, error) {
+	var (
+		a       *amplificationLimiter = &amplificationLimiter{factor: factor, limit: limit, clients: make(map[string]*amplificationClient), order: list.New()}
+		network *net.IPNet
+		ip      net.IP
+		invalid []string
+		err     error
+	)
+	if a.limit <= 0 {
+		a.limit = AMPLIFICATION_DEFAULT_LIMIT
+	}
+
+	for _, entry := range allowlist {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip = net.ParseIP(entry); ip == nil {
+				invalid = append(invalid, entry)
+				continue
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		if _, network, err = net.ParseCIDR(entry); err != nil {
+			invalid = append(invalid, entry)
+			continue
+		}
+		a.allowlist = append(a.allowlist, network)
+	}
+
+	if len(invalid) > 0 {
+		return a, fmt.Errorf("invalid amplification allowlist entries: %s", strings.Join(invalid, ", "))
+	}
+
+	return a, nil
+}
+
+func (a *amplificationLimiter) allowlisted(ip net.IP) bool {
+	for _, network := range a.allowlist {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// false when the answer is amplified and the client already got its share of those
+func (a *amplificationLimiter) Allow(ip net.IP, querySize int, responseSize int, now time.Time) bool {
+	if responseSize <= querySize*a.factor || a.allowlisted(ip) {
+		return true
+	}
+
+	var (
+		key    string = ip.String()
+		client *amplificationClient
+		ok     bool
+	)
+	a.mu.Lock()
+	if client, ok = a.clients[key]; ok {
+		a.order.MoveToFront(client.element)
+	} else {
+		if len(a.clients) >= AMPLIFICATION_MAX_CLIENTS {
+			delete(a.clients, a.order.Remove(a.order.Back()).(string))
+		}
+		client = &amplificationClient{limiter: newRollingLimiter(a.limit, AMPLIFICATION_WINDOW), element: a.order.PushFront(key)}
+		a.clients[key] = client
+	}
+	a.mu.Unlock()
+
+	return client.limiter.Allow(now)
+}
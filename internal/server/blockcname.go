@@ -0,0 +1,52 @@
+package server
+
+import (
+	"flash-dns/internal/filter"
+	"flash-dns/internal/utils"
+)
+
+const BLOCK_CNAME_TTL uint32 = 60 // same as the null and sinkhole answers
+
+// cname mode answer: the question name is an alias of Config.BlockCNAMETarget,
+// followed by the records of the target the local zone has for the query type,
+// so the browser lands on the block page with a matching SNI
+// without a target it falls back to NXDOMAIN
+func (s *DNSServer) appendBlockCNAMEResponse(dst []byte, query []byte, qtype uint16) []byte {
+	var (
+		target    string = s.config.BlockCNAMETarget
+		queryInfo *utils.QueryInfo
+		answer    []utils.ResourceRecord
+		err       error
+	)
+	if queryInfo, err = utils.ParseQuery(query); err != nil || target == "" {
+		return filter.AppendBlockedResponse(dst, query)
+	}
+
+	answer = append(answer, utils.ResourceRecord{Name: queryInfo.Domain, Type: utils.TYPE_CNAME, Class: 1, TTL: BLOCK_CNAME_TTL, Data: utils.EncodeName(target)})
+	answer = append(answer, s.localRecords(target, qtype)...)
+
+	return append(dst, utils.CreateSectionsResponse(query, 0, answer, nil)...)
+}
+
+// records of the name from the local zone, none when the zone doesn't have them
+func (s *DNSServer) localRecords(name string, qtype uint16) []utils.ResourceRecord {
+	var (
+		query    []byte
+		response []byte
+		answer   []utils.ResourceRecord
+		found    bool
+		err      error
+	)
+	if s.zone == nil {
+		return nil
+	}
+
+	query = newRecursiveQuery(name, qtype)
+	if response, found = s.zone.Answer(query, &utils.QueryInfo{Domain: name, QType: qtype}); !found {
+		return nil
+	}
+	if answer, _, _, err = utils.ParseRecords(response); err != nil {
+		return nil
+	}
+	return answer
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"flash-dns/internal/utils"
+	"fmt"
+	"strings"
+)
+
+const CNAME_CHAIN_MAX_LENGTH int = 8 // longer chains (or loops) aren't split
+
+// answer for one of the targets of a CNAME chain
+type chainAnswer struct {
+	domain   string
+	response []byte
+}
+
+// splits an answer like a.cdn.example CNAME b.cdn.example, b.cdn.example A 1.2.3.4
+// into the answers for the targets (here b.cdn.example A 1.2.3.4), so a later
+// query for a target is served from the cache
+// only chains ending in records of the asked type are split
+func chainTargetAnswers(response []byte) []chainAnswer {
+	var (
+		message  *utils.Message
+		question utils.Question
+		cnames   []utils.ResourceRecord
+		final    []utils.ResourceRecord
+		extra    []utils.ResourceRecord
+		record   utils.ResourceRecord
+		owner    string
+		answers  []chainAnswer
+		found    bool
+		err      error
+		i        int
+	)
+	if message, err = utils.ParseResponse(response); err != nil || message.Header.Rcode() != 0 || len(message.Questions) != 1 {
+		return nil
+	}
+	question = message.Questions[0]
+	if question.Type == utils.TYPE_CNAME { // the CNAME itself is the answer
+		return nil
+	}
+
+	// follow the chain from the question name
+	owner = question.Name
+	for len(cnames) < CNAME_CHAIN_MAX_LENGTH {
+		if record, found = findRecord(message.Answers, owner, utils.TYPE_CNAME); !found {
+			break
+		}
+		cnames = append(cnames, record)
+		owner = record.Target()
+	}
+
+	for _, record = range message.Answers {
+		if record.Type == question.Type && strings.EqualFold(record.Name, owner) {
+			final = append(final, record)
+		}
+	}
+	if len(cnames) == 0 || len(final) == 0 {
+		return nil
+	}
+
+	for _, record = range message.Additional {
+		if record.Type == utils.TYPE_OPT {
+			extra = append(extra, record)
+		}
+	}
+
+	for i = 1; i <= len(cnames); i++ {
+		var target utils.Message = utils.Message{
+			Header:     message.Header,
+			Questions:  []utils.Question{{Name: cnames[i-1].Target(), Type: question.Type, Class: question.Class}},
+			Answers:    append(append([]utils.ResourceRecord(nil), cnames[i:]...), final...),
+			Additional: extra,
+		}
+		answers = append(answers, chainAnswer{domain: cnames[i-1].Target(), response: target.Pack()})
+	}
+
+	return answers
+}
+
+func findRecord(records []utils.ResourceRecord, name string, rtype uint16) (utils.ResourceRecord, bool) {
+	for _, record := range records {
+		if record.Type == rtype && strings.EqualFold(record.Name, name) {
+			return record, true
+		}
+	}
+
+	return utils.ResourceRecord{}, false
+}
+
+// caches the answers of the chain targets next to the answer of the query
+// answers with DNSSEC records are left alone, the signatures cover the whole chain
+func (s *DNSServer) cacheChainTargets(response []byte, queryInfo *utils.QueryInfo, source string) {
+	var (
+		key string
+		ttl uint32
+	)
+	// the target answers depend on the client subnet too, and only the query key carries it
+	if queryInfo.DNSSECOk || s.config.ForwardClientSubnet {
+		return
+	}
+
+	for _, answer := range chainTargetAnswers(response) {
+		key = fmt.Sprintf("%s:%d", answer.domain, queryInfo.QType)
+		ttl = utils.ExtractTTL(answer.response)
+		s.setCache(key, answer.response, ttl, source)
+	}
+}
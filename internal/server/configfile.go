@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"time"
+)
+
+// the json config file, durations are strings like "30s"
+// fields missing from the file keep the value of the base config
+//
+//	{
+//	  "listen": "0.0.0.0:53",
+//	  "upstream": "1.1.1.1,tls://9.9.9.9",
+//	  "upstream_strategy": "failover",
+//	  "filter_mode": "null",
+//	  "min_ttl": "60s",
+//	  "sinkhole_host": "block.example.lan"
+//	}
+type configFile struct {
+	Listen                   string            `json:"listen"`
+	Upstream                 string            `json:"upstream"`
+	UpstreamStrategy         string            `json:"upstream_strategy"`
+	UpstreamByType           map[uint16]string `json:"upstream_by_type"`
+	UpstreamProxy            string            `json:"upstream_proxy"`
+	RetryOnServfail          bool              `json:"retry_on_servfail"`
+	AnswerLocalhost          bool              `json:"answer_localhost"`
+	MaxUpstreamResponseBytes int               `json:"max_upstream_response_bytes"`
+	FilterMode               string            `json:"filter_mode"`
+	StartupBehavior          string            `json:"startup_behavior"`
+	BlockCNAMETarget         string            `json:"block_cname_target"`
+	AllowlistFile            string            `json:"allowlist_file"`
+	MaxBlocklistEntries      int               `json:"max_blocklist_entries"`
+	MaxBlocklistLineLength   int               `json:"max_blocklist_line_length"`
+	MinTTL                   configDuration    `json:"min_ttl"`
+	SinkholeHost             string            `json:"sinkhole_host"`
+	AdminAddr                string            `json:"admin_addr"`
+	AdminToken               string            `json:"admin_token"`
+	HostsFile                string            `json:"hosts_file"`
+	DHCPLeasesFile           string            `json:"dhcp_leases_file"`
+	ZoneFile                 string            `json:"zone_file"`
+	CacheHandoffFile         string            `json:"cache_handoff_file"`
+	LogTarget                string            `json:"log_target"`
+}
+
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalJSON(data []byte) error {
+	var (
+		text     string
+		duration time.Duration
+		err      error
+	)
+	if err = json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("durations are strings like \"30s\": %w", err)
+	}
+	if duration, err = time.ParseDuration(text); err != nil {
+		return err
+	}
+
+	*d = configDuration(duration)
+	return nil
+}
+
+// reads a json config file on top of base, e.g. the config built from the flags
+// unknown fields are an error so a typo doesn't go unnoticed
+func LoadConfig(filename string, base Config) (Config, error) {
+	var (
+		file    *os.File
+		decoder *json.Decoder
+		fields  configFile = configFile{
+			Listen:                   base.LocalAddr,
+			Upstream:                 base.UpstreamDns,
+			UpstreamStrategy:         base.UpstreamStrategy,
+			UpstreamByType:           maps.Clone(base.UpstreamByType), // decoding merges into the map
+			UpstreamProxy:            base.UpstreamProxy,
+			RetryOnServfail:          base.RetryOnServfail,
+			AnswerLocalhost:          base.AnswerLocalhost,
+			MaxUpstreamResponseBytes: base.MaxUpstreamResponseBytes,
+			FilterMode:               base.FilterMode,
+			StartupBehavior:          base.StartupBehavior,
+			BlockCNAMETarget:         base.BlockCNAMETarget,
+			AllowlistFile:            base.AllowlistFile,
+			MaxBlocklistEntries:      base.MaxBlocklistEntries,
+			MaxBlocklistLineLength:   base.MaxBlocklistLineLength,
+			MinTTL:                   configDuration(base.MinTTL),
+			SinkholeHost:             base.SinkholeHost,
+			AdminAddr:                base.AdminAddr,
+			AdminToken:               base.AdminToken,
+			HostsFile:                base.HostsFile,
+			DHCPLeasesFile:           base.DHCPLeasesFile,
+			ZoneFile:                 base.ZoneFile,
+			CacheHandoffFile:         base.CacheHandoffFile,
+			LogTarget:                base.LogTarget,
+		}
+		err error
+	)
+	file, err = os.Open(filename)
+	if err != nil {
+		return Config{}, err
+	}
+	defer file.Close()
+
+	decoder = json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&fields); err != nil {
+		return Config{}, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	base.LocalAddr = fields.Listen
+	base.UpstreamDns = fields.Upstream
+	base.UpstreamStrategy = fields.UpstreamStrategy
+	base.UpstreamByType = fields.UpstreamByType
+	base.UpstreamProxy = fields.UpstreamProxy
+	base.RetryOnServfail = fields.RetryOnServfail
+	base.AnswerLocalhost = fields.AnswerLocalhost
+	base.MaxUpstreamResponseBytes = fields.MaxUpstreamResponseBytes
+	base.FilterMode = fields.FilterMode
+	base.StartupBehavior = fields.StartupBehavior
+	base.BlockCNAMETarget = fields.BlockCNAMETarget
+	base.AllowlistFile = fields.AllowlistFile
+	base.MaxBlocklistEntries = fields.MaxBlocklistEntries
+	base.MaxBlocklistLineLength = fields.MaxBlocklistLineLength
+	base.MinTTL = time.Duration(fields.MinTTL)
+	base.SinkholeHost = fields.SinkholeHost
+	base.AdminAddr = fields.AdminAddr
+	base.AdminToken = fields.AdminToken
+	base.HostsFile = fields.HostsFile
+	base.DHCPLeasesFile = fields.DHCPLeasesFile
+	base.ZoneFile = fields.ZoneFile
+	base.CacheHandoffFile = fields.CacheHandoffFile
+	base.LogTarget = fields.LogTarget
+	return base, nil
+}
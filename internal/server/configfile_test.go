@@ -0,0 +1,139 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TEST 1: Config file fields override the base config
+// Tests that LoadConfig keeps the base values the file doesn't set and rejects unknown fields
+func TestLoadConfig(t *testing.T) {
+	var (
+		dir      string = t.TempDir()
+		filename string = filepath.Join(dir, "config.json")
+		base     Config = Config{LocalAddr: "0.0.0.0:53", UpstreamDns: "1.1.1.1", FilterMode: "nxdomain", AnswerLocalhost: true}
+		config   Config
+		err      error
+	)
+	if err = os.WriteFile(filename, []byte(`{"upstream": "9.9.9.9", "filter_mode": "null", "min_ttl": "1m"}`), 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if config, err = LoadConfig(filename, base); err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if config.UpstreamDns != "9.9.9.9" || config.FilterMode != "null" || config.MinTTL != time.Minute {
+		t.Errorf("Expected the file values, got upstream %q, filter mode %q, min ttl %v", config.UpstreamDns, config.FilterMode, config.MinTTL)
+	}
+	if config.LocalAddr != base.LocalAddr || !config.AnswerLocalhost {
+		t.Errorf("Expected the base values for fields the file doesn't set, got %+v", config)
+	}
+
+	if err = os.WriteFile(filename, []byte(`{"answer_localhost": false}`), 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if config, err = LoadConfig(filename, base); err != nil || config.AnswerLocalhost {
+		t.Errorf("Expected the file to turn localhost answers off, got %v (%v)", config.AnswerLocalhost, err)
+	}
+
+	var tests = []string{
+		`{"upstrem": "9.9.9.9"}`,
+		`{"min_ttl": 60}`,
+		`{"min_ttl": "a minute"}`,
+	}
+	for _, content := range tests {
+		if err = os.WriteFile(filename, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+		if _, err = LoadConfig(filename, base); err == nil {
+			t.Errorf("%s: expected an error", content)
+		}
+	}
+}
+
+// TEST 2: Reloading the config swaps the upstream and the filter mode
+// Tests that after ReloadConfig the new upstream answers and blocked domains get the new filter mode, an invalid config changes nothing
+func TestDNSServer_ReloadConfig(t *testing.T) {
+	var (
+		before   *MockResolver = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 1, 1, 1})}
+		after    *MockResolver = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{2, 2, 2, 2})}
+		config   Config        = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "1.1.1.1", FilterMode: "nxdomain"}
+		server   *DNSServer    = NewDNSServer(config, before, nil)
+		tcp      *TCPResolver
+		response []byte
+		ok       bool
+		err      error
+	)
+	if server.resolverFor(1) != before || server.createBlockedResponse(buildDNSQuery("ads.com", 1, 1))[3]&0x0F != RCODE_NXDOMAIN {
+		t.Fatal("Expected the first upstream and NXDOMAIN for blocked domains before the reload")
+	}
+
+	config.UpstreamDns = "9.9.9.9,8.8.8.8"
+	config.FilterMode = "null"
+	config.LocalAddr = "127.0.0.1:5454" // only logged, needs a restart
+	if err = server.ReloadConfig(config, after); err != nil {
+		t.Fatalf("ReloadConfig failed: %v", err)
+	}
+
+	if server.resolverFor(1) != after {
+		t.Errorf("Expected the new upstream, got %T", server.resolverFor(1))
+	}
+	if tcp, ok = server.currentUpstreams().tcp.(*TCPResolver); !ok || len(tcp.upstreamAddrs) != 2 {
+		t.Errorf("Expected tcp retries against the new udp upstreams, got %v", server.currentUpstreams().tcp)
+	}
+	response = server.createBlockedResponse(buildDNSQuery("ads.com", 1, 1))
+	if response[3]&0x0F != 0 || len(response) <= len(buildDNSQuery("ads.com", 1, 1)) {
+		t.Errorf("Expected a null mode answer after the reload, got rcode %d", response[3]&0x0F)
+	}
+	if server.mainListener().addr != "127.0.0.1:5353" {
+		t.Errorf("Expected the listen address to need a restart, got %s", server.mainListener().addr)
+	}
+
+	config.FilterMode = "redirect"
+	if err = server.ReloadConfig(config, before); err == nil {
+		t.Error("Expected an error for an unknown filter mode")
+	}
+	config.FilterMode = "null"
+	config.UpstreamDns = "tls://1.1.1.1,8.8.8.8"
+	config.UpstreamStrategy = "weighted"
+	if err = server.ReloadConfig(config, nil); err == nil {
+		t.Error("Expected an error for an invalid upstream")
+	}
+	if server.resolverFor(1) != after || server.filterMode() != "null" {
+		t.Error("Expected a rejected config to keep the current upstream and filter mode")
+	}
+}
+
+// TEST 3: Fields a reload doesn't apply are reported
+// Tests that every changed field outside the reloaded ones, e.g. DefaultDeny, TxtRecords
+// or LocalDomain, is reported as needing a restart and the reloaded ones aren't
+func TestDNSServer_RestartOnlyChanges(t *testing.T) {
+	var (
+		config  Config     = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "1.1.1.1"}
+		server  *DNSServer = NewDNSServer(config, &MockResolver{}, nil)
+		changed []string
+	)
+	config.UpstreamDns = "9.9.9.9"
+	config.FilterMode = "null"
+	config.DefaultDeny = true
+	config.TxtRecords = map[string][]string{"example.lan": {"v=spf1 -all"}}
+	config.LocalDomain = "lan"
+	config.AddressFamilyPreference = "ipv4"
+	config.ServeExpiredOnOutage = true
+	config.RewriteRules = []RewriteRule{{Domain: "example.com"}}
+
+	changed = server.restartOnlyChanges(config)
+	for _, field := range []string{"DefaultDeny", "TxtRecords", "LocalDomain", "AddressFamilyPreference", "ServeExpiredOnOutage", "RewriteRules"} {
+		if !slices.Contains(changed, field) {
+			t.Errorf("Expected %s to need a restart, got %v", field, changed)
+		}
+	}
+	if slices.Contains(changed, "UpstreamDns") || slices.Contains(changed, "FilterMode") {
+		t.Errorf("Expected the reloaded fields not to be reported, got %v", changed)
+	}
+	if len(changed) != 6 {
+		t.Errorf("Expected only the changed fields, got %v", changed)
+	}
+}
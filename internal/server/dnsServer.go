@@ -1,14 +1,19 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"flash-dns/internal/cache"
 	"flash-dns/internal/filter"
 	"flash-dns/internal/logger"
 	"flash-dns/internal/utils"
+	"flash-dns/internal/zone"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,16 +21,54 @@ const (
 	CLEANUP_TIME        time.Duration = 90 * time.Second // set the interval to clean expired cache
 	REPORT_STATUS_TIME  time.Duration = 5 * time.Minute  // interval to report status to the log
 	CLIENT_REQUEST_TIME time.Duration = 3 * time.Second  // how long we will read a client request
+
+	NO_IPV6_NEGATIVE_TTL uint32 = 300 // how long clients keep the synthesized AAAA NODATA
+	BLOCKED_NODATA_TTL   uint32 = 60  // how long clients keep the NODATA of a blocked DNSSEC query
+	EXPIRED_ANSWER_TTL   uint32 = 30  // TTL of the expired answers of ServeExpiredOnOutage, RFC 8767 suggests 30s
+
+	RCODE_FORMERR  uint8 = 1
+	RCODE_SERVFAIL uint8 = 2
+	RCODE_NXDOMAIN uint8 = 3
+	RCODE_NOTIMP   uint8 = 4
+	RCODE_REFUSED  uint8 = 5
 )
 
+var blockedBufferPool = sync.Pool{
+	New: func() interface{} {
+		var buffer []byte = make([]byte, 0, 512)
+		return &buffer
+	},
+}
+
 // Interfaces to be used in the server
 // they will divide work and make code more organized :)
 type Resolver interface {
 	Resolve(ctx context.Context, query []byte) ([]byte, error)
 }
 
+// resolvers that can say which upstream answered
+type sourceResolver interface {
+	ResolveWithSource(ctx context.Context, query []byte) ([]byte, string, error)
+}
+
+// caches that can remember where an answer came from
+type sourceCache interface {
+	SetWithSource(key string, response []byte, ttl uint32, source string)
+}
+
+// caches that count the background refreshes of their entries
+type prefetchCounter interface {
+	RecordPrefetchAttempt()
+	RecordPrefetchResult(success bool)
+}
+
+// decides which domains are blocked, *filter.FilterList is the built in one
+// other backends (a database, an external service...) plug in through NewDNSServer
+// and may implement typedFilter, filterReporter or categoryToggler as well
+// Count is only used for logs and may be approximate for an external backend
 type Filter interface {
 	IsBlocked(domain string) bool
+	IsAllowed(domain string) bool // explicitly allowlisted
 	Count() int
 }
 
@@ -35,126 +78,874 @@ type Cache interface {
 	Clean()
 }
 
+// filters with rules for some query types only
+type typedFilter interface {
+	IsBlockedType(domain string, qtype uint16) bool
+}
+
+// filters with domains that are never blocked and always resolved fresh
+type passthroughFilter interface {
+	IsPassthrough(domain string) bool
+}
+
+// caches that can drop every entry of a domain and its subdomains
+type domainInvalidator interface {
+	InvalidateDomain(domain string) int
+}
+
+// caches that keep entries past the grace period for ServeExpiredOnOutage
+type expiredCache interface {
+	GetExpired(key string) ([]byte, bool)
+}
+
+// caches that can tell an expired (stale) entry from one due for prefetch
+type staleReporter interface {
+	IsStale(key string) bool
+}
+
 type ServerStatistics interface {
 	incrementBlocked()
+	incrementBlockedByPolicy()
 	incrementAllowed()
 	incrementCacheHits()
 	incrementCacheMisses()
+	incrementInFlight()
+	decrementInFlight()
+	incrementRateLimited()
+	incrementNonRecursive()
+	incrementAmplificationLimited()
+	incrementWriteErrors()
+	incrementNotImplemented()
+	incrementServedExpired()
+	incrementDuplicates()
+	recordResponseSize(size int)
+	incrementNxdomainThrottled()
+	RateLimited() uint64
+	NonRecursive() uint64
+	AmplificationLimited() uint64
+	WriteErrors() uint64
+	NotImplemented() uint64
+	ServedExpired() uint64
+	Duplicates() uint64
+	ResponseSizes() [RESPONSE_SIZE_BUCKETS]uint64
+	NxdomainThrottled() uint64
+	InFlight() int64
 	GetStats() (blocked, allowed, cacheHits, cacheMisses uint64)
+	GetBlockedStats() (byList, byPolicy uint64)
 	Log()
+	Reset()
+}
+
+// resolvers that can move on to another upstream when one answers SERVFAIL
+type servfailRetrier interface {
+	SetRetryOnServfail(retry bool)
+}
+
+// resolvers that can cap the size of upstream answers
+type responseLimiter interface {
+	SetMaxResponseBytes(n int)
+}
+
+type Listener struct {
+	Addr       string
+	FilterMode string             // nxdomain, null or cname, default to nxdomain
+	Filter     *filter.FilterList // nil only applies the server wide rules
 }
 
 type Config struct {
-	LocalAddr   string
-	UpstreamDns string
-	FilterMode  string // nxdomain or null, default to nxdomain
+	LocalAddr     string
+	UpstreamDns   string // comma separated, see NewResolver for the accepted schemes
+	FilterMode    string // nxdomain, null or cname, default to nxdomain
+	AllowlistFile string // domains that are never blocked, one per line
+	DefaultDeny   bool   // block everything that isn't allowlisted
+
+	// block page host the cname filter mode points blocked domains at, e.g. blocked.mylan
+	// give it an address in the hosts or zone file so the answer carries it
+	BlockCNAMETarget string
+
+	// guards for the lists the filter is loaded from, see FilterOptions
+	MaxBlocklistEntries    int // rules kept at most, loading stops there; zero means no limit
+	MaxBlocklistLineLength int // longer lines are skipped, zero uses filter.DEFAULT_MAX_LINE_LENGTH
+
+	// domains blocked only inside a time window (parental controls)
+	TimedRules []filter.TimedRule
+
+	// extra udp listeners with their own filtering, e.g. strict for guests
+	// LocalAddr keeps using FilterMode and the filter given to NewDNSServer
+	Listeners []Listener
+
+	// dnsmasq leases file naming the clients, the hostnames label them in the query
+	// log and pick their DevicePolicies, which survive the ip changing
+	DHCPLeasesFile string
+
+	// lowercased hostname -> filtering for that device, instead of the listener's
+	// needs DHCPLeasesFile
+	DevicePolicies map[string]DevicePolicy
+
+	// how NewResolver combines the upstreams: race (default for plain udp lists),
+	// failover (default otherwise), roundrobin or weighted
+	UpstreamStrategy string
+
+	// qtype -> upstream list (same format as UpstreamDns), e.g. 28 (AAAA) -> "9.9.9.9"
+	// types not in the map use the default resolver
+	UpstreamByType map[uint16]string
+
+	// lock shards of the answer cache, rounded up to a power of two,
+	// zero uses cache.CACHE_SHARDS
+	CacheShards int
+
+	// bounds of how long before expiry popular entries are refreshed, the lead is
+	// 20% of the TTL kept between the two; zero uses cache.PREFETCH_MIN_LEAD and
+	// cache.PREFETCH_MAX_LEAD
+	PrefetchMinLead time.Duration
+	PrefetchMaxLead time.Duration
+
+	// also cache the answers for the targets of CNAME chains, so a query for
+	// b.cdn.example after a.cdn.example CNAME b.cdn.example is a cache hit
+	CacheCNAMEChains bool
+
+	// answer TTLs below this are raised to it as they come from the upstream,
+	// before the cache and the clients see them, zero leaves them alone
+	MinTTL time.Duration
+
+	// a SERVFAIL from one upstream tries the others instead of being answered
+	// right away, it's only returned when every upstream gives it
+	RetryOnServfail bool
+
+	// upstream answers bigger than this are dropped, zero means 65535 (the dns max)
+	MaxUpstreamResponseBytes int
+
+	// when set, a stale entry is only served if a refresh of it is running or finished
+	// within this window, otherwise the client waits for a synchronous refresh
+	StaleRefreshWindow time.Duration
+
+	// when the upstream fails and only an entry past the grace period is left (not
+	// cleaned yet), serve it with EXPIRED_ANSWER_TTL rather than SERVFAIL
+	ServeExpiredOnOutage bool
+
+	// background refreshes running at once, the extra ones are skipped
+	// since the cached answer is still served, zero means no limit
+	MaxBackgroundRefreshes int
+
+	// blocked, cached and local answers wait at least this long before being sent,
+	// hiding that they didn't go upstream, zero sends them right away
+	MinResponseDelay time.Duration
+
+	// queries per second accepted by the whole server, the excess is dropped
+	// zero disables the limit
+	MaxGlobalQPS int
+
+	// upstream NXDOMAIN answers per second a client may cause, past it the client
+	// is refused (REFUSED) the names that aren't cached for NXDOMAIN_THROTTLE
+	// zero disables the limit
+	MaxNxdomainPerSecond int
+
+	// udp answers bigger than AmplificationFactor times their query (ANY, large TXT...)
+	// are limited to MaxAmplifiedPerClient per second for each client, the excess is
+	// dropped; clients in AmplificationAllowlist (ips or CIDRs) aren't limited
+	// zero AmplificationFactor disables the check, zero MaxAmplifiedPerClient uses
+	// AMPLIFICATION_DEFAULT_LIMIT
+	AmplificationFactor    int
+	MaxAmplifiedPerClient  int
+	AmplificationAllowlist []string
+
+	// largest udp answer we send, and the buffer size our OPT records advertise
+	// clients get min(their EDNS buffer, this), 512 without EDNS, and the answers
+	// that don't fit are truncated with TC; zero uses UDP_DEFAULT_MAX_SIZE
+	MaxUDPSize int
+
+	// also answer over tcp on LocalAddr, for clients retrying truncated answers
+	ListenTCP bool
+
+	// set SO_REUSEPORT on the udp and tcp sockets, so several processes can bind
+	// the same address and the kernel balances the queries between them
+	// ignored with a warning on the platforms without it
+	ReusePort bool
+
+	// open tcp connections at once, the extra ones are closed when accepted
+	// zero means no limit
+	MaxTCPConns int
+
+	// tcp connections without a query for this long are closed, zero uses TCP_IDLE_TIMEOUT
+	TCPIdleTimeout time.Duration
+
+	// answer localhost and its reverse lookups locally instead of forwarding them,
+	// the config built from the flags turns it on, a config file can turn it off
+	AnswerLocalhost bool
+
+	// answer the RFC 6761 special-use names locally: .localhost with the loopback
+	// addresses, .invalid, .test and .example with NXDOMAIN, none of them go upstream
+	HandleSpecialUseDomains bool
+
+	// hosts file with local names, a name listed several times rotates its addresses
+	HostsFile string
+
+	// search domain of the lan, e.g. home: single label names and names under it are
+	// answered from the local zone or get NXDOMAIN, they are never forwarded
+	LocalDomain string
+
+	// zone file with local records, see zone.LoadZoneFile, e.g. HTTPS records with ECH configs
+	ZoneFile string
+
+	// TXT answers for these names, each string a character-string of the record
+	// (split when over 255 bytes), e.g. for domain ownership verification
+	// only TXT queries are answered, the other types of the names go upstream
+	TxtRecords map[string][]string
+
+	// send the client subnet upstream in the EDNS Client Subnet option (/24 for
+	// ipv4, /56 for ipv6) and cache the answers per subnet, for CDNs that answer
+	// by location; the option is removed from the answers sent back
+	ForwardClientSubnet bool
+
+	// host (or ip) null mode answers point to instead of 0.0.0.0, e.g. a block page
+	// server, resolved through the upstream at startup and every
+	// SinkholeRefreshInterval (zero only resolves it at startup)
+	SinkholeHost            string
+	SinkholeRefreshInterval time.Duration
+
+	// answer queries with RD clear with REFUSED instead of forwarding them
+	// we only forward so we can't give the authoritative answer they ask for,
+	// and they are what cache snooping uses; they are counted either way
+	RefuseNonRecursive bool
+
+	// answer AAAA with NODATA instead of forwarding, for networks without ipv6
+	SynthesizeNoIPv6 bool
+
+	// what queries get while the blocklist is loading, until MarkReady is called:
+	// refuse answers REFUSED, forward resolves them without filtering
+	// empty expects the blocklist to be passed to NewDNSServer and is ready right away
+	StartupBehavior string
+
+	// address family of the A/AAAA records sent to clients: ipv4 strips the AAAA
+	// records of every answer, ipv6 the A ones, both (or empty) keeps them all
+	// unlike SynthesizeNoIPv6 the queries still go upstream and get cached
+	AddressFamilyPreference string
+
+	// shuffle the A/AAAA records of forwarded and cached answers on every response,
+	// spreading clients that only use the first address over all of them
+	ShuffleAnswers bool
+
+	// reject upstream answers whose question isn't the one asked or with records
+	// for names outside the question's CNAME chain, as injected by some middleboxes
+	StrictAnswerValidation bool
+
+	// A/AAAA rewrites applied to upstream answers before they are cached
+	RewriteRules []RewriteRule
+
+	// faults (SERVFAIL, a delay or no answer) injected into a share of the queries
+	// for some domains, to test how clients cope with a failing resolver
+	// for testing only, empty (the default) injects nothing
+	FaultInjection []FaultRule
+
+	// snapshot written by DNSCache.SaveSnapshot, answers from it are served
+	// only when the cache misses and the upstream fails
+	FallbackCacheFile string
+
+	// the cache is saved here when Start returns (SIGTERM in flash-dns) and loaded
+	// back by NewDNSServer, so the replacement process starts with a warm cache
+	CacheHandoffFile string
+
+	// socks5:// proxy for the tcp, tls and https upstream connections and the tcp
+	// retries of truncated answers, udp can't go through socks5
+	UpstreamProxy string
+
+	// where the logs go: file (the logger.Init file, default), stderr or syslog
+	// LogFacility (daemon by default, local0-7...) and LogTag only apply to syslog
+	// the logger is global, cmd/main.go sets it up from these, NewDNSServer doesn't
+	LogTarget   string
+	LogFacility string
+	LogTag      string
+
+	// also write the debug lines, e.g. the answers that couldn't be sent back
+	LogDebug bool
+
+	// address of the admin api (/stats, /cache...), disabled when empty
+	// host:port, or unix:/path/to.sock to keep it off the network
+	AdminAddr string
+
+	// bearer token the POST routes of the admin api (pause, resume, categories) require
+	// over tcp, without one they're only accepted over a unix socket
+	AdminToken string
+
+	// unchanged statistics are logged at most once per interval, zero uses STATS_LOG_MAX_INTERVAL
+	StatsLogMaxInterval time.Duration
+
+	// how often the statistics are logged, zero uses REPORT_STATUS_TIME
+	// with ResetStatsOnReport the counters start over after each line (per interval reports)
+	StatsReportInterval time.Duration
+	ResetStatsOnReport  bool
 }
 
 // server implementation
 // orchestrate all the interfaces from before
 type DNSServer struct {
-	config     Config
-	cache      Cache
+	config          Config
+	cache           Cache
+	fallback        *cache.FallbackCache // nil without Config.FallbackCacheFile
+	zone            *zone.Zone           // local names, nil without Config.HostsFile and Config.ZoneFile
+	txtRecords      map[string][]byte    // TXT rdata by lowercased name, from Config.TxtRecords
+	filter          Filter
+	filterMu        sync.RWMutex // guards filter, ReloadFilter swaps it while serving
+	configMu        sync.RWMutex // guards the upstreams and the reloadable config fields, ReloadConfig swaps them while serving
+	listeners       []listener   // from Config.Listeners
+	resolver        Resolver
+	resolversByType map[uint16]Resolver
+	tcpResolver     Resolver            // retries truncated udp answers
+	tcpByType       map[uint16]Resolver // retries those of the resolversByType
+	statistics      ServerStatistics
+	refreshes       *refreshTracker
+	duplicates      *duplicateTracker             // queries in flight, a client resending one waits for its answer
+	globalLimiter   *rollingLimiter               // nil when MaxGlobalQPS is not set
+	amplification   *amplificationLimiter         // nil when AmplificationFactor is not set
+	nxdomains       *nxdomainLimiter              // nil when MaxNxdomainPerSecond is not set
+	background      sync.WaitGroup                // background refreshes, Start waits for them before returning
+	backgroundMu    sync.Mutex                    // orders background.Add against that Wait
+	backgroundDone  bool                          // set by stopBackground, no refresh starts after it
+	refreshSlots    chan struct{}                 // semaphore for MaxBackgroundRefreshes, nil without a limit
+	tcpSlots        chan struct{}                 // semaphore for MaxTCPConns, nil without a limit
+	queryLogger     QueryLogger                   // nil doesn't log queries
+	pausedUntil     atomic.Int64                  // unix nanoseconds until blocking resumes, zero when not paused
+	ready           atomic.Bool                   // false while the blocklist loads, see Config.StartupBehavior
+	sinkhole        atomic.Pointer[sinkholeAddrs] // from Config.SinkholeHost, nil answers 0.0.0.0
+	leases          atomic.Pointer[leaseTable]    // from Config.DHCPLeasesFile, nil without it
+	now             func() time.Time              // injectable clock for time based rules
+}
+
+// a nil resolver is built from the config with NewResolver
+// the blocklist is usually a *filter.FilterList, nil (or a nil list) filters nothing
+func NewDNSServer(config Config, resolver Resolver, blocklist Filter) *DNSServer {
+	var (
+		err        error
+		upstreams  upstreamSet
+		statistics *Statistics     = &Statistics{maxLogInterval: config.StatsLogMaxInterval}
+		answers    *cache.DNSCache = cache.NewShardedDNSCache(config.CacheShards)
+		server     *DNSServer      = &DNSServer{
+			cache:      answers,
+			config:     config,
+			statistics: statistics,
+			refreshes:  newRefreshTracker(config.StaleRefreshWindow),
+			duplicates: newDuplicateTracker(),
+			now:        time.Now,
+		}
+	)
+
+	answers.SetPrefetchLead(config.PrefetchMinLead, config.PrefetchMaxLead)
+	answers.SetKeepExpired(config.ServeExpiredOnOutage)
+	loadCacheHandoff(answers, config.CacheHandoffFile)
+
+	switch strings.ToLower(config.StartupBehavior) {
+	case STARTUP_REFUSE, STARTUP_FORWARD:
+	case "":
+		server.ready.Store(true)
+	default:
+		logger.Error(fmt.Sprintf("unknown startup behavior %q, filtering right away", config.StartupBehavior))
+		server.ready.Store(true)
+	}
+
+	checkFaultRules(config.FaultInjection)
+
+	switch config.AddressFamilyPreference {
+	case "", ADDRESS_FAMILY_BOTH, ADDRESS_FAMILY_IPV4, ADDRESS_FAMILY_IPV6:
+	default:
+		logger.Error(fmt.Sprintf("unknown address family preference %q, keeping both", config.AddressFamilyPreference))
+	}
+
+	if config.MaxBackgroundRefreshes > 0 {
+		server.refreshSlots = make(chan struct{}, config.MaxBackgroundRefreshes)
+	}
+
+	if config.MaxTCPConns > 0 {
+		server.tcpSlots = make(chan struct{}, config.MaxTCPConns)
+	}
+
+	if config.MaxGlobalQPS > 0 {
+		server.globalLimiter = newRollingLimiter(config.MaxGlobalQPS, time.Second)
+	}
+
+	if config.MaxNxdomainPerSecond > 0 {
+		server.nxdomains = newNxdomainLimiter(config.MaxNxdomainPerSecond)
+	}
+
+	if config.AmplificationFactor > 0 {
+		if server.amplification, err = newAmplificationLimiter(config.AmplificationFactor, config.MaxAmplifiedPerClient, config.AmplificationAllowlist); err != nil {
+			logger.Error(fmt.Sprintf("%v, ignoring them", err))
+		}
+	}
+
+	upstreams = newUpstreams(config, resolver)
+	server.resolver, server.resolversByType, server.tcpResolver, server.tcpByType = upstreams.resolver, upstreams.byType, upstreams.tcp, upstreams.tcpByType
+
+	server.txtRecords = newTXTRecords(config.TxtRecords)
+
+	if config.HostsFile != "" || config.ZoneFile != "" {
+		server.zone = zone.NewZone()
+	}
+
+	if config.HostsFile != "" {
+		if err = server.zone.LoadHostsFile(config.HostsFile); err != nil {
+			logger.Error(fmt.Sprintf("failed to load hosts file: %v", err))
+		}
+	}
+
+	if config.ZoneFile != "" {
+		if err = server.zone.LoadZoneFile(config.ZoneFile); err != nil {
+			logger.Error(fmt.Sprintf("failed to load zone file: %v", err))
+		}
+	}
+
+	if config.FallbackCacheFile != "" {
+		if server.fallback, err = cache.LoadFallbackCache(config.FallbackCacheFile); err != nil {
+			logger.Error(fmt.Sprintf("failed to load fallback cache: %v", err))
+		}
+	}
+
+	if err = server.ReloadLeases(); err != nil {
+		logger.Error(err.Error())
+	}
+
+	server.filter = server.prepareBackend(blocklist)
+
+	for _, definition := range config.Listeners {
+		var l listener = listener{addr: definition.Addr, filterMode: definition.FilterMode}
+		if definition.Filter != nil {
+			l.filter = definition.Filter
+		}
+		server.listeners = append(server.listeners, l)
+	}
+
+	return server
+}
+
+// filtering settings of the socket a query came in on
+type listener struct {
+	addr       string
 	filter     Filter
-	resolver   Resolver
-	statistics ServerStatistics
+	filterMode string
+	main       bool // filter and filterMode are the server's, read per query
+}
+
+// the main listener follows ReloadFilter and ReloadConfig, its filter and mode
+// are filled in when each query is handled
+func (s *DNSServer) mainListener() listener {
+	return listener{addr: s.config.LocalAddr, main: true}
 }
 
-func NewDNSServer(config Config, resolver Resolver, filterList *filter.FilterList) *DNSServer {
-	var statistics *Statistics = &Statistics{}
-	return &DNSServer{
-		cache:      cache.NewDNSCache(),
-		config:     config,
-		filter:     filterList,
-		resolver:   resolver,
-		statistics: statistics,
+// the listener with the filter and mode in place right now
+func (s *DNSServer) currentListener(l listener) listener {
+	if l.main {
+		l.filter, l.filterMode = s.currentFilter(), s.filterMode()
 	}
+	return l
 }
 
 func (s *DNSServer) handleQuery(ctx context.Context, query []byte, clientAddr *net.UDPAddr, conn *net.UDPConn) {
+	s.handleListenerQuery(ctx, s.mainListener(), query, &udpResponseWriter{conn: conn, addr: clientAddr})
+}
+
+func (s *DNSServer) handleListenerQuery(ctx context.Context, l listener, query []byte, w responseWriter) {
 	select {
 	case <-ctx.Done():
 		return
 	default:
 	}
 
+	var started time.Time = time.Now()
+	l = s.currentListener(l)
+	s.statistics.incrementInFlight()
+	defer s.statistics.decrementInFlight()
+
+	if s.globalLimiter != nil && !s.globalLimiter.Allow(s.now()) {
+		s.statistics.incrementRateLimited()
+		return
+	}
+
 	// filtering the query
 	var (
-		queryInfo *utils.QueryInfo
-		err       error
-		response  []byte = make([]byte, 512)
-		blocked   bool
+		queryInfo   *utils.QueryInfo
+		err         error
+		response    []byte = make([]byte, 512)
+		local       []byte
+		opcode      uint8
+		blocked     bool
+		passthrough bool
+		ok          bool
 	)
+	// NOTIFY, UPDATE and friends don't carry a question we can answer, and
+	// their sections would be misread as one
+	if opcode = utils.Opcode(query); opcode != 0 && len(query) >= 12 {
+		s.statistics.incrementNotImplemented()
+		logger.Info(fmt.Sprintf("NOTIMP: opcode %d", opcode))
+		s.holdResponse(ctx, started)
+		s.send(w, query, filter.CreateErrorResponse(query, RCODE_NOTIMP), started)
+		return
+	}
+
 	queryInfo, err = utils.ParseQuery(query)
+	if errors.Is(err, utils.ErrNoQuestion) { // nothing to resolve, not worth an error log
+		logger.Debug("FORMERR: query without a question")
+		s.send(w, query, filter.CreateErrorResponse(query, RCODE_FORMERR), started)
+		return
+	}
 	if err != nil {
-		logger.Error(fmt.Sprintf("failed to parse query: %v", err))
+		logger.ErrorLimited("parse", fmt.Sprintf("failed to parse query: %v", err))
+		// a cut short packet may not even be from a real client, corrupt names get FORMERR
+		if errors.Is(err, utils.ErrInvalidLabel) || errors.Is(err, utils.ErrNameTooLong) {
+			s.send(w, query, filter.CreateErrorResponse(query, RCODE_FORMERR), started)
+		}
+		return
+	}
+
+	// a resend of a query still being handled gets the same answer
+	var (
+		duplicate string = duplicateKey(w.clientAddr(), query, queryInfo)
+		pending   *pendingQuery
+		fault     FaultRule
+	)
+	if duplicate != "" {
+		if pending, ok = s.duplicates.begin(duplicate); !ok {
+			s.answerDuplicate(ctx, pending, query, queryInfo, w)
+			return
+		}
+		defer s.duplicates.end(duplicate, pending)
+		w = &sharedWriter{responseWriter: w, pending: pending}
+	}
+
+	// injected faults for testing clients, see Config.FaultInjection
+	if fault, ok = s.pickFault(queryInfo.Domain); ok && !s.applyFault(ctx, fault, query, queryInfo, w, started) {
 		return
 	}
 
-	if blocked = s.filterDomain(queryInfo.Domain); blocked {
-		copy(response, s.createBlockedResponse(query))
-		conn.WriteToUDP(response, clientAddr)
+	if !utils.RecursionDesired(query) {
+		s.statistics.incrementNonRecursive()
+		if s.config.RefuseNonRecursive {
+			logger.Info(fmt.Sprintf("REFUSED NON RECURSIVE: %s", queryInfo.Domain))
+			s.holdResponse(ctx, started)
+			s.send(w, query, filter.CreateErrorResponse(query, RCODE_REFUSED), started)
+			return
+		}
+	}
+
+	if s.config.AnswerLocalhost {
+		if local, ok = localhostResponse(query, queryInfo); ok {
+			s.holdResponse(ctx, started)
+			response = append(response[:0], local...)
+			s.send(w, query, response, started)
+			return
+		}
+	}
+
+	if local, ok = s.txtResponse(query, queryInfo); ok {
+		logger.Info(fmt.Sprintf("LOCAL TXT: %s", queryInfo.Domain))
+		s.holdResponse(ctx, started)
+		response = append(response[:0], local...)
+		s.send(w, query, response, started)
+		return
+	}
+
+	if s.zone != nil {
+		if local, ok = s.zone.Answer(query, queryInfo); ok {
+			logger.Info(fmt.Sprintf("LOCAL: %s", queryInfo.Domain))
+			s.holdResponse(ctx, started)
+			response = append(response[:0], local...)
+			s.send(w, query, response, started)
+			return
+		}
+	}
+
+	if local, ok = s.localDomainResponse(query, queryInfo); ok {
+		logger.Info(fmt.Sprintf("LOCAL DOMAIN: %s", queryInfo.Domain))
+		s.holdResponse(ctx, started)
+		response = append(response[:0], local...)
+		s.send(w, query, response, started)
+		return
+	}
+
+	if s.config.HandleSpecialUseDomains {
+		if local, ok = specialUseResponse(query, queryInfo); ok {
+			logger.Info(fmt.Sprintf("SPECIAL USE: %s", queryInfo.Domain))
+			s.holdResponse(ctx, started)
+			response = append(response[:0], local...)
+			s.send(w, query, response, started)
+			return
+		}
+	}
+
+	if !s.Ready() && s.refuseUntilReady() {
+		logger.Info(fmt.Sprintf("REFUSED (blocklist loading): %s", queryInfo.Domain))
+		s.send(w, query, filter.CreateErrorResponse(query, RCODE_REFUSED), started)
+		return
+	}
+
+	l = s.devicePolicy(l, w.clientAddr())
+
+	// passthrough domains skip the filter and the cache, nothing is filtered until ready
+	passthrough = isPassthrough(l.filter, queryInfo.Domain)
+	if blocked = !passthrough && s.Ready() && s.filterQueryWith(l.filter, queryInfo.Domain, queryInfo.QType); blocked {
+		s.holdResponse(ctx, started)
+		s.writeBlockedResponse(l.filterMode, query, queryInfo.QType, w, started)
 		return
 	}
 	s.statistics.incrementAllowed()
 
+	if s.config.SynthesizeNoIPv6 && queryInfo.QType == utils.TYPE_AAAA {
+		s.holdResponse(ctx, started)
+		response = append(response[:0], utils.CreateNoDataResponse(query, NO_IPV6_NEGATIVE_TTL)...)
+		s.send(w, query, response, started)
+		return
+	}
+
 	// response from cache immediately
 	var (
 		cachedResponse []byte = make([]byte, 512)
+		forwarded      []byte = s.clientSubnetQuery(query, queryInfo, w.clientAddr()) // what goes upstream
 		found          bool
 		needsRefresh   bool
 	)
-	if cachedResponse, found, needsRefresh = s.getCache(queryInfo.CacheKey, queryInfo.Domain); found {
-		copy(response, cachedResponse)
-		copy(response[0:2], query[0:2])
-		if needsRefresh {
+	if !passthrough {
+		cachedResponse, found, needsRefresh = s.getCache(queryInfo.CacheKey, queryInfo.Domain)
+	}
+	if found {
+		if needsRefresh && !s.shouldServeStale(queryInfo.CacheKey) {
+			cachedResponse = s.refreshNow(ctx, forwarded, queryInfo, cachedResponse)
+		} else if needsRefresh {
 			logger.Info(fmt.Sprintf("REFRESH CACHE: %s", queryInfo.Domain))
-			go s.refreshCache(ctx, query, queryInfo)
+			s.startRefresh(ctx, forwarded, queryInfo)
 		}
 
-		conn.WriteToUDP(response, clientAddr)
+		s.holdResponse(ctx, started)
+		response = append(response[:0], s.shuffleAnswers(cachedResponse)...)
+		copy(response[0:2], query[0:2])
+		setAnswerFlags(response, query)
+
+		s.send(w, query, response, started)
 		return
 	}
 
-	s.statistics.incrementCacheMisses()
-	logger.Info(fmt.Sprintf("CACHE MISS: %s - querying Upstream", queryInfo.Domain))
+	if !s.allowUncached(w.clientAddr()) {
+		s.statistics.incrementNxdomainThrottled()
+		s.send(w, query, filter.CreateErrorResponse(query, RCODE_REFUSED), started)
+		return
+	}
 
 	// if miss, query upstream
-	response, err = s.queryUpstream(ctx, query, queryInfo)
+	if passthrough {
+		logger.Info(fmt.Sprintf("PASSTHROUGH: %s - querying Upstream", queryInfo.Domain))
+		response, _, err = s.fetchUpstream(ctx, forwarded, queryInfo)
+	} else {
+		s.statistics.incrementCacheMisses()
+		logger.Info(fmt.Sprintf("CACHE MISS: %s - querying Upstream", queryInfo.Domain))
+		response, err = s.queryUpstream(ctx, forwarded, queryInfo)
+	}
 	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to Resolve: %s - %v", queryInfo.Domain, err))
+		logger.ErrorLimited("resolve", fmt.Sprintf("Failed to Resolve: %s - %v", queryInfo.Domain, err))
+		if response, ok = s.getFallback(query, queryInfo); ok {
+			setAnswerFlags(response, query)
+			s.send(w, query, response, started)
+			return
+		}
+		if response, ok = s.getExpired(query, queryInfo); ok {
+			setAnswerFlags(response, query)
+			s.send(w, query, response, started)
+			return
+		}
+		s.send(w, query, filter.CreateErrorResponse(query, RCODE_SERVFAIL), started)
 		return
 	}
 
-	conn.WriteToUDP(response, clientAddr)
+	s.recordNxdomain(w.clientAddr(), response)
+
+	response = bytes.Clone(s.shuffleAnswers(response)) // the cache keeps the original
+	setAnswerFlags(response, query)
+	s.send(w, query, response, started)
 }
 
-func (s *DNSServer) queryUpstream(ctx context.Context, query []byte, queryInfo *utils.QueryInfo) ([]byte, error) {
+// a reordered copy with Config.ShuffleAnswers, the response itself otherwise
+func (s *DNSServer) shuffleAnswers(response []byte) []byte {
+	if !s.config.ShuffleAnswers {
+		return response
+	}
+	return utils.ShuffleAddresses(response)
+}
+
+// RA is always set since we recurse for the client, RD echoes the query
+// the upstream or the query that filled the cache may have asked differently
+func setAnswerFlags(response []byte, query []byte) {
+	if len(response) < 4 || len(query) < 4 {
+		return
+	}
+
+	response[2] = response[2]&^0x01 | query[2]&0x01 // RD
+	response[3] |= 0x80                             // RA
+}
+
+// waits until Config.MinResponseDelay has passed since the query came in,
+// so local answers can't be told apart from upstream ones by timing
+// runs in the query goroutine, other queries aren't held
+func (s *DNSServer) holdResponse(ctx context.Context, started time.Time) {
+	if s.config.MinResponseDelay <= 0 {
+		return
+	}
+
+	var (
+		remaining time.Duration = s.config.MinResponseDelay - time.Since(started)
+		timer     *time.Timer
+	)
+	if remaining <= 0 {
+		return
+	}
+
+	timer = time.NewTimer(remaining)
+	defer timer.Stop()
+
 	select {
+	case <-timer.C:
 	case <-ctx.Done():
-		return nil, nil
+	}
+}
 
-	default:
+// last known good answer from the fallback snapshot, with the query id
+func (s *DNSServer) getFallback(query []byte, queryInfo *utils.QueryInfo) ([]byte, bool) {
+	if s.fallback == nil {
+		return nil, false
 	}
 
 	var (
-		response []byte = make([]byte, 512)
+		stored   []byte
+		response []byte
+		found    bool
+	)
+	if stored, found = s.fallback.Get(queryInfo.CacheKey); !found {
+		return nil, false
+	}
+
+	response = bytes.Clone(stored)
+	copy(response[0:2], query[0:2])
+	logger.Info(fmt.Sprintf("FALLBACK: %s - serving the snapshot answer", queryInfo.Domain))
+
+	return response, true
+}
+
+// an entry past the grace period with its TTLs cut to EXPIRED_ANSWER_TTL,
+// only with Config.ServeExpiredOnOutage
+func (s *DNSServer) getExpired(query []byte, queryInfo *utils.QueryInfo) ([]byte, bool) {
+	var (
+		expired  expiredCache
+		stored   []byte
+		response []byte
+		ok       bool
+	)
+	if !s.config.ServeExpiredOnOutage {
+		return nil, false
+	}
+	if expired, ok = s.cache.(expiredCache); !ok {
+		return nil, false
+	}
+	if stored, ok = expired.GetExpired(queryInfo.CacheKey); !ok {
+		return nil, false
+	}
+
+	response = utils.CapTTLs(bytes.Clone(stored), EXPIRED_ANSWER_TTL)
+	copy(response[0:2], query[0:2])
+	s.statistics.incrementServedExpired()
+	logger.Info(fmt.Sprintf("EXPIRED: %s - upstream unreachable, serving the expired answer", queryInfo.Domain))
+
+	return response, true
+}
+
+func (s *DNSServer) queryUpstream(ctx context.Context, query []byte, queryInfo *utils.QueryInfo) ([]byte, error) {
+	var (
+		response []byte
+		source   string
 		err      error
 		ttl      uint32
 	)
-	response, err = s.resolver.Resolve(ctx, query)
-	if err != nil {
-		return nil, err
+	response, source, err = s.fetchUpstream(ctx, query, queryInfo)
+	if err != nil || response == nil {
+		return response, err
+	}
+
+	if utils.IsTruncated(response) { // partial answer, don't keep it
+		return response, nil
 	}
 
 	ttl = utils.ExtractTTL(response)
 
-	s.cache.Set(queryInfo.CacheKey, response, ttl)
+	s.setCache(queryInfo.CacheKey, response, ttl, source)
 	logger.Info(fmt.Sprintf("CACHED: %s (TTl: %ds)", queryInfo.Domain, ttl))
 
+	if s.config.CacheCNAMEChains {
+		s.cacheChainTargets(response, queryInfo, source)
+	}
+
 	return response, nil
 }
 
+// the upstream answer checked and rewritten, without caching it
+func (s *DNSServer) fetchUpstream(ctx context.Context, query []byte, queryInfo *utils.QueryInfo) ([]byte, string, error) {
+	select {
+	case <-ctx.Done():
+		return nil, "", nil
+
+	default:
+	}
+
+	var (
+		response []byte = make([]byte, 512)
+		source   string
+		err      error
+	)
+	response, source, err = s.resolve(ctx, query, queryInfo)
+	if err != nil {
+		return nil, "", err
+	}
+	response = s.stripClientSubnet(response, queryInfo)
+
+	if s.config.StrictAnswerValidation {
+		if err = validateAnswer(query, response); err != nil {
+			return nil, "", fmt.Errorf("rejected answer from %s: %w", source, err)
+		}
+	}
+
+	return s.applyRewrites(queryInfo.Domain, response), source, nil
+}
+
+// runs refreshCache in a goroutine tracked by the server
+func (s *DNSServer) startRefresh(ctx context.Context, query []byte, queryInfo *utils.QueryInfo) {
+	s.backgroundMu.Lock()
+	defer s.backgroundMu.Unlock()
+
+	if s.backgroundDone || ctx.Err() != nil { // shutting down, don't start anything new
+		return
+	}
+
+	if s.refreshSlots != nil {
+		select {
+		case s.refreshSlots <- struct{}{}:
+		default:
+			logger.Info(fmt.Sprintf("REFRESH SKIPPED: %s - too many refreshes running", queryInfo.Domain))
+			return
+		}
+	}
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		if s.refreshSlots != nil {
+			defer func() { <-s.refreshSlots }()
+		}
+		s.refreshCache(ctx, query, queryInfo)
+	}()
+}
+
+// stops new refreshes from starting and waits for the running ones
+func (s *DNSServer) stopBackground() {
+	s.backgroundMu.Lock()
+	s.backgroundDone = true
+	s.backgroundMu.Unlock()
+
+	s.background.Wait()
+}
+
 func (s *DNSServer) refreshCache(ctx context.Context, query []byte, queryInfo *utils.QueryInfo) {
 	select {
 	case <-ctx.Done():
@@ -162,29 +953,343 @@ func (s *DNSServer) refreshCache(ctx context.Context, query []byte, queryInfo *u
 	default:
 	}
 
+	if !s.refreshes.begin(queryInfo.CacheKey) { // someone else is already on it
+		return
+	}
+	defer s.refreshes.end(queryInfo.CacheKey, time.Now())
+
+	s.statistics.incrementInFlight()
+	defer s.statistics.decrementInFlight()
+	s.countPrefetchAttempt()
+
 	var (
-		response []byte = make([]byte, 512)
+		response []byte
+		source   string
 		err      error
 		ttl      uint32
 	)
-	response, err = s.resolver.Resolve(ctx, query)
+	response, source, err = s.fetchUpstream(ctx, query, queryInfo)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to Resolve: %s - %v", queryInfo.Domain, err))
+		logger.ErrorLimited("resolve", fmt.Sprintf("Failed to Resolve: %s - %v", queryInfo.Domain, err))
+		s.countPrefetchResult(false)
+		return
+	}
+	if response == nil || ctx.Err() != nil { // the answer came after shutdown, the cache may be gone
+		return
+	}
+
+	if utils.IsTruncated(response) {
+		s.countPrefetchResult(false)
 		return
 	}
 
 	ttl = utils.ExtractTTL(response)
-	s.cache.Set(queryInfo.CacheKey, response, ttl)
+	s.setCache(queryInfo.CacheKey, response, ttl, source)
 	logger.Info(fmt.Sprintf("REFRESHED: %s (TTL %ds)", queryInfo.Domain, ttl))
+	s.countPrefetchResult(true)
 }
 
+func (s *DNSServer) countPrefetchAttempt() {
+	var (
+		counter prefetchCounter
+		ok      bool
+	)
+	if counter, ok = s.cache.(prefetchCounter); ok {
+		counter.RecordPrefetchAttempt()
+	}
+}
+
+func (s *DNSServer) countPrefetchResult(success bool) {
+	var (
+		counter prefetchCounter
+		ok      bool
+	)
+	if counter, ok = s.cache.(prefetchCounter); ok {
+		counter.RecordPrefetchResult(success)
+	}
+}
+
+// stale entries are served right away unless StaleRefreshWindow is set,
+// then only while a refresh is running or finished recently
+// entries that are only due for prefetch are always served
+func (s *DNSServer) shouldServeStale(key string) bool {
+	if s.config.StaleRefreshWindow <= 0 {
+		return true
+	}
+
+	var (
+		reporter staleReporter
+		ok       bool
+	)
+	if reporter, ok = s.cache.(staleReporter); !ok || !reporter.IsStale(key) {
+		return true
+	}
+
+	return s.refreshes.isRecent(key, time.Now())
+}
+
+// refreshes the entry while the client waits, the stale answer is kept on failure
+func (s *DNSServer) refreshNow(ctx context.Context, query []byte, queryInfo *utils.QueryInfo, stale []byte) []byte {
+	if !s.refreshes.begin(queryInfo.CacheKey) { // started meanwhile, serve the stale one
+		return stale
+	}
+	defer s.refreshes.end(queryInfo.CacheKey, time.Now())
+
+	var (
+		response []byte
+		err      error
+	)
+	logger.Info(fmt.Sprintf("STALE: %s - refreshing before answering", queryInfo.Domain))
+	s.countPrefetchAttempt()
+	response, err = s.queryUpstream(ctx, query, queryInfo)
+	if err != nil || response == nil {
+		logger.ErrorLimited("resolve", fmt.Sprintf("Failed to Resolve: %s - %v, serving stale", queryInfo.Domain, err))
+		s.countPrefetchResult(false)
+		return stale
+	}
+	s.countPrefetchResult(!utils.IsTruncated(response))
+
+	return response
+}
+
+// asks the upstream and, if the udp answer is truncated, retries over tcp
+// when tcp fails too the truncated answer is returned so the client can retry itself
+// the returned source is the upstream that answered, empty if the resolver can't tell
+func (s *DNSServer) resolve(ctx context.Context, query []byte, queryInfo *utils.QueryInfo) ([]byte, string, error) {
+	var (
+		response    []byte
+		tcpResponse []byte
+		source      string
+		tcpSource   string
+		upstreams   upstreamSet = s.currentUpstreams()
+		tcp         Resolver    = upstreams.tcpFor(queryInfo.QType)
+		err         error
+	)
+	response, source, err = resolveWithSource(ctx, upstreams.forType(queryInfo.QType), query)
+	if err != nil || !utils.IsTruncated(response) || tcp == nil {
+		return response, source, err
+	}
+
+	logger.Info(fmt.Sprintf("TRUNCATED: %s - retrying over TCP", queryInfo.Domain))
+	tcpResponse, tcpSource, err = resolveWithSource(ctx, tcp, query)
+	if err != nil {
+		logger.ErrorLimited("tcp retry", fmt.Sprintf("TCP retry failed: %s - %v", queryInfo.Domain, err))
+		return response, source, nil
+	}
+
+	return tcpResponse, tcpSource, nil
+}
+
+func resolveWithSource(ctx context.Context, resolver Resolver, query []byte) ([]byte, string, error) {
+	var (
+		sourced  sourceResolver
+		response []byte
+		err      error
+		ok       bool
+	)
+	if sourced, ok = resolver.(sourceResolver); ok {
+		return sourced.ResolveWithSource(ctx, query)
+	}
+
+	response, err = resolver.Resolve(ctx, query)
+	return response, "", err
+}
+
+// stores the answer, with its source when the cache keeps track of it
+func (s *DNSServer) setCache(key string, response []byte, ttl uint32, source string) {
+	var (
+		sourced sourceCache
+		ok      bool
+	)
+	if sourced, ok = s.cache.(sourceCache); ok {
+		sourced.SetWithSource(key, response, ttl, source)
+		return
+	}
+
+	s.cache.Set(key, response, ttl)
+}
+
+// the upstream for the query type right now, ReloadConfig may swap it
+func (s *DNSServer) resolverFor(qtype uint16) Resolver {
+	return s.currentUpstreams().forType(qtype)
+}
+
+func (s *DNSServer) currentUpstreams() upstreamSet {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return upstreamSet{resolver: s.resolver, byType: s.resolversByType, tcp: s.tcpResolver, tcpByType: s.tcpByType}
+}
+
+// the query type isn't known, so per type rules don't apply
 func (s *DNSServer) filterDomain(domain string) bool {
-	if s.filter != nil && s.filter.IsBlocked(domain) {
+	return s.filterQueryWith(s.currentFilter(), domain, 0)
+}
+
+// filter lists get the allowlist added, other backends are used as they are
+func (s *DNSServer) prepareBackend(blocklist Filter) Filter {
+	var (
+		list          *filter.FilterList
+		allowlistFile string
+		ok            bool
+	)
+	if list, ok = blocklist.(*filter.FilterList); ok || blocklist == nil {
+		return s.prepareFilter(list)
+	}
+
+	if allowlistFile = s.allowlistFile(); allowlistFile != "" {
+		logger.Warn(fmt.Sprintf("the allowlist %s only applies to filter lists, %T decides on its own", allowlistFile, blocklist))
+	}
+	return blocklist
+}
+
+// adds the Config.AllowlistFile domains to the list
+// returns a nil interface for a nil list, the server checks the filter against nil
+func (s *DNSServer) prepareFilter(filterList *filter.FilterList) Filter {
+	var (
+		allowlistFile string = s.allowlistFile()
+		err           error
+	)
+
+	if allowlistFile != "" {
+		if filterList == nil {
+			filterList = filter.NewFilterList()
+		}
+
+		if err = filterList.LoadAllowlistFromFile(allowlistFile); err != nil {
+			logger.Error(fmt.Sprintf("failed to load allowlist: %v", err))
+		}
+	}
+
+	if filterList == nil {
+		return nil
+	}
+	return filterList
+}
+
+func (s *DNSServer) currentFilter() Filter {
+	s.filterMu.RLock()
+	defer s.filterMu.RUnlock()
+	return s.filter
+}
+
+// swaps the main filter and drops cached answers of the domains it now blocks,
+// newly allowed domains keep their entries. returns how many entries were dropped
+// categories disabled in the old filter stay disabled in the new one
+func (s *DNSServer) ReloadFilter(filterList *filter.FilterList) int {
+	var (
+		list        Filter = s.prepareFilter(filterList)
+		toggler     categoryToggler
+		dumper      cacheDumper
+		invalidator domainInvalidator
+		dropped     map[string]bool = make(map[string]bool)
+		domain      string
+		removed     int
+		ok          bool
+	)
+	if toggler, ok = s.currentFilter().(categoryToggler); ok && filterList != nil {
+		for category, enabled := range toggler.Categories() {
+			if !enabled {
+				filterList.SetCategoryEnabled(category, false)
+			}
+		}
+	}
+
+	s.filterMu.Lock()
+	s.filter = list
+	s.filterMu.Unlock()
+
+	if list == nil {
+		return 0
+	}
+	if dumper, ok = s.cache.(cacheDumper); !ok {
+		return 0
+	}
+	if invalidator, ok = s.cache.(domainInvalidator); !ok {
+		return 0
+	}
+
+	for _, entry := range dumper.Snapshot() {
+		domain = cache.KeyDomain(entry.Key)
+		if dropped[domain] {
+			continue
+		}
+
+		if listBlocks(list, domain, cache.KeyType(entry.Key)) {
+			removed += invalidator.InvalidateDomain(domain)
+			dropped[domain] = true
+		}
+	}
+
+	logger.Info(fmt.Sprintf("Filter Reloaded: %d domains, %d cache entries dropped", list.Count(), removed))
+	return removed
+}
+
+// the list checks use the listener filter, schedules and default deny are server wide
+// nothing is blocked while PauseBlocking is in effect
+// qtype is zero when unknown
+func (s *DNSServer) filterQueryWith(list Filter, domain string, qtype uint16) bool {
+	if s.blockingPaused() {
+		return false
+	}
+
+	if listBlocks(list, domain, qtype) {
 		s.statistics.incrementBlocked()
 		logger.Info(fmt.Sprintf("BLOCKED: %s", domain))
 		return true
 	}
 
+	if s.isScheduledBlock(domain) {
+		s.statistics.incrementBlocked()
+		logger.Info(fmt.Sprintf("BLOCKED (schedule): %s", domain))
+		return true
+	}
+
+	if s.config.DefaultDeny && (list == nil || !list.IsAllowed(domain)) {
+		s.statistics.incrementBlockedByPolicy()
+		logger.Info(fmt.Sprintf("BLOCKED (not allowlisted): %s", domain))
+		return true
+	}
+
+	return false
+}
+
+func isPassthrough(list Filter, domain string) bool {
+	var (
+		passthrough passthroughFilter
+		ok          bool
+	)
+	if passthrough, ok = list.(passthroughFilter); !ok {
+		return false
+	}
+
+	return passthrough.IsPassthrough(domain)
+}
+
+// uses the $dnstype rules when the list has them and the type is known
+func listBlocks(list Filter, domain string, qtype uint16) bool {
+	if list == nil {
+		return false
+	}
+
+	var (
+		typed typedFilter
+		ok    bool
+	)
+	if typed, ok = list.(typedFilter); ok && qtype != 0 {
+		return typed.IsBlockedType(domain, qtype)
+	}
+
+	return list.IsBlocked(domain)
+}
+
+func (s *DNSServer) isScheduledBlock(domain string) bool {
+	var now time.Time = s.now()
+	for _, rule := range s.config.TimedRules {
+		if rule.IsActive(domain, now) {
+			return true
+		}
+	}
+
 	return false
 }
 
@@ -206,54 +1311,163 @@ func (s *DNSServer) getCache(cacheKey, domain string) ([]byte, bool, bool) {
 }
 
 func (s *DNSServer) createBlockedResponse(query []byte) []byte {
-	if strings.EqualFold(s.config.FilterMode, "null") {
-		return filter.CreateNullResponse(query)
+	var (
+		queryInfo *utils.QueryInfo
+		qtype     uint16
+		err       error
+	)
+	if queryInfo, err = utils.ParseQuery(query); err == nil {
+		qtype = queryInfo.QType
 	}
 
-	return filter.CreateBlockedResponse(query)
+	return s.appendBlockedResponse(s.filterMode(), nil, query, qtype)
+}
+
+// DNSSEC types have no address to sinkhole or alias, they get NODATA in every mode
+func (s *DNSServer) appendBlockedResponse(filterMode string, dst []byte, query []byte, qtype uint16) []byte {
+	if utils.IsDNSSECType(qtype) {
+		return append(dst, utils.CreateNoDataResponse(query, BLOCKED_NODATA_TTL)...)
+	}
+	if strings.EqualFold(filterMode, "null") {
+		return filter.AppendSinkholeResponse(dst, query, s.sinkholeIP(qtype))
+	}
+	if strings.EqualFold(filterMode, "cname") {
+		return s.appendBlockCNAMEResponse(dst, query, qtype)
+	}
+
+	return filter.AppendBlockedResponse(dst, query)
+}
+
+// builds the blocked answer in a pooled buffer, blocking is the hot path on ad heavy networks
+func (s *DNSServer) writeBlockedResponse(filterMode string, query []byte, qtype uint16, w responseWriter, received time.Time) {
+	var buffer *[]byte = blockedBufferPool.Get().(*[]byte)
+	defer blockedBufferPool.Put(buffer)
+
+	*buffer = s.appendBlockedResponse(filterMode, (*buffer)[:0], query, qtype)
+	s.send(w, query, *buffer, received)
 }
 
 func (s *DNSServer) Start(ctx context.Context) error {
 	var (
-		err    error
-		addr   *net.UDPAddr
-		conn   *net.UDPConn
-		buffer []byte = make([]byte, 512)
+		err   error
+		conn  *net.UDPConn
+		conns []*net.UDPConn
 	)
-	addr, err = net.ResolveUDPAddr("udp", s.config.LocalAddr)
-	if err != nil {
-		return fmt.Errorf("Failed to resolve address: %w", err)
+	if s.config.ReusePort && !REUSE_PORT_SUPPORTED {
+		logger.Warn("ReusePort is not supported on this platform, listening without it")
 	}
-
-	conn, err = net.ListenUDP("udp", addr)
+	conn, err = listenUDP(s.config.LocalAddr, s.config.ReusePort)
 	if err != nil {
-		return fmt.Errorf("Failed to listen: %s", err.Error())
+		return err
 	}
 	defer conn.Close()
+	conns = append(conns, conn)
+
+	for _, l := range s.listeners {
+		var extraConn *net.UDPConn
+		extraConn, err = listenUDP(l.addr, s.config.ReusePort)
+		if err != nil {
+			return err
+		}
+		defer extraConn.Close()
+		conns = append(conns, extraConn)
+	}
+	defer s.saveCacheHandoff() // after the refreshes below are done
+	defer s.stopBackground()
+
+	var tcpListener net.Listener
+	if s.config.ListenTCP {
+		tcpListener, err = listenTCP(s.config.LocalAddr, s.config.ReusePort)
+		if err != nil {
+			return err
+		}
+		defer tcpListener.Close()
+	}
 
 	logger.Info(fmt.Sprintf("DNS server is Listening on: %s", s.config.LocalAddr))
 	logger.Info(fmt.Sprintf("DNS server upstream dns: %s", s.config.UpstreamDns))
 
-	if s.filter != nil {
-		logger.Info(fmt.Sprintf("Filter Loaded: %d domains", s.filter.Count()))
+	if s.currentFilter() != nil {
+		logger.Info(fmt.Sprintf("Filter Loaded: %d domains", s.currentFilter().Count()))
+	}
+
+	if s.config.AdminAddr != "" {
+		var adminListener net.Listener
+		adminListener, err = listenAdmin(s.config.AdminAddr)
+		if err != nil {
+			return fmt.Errorf("Failed to listen on admin address: %w", err)
+		}
+		go s.startAdmin(ctx, adminListener)
+	}
+
+	if s.sinkholeHost() != "" {
+		s.resolveSinkhole(ctx)
+		if s.config.SinkholeRefreshInterval > 0 {
+			go s.sinkholeRefresher(ctx)
+		}
 	}
 
 	go s.cacheCleanUp(ctx)
-	go s.statsReporter(ctx)
-	go s.shutdownHandler(ctx, conn)
+	s.StartStatsReporter(ctx, s.config.StatsReportInterval, s.config.ResetStatsOnReport)
+	go s.shutdownHandler(ctx, tcpListener, conns...)
+
+	if tcpListener != nil {
+		logger.Info(fmt.Sprintf("DNS server is Listening on: %s (tcp)", s.config.LocalAddr))
+		go s.serveTCP(ctx, tcpListener, s.mainListener())
+	}
+
+	for i, l := range s.listeners {
+		logger.Info(fmt.Sprintf("DNS server is Listening on: %s (filter mode: %s)", l.addr, l.filterMode))
+		go s.serveUDP(ctx, conns[i+1], l)
+	}
+
+	s.serveUDP(ctx, conn, s.mainListener())
+	return nil
+}
+
+// with reusePort the socket gets SO_REUSEPORT where the platform has it
+func listenConfig(reusePort bool) net.ListenConfig {
+	var config net.ListenConfig
+	if reusePort && REUSE_PORT_SUPPORTED {
+		config.Control = reusePortControl
+	}
+
+	return config
+}
+
+func listenUDP(address string, reusePort bool) (*net.UDPConn, error) {
+	var (
+		config     net.ListenConfig = listenConfig(reusePort)
+		packetConn net.PacketConn
+		err        error
+	)
+	packetConn, err = config.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen: %s", err.Error())
+	}
+
+	return packetConn.(*net.UDPConn), nil
+}
+
+// reads queries from the socket until the context is cancelled
+func (s *DNSServer) serveUDP(ctx context.Context, conn *net.UDPConn, l listener) {
+	var (
+		err    error
+		buffer []byte = make([]byte, 512)
+	)
 
 	for {
 		select {
 		case <-ctx.Done():
-			logger.Info("Server Stopping")
-			return nil
+			logger.Info(fmt.Sprintf("Server Stopping: %s", l.addr))
+			return
 		default:
 		}
 
 		var (
 			bytesRead  int
 			clientAddr *net.UDPAddr
-			query      []byte = make([]byte, 512)
+			query      []byte
 		)
 		conn.SetReadDeadline(time.Now().Add(CLIENT_REQUEST_TIME))
 
@@ -269,14 +1483,14 @@ func (s *DNSServer) Start(ctx context.Context) error {
 
 			select {
 			case <-ctx.Done():
-				return nil
+				return
 			default:
 				logger.Error(fmt.Sprintf("Error reading: %v", err))
 				continue
 			}
 		}
-		copy(query, buffer[:bytesRead])
-		go s.handleQuery(ctx, query, clientAddr, conn)
+		query = bytes.Clone(buffer[:bytesRead]) // only what was read, the size matters to the amplification limit
+		go s.handleListenerQuery(ctx, l, query, &udpResponseWriter{conn: conn, addr: clientAddr})
 	}
 }
 
@@ -290,6 +1504,7 @@ func (s *DNSServer) cacheCleanUp(ctx context.Context) {
 		select {
 		case <-ticker.C:
 			s.cache.Clean()
+			s.refreshes.prune(time.Now())
 		case <-ctx.Done():
 			logger.Info("Cache Cleanup Stopped")
 			return
@@ -297,14 +1512,27 @@ func (s *DNSServer) cacheCleanUp(ctx context.Context) {
 	}
 }
 
-func (s *DNSServer) statsReporter(ctx context.Context) {
-	var ticker *time.Ticker = time.NewTicker(REPORT_STATUS_TIME)
+// logs the statistics every interval (REPORT_STATUS_TIME when zero) until ctx is done,
+// resetting the counters after each line when reset is set
+func (s *DNSServer) StartStatsReporter(ctx context.Context, interval time.Duration, reset bool) {
+	if interval <= 0 {
+		interval = REPORT_STATUS_TIME
+	}
+
+	go s.statsReporter(ctx, interval, reset)
+}
+
+func (s *DNSServer) statsReporter(ctx context.Context, interval time.Duration, reset bool) {
+	var ticker *time.Ticker = time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
 			s.statistics.Log()
+			if reset {
+				s.statistics.Reset()
+			}
 		case <-ctx.Done():
 			s.statistics.Log()
 			return
@@ -312,8 +1540,14 @@ func (s *DNSServer) statsReporter(ctx context.Context) {
 	}
 }
 
-func (s *DNSServer) shutdownHandler(ctx context.Context, conn *net.UDPConn) {
+// tcpListener may be nil when tcp isn't enabled
+func (s *DNSServer) shutdownHandler(ctx context.Context, tcpListener net.Listener, conns ...*net.UDPConn) {
 	<-ctx.Done()
 	logger.Info("Shutdown signal received, closing the server.")
-	conn.Close()
+	if tcpListener != nil {
+		tcpListener.Close()
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
 }
@@ -1,11 +1,21 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
+	"flash-dns/internal/cache"
 	"flash-dns/internal/filter"
 	"flash-dns/internal/utils"
+	"flash-dns/internal/zone"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -29,6 +39,57 @@ func (m *MockResolver) Resolve(ctx context.Context, query []byte) ([]byte, error
 	return m.response, nil
 }
 
+// BlockingResolver holds every query until release is closed
+type BlockingResolver struct {
+	response []byte
+	release  chan struct{}
+}
+
+func (b *BlockingResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	select {
+	case <-b.release:
+		return b.response, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// StubbornResolver holds every query until release is closed, even after the context is cancelled
+type StubbornResolver struct {
+	response []byte
+	release  chan struct{}
+}
+
+func (s *StubbornResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	<-s.release
+	return s.response, nil
+}
+
+// ConcurrencyResolver holds queries until release is closed and tracks how many wait at once
+type ConcurrencyResolver struct {
+	response []byte
+	release  chan struct{}
+	calls    atomic.Int64
+	active   atomic.Int64
+	peak     atomic.Int64
+}
+
+func (c *ConcurrencyResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var active int64 = c.active.Add(1)
+	defer c.active.Add(-1)
+	c.calls.Add(1)
+
+	for {
+		var peak int64 = c.peak.Load()
+		if active <= peak || c.peak.CompareAndSwap(peak, active) {
+			break
+		}
+	}
+
+	<-c.release
+	return c.response, nil
+}
+
 // MockCache simulates cache operations
 type MockCache struct {
 	data         map[string][]byte
@@ -64,12 +125,14 @@ func (m *MockCache) Clean() {
 // MockFilter simulates domain filtering
 type MockFilter struct {
 	blockedDomains map[string]bool
+	allowedDomains map[string]bool
 	count          int
 }
 
 func NewMockFilter() *MockFilter {
 	return &MockFilter{
 		blockedDomains: make(map[string]bool),
+		allowedDomains: make(map[string]bool),
 	}
 }
 
@@ -79,6 +142,10 @@ func (m *MockFilter) IsBlocked(domain string) bool {
 	return blocked
 }
 
+func (m *MockFilter) IsAllowed(domain string) bool {
+	return m.allowedDomains[domain]
+}
+
 func (m *MockFilter) Count() int {
 	return m.count
 }
@@ -578,100 +645,2970 @@ func TestDNSServer_QueryUpstream_ContextCancelled(t *testing.T) {
 	}
 }
 
-// ============================================================================
-// HELPER FUNCTIONS FOR BUILDING DNS PACKETS
-// ============================================================================
+// TEST 13: Route query to upstream by qtype
+// Tests that AAAA queries use the mapped resolver and A queries the default
+func TestDNSServer_QueryUpstream_ByType(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		defaultResolver *MockResolver = &MockResolver{
+			response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}),
+		}
+		ipv6Resolver *MockResolver = &MockResolver{
+			response: buildDNSResponse("example.com", 28, 1, 300, make([]byte, 16)),
+		}
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		aInfo      *utils.QueryInfo = &utils.QueryInfo{Domain: "example.com", CacheKey: "example.com:1", QType: 1, QClass: 1}
+		aaaaInfo   *utils.QueryInfo = &utils.QueryInfo{Domain: "example.com", CacheKey: "example.com:28", QType: 28, QClass: 1}
+		err        error
+	)
 
-func buildDNSQuery(domain string, qtype uint16, qclass uint16) []byte {
+	server = NewDNSServer(config, defaultResolver, filterList)
+	server.cache = NewMockCache()
+	server.resolversByType[28] = ipv6Resolver
+
+	_, err = server.queryUpstream(ctx, buildDNSQuery("example.com", 28, 1), aaaaInfo)
+	if err != nil {
+		t.Fatalf("QueryUpstream failed: %v", err)
+	}
+	_, err = server.queryUpstream(ctx, buildDNSQuery("example.com", 1, 1), aInfo)
+	if err != nil {
+		t.Fatalf("QueryUpstream failed: %v", err)
+	}
+
+	if ipv6Resolver.callCount != 1 {
+		t.Errorf("Expected 1 call to the AAAA resolver, got %d", ipv6Resolver.callCount)
+	}
+	if defaultResolver.callCount != 1 {
+		t.Errorf("Expected 1 call to the default resolver, got %d", defaultResolver.callCount)
+	}
+}
+
+// TEST 14: Upstream by type is built from config
+// Tests that NewDNSServer creates a resolver for each mapped qtype
+func TestNewDNSServer_UpstreamByType(t *testing.T) {
 	var (
-		query    []byte = make([]byte, 12)
-		labels   []string
-		i        int
-		label    string
-		labelLen int
+		config Config = Config{
+			LocalAddr:      "127.0.0.1:5353",
+			UpstreamDns:    "8.8.8.8",
+			UpstreamByType: map[uint16]string{28: "9.9.9.9"},
+		}
+		resolver *MockResolver = &MockResolver{}
+		server   *DNSServer
+		ok       bool
 	)
 
-	binary.BigEndian.PutUint16(query[0:2], 0x1234)
-	binary.BigEndian.PutUint16(query[4:6], 1)
+	server = NewDNSServer(config, resolver, nil)
 
-	labels = splitDomain(domain)
-	for i, label = range labels {
-		_ = i
-		labelLen = len(label)
-		query = append(query, byte(labelLen))
-		query = append(query, []byte(label)...)
+	if _, ok = server.resolverFor(28).(*UpstreamResolver); !ok {
+		t.Error("AAAA should use the configured upstream resolver")
 	}
-	query = append(query, 0)
+	if server.resolverFor(1) != resolver {
+		t.Error("A should fall back to the default resolver")
+	}
+	if server.filter != nil {
+		t.Error("A nil filter list should leave the filter unset")
+	}
+}
 
-	var typeClass []byte = make([]byte, 4)
-	binary.BigEndian.PutUint16(typeClass[0:2], qtype)
-	binary.BigEndian.PutUint16(typeClass[2:4], qclass)
-	query = append(query, typeClass...)
+// TEST 15: In-flight counter tracks slow handlers
+// Tests that queries waiting on upstream are counted and released after completion
+func TestDNSServer_HandleQuery_InFlight(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		resolver *BlockingResolver = &BlockingResolver{
+			response: buildDNSResponse("slow.com", 1, 1, 300, []byte{1, 2, 3, 4}),
+			release:  make(chan struct{}),
+		}
+		server     *DNSServer
+		conn       *net.UDPConn
+		clientAddr *net.UDPAddr
+		wg         sync.WaitGroup
+		handlers   int = 5
+		deadline   time.Time
+		i          int
+		err        error
+	)
 
-	return query
+	server = NewDNSServer(config, resolver, nil)
+
+	conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to create UDP connection: %v", err)
+	}
+	defer conn.Close()
+	clientAddr = conn.LocalAddr().(*net.UDPAddr)
+
+	for i = 0; i < handlers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.handleQuery(ctx, buildDNSQuery("slow.com", 1, 1), clientAddr, conn)
+		}()
+	}
+
+	deadline = time.Now().Add(time.Second)
+	for server.statistics.InFlight() != int64(handlers) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if server.statistics.InFlight() != int64(handlers) {
+		t.Errorf("Expected %d queries in flight, got %d", handlers, server.statistics.InFlight())
+	}
+
+	close(resolver.release)
+	wg.Wait()
+
+	if server.statistics.InFlight() != 0 {
+		t.Errorf("Expected 0 queries in flight after completion, got %d", server.statistics.InFlight())
+	}
 }
 
-func buildDNSResponse(domain string, qtype uint16, qclass uint16, ttl uint32, rdata []byte) []byte {
+// TEST 16: Truncated upstream answer is retried over TCP
+// Tests that a TC response triggers the TCP resolver and the full answer is cached
+func TestDNSServer_QueryUpstream_TruncatedRetriesTCP(t *testing.T) {
 	var (
-		response []byte = make([]byte, 12)
-		labels   []string
-		i        int
-		label    string
-		labelLen int
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		truncated    []byte        = buildDNSQuery("big.example.com", 16, 1)
+		fullResponse []byte        = buildDNSResponse("big.example.com", 16, 1, 300, []byte("\x05hello"))
+		udpResolver  *MockResolver = &MockResolver{response: truncated}
+		tcpResolver  *MockResolver = &MockResolver{response: fullResponse}
+		mockCache    *MockCache    = NewMockCache()
+		server       *DNSServer
+		queryInfo    *utils.QueryInfo = &utils.QueryInfo{Domain: "big.example.com", CacheKey: "big.example.com:16", QType: 16, QClass: 1}
+		response     []byte
+		err          error
 	)
 
-	binary.BigEndian.PutUint16(response[0:2], 0x1234)
-	binary.BigEndian.PutUint16(response[2:4], 0x8180)
-	binary.BigEndian.PutUint16(response[4:6], 1)
-	binary.BigEndian.PutUint16(response[6:8], 1)
+	binary.BigEndian.PutUint16(truncated[2:4], 0x8380) // QR, TC, RD, RA
 
-	labels = splitDomain(domain)
-	for i, label = range labels {
-		_ = i
-		labelLen = len(label)
-		response = append(response, byte(labelLen))
-		response = append(response, []byte(label)...)
+	server = NewDNSServer(config, udpResolver, nil)
+	server.cache = mockCache
+	server.tcpResolver = tcpResolver
+
+	response, err = server.queryUpstream(ctx, buildDNSQuery("big.example.com", 16, 1), queryInfo)
+	if err != nil {
+		t.Fatalf("QueryUpstream failed: %v", err)
 	}
-	response = append(response, 0)
 
-	var typeClass []byte = make([]byte, 4)
-	binary.BigEndian.PutUint16(typeClass[0:2], qtype)
-	binary.BigEndian.PutUint16(typeClass[2:4], qclass)
-	response = append(response, typeClass...)
+	if tcpResolver.callCount != 1 {
+		t.Errorf("Expected 1 TCP retry, got %d", tcpResolver.callCount)
+	}
+	if string(response) != string(fullResponse) {
+		t.Error("Expected the full TCP answer to be returned")
+	}
+	if string(mockCache.data[queryInfo.CacheKey]) != string(fullResponse) {
+		t.Error("Expected the full TCP answer to be cached")
+	}
+}
 
-	response = append(response, 0xC0, 0x0C)
+// TEST 17: Truncated answer is forwarded but not cached when TCP fails
+// Tests the graceful fallback when the TCP retry errors
+func TestDNSServer_QueryUpstream_TruncatedTCPFails(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		truncated   []byte        = buildDNSQuery("big.example.com", 16, 1)
+		udpResolver *MockResolver = &MockResolver{response: truncated}
+		tcpResolver *MockResolver = &MockResolver{err: errors.New("connection refused")}
+		mockCache   *MockCache    = NewMockCache()
+		server      *DNSServer
+		queryInfo   *utils.QueryInfo = &utils.QueryInfo{Domain: "big.example.com", CacheKey: "big.example.com:16", QType: 16, QClass: 1}
+		response    []byte
+		err         error
+	)
 
-	var answerData []byte = make([]byte, 10)
-	binary.BigEndian.PutUint16(answerData[0:2], qtype)
-	binary.BigEndian.PutUint16(answerData[2:4], qclass)
-	binary.BigEndian.PutUint32(answerData[4:8], ttl)
-	binary.BigEndian.PutUint16(answerData[8:10], uint16(len(rdata)))
-	response = append(response, answerData...)
-	response = append(response, rdata...)
+	binary.BigEndian.PutUint16(truncated[2:4], 0x8380)
 
-	return response
+	server = NewDNSServer(config, udpResolver, nil)
+	server.cache = mockCache
+	server.tcpResolver = tcpResolver
+
+	response, err = server.queryUpstream(ctx, buildDNSQuery("big.example.com", 16, 1), queryInfo)
+	if err != nil {
+		t.Fatalf("QueryUpstream failed: %v", err)
+	}
+
+	if !utils.IsTruncated(response) {
+		t.Error("Expected the truncated answer to be forwarded")
+	}
+	if mockCache.setCallCount != 0 {
+		t.Errorf("Truncated answers should not be cached, got %d sets", mockCache.setCallCount)
+	}
 }
 
-func splitDomain(domain string) []string {
+// TEST 18: Blocklist hits and default deny misses use separate counters
+// Tests that the reason a domain was blocked is recorded
+func TestDNSServer_FilterDomain_BlockReasons(t *testing.T) {
 	var (
-		labels []string
-		start  int = 0
-		i      int
-		ch     rune
+		config Config = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+			DefaultDeny: true,
+		}
+		mockFilter *MockFilter = NewMockFilter()
+		server     *DNSServer
+		byList     uint64
+		byPolicy   uint64
+		blocked    uint64
 	)
 
-	for i, ch = range domain {
-		if ch == '.' {
-			if i > start {
-				labels = append(labels, domain[start:i])
-			}
-			start = i + 1
+	mockFilter.AddBlocked("ads.example.com")
+	mockFilter.allowedDomains["example.com"] = true
+	server = NewDNSServer(config, &MockResolver{}, nil)
+	server.filter = mockFilter
+
+	if !server.filterDomain("ads.example.com") {
+		t.Error("Blocklisted domain should be blocked")
+	}
+	if !server.filterDomain("unknown.org") {
+		t.Error("Domain missing from the allowlist should be blocked under default deny")
+	}
+	if server.filterDomain("example.com") {
+		t.Error("Allowlisted domain should not be blocked under default deny")
+	}
+
+	byList, byPolicy = server.statistics.GetBlockedStats()
+	if byList != 1 {
+		t.Errorf("Expected 1 blocked by list, got %d", byList)
+	}
+	if byPolicy != 1 {
+		t.Errorf("Expected 1 blocked by policy, got %d", byPolicy)
+	}
+
+	blocked, _, _, _ = server.statistics.GetStats()
+	if blocked != 2 {
+		t.Errorf("Expected the total blocked to include both reasons, got %d", blocked)
+	}
+}
+
+// TEST 19: First stale hit refreshes synchronously, later ones are served stale
+// Tests that with StaleRefreshWindow a stale answer is only served while a refresh runs
+func TestDNSServer_HandleQuery_StaleOnlyDuringRefresh(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:          "127.0.0.1:5353",
+			UpstreamDns:        "8.8.8.8:53",
+			StaleRefreshWindow: time.Minute,
+		}
+		resolver *BlockingResolver = &BlockingResolver{
+			response: buildDNSResponse("stale.com", 1, 1, 300, []byte{2, 2, 2, 2}),
+			release:  make(chan struct{}),
+		}
+		server     *DNSServer
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		firstDone  chan struct{} = make(chan struct{})
+		second     []byte
+		deadline   time.Time
+		ips        []net.IP
+		err        error
+	)
+
+	server = NewDNSServer(config, resolver, nil)
+	server.cache.Set("stale.com:1", buildDNSResponse("stale.com", 1, 1, 0, []byte{1, 1, 1, 1}), 0)
+	time.Sleep(10 * time.Millisecond) // let the 0 TTL entry expire into the grace period
+
+	serverConn, clientConn, err = newUDPPair()
+	if err != nil {
+		t.Fatalf("Failed to create UDP connections: %v", err)
+	}
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	go func() {
+		server.handleQuery(ctx, buildDNSQuery("stale.com", 1, 1), clientConn.LocalAddr().(*net.UDPAddr), serverConn)
+		close(firstDone)
+	}()
+
+	deadline = time.Now().Add(time.Second)
+	for !server.refreshes.isRecent("stale.com:1", time.Now()) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the refresh is running, so this one gets the stale answer right away
+	// a new id, the same id would wait for the first query as a resend
+	second = buildDNSQuery("stale.com", 1, 1)
+	binary.BigEndian.PutUint16(second[0:2], 0x4321)
+	server.handleQuery(ctx, second, clientConn.LocalAddr().(*net.UDPAddr), serverConn)
+	ips, err = readAnswerIPs(clientConn)
+	if err != nil {
+		t.Fatalf("Failed to read the stale answer: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(1, 1, 1, 1)) {
+		t.Errorf("Expected the stale answer 1.1.1.1, got %v", ips)
+	}
+
+	select {
+	case <-firstDone:
+		t.Fatal("The first stale hit should wait for the refresh")
+	default:
+	}
+
+	close(resolver.release)
+	<-firstDone
+
+	ips, err = readAnswerIPs(clientConn)
+	if err != nil {
+		t.Fatalf("Failed to read the refreshed answer: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(2, 2, 2, 2)) {
+		t.Errorf("Expected the refreshed answer 2.2.2.2, got %v", ips)
+	}
+}
+
+// TEST 20: Timed rules only block inside their window
+// Tests scheduled blocking with an injected clock
+func TestDNSServer_FilterDomain_TimedRules(t *testing.T) {
+	var (
+		monday15h time.Time = time.Date(2024, time.January, 15, 15, 0, 0, 0, time.Local)
+		config    Config    = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+			TimedRules: []filter.TimedRule{
+				{Domain: "homework-distraction.com", Start: 14 * time.Hour, End: 18 * time.Hour},
+				{Domain: "late-night.com", Start: 22 * time.Hour, End: 6 * time.Hour},
+			},
 		}
+		server *DNSServer
+	)
+
+	server = NewDNSServer(config, &MockResolver{}, nil)
+	server.now = func() time.Time { return monday15h }
+
+	if !server.filterDomain("www.homework-distraction.com") {
+		t.Error("Domain should be blocked inside its window")
+	}
+	if server.filterDomain("late-night.com") {
+		t.Error("Domain should resolve outside its window")
 	}
 
-	if len(domain) > start {
-		labels = append(labels, domain[start:])
+	server.now = func() time.Time { return monday15h.Add(4 * time.Hour) }
+	if server.filterDomain("www.homework-distraction.com") {
+		t.Error("Domain should resolve once the window is over")
 	}
+}
 
-	return labels
+// TEST 21: DO and non-DO queries don't share cache entries
+// Tests that a DNSSEC answer isn't served to a plain query and vice versa
+func TestDNSServer_HandleQuery_DNSSECCacheSeparation(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		resolver   *MockResolver = &MockResolver{response: buildDNSResponse("signed.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		server     *DNSServer
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		clientAddr *net.UDPAddr
+		err        error
+	)
+
+	server = NewDNSServer(config, resolver, nil)
+	serverConn, clientConn, err = newUDPPair()
+	if err != nil {
+		t.Fatalf("Failed to create UDP connections: %v", err)
+	}
+	defer serverConn.Close()
+	defer clientConn.Close()
+	clientAddr = clientConn.LocalAddr().(*net.UDPAddr)
+
+	server.handleQuery(ctx, appendOPT(buildDNSQuery("signed.com", 1, 1), 4096, true), clientAddr, serverConn)
+	server.handleQuery(ctx, buildDNSQuery("signed.com", 1, 1), clientAddr, serverConn)
+
+	if resolver.callCount != 2 {
+		t.Errorf("Expected the plain query to miss the DNSSEC entry, got %d upstream calls", resolver.callCount)
+	}
+
+	server.handleQuery(ctx, appendOPT(buildDNSQuery("signed.com", 1, 1), 4096, true), clientAddr, serverConn)
+	server.handleQuery(ctx, buildDNSQuery("signed.com", 1, 1), clientAddr, serverConn)
+
+	if resolver.callCount != 2 {
+		t.Errorf("Expected both variants to be cached separately, got %d upstream calls", resolver.callCount)
+	}
+}
+
+// TEST 22: Global QPS limit drops the excess
+// Tests that queries past MaxGlobalQPS are dropped until the window moves on
+func TestDNSServer_HandleQuery_GlobalQPSLimit(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:    "127.0.0.1:5353",
+			UpstreamDns:  "8.8.8.8:53",
+			MaxGlobalQPS: 3,
+		}
+		resolver   *MockResolver = &MockResolver{response: buildDNSResponse("flood.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		now        time.Time     = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		server     *DNSServer
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		clientAddr *net.UDPAddr
+		blocked    uint64
+		allowed    uint64
+		i          int
+		err        error
+	)
+
+	server = NewDNSServer(config, resolver, nil)
+	server.now = func() time.Time { return now }
+	serverConn, clientConn, err = newUDPPair()
+	if err != nil {
+		t.Fatalf("Failed to create UDP connections: %v", err)
+	}
+	defer serverConn.Close()
+	defer clientConn.Close()
+	clientAddr = clientConn.LocalAddr().(*net.UDPAddr)
+
+	for i = 0; i < 10; i++ {
+		server.handleQuery(ctx, buildDNSQuery("flood.com", 1, 1), clientAddr, serverConn)
+	}
+
+	blocked, allowed, _, _ = server.statistics.GetStats()
+	if blocked+allowed != 3 {
+		t.Errorf("Expected 3 queries under the limit to be handled, got %d", blocked+allowed)
+	}
+	if server.statistics.RateLimited() != 7 {
+		t.Errorf("Expected 7 queries to be rate limited, got %d", server.statistics.RateLimited())
+	}
+
+	now = now.Add(time.Second)
+	server.handleQuery(ctx, buildDNSQuery("flood.com", 1, 1), clientAddr, serverConn)
+
+	if server.statistics.RateLimited() != 7 {
+		t.Errorf("Expected queries to pass again after the window, got %d limited", server.statistics.RateLimited())
+	}
+}
+
+// TEST 23: Shutdown during a slow refresh doesn't write to the cache
+// Tests that background refreshes are waited for and drop answers arriving after cancel
+func TestDNSServer_RefreshCache_Shutdown(t *testing.T) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+		config Config = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		resolver *StubbornResolver = &StubbornResolver{
+			response: buildDNSResponse("slow.com", 1, 1, 300, []byte{1, 2, 3, 4}),
+			release:  make(chan struct{}),
+		}
+		mockCache *MockCache = NewMockCache()
+		server    *DNSServer
+		query     []byte = buildDNSQuery("slow.com", 1, 1)
+		queryInfo *utils.QueryInfo
+		done      chan struct{} = make(chan struct{})
+		deadline  time.Time
+		err       error
+	)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	server = NewDNSServer(config, resolver, nil)
+	server.cache = mockCache
+
+	queryInfo, err = utils.ParseQuery(query)
+	if err != nil {
+		t.Fatalf("Failed to parse query: %v", err)
+	}
+
+	server.startRefresh(ctx, query, queryInfo)
+	deadline = time.Now().Add(time.Second)
+	for server.statistics.InFlight() == 0 && time.Now().Before(deadline) { // wait for the refresh to reach the upstream
+		time.Sleep(time.Millisecond)
+	}
+	if server.statistics.InFlight() == 0 {
+		t.Fatal("The refresh never reached the upstream")
+	}
+	cancel()
+
+	go func() {
+		server.stopBackground()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Shutdown should wait for the running refresh")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(resolver.release)
+	<-done
+
+	if mockCache.setCallCount != 0 {
+		t.Errorf("Expected no cache write after shutdown, got %d", mockCache.setCallCount)
+	}
+
+	// nothing new starts once the context is gone or the server stopped waiting
+	server.startRefresh(ctx, query, queryInfo)
+	server.startRefresh(context.Background(), query, queryInfo)
+	server.background.Wait()
+	if mockCache.setCallCount != 0 {
+		t.Errorf("Expected no refresh after shutdown, got %d cache writes", mockCache.setCallCount)
+	}
+}
+
+// TEST 24: Fallback snapshot answers when upstream fails
+// Tests that an empty cache plus a failing upstream serves the snapshot answer
+func TestDNSServer_HandleQuery_FallbackSnapshot(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		snapshot *cache.DNSCache = cache.NewDNSCache()
+		filename string          = filepath.Join(t.TempDir(), "snapshot.json")
+		config   Config          = Config{
+			LocalAddr:         "127.0.0.1:5353",
+			UpstreamDns:       "8.8.8.8:53",
+			FallbackCacheFile: filename,
+		}
+		resolver   *MockResolver = &MockResolver{err: errors.New("upstream down")}
+		server     *DNSServer
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		clientAddr *net.UDPAddr
+		query      []byte = buildDNSQuery("offline.com", 1, 1)
+		response   []byte
+		ips        []net.IP
+		err        error
+	)
+
+	snapshot.Set("offline.com:1", buildDNSResponse("offline.com", 1, 1, 300, []byte{5, 6, 7, 8}), 300)
+	if err = snapshot.SaveSnapshot(filename); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+
+	server = NewDNSServer(config, resolver, nil)
+	serverConn, clientConn, err = newUDPPair()
+	if err != nil {
+		t.Fatalf("Failed to create UDP connections: %v", err)
+	}
+	defer serverConn.Close()
+	defer clientConn.Close()
+	clientAddr = clientConn.LocalAddr().(*net.UDPAddr)
+
+	binary.BigEndian.PutUint16(query[0:2], 0xCAFE)
+	server.handleQuery(ctx, query, clientAddr, serverConn)
+
+	response, err = readAnswer(clientConn)
+	if err != nil {
+		t.Fatalf("Expected the fallback answer, got %v", err)
+	}
+	if binary.BigEndian.Uint16(response[0:2]) != 0xCAFE {
+		t.Error("Fallback answer should carry the query id")
+	}
+
+	ips = utils.ExtractAnswers(response)
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(5, 6, 7, 8)) {
+		t.Errorf("Expected 5.6.7.8 from the snapshot, got %v", ips)
+	}
+}
+
+// TEST 25: AAAA gets NODATA without ipv6
+// Tests that SynthesizeNoIPv6 answers AAAA locally with an SOA and still forwards A
+func TestDNSServer_HandleQuery_SynthesizeNoIPv6(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:        "127.0.0.1:5353",
+			UpstreamDns:      "8.8.8.8:53",
+			SynthesizeNoIPv6: true,
+		}
+		resolver   *MockResolver = &MockResolver{response: buildDNSResponse("dual.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		server     *DNSServer
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		clientAddr *net.UDPAddr
+		response   []byte
+		position   int
+		err        error
+	)
+
+	server = NewDNSServer(config, resolver, nil)
+	serverConn, clientConn, err = newUDPPair()
+	if err != nil {
+		t.Fatalf("Failed to create UDP connections: %v", err)
+	}
+	defer serverConn.Close()
+	defer clientConn.Close()
+	clientAddr = clientConn.LocalAddr().(*net.UDPAddr)
+
+	server.handleQuery(ctx, buildDNSQuery("dual.com", utils.TYPE_AAAA, 1), clientAddr, serverConn)
+	response, err = readAnswer(clientConn)
+	if err != nil {
+		t.Fatalf("Failed to read answer: %v", err)
+	}
+
+	if binary.BigEndian.Uint16(response[2:4])&0x000F != 0 {
+		t.Errorf("Expected NOERROR, got rcode %d", binary.BigEndian.Uint16(response[2:4])&0x000F)
+	}
+	if binary.BigEndian.Uint16(response[6:8]) != 0 || binary.BigEndian.Uint16(response[8:10]) != 1 {
+		t.Errorf("Expected no answers and one authority record, got %d and %d",
+			binary.BigEndian.Uint16(response[6:8]), binary.BigEndian.Uint16(response[8:10]))
+	}
+
+	position = 12 + len("dual.com") + 2 + 4 + 2 // question, then the pointer of the SOA owner
+	if binary.BigEndian.Uint16(response[position:position+2]) != utils.TYPE_SOA {
+		t.Error("Expected an SOA in the authority section")
+	}
+	if resolver.callCount != 0 {
+		t.Errorf("AAAA should not be forwarded, got %d upstream calls", resolver.callCount)
+	}
+
+	server.handleQuery(ctx, buildDNSQuery("dual.com", utils.TYPE_A, 1), clientAddr, serverConn)
+	if resolver.callCount != 1 {
+		t.Errorf("A should still be forwarded, got %d upstream calls", resolver.callCount)
+	}
+}
+
+// TEST 26: Listeners filter independently
+// Tests that a domain blocked on the strict listener is resolved on the lenient one
+func TestDNSServer_HandleQuery_PerListenerFilter(t *testing.T) {
+	var (
+		ctx    context.Context    = context.Background()
+		strict *filter.FilterList = filter.NewFilterList()
+		config Config             = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+			Listeners: []Listener{
+				{Addr: "127.0.0.1:5354", FilterMode: "nxdomain", Filter: strict},
+				{Addr: "127.0.0.1:5355", FilterMode: "nxdomain"},
+			},
+		}
+		resolver   *MockResolver = &MockResolver{response: buildDNSResponse("games.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		server     *DNSServer
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		clientAddr *net.UDPAddr
+		response   []byte
+		err        error
+	)
+
+	strict.Add("games.com")
+	server = NewDNSServer(config, resolver, nil)
+	serverConn, clientConn, err = newUDPPair()
+	if err != nil {
+		t.Fatalf("Failed to create UDP connections: %v", err)
+	}
+	defer serverConn.Close()
+	defer clientConn.Close()
+	clientAddr = clientConn.LocalAddr().(*net.UDPAddr)
+
+	if len(server.listeners) != 2 {
+		t.Fatalf("Expected 2 listeners, got %d", len(server.listeners))
+	}
+
+	server.handleListenerQuery(ctx, server.listeners[0], buildDNSQuery("games.com", 1, 1), &udpResponseWriter{conn: serverConn, addr: clientAddr})
+	response, err = readAnswer(clientConn)
+	if err != nil {
+		t.Fatalf("Failed to read answer: %v", err)
+	}
+	if binary.BigEndian.Uint16(response[2:4])&0x000F != 3 {
+		t.Errorf("Expected NXDOMAIN on the strict listener, got rcode %d", binary.BigEndian.Uint16(response[2:4])&0x000F)
+	}
+
+	server.handleListenerQuery(ctx, server.listeners[1], buildDNSQuery("games.com", 1, 1), &udpResponseWriter{conn: serverConn, addr: clientAddr})
+	response, err = readAnswer(clientConn)
+	if err != nil {
+		t.Fatalf("Failed to read answer: %v", err)
+	}
+	if binary.BigEndian.Uint16(response[2:4])&0x000F != 0 || len(utils.ExtractAnswers(response)) != 1 {
+		t.Error("Expected the lenient listener to resolve the domain")
+	}
+	if resolver.callCount != 1 {
+		t.Errorf("Expected only the lenient query upstream, got %d calls", resolver.callCount)
+	}
+}
+
+// TEST 27: Background refreshes are capped
+// Tests that refreshes past MaxBackgroundRefreshes are skipped instead of queued
+func TestDNSServer_StartRefresh_MaxBackgroundRefreshes(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:              "127.0.0.1:5353",
+			UpstreamDns:            "8.8.8.8:53",
+			MaxBackgroundRefreshes: 3,
+		}
+		resolver *ConcurrencyResolver = &ConcurrencyResolver{
+			response: buildDNSResponse("refresh.com", 1, 1, 300, []byte{1, 2, 3, 4}),
+			release:  make(chan struct{}),
+		}
+		server    *DNSServer
+		query     []byte
+		queryInfo *utils.QueryInfo
+		i         int
+		err       error
+	)
+
+	server = NewDNSServer(config, resolver, nil)
+
+	for i = 0; i < 20; i++ {
+		query = buildDNSQuery(fmt.Sprintf("host%d.refresh.com", i), 1, 1)
+		queryInfo, err = utils.ParseQuery(query)
+		if err != nil {
+			t.Fatalf("Failed to parse query: %v", err)
+		}
+		server.startRefresh(ctx, query, queryInfo)
+	}
+
+	for resolver.active.Load() < 3 { // let the running ones reach the upstream
+		time.Sleep(time.Millisecond)
+	}
+	close(resolver.release)
+	server.background.Wait()
+
+	if resolver.peak.Load() > 3 {
+		t.Errorf("Expected at most 3 concurrent upstream calls, got %d", resolver.peak.Load())
+	}
+	if resolver.calls.Load() != 3 {
+		t.Errorf("Expected the extra refreshes to be skipped, got %d upstream calls", resolver.calls.Load())
+	}
+}
+
+// TEST 28: Local names rotate their addresses
+// Tests that successive queries for a hosts name get the addresses in rotated order
+func TestDNSServer_HandleQuery_HostsRoundRobin(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		filename string          = filepath.Join(t.TempDir(), "hosts")
+		config   Config          = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+			HostsFile:   filename,
+		}
+		resolver   *MockResolver = &MockResolver{}
+		server     *DNSServer
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		clientAddr *net.UDPAddr
+		ips        []net.IP
+		firsts     []string
+		i          int
+		err        error
+	)
+
+	if err = os.WriteFile(filename, []byte("10.0.0.1 app.home\n10.0.0.2 app.home\n10.0.0.3 app.home\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write hosts file: %v", err)
+	}
+
+	server = NewDNSServer(config, resolver, nil)
+	serverConn, clientConn, err = newUDPPair()
+	if err != nil {
+		t.Fatalf("Failed to create UDP connections: %v", err)
+	}
+	defer serverConn.Close()
+	defer clientConn.Close()
+	clientAddr = clientConn.LocalAddr().(*net.UDPAddr)
+
+	for i = 0; i < 3; i++ {
+		server.handleQuery(ctx, buildDNSQuery("app.home", 1, 1), clientAddr, serverConn)
+		ips, err = readAnswerIPs(clientConn)
+		if err != nil {
+			t.Fatalf("Failed to read answer: %v", err)
+		}
+		if len(ips) != 3 {
+			t.Fatalf("Expected all 3 addresses, got %v", ips)
+		}
+		firsts = append(firsts, ips[0].String())
+	}
+
+	if strings.Join(firsts, ",") != "10.0.0.1,10.0.0.2,10.0.0.3" {
+		t.Errorf("Expected the first address to rotate, got %v", firsts)
+	}
+	if resolver.callCount != 0 {
+		t.Errorf("Local names should not reach upstream, got %d calls", resolver.callCount)
+	}
+}
+
+// TEST 29: Blocked answers wait for MinResponseDelay
+// Tests that a blocked answer isn't sent early and the wait doesn't hold other queries
+func TestDNSServer_HandleQuery_MinResponseDelay(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		delay  time.Duration   = 200 * time.Millisecond
+		config Config          = Config{
+			LocalAddr:        "127.0.0.1:5353",
+			UpstreamDns:      "8.8.8.8:53",
+			FilterMode:       "nxdomain",
+			MinResponseDelay: delay,
+		}
+		list       *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		clientAddr *net.UDPAddr
+		started    time.Time
+		i          int
+		err        error
+	)
+
+	list.Add("ads.com")
+	server = NewDNSServer(config, &MockResolver{}, list)
+	serverConn, clientConn, err = newUDPPair()
+	if err != nil {
+		t.Fatalf("Failed to create UDP connections: %v", err)
+	}
+	defer serverConn.Close()
+	defer clientConn.Close()
+	clientAddr = clientConn.LocalAddr().(*net.UDPAddr)
+
+	started = time.Now()
+	go server.handleQuery(ctx, buildDNSQuery("ads.com", 1, 1), clientAddr, serverConn)
+	go server.handleQuery(ctx, buildDNSQuery("x.ads.com", 1, 1), clientAddr, serverConn)
+
+	for i = 0; i < 2; i++ {
+		if _, err = readAnswer(clientConn); err != nil {
+			t.Fatalf("Failed to read answer: %v", err)
+		}
+		if time.Since(started) < delay {
+			t.Errorf("Blocked answer sent after %v, before the %v delay", time.Since(started), delay)
+		}
+	}
+
+	if time.Since(started) >= 2*delay {
+		t.Errorf("Delays should run in parallel, both answers took %v", time.Since(started))
+	}
+}
+
+// TEST 30: Reloading the filter purges newly blocked answers
+// Tests that cached answers of a domain blocked by the new list are dropped
+func TestDNSServer_ReloadFilter_PurgesBlocked(t *testing.T) {
+	var (
+		config Config = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		list    *filter.FilterList = filter.NewFilterList()
+		server  *DNSServer
+		removed int
+		found   bool
+	)
+
+	list.Add("ads.com")
+	server = NewDNSServer(config, &MockResolver{}, list)
+	server.cache.Set("tracker.com:1", buildDNSResponse("tracker.com", 1, 1, 300, []byte{1, 2, 3, 4}), 300)
+	server.cache.Set("tracker.com:28", buildDNSResponse("tracker.com", 28, 1, 300, make([]byte, 16)), 300)
+	server.cache.Set("example.com:1", buildDNSResponse("example.com", 1, 1, 300, []byte{5, 6, 7, 8}), 300)
+
+	list = filter.NewFilterList()
+	list.Add("tracker.com")
+	removed = server.ReloadFilter(list)
+
+	if removed != 2 {
+		t.Errorf("Expected 2 entries purged, got %d", removed)
+	}
+	if _, found, _ = server.cache.Get("tracker.com:1"); found {
+		t.Error("Expected the newly blocked answer to be purged")
+	}
+	if _, found, _ = server.cache.Get("example.com:1"); !found {
+		t.Error("Expected the allowed answer to stay cached")
+	}
+	if !server.filterDomain("tracker.com") || server.filterDomain("ads.com") {
+		t.Error("Expected the new list to replace the old one")
+	}
+}
+
+// TEST 31: Answers always carry RA and the client's RD
+// Tests that blocked, forwarded and cached answers set RA and echo RD
+func TestDNSServer_HandleQuery_RecursionFlags(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+			FilterMode:  "nxdomain",
+		}
+		upstream   []byte             = buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+		list       *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		clientAddr *net.UDPAddr
+		noRD       []byte = buildDNSQuery("example.com", 1, 1)
+		response   []byte
+		flags      uint16
+		err        error
+	)
+	binary.BigEndian.PutUint16(upstream[2:4], 0x8100) // upstream without RA
+	binary.BigEndian.PutUint16(noRD[2:4], 0)
+	list.Add("ads.com")
+
+	server = NewDNSServer(config, &MockResolver{response: upstream}, list)
+	serverConn, clientConn, err = newUDPPair()
+	if err != nil {
+		t.Fatalf("Failed to create UDP connections: %v", err)
+	}
+	defer serverConn.Close()
+	defer clientConn.Close()
+	clientAddr = clientConn.LocalAddr().(*net.UDPAddr)
+
+	var tests = []struct {
+		name  string
+		query []byte
+		flags uint16
+	}{
+		{"blocked", buildDNSQuery("ads.com", 1, 1), 0x8183},
+		{"forwarded", buildDNSQuery("example.com", 1, 1), 0x8180},
+		{"cached without RD", noRD, 0x8080},
+	}
+
+	for _, test := range tests {
+		server.handleQuery(ctx, test.query, clientAddr, serverConn)
+		response, err = readAnswer(clientConn)
+		if err != nil {
+			t.Fatalf("%s: failed to read answer: %v", test.name, err)
+		}
+
+		if flags = binary.BigEndian.Uint16(response[2:4]); flags != test.flags {
+			t.Errorf("%s: expected flags 0x%04X, got 0x%04X", test.name, test.flags, flags)
+		}
+	}
+
+	if binary.BigEndian.Uint16(upstream[2:4]) != 0x8100 {
+		t.Error("The upstream answer shouldn't be modified in place")
+	}
+}
+
+// TEST 32: Paused blocking resumes on its own
+// Tests that a blocked domain is allowed during the pause and blocked after it
+func TestDNSServer_FilterDomain_PauseBlocking(t *testing.T) {
+	var (
+		config Config = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		list   *filter.FilterList = filter.NewFilterList()
+		server *DNSServer
+		now    time.Time = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	)
+	list.Add("ads.com")
+	server = NewDNSServer(config, &MockResolver{}, list)
+	server.now = func() time.Time { return now }
+
+	server.PauseBlocking(5 * time.Minute)
+	if server.filterDomain("ads.com") {
+		t.Error("Expected ads.com to be allowed while blocking is paused")
+	}
+	if server.PauseRemaining() != 5*time.Minute {
+		t.Errorf("Expected 5m left, got %v", server.PauseRemaining())
+	}
+
+	now = now.Add(5*time.Minute + time.Second)
+	if !server.filterDomain("ads.com") {
+		t.Error("Expected ads.com to be blocked once the pause is over")
+	}
+	if server.PauseRemaining() != 0 {
+		t.Errorf("Expected no pause left, got %v", server.PauseRemaining())
+	}
+}
+
+// TEST 33: Queries without RD are counted, and refused when configured
+// Tests that RD=0 queries are forwarded by default and get REFUSED with RefuseNonRecursive
+func TestDNSServer_HandleQuery_NonRecursive(t *testing.T) {
+	var tests = []struct {
+		name      string
+		refuse    bool
+		flags     uint16
+		upstreams int
+	}{
+		{"forwarded by default", false, 0x8080, 1},
+		{"refused when configured", true, 0x8085, 0},
+	}
+
+	for _, test := range tests {
+		var (
+			ctx    context.Context = context.Background()
+			config Config          = Config{
+				LocalAddr:          "127.0.0.1:5353",
+				UpstreamDns:        "8.8.8.8:53",
+				FilterMode:         "nxdomain",
+				RefuseNonRecursive: test.refuse,
+			}
+			resolver   *MockResolver = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+			server     *DNSServer    = NewDNSServer(config, resolver, filter.NewFilterList())
+			serverConn *net.UDPConn
+			clientConn *net.UDPConn
+			noRD       []byte = buildDNSQuery("example.com", 1, 1)
+			response   []byte
+			flags      uint16
+			err        error
+		)
+		binary.BigEndian.PutUint16(noRD[2:4], 0)
+
+		serverConn, clientConn, err = newUDPPair()
+		if err != nil {
+			t.Fatalf("Failed to create UDP connections: %v", err)
+		}
+
+		server.handleQuery(ctx, noRD, clientConn.LocalAddr().(*net.UDPAddr), serverConn)
+		response, err = readAnswer(clientConn)
+		if err != nil {
+			t.Fatalf("%s: failed to read answer: %v", test.name, err)
+		}
+
+		if flags = binary.BigEndian.Uint16(response[2:4]); flags != test.flags {
+			t.Errorf("%s: expected flags 0x%04X, got 0x%04X", test.name, test.flags, flags)
+		}
+		if resolver.callCount != test.upstreams {
+			t.Errorf("%s: expected %d upstream queries, got %d", test.name, test.upstreams, resolver.callCount)
+		}
+		if server.statistics.NonRecursive() != 1 {
+			t.Errorf("%s: expected 1 non recursive query counted, got %d", test.name, server.statistics.NonRecursive())
+		}
+
+		// queries with RD aren't counted
+		server.handleQuery(ctx, buildDNSQuery("example.com", 1, 1), clientConn.LocalAddr().(*net.UDPAddr), serverConn)
+		if server.statistics.NonRecursive() != 1 {
+			t.Errorf("%s: expected recursive queries not to be counted, got %d", test.name, server.statistics.NonRecursive())
+		}
+
+		serverConn.Close()
+		clientConn.Close()
+	}
+}
+
+// TEST 34: Null answers point at the resolved sinkhole host
+// Tests that SinkholeHost is resolved through the upstream and 0.0.0.0 is used when it can't be
+func TestDNSServer_HandleQuery_SinkholeHost(t *testing.T) {
+	var tests = []struct {
+		name     string
+		upstream *MockResolver
+		expected net.IP
+	}{
+		{"resolved", &MockResolver{response: buildDNSResponse("block.example.com", 1, 1, 300, []byte{192, 0, 2, 10})}, net.IPv4(192, 0, 2, 10)},
+		{"lookup failed", &MockResolver{err: fmt.Errorf("upstream down")}, net.IPv4zero},
+	}
+
+	for _, test := range tests {
+		var (
+			ctx    context.Context = context.Background()
+			config Config          = Config{
+				LocalAddr:    "127.0.0.1:5353",
+				UpstreamDns:  "8.8.8.8:53",
+				FilterMode:   "null",
+				SinkholeHost: "block.example.com",
+			}
+			list       *filter.FilterList = filter.NewFilterList()
+			server     *DNSServer
+			serverConn *net.UDPConn
+			clientConn *net.UDPConn
+			ips        []net.IP
+			err        error
+		)
+		list.Add("ads.com")
+		server = NewDNSServer(config, test.upstream, list)
+		server.resolveSinkhole(ctx)
+
+		serverConn, clientConn, err = newUDPPair()
+		if err != nil {
+			t.Fatalf("Failed to create UDP connections: %v", err)
+		}
+
+		server.handleQuery(ctx, buildDNSQuery("ads.com", 1, 1), clientConn.LocalAddr().(*net.UDPAddr), serverConn)
+		ips, err = readAnswerIPs(clientConn)
+		serverConn.Close()
+		clientConn.Close()
+		if err != nil {
+			t.Fatalf("%s: failed to read answer: %v", test.name, err)
+		}
+
+		if len(ips) != 1 || !ips[0].Equal(test.expected) {
+			t.Errorf("%s: expected the blocked answer to point at %v, got %v", test.name, test.expected, ips)
+		}
+	}
+}
+
+// TEST 35: CNAME chain targets are cached with the chain
+// Tests that after a.cdn.example CNAME b.cdn.example a query for b.cdn.example is a cache hit
+func TestDNSServer_HandleQuery_CacheCNAMEChains(t *testing.T) {
+	var tests = []struct {
+		name      string
+		enabled   bool
+		upstreams int
+	}{
+		{"enabled", true, 1},
+		{"disabled", false, 2},
+	}
+
+	for _, test := range tests {
+		var (
+			ctx   context.Context = context.Background()
+			chain utils.Message   = utils.Message{
+				Header:    utils.Header{ID: 1, Flags: 0x8180},
+				Questions: []utils.Question{{Name: "a.cdn.example", Type: utils.TYPE_A, Class: 1}},
+				Answers: []utils.ResourceRecord{
+					{Name: "a.cdn.example", Type: utils.TYPE_CNAME, Class: 1, TTL: 300, Data: utils.EncodeName("b.cdn.example")},
+					{Name: "b.cdn.example", Type: utils.TYPE_A, Class: 1, TTL: 120, Data: []byte{192, 0, 2, 7}},
+				},
+			}
+			resolver   *MockResolver = &MockResolver{response: chain.Pack()}
+			server     *DNSServer
+			serverConn *net.UDPConn
+			clientConn *net.UDPConn
+			response   []byte
+			message    *utils.Message
+			err        error
+		)
+		server = NewDNSServer(Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", CacheCNAMEChains: test.enabled}, resolver, filter.NewFilterList())
+
+		serverConn, clientConn, err = newUDPPair()
+		if err != nil {
+			t.Fatalf("Failed to create UDP connections: %v", err)
+		}
+
+		server.handleQuery(ctx, buildDNSQuery("a.cdn.example", 1, 1), clientConn.LocalAddr().(*net.UDPAddr), serverConn)
+		if _, err = readAnswer(clientConn); err != nil {
+			t.Fatalf("%s: failed to read the chain answer: %v", test.name, err)
+		}
+
+		server.handleQuery(ctx, buildDNSQuery("b.cdn.example", 1, 1), clientConn.LocalAddr().(*net.UDPAddr), serverConn)
+		response, err = readAnswer(clientConn)
+		serverConn.Close()
+		clientConn.Close()
+		if err != nil {
+			t.Fatalf("%s: failed to read the target answer: %v", test.name, err)
+		}
+
+		if resolver.callCount != test.upstreams {
+			t.Errorf("%s: expected %d upstream queries, got %d", test.name, test.upstreams, resolver.callCount)
+		}
+		if !test.enabled {
+			continue
+		}
+
+		if message, err = utils.ParseResponse(response); err != nil {
+			t.Fatalf("%s: failed to parse the target answer: %v", test.name, err)
+		}
+		if message.Questions[0].Name != "b.cdn.example" {
+			t.Errorf("%s: expected the question for b.cdn.example, got %q", test.name, message.Questions[0].Name)
+		}
+		if len(message.Answers) != 1 || !bytes.Equal(message.Answers[0].Data, []byte{192, 0, 2, 7}) {
+			t.Errorf("%s: expected only the A record of the target, got %+v", test.name, message.Answers)
+		}
+	}
+}
+
+// TEST 36: Amplified udp answers are limited per client
+// Tests that a small query with a large answer is dropped after MaxAmplifiedPerClient, unless the client is allowlisted
+func TestDNSServer_HandleQuery_AmplificationLimit(t *testing.T) {
+	var tests = []struct {
+		name      string
+		allowlist []string
+		answered  int
+	}{
+		{"limited after the threshold", nil, 3},
+		{"allowlisted client", []string{"127.0.0.0/8"}, 5},
+	}
+
+	for _, test := range tests {
+		var (
+			ctx    context.Context = context.Background()
+			config Config          = Config{
+				LocalAddr:              "127.0.0.1:5353",
+				UpstreamDns:            "8.8.8.8:53",
+				FilterMode:             "nxdomain",
+				AmplificationFactor:    10,
+				MaxAmplifiedPerClient:  3,
+				AmplificationAllowlist: test.allowlist,
+			}
+			resolver   *MockResolver = &MockResolver{response: buildDNSResponse("example.com", 16, 1, 300, bytes.Repeat([]byte{'a'}, 400))}
+			server     *DNSServer    = NewDNSServer(config, resolver, filter.NewFilterList())
+			serverConn *net.UDPConn
+			clientConn *net.UDPConn
+			query      []byte = buildDNSQuery("example.com", 16, 1)
+			err        error
+			i          int
+		)
+
+		serverConn, clientConn, err = newUDPPair()
+		if err != nil {
+			t.Fatalf("Failed to create UDP connections: %v", err)
+		}
+
+		for i = 0; i < 5; i++ {
+			server.handleQuery(ctx, query, clientConn.LocalAddr().(*net.UDPAddr), serverConn)
+		}
+
+		for i = 0; i < test.answered; i++ {
+			if _, err = readAnswer(clientConn); err != nil {
+				t.Fatalf("%s: failed to read answer %d: %v", test.name, i+1, err)
+			}
+		}
+		if server.statistics.AmplificationLimited() != uint64(5-test.answered) {
+			t.Errorf("%s: expected %d limited answers, got %d", test.name, 5-test.answered, server.statistics.AmplificationLimited())
+		}
+
+		// small answers aren't limited
+		resolver.response = buildDNSResponse("small.com", 1, 1, 300, []byte{1, 2, 3, 4})
+		server.handleQuery(ctx, buildDNSQuery("small.com", 1, 1), clientConn.LocalAddr().(*net.UDPAddr), serverConn)
+		if _, err = readAnswer(clientConn); err != nil {
+			t.Errorf("%s: small answer wasn't sent: %v", test.name, err)
+		}
+
+		serverConn.Close()
+		clientConn.Close()
+	}
+}
+
+// TEST 37: The AD bit of upstream answers reaches the client
+// Tests that AD is kept on forwarded and cached answers and cleared when a rewrite changed the answer
+func TestDNSServer_HandleQuery_AuthenticatedData(t *testing.T) {
+	var tests = []struct {
+		name     string
+		rewrites []RewriteRule
+		ad       bool
+	}{
+		{"forwarded unmodified", nil, true},
+		{"rewritten answer", []RewriteRule{{Domain: "example.com", QType: utils.TYPE_A, Answer: net.ParseIP("10.0.0.5")}}, false},
+	}
+
+	for _, test := range tests {
+		var (
+			ctx    context.Context = context.Background()
+			config Config          = Config{
+				LocalAddr:    "127.0.0.1:5353",
+				UpstreamDns:  "8.8.8.8:53",
+				FilterMode:   "nxdomain",
+				RewriteRules: test.rewrites,
+			}
+			upstream   []byte        = buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+			resolver   *MockResolver = &MockResolver{response: upstream}
+			server     *DNSServer    = NewDNSServer(config, resolver, filter.NewFilterList())
+			serverConn *net.UDPConn
+			clientConn *net.UDPConn
+			response   []byte
+			err        error
+			i          int
+		)
+		upstream[3] |= 0x20 // AD
+
+		serverConn, clientConn, err = newUDPPair()
+		if err != nil {
+			t.Fatalf("Failed to create UDP connections: %v", err)
+		}
+
+		// the first answer comes from upstream, the second from the cache
+		for i = 0; i < 2; i++ {
+			server.handleQuery(ctx, buildDNSQuery("example.com", 1, 1), clientConn.LocalAddr().(*net.UDPAddr), serverConn)
+			if response, err = readAnswer(clientConn); err != nil {
+				t.Fatalf("%s: failed to read answer %d: %v", test.name, i+1, err)
+			}
+			if utils.AuthenticatedData(response) != test.ad {
+				t.Errorf("%s: answer %d expected AD %v, got flags 0x%04X", test.name, i+1, test.ad, binary.BigEndian.Uint16(response[2:4]))
+			}
+		}
+		if resolver.callCount != 1 {
+			t.Errorf("%s: expected the second answer from the cache, got %d upstream queries", test.name, resolver.callCount)
+		}
+
+		serverConn.Close()
+		clientConn.Close()
+	}
+}
+
+// TEST 38: Udp answers fit the buffer negotiated with the client
+// Tests that a mid-size answer is truncated for a client advertising 512 and sent whole for 1232
+func TestDNSServer_HandleQuery_EDNSBufferSize(t *testing.T) {
+	var tests = []struct {
+		name      string
+		udpSize   uint16
+		truncated bool
+	}{
+		{"client advertising 512", 512, true},
+		{"client advertising 1232", 1232, false},
+	}
+
+	for _, test := range tests {
+		var (
+			ctx    context.Context = context.Background()
+			config Config          = Config{
+				LocalAddr:   "127.0.0.1:5353",
+				UpstreamDns: "8.8.8.8:53",
+				FilterMode:  "nxdomain",
+			}
+			resolver   *MockResolver = &MockResolver{response: appendOPT(buildDNSResponse("example.com", 16, 1, 300, make([]byte, 800)), 4096, false)}
+			server     *DNSServer    = NewDNSServer(config, resolver, filter.NewFilterList())
+			serverConn *net.UDPConn
+			clientConn *net.UDPConn
+			response   []byte
+			message    *utils.Message
+			err        error
+		)
+
+		serverConn, clientConn, err = newUDPPair()
+		if err != nil {
+			t.Fatalf("Failed to create UDP connections: %v", err)
+		}
+
+		server.handleQuery(ctx, appendOPT(buildDNSQuery("example.com", 16, 1), test.udpSize, false), clientConn.LocalAddr().(*net.UDPAddr), serverConn)
+		if response, err = readAnswer(clientConn); err != nil {
+			t.Fatalf("%s: failed to read answer: %v", test.name, err)
+		}
+		if len(response) > int(test.udpSize) {
+			t.Errorf("%s: answer of %d bytes doesn't fit %d", test.name, len(response), test.udpSize)
+		}
+
+		if message, err = utils.ParseResponse(response); err != nil {
+			t.Fatalf("%s: failed to parse answer: %v", test.name, err)
+		}
+		if message.Header.Truncated() != test.truncated {
+			t.Errorf("%s: expected TC %v, got %v", test.name, test.truncated, message.Header.Truncated())
+		}
+		if test.truncated == (len(message.Answers) != 0) {
+			t.Errorf("%s: got %d answers with TC %v", test.name, len(message.Answers), message.Header.Truncated())
+		}
+		if len(message.Additional) != 1 || message.Additional[0].Class != uint16(UDP_DEFAULT_MAX_SIZE) {
+			t.Errorf("%s: expected our OPT record to advertise %d, got %v", test.name, UDP_DEFAULT_MAX_SIZE, message.Additional)
+		}
+
+		serverConn.Close()
+		clientConn.Close()
+	}
+}
+
+// TEST 39: Addresses of multi record answers are shuffled when configured
+// Tests that with ShuffleAnswers the first address varies across answers and every address is kept
+func TestDNSServer_HandleQuery_ShuffleAnswers(t *testing.T) {
+	var tests = []struct {
+		name    string
+		shuffle bool
+	}{
+		{"shuffled", true},
+		{"upstream order by default", false},
+	}
+
+	for _, test := range tests {
+		var (
+			ctx    context.Context = context.Background()
+			config Config          = Config{
+				LocalAddr:      "127.0.0.1:5353",
+				UpstreamDns:    "8.8.8.8:53",
+				FilterMode:     "nxdomain",
+				ShuffleAnswers: test.shuffle,
+			}
+			upstream []byte = utils.CreateRecordsResponse(buildDNSQuery("example.com", 1, 1), []utils.Record{
+				{Type: utils.TYPE_A, TTL: 300, Data: []byte{10, 0, 0, 1}},
+				{Type: utils.TYPE_A, TTL: 300, Data: []byte{10, 0, 0, 2}},
+				{Type: utils.TYPE_A, TTL: 300, Data: []byte{10, 0, 0, 3}},
+				{Type: utils.TYPE_A, TTL: 300, Data: []byte{10, 0, 0, 4}},
+			})
+			resolver   *MockResolver   = &MockResolver{response: upstream}
+			server     *DNSServer      = NewDNSServer(config, resolver, filter.NewFilterList())
+			firsts     map[string]bool = make(map[string]bool)
+			serverConn *net.UDPConn
+			clientConn *net.UDPConn
+			ips        []net.IP
+			err        error
+			i          int
+		)
+
+		serverConn, clientConn, err = newUDPPair()
+		if err != nil {
+			t.Fatalf("Failed to create UDP connections: %v", err)
+		}
+
+		// the first answer comes from upstream, the others from the cache
+		for i = 0; i < 20; i++ {
+			server.handleQuery(ctx, buildDNSQuery("example.com", 1, 1), clientConn.LocalAddr().(*net.UDPAddr), serverConn)
+			if ips, err = readAnswerIPs(clientConn); err != nil {
+				t.Fatalf("%s: failed to read answer %d: %v", test.name, i+1, err)
+			}
+			if len(ips) != 4 {
+				t.Fatalf("%s: expected 4 addresses, got %v", test.name, ips)
+			}
+			firsts[ips[0].String()] = true
+		}
+
+		if test.shuffle && len(firsts) < 2 {
+			t.Errorf("%s: expected the first address to vary, always got %v", test.name, firsts)
+		}
+		if !test.shuffle && (len(firsts) != 1 || !firsts["10.0.0.1"]) {
+			t.Errorf("%s: expected the upstream order, got first addresses %v", test.name, firsts)
+		}
+
+		serverConn.Close()
+		clientConn.Close()
+	}
+}
+
+// TEST 40: Strict validation rejects answers for other names
+// Tests that with StrictAnswerValidation an answer record outside the question's CNAME chain is rejected
+func TestDNSServer_QueryUpstream_StrictAnswerValidation(t *testing.T) {
+	var (
+		offName []byte = renameAnswer(buildDNSResponse("example.com", 1, 1, 300, []byte{6, 6, 6, 6}), 0, "evil.com")
+		// example.com CNAME cdn.example.net, cdn.example.net A 1.2.3.4
+		chained []byte = appendAnswer(
+			utils.CreateAnswerResponse(buildDNSQuery("example.com", 1, 1), utils.TYPE_CNAME, 300, utils.EncodeName("cdn.example.net")),
+			"cdn.example.net", utils.TYPE_A, []byte{1, 2, 3, 4})
+	)
+	var tests = []struct {
+		name     string
+		strict   bool
+		upstream []byte
+		rejected bool
+	}{
+		{"off-name answer, strict", true, offName, true},
+		{"off-name answer, default", false, offName, false},
+		{"cname chain, strict", true, chained, false},
+	}
+
+	for _, test := range tests {
+		var (
+			config    Config     = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", StrictAnswerValidation: test.strict}
+			server    *DNSServer = NewDNSServer(config, &MockResolver{response: test.upstream}, nil)
+			queryInfo *utils.QueryInfo
+			found     bool
+			err       error
+		)
+		if queryInfo, err = utils.ParseQuery(buildDNSQuery("example.com", 1, 1)); err != nil {
+			t.Fatalf("Failed to parse query: %v", err)
+		}
+
+		_, err = server.queryUpstream(context.Background(), buildDNSQuery("example.com", 1, 1), queryInfo)
+		if (err != nil) != test.rejected {
+			t.Errorf("%s: expected rejected %v, got error %v", test.name, test.rejected, err)
+		}
+		if _, found, _ = server.getCache(queryInfo.CacheKey, queryInfo.Domain); found == test.rejected {
+			t.Errorf("%s: expected cached %v", test.name, !test.rejected)
+		}
+	}
+}
+
+// TEST 41: Configured TXT records are answered locally
+// Tests that a multi string TXT name is answered without upstream and its chunks decode back
+func TestDNSServer_HandleQuery_TxtRecords(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		long   string          = strings.Repeat("k", 300)
+		config Config          = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+			FilterMode:  "nxdomain",
+			TxtRecords:  map[string][]string{"_verify.example.com.": {"token=abc", long}},
+		}
+		resolver   *MockResolver = &MockResolver{response: buildDNSResponse("_verify.example.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		server     *DNSServer    = NewDNSServer(config, resolver, filter.NewFilterList())
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		answer     []byte
+		message    *utils.Message
+		chunks     []string
+		err        error
+	)
+
+	serverConn, clientConn, err = newUDPPair()
+	if err != nil {
+		t.Fatalf("Failed to create UDP connections: %v", err)
+	}
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	server.handleQuery(ctx, buildDNSQuery("_Verify.Example.com", utils.TYPE_TXT, 1), clientConn.LocalAddr().(*net.UDPAddr), serverConn)
+	if answer, err = readAnswer(clientConn); err != nil {
+		t.Fatalf("Failed to read answer: %v", err)
+	}
+	if message, err = utils.ParseResponse(answer); err != nil {
+		t.Fatalf("Failed to parse answer: %v", err)
+	}
+	if len(message.Answers) != 1 || message.Answers[0].Type != utils.TYPE_TXT {
+		t.Fatalf("Expected one TXT record, got %+v", message.Answers)
+	}
+	if chunks = decodeCharacterStrings(message.Answers[0].Data); len(chunks) != 3 {
+		t.Fatalf("Expected 3 character-strings, got %d", len(chunks))
+	}
+	if chunks[0] != "token=abc" || chunks[1] != long[:255] || chunks[2] != long[255:] {
+		t.Errorf("Unexpected character-strings %q", chunks)
+	}
+	if resolver.callCount != 0 {
+		t.Errorf("Expected no upstream query, got %d", resolver.callCount)
+	}
+
+	// the other types of the name still go upstream
+	server.handleQuery(ctx, buildDNSQuery("_verify.example.com", utils.TYPE_A, 1), clientConn.LocalAddr().(*net.UDPAddr), serverConn)
+	if _, err = readAnswer(clientConn); err != nil {
+		t.Fatalf("Failed to read answer: %v", err)
+	}
+	if resolver.callCount != 1 {
+		t.Errorf("Expected the A query upstream, got %d calls", resolver.callCount)
+	}
+}
+
+// TEST 42: Failed writes to the client are counted
+// Tests that an answer written to a closed socket bumps WriteErrors instead of panicking
+func TestDNSServer_HandleQuery_WriteError(t *testing.T) {
+	var (
+		ctx        context.Context = context.Background()
+		config     Config          = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", FilterMode: "nxdomain"}
+		resolver   *MockResolver   = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		server     *DNSServer      = NewDNSServer(config, resolver, filter.NewFilterList())
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		err        error
+	)
+
+	serverConn, clientConn, err = newUDPPair()
+	if err != nil {
+		t.Fatalf("Failed to create UDP connections: %v", err)
+	}
+	defer clientConn.Close()
+	serverConn.Close()
+
+	server.handleQuery(ctx, buildDNSQuery("example.com", 1, 1), clientConn.LocalAddr().(*net.UDPAddr), serverConn)
+
+	if server.statistics.WriteErrors() != 1 {
+		t.Errorf("Expected 1 write error, got %d", server.statistics.WriteErrors())
+	}
+}
+
+// TEST 43: Answers are cached per client subnet with ForwardClientSubnet
+// Tests that clients in different subnets get their own upstream answer and clients in the same subnet share it
+func TestDNSServer_HandleQuery_ForwardClientSubnet(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:           "127.0.0.1:5353",
+			UpstreamDns:         "8.8.8.8:53",
+			FilterMode:          "nxdomain",
+			ForwardClientSubnet: true,
+		}
+		resolver *subnetResolver = &subnetResolver{}
+		server   *DNSServer      = NewDNSServer(config, resolver, filter.NewFilterList())
+		tests                    = []struct {
+			client   string
+			expected net.IP
+			calls    int
+		}{
+			{"10.1.1.5", net.IPv4(10, 1, 1, 0), 1},
+			{"10.2.2.5", net.IPv4(10, 2, 2, 0), 2},
+			{"10.1.1.77", net.IPv4(10, 1, 1, 0), 2}, // same /24 as the first one, from the cache
+		}
+		writer  *recordingWriter
+		message *utils.Message
+		ips     []net.IP
+		err     error
+	)
+
+	for _, test := range tests {
+		writer = &recordingWriter{addr: &net.UDPAddr{IP: net.ParseIP(test.client), Port: 5000}}
+		server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("cdn.example.com", 1, 1), writer)
+
+		if len(writer.responses) != 1 {
+			t.Fatalf("%s: expected one answer, got %d", test.client, len(writer.responses))
+		}
+		if ips = utils.ExtractAnswers(writer.responses[0]); len(ips) != 1 || !ips[0].Equal(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.client, test.expected, ips)
+		}
+		if resolver.calls != test.calls {
+			t.Errorf("%s: expected %d upstream queries, got %d", test.client, test.calls, resolver.calls)
+		}
+		if message, err = utils.ParseResponse(writer.responses[0]); err != nil {
+			t.Fatalf("%s: failed to parse the answer: %v", test.client, err)
+		}
+		for _, record := range message.Additional {
+			if record.Type == utils.TYPE_OPT && len(record.Data) != 0 {
+				t.Errorf("%s: expected the ECS echo to be removed, got %v", test.client, record.Data)
+			}
+		}
+	}
+}
+
+// TEST 44: Prefetch outcomes are counted by the cache
+// Tests that a successful and a failing background refresh bump their own counters
+func TestDNSServer_RefreshCache_PrefetchStats(t *testing.T) {
+	var (
+		ctx       context.Context  = context.Background()
+		config    Config           = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}
+		query     []byte           = buildDNSQuery("example.com", 1, 1)
+		resolver  *MockResolver    = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		server    *DNSServer       = NewDNSServer(config, resolver, filter.NewFilterList())
+		queryInfo *utils.QueryInfo = &utils.QueryInfo{Domain: "example.com", CacheKey: "example.com:1", QType: 1, QClass: 1}
+		stats     cache.CacheStats
+	)
+
+	server.refreshCache(ctx, query, queryInfo)
+
+	resolver.response = nil
+	resolver.err = errors.New("upstream down")
+	server.refreshCache(ctx, query, queryInfo)
+
+	stats = server.cache.(*cache.DNSCache).Stats()
+	if stats.PrefetchAttempts != 2 || stats.PrefetchSuccesses != 1 || stats.PrefetchFailures != 1 {
+		t.Errorf("Expected 2 attempts, 1 success and 1 failure, got %+v", stats)
+	}
+}
+
+// TEST 45: Non-QUERY opcodes are answered NOTIMP
+// Tests that an UPDATE gets NOTIMP with its opcode echoed, never reaches the upstream and is counted
+func TestDNSServer_HandleQuery_NotImplementedOpcode(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		config   Config          = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", FilterMode: "nxdomain"}
+		resolver *MockResolver   = &MockResolver{response: buildDNSResponse("example.com", 6, 1, 300, nil)}
+		server   *DNSServer      = NewDNSServer(config, resolver, filter.NewFilterList())
+		writer   *recordingWriter
+		query    []byte = buildDNSQuery("example.com", 6, 1)
+		flags    uint16
+	)
+	query[2] = (query[2] & 0x87) | 5<<3 // UPDATE
+
+	writer = &recordingWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}}
+	server.handleListenerQuery(ctx, server.mainListener(), query, writer)
+
+	if len(writer.responses) != 1 {
+		t.Fatalf("Expected one answer, got %d", len(writer.responses))
+	}
+	flags = binary.BigEndian.Uint16(writer.responses[0][2:4])
+	if flags&0x8000 == 0 || flags&0x000F != uint16(RCODE_NOTIMP) || (flags>>11)&0x0F != 5 {
+		t.Errorf("Expected a NOTIMP answer with opcode 5, got flags %#04x", flags)
+	}
+	if resolver.callCount != 0 {
+		t.Errorf("Expected no upstream call, got %d", resolver.callCount)
+	}
+	if server.statistics.NotImplemented() != 1 {
+		t.Errorf("Expected 1 not implemented query, got %d", server.statistics.NotImplemented())
+	}
+
+	// a standard query still goes through
+	writer.responses = nil
+	server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("example.com", 6, 1), writer)
+	if resolver.callCount != 1 || server.statistics.NotImplemented() != 1 {
+		t.Errorf("Expected the QUERY to be resolved, got %d calls", resolver.callCount)
+	}
+}
+
+// TEST 46: Stale answers keep being served while the refresh cap is full
+// Tests that queries for many stale domains all get their cached answer and only MaxBackgroundRefreshes reach the upstream
+func TestDNSServer_HandleQuery_StaleWhileRefreshCapped(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:              "127.0.0.1:5353",
+			UpstreamDns:            "8.8.8.8:53",
+			MaxBackgroundRefreshes: 2,
+		}
+		resolver *ConcurrencyResolver = &ConcurrencyResolver{
+			response: buildDNSResponse("hot.com", 1, 1, 300, []byte{2, 2, 2, 2}),
+			release:  make(chan struct{}),
+		}
+		server *DNSServer = NewDNSServer(config, resolver, nil)
+		writer *recordingWriter
+		domain string
+		ips    []net.IP
+		i      int
+	)
+	for i = 0; i < 10; i++ {
+		domain = fmt.Sprintf("host%d.hot.com", i)
+		server.cache.Set(domain+":1", buildDNSResponse(domain, 1, 1, 0, []byte{1, 1, 1, byte(i)}), 0)
+	}
+	time.Sleep(10 * time.Millisecond) // let the 0 TTL entries expire into the grace period
+
+	for i = 0; i < 10; i++ {
+		domain = fmt.Sprintf("host%d.hot.com", i)
+		writer = &recordingWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}}
+		server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery(domain, 1, 1), writer)
+
+		if len(writer.responses) != 1 {
+			t.Fatalf("%s: expected one answer, got %d", domain, len(writer.responses))
+		}
+		if ips = utils.ExtractAnswers(writer.responses[0]); len(ips) != 1 || !ips[0].Equal(net.IPv4(1, 1, 1, byte(i))) {
+			t.Errorf("%s: expected the stale answer, got %v", domain, ips)
+		}
+	}
+
+	for resolver.active.Load() < 2 { // let the running ones reach the upstream
+		time.Sleep(time.Millisecond)
+	}
+	close(resolver.release)
+	server.background.Wait()
+
+	if resolver.peak.Load() > 2 || resolver.calls.Load() != 2 {
+		t.Errorf("Expected 2 upstream refreshes at most 2 at a time, got %d calls and a peak of %d", resolver.calls.Load(), resolver.peak.Load())
+	}
+}
+
+// TEST 47: Corrupt queries get FORMERR, truncated ones are dropped
+// Tests that ParseQuery's sentinel errors decide between answering FORMERR and staying silent
+func TestDNSServer_HandleQuery_MalformedQueries(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		config   Config          = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", FilterMode: "nxdomain"}
+		resolver *MockResolver   = &MockResolver{}
+		server   *DNSServer      = NewDNSServer(config, resolver, filter.NewFilterList())
+		valid    []byte          = buildDNSQuery("example.com", 1, 1)
+		corrupt  []byte          = append([]byte(nil), valid...)
+		writer   *recordingWriter
+	)
+	corrupt[12] = 0x50 // label length 80
+
+	var tests = []struct {
+		name    string
+		query   []byte
+		formerr bool
+	}{
+		{"corrupt label", corrupt, true},
+		{"truncated name", valid[:16], false},
+		{"truncated question", valid[:len(valid)-2], false},
+	}
+	for _, test := range tests {
+		writer = &recordingWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}}
+		server.handleListenerQuery(ctx, server.mainListener(), test.query, writer)
+
+		if !test.formerr {
+			if len(writer.responses) != 0 {
+				t.Errorf("%s: expected no answer, got %d", test.name, len(writer.responses))
+			}
+			continue
+		}
+		if len(writer.responses) != 1 || writer.responses[0][3]&0x0F != RCODE_FORMERR {
+			t.Errorf("%s: expected a FORMERR answer, got %v", test.name, writer.responses)
+		}
+	}
+	if resolver.callCount != 0 {
+		t.Errorf("Expected no upstream call, got %d", resolver.callCount)
+	}
+}
+
+// TEST 48: An ipv4 preference strips the AAAA answers
+// Tests that AAAA records are removed from forwarded and cached answers while the A ones and the cache stay intact
+func TestDNSServer_HandleQuery_AddressFamilyPreference(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:               "127.0.0.1:5353",
+			UpstreamDns:             "8.8.8.8:53",
+			FilterMode:              "nxdomain",
+			AddressFamilyPreference: ADDRESS_FAMILY_IPV4,
+		}
+		ipv6     net.IP        = net.ParseIP("2001:db8::1")
+		resolver *MockResolver = &MockResolver{response: buildDNSResponse("dual.com", utils.TYPE_AAAA, 1, 300, ipv6)}
+		server   *DNSServer    = NewDNSServer(config, resolver, filter.NewFilterList())
+		writer   *recordingWriter
+		cached   []byte
+		found    bool
+		i        int
+	)
+
+	for i = 0; i < 2; i++ { // forwarded, then from the cache
+		writer = &recordingWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}}
+		server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("dual.com", utils.TYPE_AAAA, 1), writer)
+
+		if len(writer.responses) != 1 {
+			t.Fatalf("Query %d: expected one answer, got %d", i, len(writer.responses))
+		}
+		if binary.BigEndian.Uint16(writer.responses[0][6:8]) != 0 || writer.responses[0][3]&0x0F != 0 {
+			t.Errorf("Query %d: expected NOERROR without AAAA records, got %d answers", i, binary.BigEndian.Uint16(writer.responses[0][6:8]))
+		}
+	}
+	if resolver.callCount != 1 {
+		t.Errorf("Expected the second query to come from the cache, got %d upstream calls", resolver.callCount)
+	}
+	if cached, found, _ = server.cache.Get("dual.com:28"); !found || len(utils.ExtractAnswers(cached)) != 1 {
+		t.Error("Expected the cache to keep the AAAA record")
+	}
+
+	resolver.response = buildDNSResponse("dual.com", utils.TYPE_A, 1, 300, []byte{1, 2, 3, 4})
+	writer = &recordingWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}}
+	server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("dual.com", utils.TYPE_A, 1), writer)
+	if len(writer.responses) != 1 || len(utils.ExtractAnswers(writer.responses[0])) != 1 {
+		t.Error("Expected the A record to be kept")
+	}
+}
+
+// TEST 49: Expired answers are a last resort during an upstream outage
+// Tests that with ServeExpiredOnOutage an entry past the grace period is served with a short TTL
+// and counted when the upstream fails, and that without the flag the client gets SERVFAIL
+func TestDNSServer_HandleQuery_ServeExpiredOnOutage(t *testing.T) {
+	var tests = []struct {
+		name    string
+		enabled bool
+		rcode   uint8
+		served  uint64
+	}{
+		{"flag set", true, 0, 1},
+		{"flag unset", false, RCODE_SERVFAIL, 0},
+	}
+
+	for _, test := range tests {
+		var (
+			ctx      context.Context = context.Background()
+			config   Config          = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", ServeExpiredOnOutage: test.enabled}
+			resolver *MockResolver   = &MockResolver{err: errors.New("upstream down")}
+			server   *DNSServer      = NewDNSServer(config, resolver, nil)
+			clock    *manualClock    = &manualClock{now: time.Now()}
+			answers  *cache.DNSCache = cache.NewDNSCacheWithClock(clock)
+			writer   *recordingWriter
+			ips      []net.IP
+		)
+		answers.SetKeepExpired(test.enabled)
+		server.cache = answers
+		answers.Set("old.com:1", buildDNSResponse("old.com", 1, 1, 300, []byte{5, 6, 7, 8}), 300)
+		clock.now = clock.now.Add(300*time.Second + cache.GRACE_PERIOD + time.Minute)
+
+		writer = &recordingWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}}
+		server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("old.com", 1, 1), writer)
+
+		if len(writer.responses) != 1 {
+			t.Fatalf("%s: expected one answer, got %d", test.name, len(writer.responses))
+		}
+		if writer.responses[0][3]&0x0F != test.rcode {
+			t.Errorf("%s: expected rcode %d, got %d", test.name, test.rcode, writer.responses[0][3]&0x0F)
+		}
+		if server.statistics.ServedExpired() != test.served {
+			t.Errorf("%s: expected %d expired answers counted, got %d", test.name, test.served, server.statistics.ServedExpired())
+		}
+		if !test.enabled {
+			continue
+		}
+
+		if ips = utils.ExtractAnswers(writer.responses[0]); len(ips) != 1 || !ips[0].Equal(net.IPv4(5, 6, 7, 8)) {
+			t.Errorf("%s: expected the expired 5.6.7.8, got %v", test.name, ips)
+		}
+		if utils.ExtractTTL(writer.responses[0]) != EXPIRED_ANSWER_TTL {
+			t.Errorf("%s: expected ttl %d, got %d", test.name, EXPIRED_ANSWER_TTL, utils.ExtractTTL(writer.responses[0]))
+		}
+	}
+}
+
+// TEST 50: A custom filter backend decides what is blocked
+// Tests that NewDNSServer takes any Filter, here one asking an external lookup function,
+// and that its answers drive blocking while allowed names still go upstream
+func TestDNSServer_HandleQuery_CustomFilter(t *testing.T) {
+	var (
+		ctx     context.Context = context.Background()
+		asked   []string
+		backend *funcFilter = &funcFilter{lookup: func(domain string) bool {
+			asked = append(asked, domain)
+			return strings.HasSuffix(domain, ".tracker.net")
+		}}
+		config   Config        = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", AllowlistFile: "unused.txt"}
+		resolver *MockResolver = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		server   *DNSServer    = NewDNSServer(config, resolver, backend)
+		writer   *recordingWriter
+	)
+	if server.currentFilter() != Filter(backend) {
+		t.Fatalf("Expected the custom filter to be used as is, got %T", server.currentFilter())
+	}
+
+	writer = &recordingWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}}
+	server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("px.tracker.net", 1, 1), writer)
+	if len(writer.responses) != 1 || writer.responses[0][3]&0x0F != RCODE_NXDOMAIN {
+		t.Errorf("Expected NXDOMAIN for a domain the backend blocks, got %v", writer.responses)
+	}
+
+	writer = &recordingWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}}
+	server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("example.com", 1, 1), writer)
+	if len(writer.responses) != 1 || resolver.callCount != 1 {
+		t.Errorf("Expected example.com to be forwarded, got %d answers and %d upstream calls", len(writer.responses), resolver.callCount)
+	}
+
+	if len(asked) != 2 || asked[0] != "px.tracker.net" || asked[1] != "example.com" {
+		t.Errorf("Expected the backend to be asked about both domains, got %v", asked)
+	}
+}
+
+// TEST 51: The cname filter mode aliases blocked domains to the block page
+// Tests that a blocked A query gets a CNAME to Config.BlockCNAMETarget followed by the
+// target's local address, and that a type the zone lacks gets the CNAME alone
+func TestDNSServer_HandleQuery_BlockCNAME(t *testing.T) {
+	var (
+		ctx        context.Context    = context.Background()
+		config     Config             = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", FilterMode: "cname", BlockCNAMETarget: "blocked.mylan"}
+		filterList *filter.FilterList = filter.NewFilterList()
+		server     *DNSServer
+		writer     *recordingWriter
+		answer     []utils.ResourceRecord
+		err        error
+	)
+	filterList.Add("ads.com")
+	server = NewDNSServer(config, &MockResolver{}, filterList)
+	server.zone = zone.NewZone()
+	server.zone.AddAddress("blocked.mylan", net.IPv4(10, 0, 0, 80))
+
+	var tests = []struct {
+		qtype   uint16
+		records int
+	}{
+		{utils.TYPE_A, 2},
+		{utils.TYPE_AAAA, 1},
+	}
+	for _, test := range tests {
+		writer = &recordingWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}}
+		server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("www.ads.com", test.qtype, 1), writer)
+
+		if len(writer.responses) != 1 {
+			t.Fatalf("type %d: expected one answer, got %d", test.qtype, len(writer.responses))
+		}
+		if answer, _, _, err = utils.ParseRecords(writer.responses[0]); err != nil || len(answer) != test.records {
+			t.Fatalf("type %d: expected %d records, got %d (%v)", test.qtype, test.records, len(answer), err)
+		}
+		if answer[0].Type != utils.TYPE_CNAME || answer[0].Name != "www.ads.com" || answer[0].Target() != "blocked.mylan" {
+			t.Errorf("type %d: expected www.ads.com CNAME blocked.mylan, got %+v", test.qtype, answer[0])
+		}
+		if test.records == 2 && (answer[1].Name != "blocked.mylan" || !net.IP(answer[1].Data).Equal(net.IPv4(10, 0, 0, 80))) {
+			t.Errorf("type %d: expected the block page address after the CNAME, got %+v", test.qtype, answer[1])
+		}
+	}
+}
+
+// TEST 52: A resent query waits for the one in flight
+// Tests that a query with the same client, id and question as one still resolving
+// gets its answer without a second upstream call, while a new id resolves on its own
+func TestDNSServer_HandleQuery_DuplicateInFlight(t *testing.T) {
+	var (
+		ctx      context.Context           = context.Background()
+		resolver *countingBlockingResolver = &countingBlockingResolver{
+			response: buildDNSResponse("slow.com", 1, 1, 300, []byte{2, 2, 2, 2}),
+			release:  make(chan struct{}),
+		}
+		server     *DNSServer         = NewDNSServer(Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}, resolver, nil)
+		client     net.Addr           = &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 40000}
+		writers    []*recordingWriter = []*recordingWriter{{addr: client}, {addr: client}, {addr: client}}
+		queries    [][]byte           = [][]byte{buildDNSQuery("slow.com", 1, 1), buildDNSQuery("slow.com", 1, 1), buildDNSQuery("slow.com", 1, 1)}
+		group      sync.WaitGroup
+		duplicated chan struct{} = make(chan struct{})
+		deadline   time.Time
+		ips        []net.IP
+		i          int
+	)
+	binary.BigEndian.PutUint16(queries[2][0:2], 0x4321) // a different query from the same client
+
+	group.Add(1)
+	go func() {
+		defer group.Done()
+		server.handleListenerQuery(ctx, server.mainListener(), queries[0], writers[0])
+	}()
+	deadline = time.Now().Add(time.Second)
+	for resolver.calls.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	go func() {
+		server.handleListenerQuery(ctx, server.mainListener(), queries[1], writers[1])
+		close(duplicated)
+	}()
+	group.Add(1)
+	go func() {
+		defer group.Done()
+		server.handleListenerQuery(ctx, server.mainListener(), queries[2], writers[2])
+	}()
+	deadline = time.Now().Add(time.Second)
+	for resolver.calls.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	select {
+	case <-duplicated:
+		t.Fatal("Expected the resent query to wait for the first one")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(resolver.release)
+	group.Wait()
+	<-duplicated
+
+	if resolver.calls.Load() != 2 {
+		t.Errorf("Expected one upstream call for the query and its resend and one for the new id, got %d", resolver.calls.Load())
+	}
+	for i = range writers {
+		if len(writers[i].responses) != 1 {
+			t.Fatalf("query %d: expected one answer, got %d", i, len(writers[i].responses))
+		}
+		if ips = utils.ExtractAnswers(writers[i].responses[0]); len(ips) != 1 || !ips[0].Equal(net.IPv4(2, 2, 2, 2)) {
+			t.Errorf("query %d: expected 2.2.2.2, got %v", i, ips)
+		}
+	}
+	if len(writers[0].responses) == 1 && len(writers[1].responses) == 1 && !bytes.Equal(writers[0].responses[0], writers[1].responses[0]) {
+		t.Error("Expected the resend to get the same answer as the first query")
+	}
+	if server.statistics.Duplicates() != 1 {
+		t.Errorf("Expected 1 duplicate counted, got %d", server.statistics.Duplicates())
+	}
+}
+
+// TEST 53: Passthrough domains skip the filter and the cache
+// Tests that a passthrough domain under a blocked parent is resolved upstream on every
+// query and never cached, while the parent stays blocked
+func TestDNSServer_HandleQuery_Passthrough(t *testing.T) {
+	var (
+		ctx      context.Context    = context.Background()
+		resolver *MockResolver      = &MockResolver{response: buildDNSResponse("api.dyn.com", 1, 1, 300, []byte{3, 3, 3, 3})}
+		list     *filter.FilterList = filter.NewFilterList()
+		server   *DNSServer
+		writer   *recordingWriter
+		ips      []net.IP
+		found    bool
+		i        int
+	)
+	list.Add("dyn.com")
+	list.AddPassthrough("api.dyn.com")
+	server = NewDNSServer(Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}, resolver, list)
+
+	for i = 0; i < 3; i++ {
+		writer = &recordingWriter{}
+		server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("api.dyn.com", 1, 1), writer)
+		if len(writer.responses) != 1 {
+			t.Fatalf("query %d: expected one answer, got %d", i, len(writer.responses))
+		}
+		if ips = utils.ExtractAnswers(writer.responses[0]); len(ips) != 1 || !ips[0].Equal(net.IPv4(3, 3, 3, 3)) {
+			t.Errorf("query %d: expected the upstream answer, got %v", i, ips)
+		}
+	}
+
+	if resolver.callCount != 3 {
+		t.Errorf("Expected every query to go upstream, got %d calls", resolver.callCount)
+	}
+	if _, found, _ = server.cache.Get("api.dyn.com:1"); found {
+		t.Error("Expected the passthrough answer not to be cached")
+	}
+
+	writer = &recordingWriter{}
+	server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("www.dyn.com", 1, 1), writer)
+	if len(writer.responses) != 1 || writer.responses[0][3]&0x0F != RCODE_NXDOMAIN {
+		t.Error("Expected the rest of the blocked domain to stay blocked")
+	}
+}
+
+// TEST 54: A query without a question gets FORMERR
+// Tests that a header with QDCOUNT 0 is answered FORMERR with its id and never goes upstream
+func TestDNSServer_HandleQuery_NoQuestion(t *testing.T) {
+	var (
+		ctx      context.Context  = context.Background()
+		resolver *MockResolver    = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 1, 1, 1})}
+		server   *DNSServer       = NewDNSServer(Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}, resolver, nil)
+		writer   *recordingWriter = &recordingWriter{}
+		query    []byte           = []byte{0xAB, 0xCD, 0x01, 0x00, 0, 0, 0, 0, 0, 0, 0, 0}
+	)
+	server.handleListenerQuery(ctx, server.mainListener(), query, writer)
+
+	if len(writer.responses) != 1 {
+		t.Fatalf("Expected one answer, got %d", len(writer.responses))
+	}
+	if writer.responses[0][3]&0x0F != RCODE_FORMERR || writer.responses[0][2]&0x80 == 0 {
+		t.Errorf("Expected a FORMERR response, got flags %x", writer.responses[0][2:4])
+	}
+	if !bytes.Equal(writer.responses[0][0:2], query[0:2]) {
+		t.Error("Expected the query id in the answer")
+	}
+	if resolver.callCount != 0 {
+		t.Errorf("Expected no upstream call, got %d", resolver.callCount)
+	}
+}
+
+// TEST 55: A client flooding NXDOMAINs is refused uncached names
+// Tests that once a client goes over Config.MaxNxdomainPerSecond its uncached names are
+// REFUSED without going upstream, cached names and other clients still get answers,
+// and the throttle ends after NXDOMAIN_THROTTLE
+func TestDNSServer_HandleQuery_NxdomainThrottle(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		resolver *MockResolver   = &MockResolver{response: filter.CreateErrorResponse(buildDNSQuery("random.example.com", 1, 1), RCODE_NXDOMAIN)}
+		server   *DNSServer      = NewDNSServer(Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", MaxNxdomainPerSecond: 3}, resolver, nil)
+		clock    time.Time       = time.Now()
+		flooder  net.Addr        = &net.UDPAddr{IP: net.IPv4(192, 168, 1, 66), Port: 40000}
+		other    net.Addr        = &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 40000}
+		rcode    uint8
+		i        int
+	)
+	server.now = func() time.Time { return clock }
+	server.cache.Set("cached.example.com:1", buildDNSResponse("cached.example.com", 1, 1, 300, []byte{1, 1, 1, 1}), 300)
+
+	var ask = func(client net.Addr, domain string) uint8 {
+		var writer *recordingWriter = &recordingWriter{addr: client}
+		server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery(domain, 1, 1), writer)
+		if len(writer.responses) != 1 {
+			t.Fatalf("%s from %v: expected one answer, got %d", domain, client, len(writer.responses))
+		}
+		return writer.responses[0][3] & 0x0F
+	}
+
+	for i = 0; i < 4; i++ {
+		if rcode = ask(flooder, fmt.Sprintf("r%d.example.com", i)); rcode != RCODE_NXDOMAIN {
+			t.Fatalf("query %d: expected NXDOMAIN before the throttle, got %d", i, rcode)
+		}
+	}
+
+	if rcode = ask(flooder, "r9.example.com"); rcode != RCODE_REFUSED {
+		t.Errorf("Expected REFUSED over the limit, got %d", rcode)
+	}
+	if resolver.callCount != 4 {
+		t.Errorf("Expected the refused query not to go upstream, got %d calls", resolver.callCount)
+	}
+	if rcode = ask(flooder, "cached.example.com"); rcode != 0 {
+		t.Errorf("Expected cached names to still be answered, got %d", rcode)
+	}
+	if rcode = ask(other, "r10.example.com"); rcode != RCODE_NXDOMAIN {
+		t.Errorf("Expected other clients not to be throttled, got %d", rcode)
+	}
+	if server.statistics.NxdomainThrottled() != 1 {
+		t.Errorf("Expected 1 throttled query counted, got %d", server.statistics.NxdomainThrottled())
+	}
+
+	clock = clock.Add(NXDOMAIN_THROTTLE + time.Second)
+	if rcode = ask(flooder, "r11.example.com"); rcode != RCODE_NXDOMAIN {
+		t.Errorf("Expected the throttle to end, got %d", rcode)
+	}
+}
+
+// TEST 56: DNSSEC answers are forwarded and cached unchanged, blocked ones get NODATA
+// Tests that a DNSKEY answer reaches the client byte for byte from upstream and then from
+// the cache with its TTL, and that blocked DS and DNSKEY queries get NODATA in null mode
+func TestDNSServer_HandleQuery_DNSSECTypes(t *testing.T) {
+	var (
+		ctx      context.Context    = context.Background()
+		key      []byte             = append([]byte{0x01, 0x01, 3, 8}, bytes.Repeat([]byte{0xA5}, 260)...)
+		upstream []byte             = buildDNSResponse("example.com", utils.TYPE_DNSKEY, 1, 1800, key)
+		resolver *MockResolver      = &MockResolver{response: upstream}
+		list     *filter.FilterList = filter.NewFilterList()
+		server   *DNSServer
+		writer   *recordingWriter
+		answer   []utils.ResourceRecord
+		auth     []utils.ResourceRecord
+		cached   []byte
+		found    bool
+		i        int
+		err      error
+	)
+	list.Add("ads.com")
+	server = NewDNSServer(Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", FilterMode: "null"}, resolver, list)
+
+	for i = 0; i < 2; i++ {
+		writer = &recordingWriter{}
+		server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("example.com", utils.TYPE_DNSKEY, 1), writer)
+		if len(writer.responses) != 1 || !bytes.Equal(writer.responses[0], upstream) {
+			t.Errorf("query %d: expected the upstream DNSKEY answer unchanged", i)
+		}
+	}
+	if resolver.callCount != 1 {
+		t.Errorf("Expected the second query to come from the cache, got %d upstream calls", resolver.callCount)
+	}
+	if cached, found, _ = server.cache.Get("example.com:48"); !found || utils.ExtractTTL(cached) != 1800 {
+		t.Errorf("Expected the DNSKEY answer cached with TTL 1800, found %v", found)
+	}
+
+	for _, qtype := range []uint16{utils.TYPE_DS, utils.TYPE_DNSKEY} {
+		writer = &recordingWriter{}
+		server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("ads.com", qtype, 1), writer)
+		if len(writer.responses) != 1 {
+			t.Fatalf("type %d: expected one answer, got %d", qtype, len(writer.responses))
+		}
+		answer, auth, _, err = utils.ParseRecords(writer.responses[0])
+		if err != nil || writer.responses[0][3]&0x0F != 0 || len(answer) != 0 || len(auth) != 1 || auth[0].Type != utils.TYPE_SOA {
+			t.Errorf("type %d: expected NODATA with a SOA, got rcode %d, %d answers (%v)", qtype, writer.responses[0][3]&0x0F, len(answer), err)
+		}
+	}
+}
+
+// TEST 57: Queries before the blocklist is ready follow Config.StartupBehavior
+// Tests that before MarkReady refuse answers REFUSED without going upstream and forward
+// resolves even blocked domains, and that both filter normally once ready
+func TestDNSServer_HandleQuery_StartupBehavior(t *testing.T) {
+	var tests = []struct {
+		behavior     string
+		beforeRcodes [2]uint8 // example.com, ads.com
+		beforeCalls  int
+	}{
+		{STARTUP_REFUSE, [2]uint8{RCODE_REFUSED, RCODE_REFUSED}, 0},
+		{STARTUP_FORWARD, [2]uint8{0, 0}, 2},
+	}
+
+	for _, test := range tests {
+		var (
+			ctx      context.Context    = context.Background()
+			resolver *MockResolver      = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 1, 1, 1})}
+			list     *filter.FilterList = filter.NewFilterList()
+			server   *DNSServer
+			domains  [2]string = [2]string{"example.com", "ads.com"}
+			rcodes   [2]uint8
+			writer   *recordingWriter
+			i        int
+		)
+		list.Add("ads.com")
+		server = NewDNSServer(Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", StartupBehavior: test.behavior}, resolver, list)
+		var ask = func() [2]uint8 {
+			for i = range domains {
+				writer = &recordingWriter{}
+				server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery(domains[i], 1, 1), writer)
+				if len(writer.responses) != 1 {
+					t.Fatalf("%s: %s: expected one answer, got %d", test.behavior, domains[i], len(writer.responses))
+				}
+				rcodes[i] = writer.responses[0][3] & 0x0F
+			}
+			return rcodes
+		}
+
+		if server.Ready() {
+			t.Errorf("%s: expected the server not to be ready before MarkReady", test.behavior)
+		}
+		if rcodes = ask(); rcodes != test.beforeRcodes || resolver.callCount != test.beforeCalls {
+			t.Errorf("%s: before ready expected rcodes %v with %d upstream calls, got %v with %d", test.behavior, test.beforeRcodes, test.beforeCalls, rcodes, resolver.callCount)
+		}
+
+		server.ReloadFilter(list) // drops what forward mode cached for ads.com
+		server.MarkReady()
+		if rcodes = ask(); rcodes != [2]uint8{0, RCODE_NXDOMAIN} {
+			t.Errorf("%s: after ready expected example.com answered and ads.com blocked, got %v", test.behavior, rcodes)
+		}
+	}
+}
+
+// TEST 58: Fault injection fails the matching queries
+// Tests that a 100% SERVFAIL rule answers SERVFAIL for the domain and its subdomains
+// without going upstream, that a 100% drop rule sends nothing, and that other
+// domains resolve as usual
+func TestDNSServer_HandleQuery_FaultInjection(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		resolver *MockResolver   = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 1, 1, 1})}
+		server   *DNSServer      = NewDNSServer(Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+			FaultInjection: []FaultRule{
+				{Domain: "*.flaky.test", Action: FAULT_SERVFAIL, Percent: 100},
+				{Domain: "lost.test", Action: FAULT_DROP, Percent: 100},
+			},
+		}, resolver, nil)
+		writer *recordingWriter
+	)
+	var tests = []struct {
+		domain  string
+		answers int
+		rcode   uint8
+		calls   int // upstream calls so far
+	}{
+		{"flaky.test", 1, RCODE_SERVFAIL, 0},
+		{"api.flaky.test", 1, RCODE_SERVFAIL, 0},
+		{"lost.test", 0, 0, 0},
+		{"example.com", 1, 0, 1},
+	}
+
+	for _, test := range tests {
+		writer = &recordingWriter{}
+		server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery(test.domain, 1, 1), writer)
+		if len(writer.responses) != test.answers {
+			t.Fatalf("%s: expected %d answers, got %d", test.domain, test.answers, len(writer.responses))
+		}
+		if test.answers > 0 && writer.responses[0][3]&0x0F != test.rcode {
+			t.Errorf("%s: expected rcode %d, got %d", test.domain, test.rcode, writer.responses[0][3]&0x0F)
+		}
+		if resolver.callCount != test.calls {
+			t.Errorf("%s: expected %d upstream calls, got %d", test.domain, test.calls, resolver.callCount)
+		}
+	}
+}
+
+// TEST 59: A filter reload applies to the running listeners
+// Tests that a domain added with ReloadFilter after Start is blocked for queries
+// sent over a real udp socket
+func TestDNSServer_Start_ReloadFilter(t *testing.T) {
+	var (
+		address  string             = freeUDPAddr(t)
+		resolver *MockResolver      = &MockResolver{response: buildDNSResponse("tracker.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		list     *filter.FilterList = filter.NewFilterList()
+		reloaded *filter.FilterList = filter.NewFilterList()
+		server   *DNSServer
+		answer   []byte
+	)
+	list.Add("ads.com")
+	reloaded.Add("ads.com")
+	reloaded.Add("tracker.com")
+	server = NewDNSServer(Config{LocalAddr: address, UpstreamDns: "8.8.8.8:53"}, resolver, list)
+	serveForTest(t, server)
+
+	if answer = exchangeOverUDP(t, address, buildDNSQuery("tracker.com", 1, 1)); answer[3]&0x0F != 0 {
+		t.Fatalf("Expected tracker.com to resolve before the reload, got rcode %d", answer[3]&0x0F)
+	}
+
+	server.ReloadFilter(reloaded)
+	if answer = exchangeOverUDP(t, address, buildDNSQuery("tracker.com", 1, 1)); answer[3]&0x0F != RCODE_NXDOMAIN {
+		t.Errorf("Expected tracker.com to be blocked after the reload, got rcode %d", answer[3]&0x0F)
+	}
+}
+
+// TEST 60: Filtering starts on the running listeners once the blocklist is ready
+// Tests that a server started with StartupBehavior and no filter blocks the domains of
+// the list given to ReloadFilter after MarkReady, over a real udp socket
+func TestDNSServer_Start_StartupBehavior(t *testing.T) {
+	var (
+		address  string             = freeUDPAddr(t)
+		resolver *MockResolver      = &MockResolver{response: buildDNSResponse("ads.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		list     *filter.FilterList = filter.NewFilterList()
+		server   *DNSServer
+		answer   []byte
+	)
+	list.Add("ads.com")
+	server = NewDNSServer(Config{LocalAddr: address, UpstreamDns: "8.8.8.8:53", StartupBehavior: STARTUP_REFUSE}, resolver, nil)
+	serveForTest(t, server)
+
+	if answer = exchangeOverUDP(t, address, buildDNSQuery("ads.com", 1, 1)); answer[3]&0x0F != RCODE_REFUSED {
+		t.Errorf("Expected REFUSED while the blocklist loads, got rcode %d", answer[3]&0x0F)
+	}
+
+	server.ReloadFilter(list)
+	server.MarkReady()
+	if answer = exchangeOverUDP(t, address, buildDNSQuery("ads.com", 1, 1)); answer[3]&0x0F != RCODE_NXDOMAIN {
+		t.Errorf("Expected ads.com to be blocked once ready, got rcode %d", answer[3]&0x0F)
+	}
+	if answer = exchangeOverUDP(t, address, buildDNSQuery("example.com", 1, 1)); answer[3]&0x0F != 0 {
+		t.Errorf("Expected example.com to resolve once ready, got rcode %d", answer[3]&0x0F)
+	}
+}
+
+// TEST 61: Duplicates get a copy of the first answer
+// Tests that the answer kept for resent queries doesn't change when the buffer it was
+// written from is reused, as the pooled blocked answers are
+func TestSharedWriter_KeepsACopy(t *testing.T) {
+	var (
+		pending *pendingQuery    = &pendingQuery{done: make(chan struct{})}
+		writer  *recordingWriter = &recordingWriter{}
+		shared  *sharedWriter    = &sharedWriter{responseWriter: writer, pending: pending}
+		buffer  []byte           = buildDNSResponse("ads.com", 1, 1, 300, []byte{0, 0, 0, 0})
+		sent    []byte           = bytes.Clone(buffer)
+		err     error
+	)
+	if err = shared.write(buffer); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	copy(buffer, buildDNSQuery("other.com", 1, 1)) // the next query takes the buffer
+
+	if !bytes.Equal(pending.response, sent) {
+		t.Errorf("Expected the kept answer to stay as sent, got %v", pending.response)
+	}
+}
+
+// TEST 62: The amplification limit applies to queries read from the socket
+// Tests that the ratio uses the size of the query that was read, not of the read
+// buffer, so small queries with large answers over a real udp socket are limited
+func TestDNSServer_Start_AmplificationLimit(t *testing.T) {
+	var (
+		address  string        = freeUDPAddr(t)
+		resolver *MockResolver = &MockResolver{response: buildDNSResponse("example.com", 16, 1, 300, bytes.Repeat([]byte{'a'}, 350))}
+		server   *DNSServer    = NewDNSServer(Config{
+			LocalAddr:             address,
+			UpstreamDns:           "8.8.8.8:53",
+			AmplificationFactor:   10,
+			MaxAmplifiedPerClient: 1,
+		}, resolver, nil)
+		query    []byte = buildDNSQuery("example.com", 16, 1)
+		conn     net.Conn
+		deadline time.Time
+		i        int
+		err      error
+	)
+	serveForTest(t, server)
+
+	// the first one is within the limit, and tells the server is up
+	if len(exchangeOverUDP(t, address, query)) <= len(query)*10 {
+		t.Fatal("Expected an answer over ten times the query size")
+	}
+
+	if conn, err = net.Dial("udp", address); err != nil {
+		t.Fatalf("Failed to dial %s: %v", address, err)
+	}
+	defer conn.Close()
+	for i = 0; i < 4; i++ {
+		if _, err = conn.Write(query); err != nil {
+			t.Fatalf("Failed to send the query: %v", err)
+		}
+	}
+
+	deadline = time.Now().Add(2 * time.Second)
+	for server.statistics.AmplificationLimited() < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.statistics.AmplificationLimited() != 4 {
+		t.Errorf("Expected the 4 later answers to be limited, got %d", server.statistics.AmplificationLimited())
+	}
+}
+
+// TEST 63: Finished refreshes are only remembered for StaleRefreshWindow
+// Tests that nothing is kept without a window and that prune drops the refreshes
+// that finished longer than the window ago
+func TestRefreshTracker_Prune(t *testing.T) {
+	var (
+		now      time.Time       = time.Now()
+		disabled *refreshTracker = newRefreshTracker(0)
+		tracker  *refreshTracker = newRefreshTracker(time.Minute)
+	)
+	disabled.begin("a.com:1")
+	disabled.end("a.com:1", now)
+	if len(disabled.finished) != 0 {
+		t.Errorf("Expected no finished refreshes without a window, got %d", len(disabled.finished))
+	}
+
+	tracker.begin("old.com:1")
+	tracker.end("old.com:1", now.Add(-2*time.Minute))
+	tracker.begin("new.com:1")
+	tracker.end("new.com:1", now)
+	tracker.prune(now)
+	if len(tracker.finished) != 1 || !tracker.isRecent("new.com:1", now) {
+		t.Errorf("Expected only the recent refresh to be kept, got %v", tracker.finished)
+	}
+}
+
+// TEST 64: Truncated answers of a per type upstream are retried on that upstream
+// Tests that the tcp retry of a type routed by UpstreamByType goes to its own
+// servers and not to the default UpstreamDns list
+func TestDNSServer_QueryUpstream_TruncatedRetriesTypeUpstream(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:      "127.0.0.1:5353",
+			UpstreamDns:    "8.8.8.8:53",
+			UpstreamByType: map[uint16]string{utils.TYPE_AAAA: "10.0.0.1"},
+		}
+		truncated    []byte        = buildDNSQuery("big.example.com", utils.TYPE_AAAA, 1)
+		fullResponse []byte        = buildDNSResponse("big.example.com", utils.TYPE_AAAA, 1, 300, net.ParseIP("2001:db8::1"))
+		typeResolver *MockResolver = &MockResolver{response: truncated}
+		typeTCP      *MockResolver = &MockResolver{response: fullResponse}
+		defaultTCP   *MockResolver = &MockResolver{response: fullResponse}
+		server       *DNSServer
+		queryInfo    *utils.QueryInfo = &utils.QueryInfo{Domain: "big.example.com", CacheKey: "big.example.com:28", QType: utils.TYPE_AAAA, QClass: 1}
+		tcp          *TCPResolver
+		response     []byte
+		err          error
+	)
+	binary.BigEndian.PutUint16(truncated[2:4], 0x8380) // QR, TC, RD, RA
+
+	server = NewDNSServer(config, &MockResolver{}, nil)
+	if tcp = server.tcpByType[utils.TYPE_AAAA].(*TCPResolver); fmt.Sprint(tcp.upstreamAddrs) != "[10.0.0.1:53]" {
+		t.Errorf("Expected the AAAA retries to go to 10.0.0.1, got %v", tcp.upstreamAddrs)
+	}
+
+	server.resolversByType[utils.TYPE_AAAA] = typeResolver
+	server.tcpByType[utils.TYPE_AAAA] = typeTCP
+	server.tcpResolver = defaultTCP
+	response, err = server.queryUpstream(ctx, buildDNSQuery("big.example.com", utils.TYPE_AAAA, 1), queryInfo)
+	if err != nil {
+		t.Fatalf("QueryUpstream failed: %v", err)
+	}
+
+	if typeTCP.callCount != 1 || defaultTCP.callCount != 0 {
+		t.Errorf("Expected the retry on the AAAA upstream only, got %d there and %d on the default", typeTCP.callCount, defaultTCP.callCount)
+	}
+	if string(response) != string(fullResponse) {
+		t.Error("Expected the full TCP answer to be returned")
+	}
+}
+
+// TEST 65: The per client limiters track a bounded number of clients
+// Tests that a flood of new clients keeps the NXDOMAIN and amplification tables at
+// their maximum by forgetting the least recently seen client, not a recent one
+func TestClientLimiters_Bounded(t *testing.T) {
+	var (
+		now           time.Time = time.Now()
+		nxdomains     *nxdomainLimiter
+		amplification *amplificationLimiter
+		first         net.IP = net.IPv4(10, 0, 0, 0)
+		second        net.IP = net.IPv4(10, 0, 0, 1)
+		found         bool
+		err           error
+		i             int
+	)
+	nxdomains = newNxdomainLimiter(1)
+	if amplification, err = newAmplificationLimiter(10, 1, nil); err != nil {
+		t.Fatalf("Failed to create the limiter: %v", err)
+	}
+
+	nxdomains.record(first, now)
+	nxdomains.record(first, now) // over the limit
+	amplification.Allow(first, 50, 1000, now)
+	for i = 1; i <= NXDOMAIN_MAX_CLIENTS; i++ {
+		if i == 2 { // the first client stays active while the others arrive
+			nxdomains.record(first, now)
+			amplification.Allow(first, 50, 1000, now)
+		}
+		nxdomains.record(net.IPv4(10, 0, byte(i>>8), byte(i)), now)
+		amplification.Allow(net.IPv4(10, 0, byte(i>>8), byte(i)), 50, 1000, now)
+	}
+
+	if len(nxdomains.clients) != NXDOMAIN_MAX_CLIENTS || nxdomains.order.Len() != NXDOMAIN_MAX_CLIENTS {
+		t.Errorf("Expected %d tracked NXDOMAIN clients, got %d", NXDOMAIN_MAX_CLIENTS, len(nxdomains.clients))
+	}
+	if len(amplification.clients) != AMPLIFICATION_MAX_CLIENTS || amplification.order.Len() != AMPLIFICATION_MAX_CLIENTS {
+		t.Errorf("Expected %d tracked amplification clients, got %d", AMPLIFICATION_MAX_CLIENTS, len(amplification.clients))
+	}
+	if !nxdomains.throttled(first, now) || amplification.Allow(first, 50, 1000, now) {
+		t.Error("Expected the recently seen client to keep its state")
+	}
+	if _, found = nxdomains.clients[second.String()]; found {
+		t.Error("Expected the least recently seen client to be forgotten")
+	}
+}
+
+// TEST 66: The subnet option respects the client's EDNS
+// Tests that with ForwardClientSubnet a client without EDNS gets no OPT back, one
+// with EDNS keeps it, and a client's own subnet (a /0 here) goes upstream unchanged
+// and is cached apart
+func TestDNSServer_HandleQuery_ForwardClientSubnet_ClientEDNS(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:           "127.0.0.1:5353",
+			UpstreamDns:         "8.8.8.8:53",
+			FilterMode:          "nxdomain",
+			ForwardClientSubnet: true,
+		}
+		resolver *subnetResolver = &subnetResolver{}
+		server   *DNSServer      = NewDNSServer(config, resolver, filter.NewFilterList())
+		noSubnet []byte          = utils.SetClientSubnet(appendOPT(buildDNSQuery("cdn.example.com", 1, 1), 1232, false), net.IPv4zero, 0)
+		tests                    = []struct {
+			name     string
+			query    []byte
+			opt      bool
+			expected net.IP
+			calls    int
+		}{
+			{"without EDNS", buildDNSQuery("cdn.example.com", 1, 1), false, net.IPv4(10, 1, 1, 0), 1},
+			{"with EDNS", appendOPT(buildDNSQuery("cdn.example.com", 1, 1), 1232, false), true, net.IPv4(10, 1, 1, 0), 1},
+			{"with a /0 subnet", noSubnet, true, net.IPv4(0, 0, 0, 0), 2},
+		}
+		writer  *recordingWriter
+		message *utils.Message
+		opt     []byte
+		ips     []net.IP
+		err     error
+	)
+
+	for _, test := range tests {
+		writer = &recordingWriter{addr: &net.UDPAddr{IP: net.ParseIP("10.1.1.5"), Port: 5000}}
+		server.handleListenerQuery(ctx, server.mainListener(), test.query, writer)
+
+		if len(writer.responses) != 1 {
+			t.Fatalf("%s: expected one answer, got %d", test.name, len(writer.responses))
+		}
+		if ips = utils.ExtractAnswers(writer.responses[0]); len(ips) != 1 || !ips[0].Equal(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, ips)
+		}
+		if resolver.calls != test.calls {
+			t.Errorf("%s: expected %d upstream queries, got %d", test.name, test.calls, resolver.calls)
+		}
+		if message, err = utils.ParseResponse(writer.responses[0]); err != nil {
+			t.Fatalf("%s: failed to parse the answer: %v", test.name, err)
+		}
+		opt = nil
+		for _, record := range message.Additional {
+			if record.Type == utils.TYPE_OPT {
+				opt = append([]byte{}, record.Data...)
+			}
+		}
+		if (opt != nil) != test.opt {
+			t.Errorf("%s: expected an OPT record %v, got %v", test.name, test.opt, opt != nil)
+		}
+	}
+
+	// the /0 option the client sent comes back, it's the answer to its own question
+	if !bytes.Equal(opt, []byte{0, 8, 0, 4, 0, 1, 0, 0}) {
+		t.Errorf("Expected the client's /0 option to be echoed, got %v", opt)
+	}
+}
+
+// TEST 67: Synchronous stale refreshes are counted like the background ones
+// Tests that refreshNow bumps the prefetch counters and serves the stale answer on failure
+func TestDNSServer_RefreshNow_PrefetchStats(t *testing.T) {
+	var (
+		ctx       context.Context  = context.Background()
+		config    Config           = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}
+		query     []byte           = buildDNSQuery("example.com", 1, 1)
+		stale     []byte           = buildDNSResponse("example.com", 1, 1, 0, []byte{1, 1, 1, 1})
+		resolver  *MockResolver    = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{2, 2, 2, 2})}
+		server    *DNSServer       = NewDNSServer(config, resolver, nil)
+		queryInfo *utils.QueryInfo = &utils.QueryInfo{Domain: "example.com", CacheKey: "example.com:1", QType: 1, QClass: 1}
+		ips       []net.IP
+		stats     cache.CacheStats
+	)
+
+	if ips = utils.ExtractAnswers(server.refreshNow(ctx, query, queryInfo, stale)); len(ips) != 1 || !ips[0].Equal(net.IPv4(2, 2, 2, 2)) {
+		t.Errorf("Expected the refreshed answer, got %v", ips)
+	}
+
+	resolver.response = nil
+	resolver.err = errors.New("upstream down")
+	if ips = utils.ExtractAnswers(server.refreshNow(ctx, query, queryInfo, stale)); len(ips) != 1 || !ips[0].Equal(net.IPv4(1, 1, 1, 1)) {
+		t.Errorf("Expected the stale answer on failure, got %v", ips)
+	}
+
+	stats = server.cache.(*cache.DNSCache).Stats()
+	if stats.PrefetchAttempts != 2 || stats.PrefetchSuccesses != 1 || stats.PrefetchFailures != 1 {
+		t.Errorf("Expected 2 attempts, 1 success and 1 failure, got %+v", stats)
+	}
+}
+
+// ============================================================================
+// HELPER FUNCTIONS FOR BUILDING DNS PACKETS
+// ============================================================================
+
+func buildDNSQuery(domain string, qtype uint16, qclass uint16) []byte {
+	var (
+		query    []byte = make([]byte, 12)
+		labels   []string
+		i        int
+		label    string
+		labelLen int
+	)
+
+	binary.BigEndian.PutUint16(query[0:2], 0x1234)
+	binary.BigEndian.PutUint16(query[2:4], 0x0100) // RD, like stub resolvers send
+	binary.BigEndian.PutUint16(query[4:6], 1)
+
+	labels = splitDomain(domain)
+	for i, label = range labels {
+		_ = i
+		labelLen = len(label)
+		query = append(query, byte(labelLen))
+		query = append(query, []byte(label)...)
+	}
+	query = append(query, 0)
+
+	var typeClass []byte = make([]byte, 4)
+	binary.BigEndian.PutUint16(typeClass[0:2], qtype)
+	binary.BigEndian.PutUint16(typeClass[2:4], qclass)
+	query = append(query, typeClass...)
+
+	return query
+}
+
+func buildDNSResponse(domain string, qtype uint16, qclass uint16, ttl uint32, rdata []byte) []byte {
+	var (
+		response []byte = make([]byte, 12)
+		labels   []string
+		i        int
+		label    string
+		labelLen int
+	)
+
+	binary.BigEndian.PutUint16(response[0:2], 0x1234)
+	binary.BigEndian.PutUint16(response[2:4], 0x8180)
+	binary.BigEndian.PutUint16(response[4:6], 1)
+	binary.BigEndian.PutUint16(response[6:8], 1)
+
+	labels = splitDomain(domain)
+	for i, label = range labels {
+		_ = i
+		labelLen = len(label)
+		response = append(response, byte(labelLen))
+		response = append(response, []byte(label)...)
+	}
+	response = append(response, 0)
+
+	var typeClass []byte = make([]byte, 4)
+	binary.BigEndian.PutUint16(typeClass[0:2], qtype)
+	binary.BigEndian.PutUint16(typeClass[2:4], qclass)
+	response = append(response, typeClass...)
+
+	response = append(response, 0xC0, 0x0C)
+
+	var answerData []byte = make([]byte, 10)
+	binary.BigEndian.PutUint16(answerData[0:2], qtype)
+	binary.BigEndian.PutUint16(answerData[2:4], qclass)
+	binary.BigEndian.PutUint32(answerData[4:8], ttl)
+	binary.BigEndian.PutUint16(answerData[8:10], uint16(len(rdata)))
+	response = append(response, answerData...)
+	response = append(response, rdata...)
+
+	return response
+}
+
+func splitDomain(domain string) []string {
+	var (
+		labels []string
+		start  int = 0
+		i      int
+		ch     rune
+	)
+
+	for i, ch = range domain {
+		if ch == '.' {
+			if i > start {
+				labels = append(labels, domain[start:i])
+			}
+			start = i + 1
+		}
+	}
+
+	if len(domain) > start {
+		labels = append(labels, domain[start:])
+	}
+
+	return labels
+}
+
+// newUDPPair returns a socket for the server to write from and one for the client to read on
+func newUDPPair() (*net.UDPConn, *net.UDPConn, error) {
+	var (
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		err        error
+	)
+
+	serverConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clientConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		serverConn.Close()
+		return nil, nil, err
+	}
+
+	return serverConn, clientConn, nil
+}
+
+// readAnswer waits for one response on the client socket
+func readAnswer(conn *net.UDPConn) ([]byte, error) {
+	var (
+		buffer    []byte = make([]byte, 4096)
+		bytesRead int
+		err       error
+	)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	bytesRead, _, err = conn.ReadFromUDP(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer[:bytesRead], nil
+}
+
+// readAnswerIPs waits for one response and returns its A/AAAA answers
+func readAnswerIPs(conn *net.UDPConn) ([]net.IP, error) {
+	var (
+		response []byte
+		err      error
+	)
+
+	response, err = readAnswer(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return utils.ExtractAnswers(response), nil
+}
+
+// appendOPT adds an EDNS OPT record to the additional section
+func appendOPT(query []byte, udpSize uint16, dnssecOk bool) []byte {
+	var opt []byte = make([]byte, 11) // root name, type, class, ttl, rdlength
+
+	binary.BigEndian.PutUint16(opt[1:3], 41)
+	binary.BigEndian.PutUint16(opt[3:5], udpSize)
+	if dnssecOk {
+		binary.BigEndian.PutUint16(opt[7:9], 0x8000)
+	}
+
+	binary.BigEndian.PutUint16(query[10:12], binary.BigEndian.Uint16(query[10:12])+1)
+	return append(query, opt...)
+}
+
+// renames the answer record at index, e.g. to point it at another name
+func renameAnswer(response []byte, index int, name string) []byte {
+	var (
+		message *utils.Message
+		err     error
+	)
+	if message, err = utils.ParseResponse(response); err != nil {
+		return response
+	}
+	message.Answers[index].Name = name
+	return message.Pack()
+}
+
+// adds a record to the answer section
+func appendAnswer(response []byte, name string, rtype uint16, rdata []byte) []byte {
+	var (
+		message *utils.Message
+		err     error
+	)
+	if message, err = utils.ParseResponse(response); err != nil {
+		return response
+	}
+	message.Answers = append(message.Answers, utils.ResourceRecord{Name: name, Type: rtype, Class: 1, TTL: 300, Data: rdata})
+	return message.Pack()
+}
+
+// decodeCharacterStrings splits TXT rdata in its length prefixed strings
+func decodeCharacterStrings(rdata []byte) []string {
+	var (
+		chunks   []string
+		position int
+		length   int
+	)
+	for position < len(rdata) {
+		length = int(rdata[position])
+		if position+1+length > len(rdata) {
+			break
+		}
+		chunks = append(chunks, string(rdata[position+1:position+1+length]))
+		position += 1 + length
+	}
+
+	return chunks
+}
+
+// recordingWriter keeps the answers instead of sending them, for any client address
+type recordingWriter struct {
+	addr      net.Addr
+	responses [][]byte
+}
+
+func (r *recordingWriter) write(response []byte) error {
+	r.responses = append(r.responses, bytes.Clone(response))
+	return nil
+}
+
+func (r *recordingWriter) clientAddr() net.Addr { return r.addr }
+func (r *recordingWriter) localAddr() net.Addr  { return nil }
+
+// subnetResolver answers with the address of the ECS option it got and echoes the
+// option back like real upstreams do
+type subnetResolver struct {
+	calls int
+}
+
+func (r *subnetResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var (
+		message *utils.Message
+		address net.IP = make(net.IP, 4)
+		err     error
+	)
+	r.calls++
+	if message, err = utils.ParseResponse(query); err != nil {
+		return nil, err
+	}
+
+	for _, record := range message.Additional {
+		// family (2), source prefix, scope prefix, then the address after the option header
+		if record.Type == utils.TYPE_OPT && len(record.Data) > 8 && binary.BigEndian.Uint16(record.Data[0:2]) == utils.EDNS_OPTION_ECS {
+			copy(address, record.Data[8:])
+		}
+	}
+
+	message.Header.Flags |= 0x8000
+	message.Answers = []utils.ResourceRecord{{Name: message.Questions[0].Name, Type: utils.TYPE_A, Class: 1, TTL: 300, Data: address}}
+	return message.Pack(), nil
+}
+
+// clock the tests move by hand
+type manualClock struct {
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	return c.now
+}
+
+// filter backed by an external lookup, like a database or a remote service
+type funcFilter struct {
+	lookup func(domain string) bool
+}
+
+func (f *funcFilter) IsBlocked(domain string) bool {
+	return f.lookup(domain)
+}
+
+func (f *funcFilter) IsAllowed(domain string) bool {
+	return false
+}
+
+func (f *funcFilter) Count() int {
+	return 0 // unknown for an external backend
+}
+
+// countingBlockingResolver holds every query until release is closed and counts them
+type countingBlockingResolver struct {
+	response []byte
+	release  chan struct{}
+	calls    atomic.Int32
+}
+
+func (c *countingBlockingResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	_ = c.calls.Add(1)
+	select {
+	case <-c.release:
+		return c.response, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// freeUDPAddr returns a local address with a port nothing listens on
+func freeUDPAddr(t *testing.T) string {
+	var (
+		conn *net.UDPConn
+		err  error
+	)
+	if conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().String()
+}
+
+// serveForTest runs Start until the test ends
+func serveForTest(t *testing.T, server *DNSServer) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+		done   chan error = make(chan error, 1)
+	)
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		done <- server.Start(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("Start didn't return after the context ended")
+		}
+	})
+}
+
+// exchangeOverUDP sends the query to the address and returns the answer, resending
+// it while the server is still starting
+func exchangeOverUDP(t *testing.T, address string, query []byte) []byte {
+	var (
+		conn     net.Conn
+		buffer   []byte    = make([]byte, 4096)
+		deadline time.Time = time.Now().Add(3 * time.Second)
+		n        int
+		err      error
+	)
+	if conn, err = net.Dial("udp", address); err != nil {
+		t.Fatalf("Failed to dial %s: %v", address, err)
+	}
+	defer conn.Close()
+
+	for time.Now().Before(deadline) {
+		if _, err = conn.Write(query); err != nil {
+			t.Fatalf("Failed to send the query: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if n, err = conn.Read(buffer); err == nil {
+			return buffer[:n]
+		}
+	}
+
+	t.Fatalf("No answer from %s: %v", address, err)
+	return nil
 }
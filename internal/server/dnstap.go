@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flash-dns/internal/logger"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// frame streams framing used by dnstap, see github.com/farsightsec/fstrm
+const (
+	FSTRM_CONTROL_ACCEPT       uint32 = 0x01
+	FSTRM_CONTROL_START        uint32 = 0x02
+	FSTRM_CONTROL_STOP         uint32 = 0x03
+	FSTRM_CONTROL_READY        uint32 = 0x04
+	FSTRM_FIELD_CONTENT_TYPE   uint32 = 0x01
+	DNSTAP_CONTENT_TYPE        string = "protobuf:dnstap.Dnstap"
+	DNSTAP_TYPE_MESSAGE        uint64 = 1
+	DNSTAP_CLIENT_QUERY        uint64 = 5
+	DNSTAP_CLIENT_RESPONSE     uint64 = 6
+	DNSTAP_SOCKET_FAMILY_INET  uint64 = 1
+	DNSTAP_SOCKET_FAMILY_INET6 uint64 = 2
+	DNSTAP_PROTOCOL_UDP        uint64 = 1
+	DNSTAP_PROTOCOL_TCP        uint64 = 2
+	DNSTAP_QUEUE_SIZE          int    = 1024 // exchanges waiting for the writer, more are dropped
+	FSTRM_MAX_CONTROL_SIZE     uint32 = 512  // longest control frame we read from the collector
+)
+
+// QueryLogger writing dnstap CLIENT_QUERY and CLIENT_RESPONSE frames
+// to a file or to a unix socket (e.g. dnstap -u /run/dnstap.sock)
+// a goroutine does the writes so a slow collector never holds up a query,
+// exchanges logged while the queue is full are dropped
+type DnstapLogger struct {
+	mu       sync.RWMutex // guards closed, sends on queue are made under the read lock
+	queue    chan []byte
+	done     chan struct{} // closed once the writer has written the whole queue
+	closed   bool
+	writer   io.WriteCloser
+	identity []byte
+}
+
+func NewDnstapFileLogger(filename string) (*DnstapLogger, error) {
+	var (
+		file *os.File
+		err  error
+	)
+	file, err = os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDnstapLogger(file)
+}
+
+// connects to a dnstap collector, the socket side does the bidirectional handshake
+func NewDnstapSocketLogger(path string) (*DnstapLogger, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	conn, err = net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = fstrmHandshake(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return newDnstapLogger(conn)
+}
+
+func newDnstapLogger(writer io.WriteCloser) (*DnstapLogger, error) {
+	var (
+		dnstap   *DnstapLogger
+		identity []byte
+		hostname string
+		err      error
+	)
+	if hostname, err = os.Hostname(); err == nil {
+		identity = []byte(hostname)
+	}
+
+	if _, err = writer.Write(fstrmControl(FSTRM_CONTROL_START, true)); err != nil {
+		writer.Close()
+		return nil, err
+	}
+
+	dnstap = &DnstapLogger{
+		queue:    make(chan []byte, DNSTAP_QUEUE_SIZE),
+		done:     make(chan struct{}),
+		writer:   writer,
+		identity: identity,
+	}
+	go dnstap.writeFrames()
+
+	return dnstap, nil
+}
+
+func (d *DnstapLogger) writeFrames() {
+	var err error
+	defer close(d.done)
+
+	for frames := range d.queue {
+		if _, err = d.writer.Write(frames); err != nil {
+			logger.ErrorLimited("dnstap write", fmt.Sprintf("dnstap: failed to write frames: %v", err))
+		}
+	}
+}
+
+// sends READY and waits for the collector to ACCEPT our content type
+func fstrmHandshake(conn net.Conn) error {
+	var (
+		header  []byte = make([]byte, 8)
+		payload []byte
+		err     error
+	)
+	if _, err = conn.Write(fstrmControl(FSTRM_CONTROL_READY, true)); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(header[0:4]) != 0 {
+		return fmt.Errorf("dnstap: expected a control frame")
+	}
+
+	if binary.BigEndian.Uint32(header[4:8]) > FSTRM_MAX_CONTROL_SIZE {
+		return fmt.Errorf("dnstap: control frame of %d bytes is too long", binary.BigEndian.Uint32(header[4:8]))
+	}
+
+	payload = make([]byte, binary.BigEndian.Uint32(header[4:8]))
+	if _, err = io.ReadFull(conn, payload); err != nil {
+		return err
+	}
+	if len(payload) < 4 || binary.BigEndian.Uint32(payload[0:4]) != FSTRM_CONTROL_ACCEPT {
+		return fmt.Errorf("dnstap: collector didn't accept the stream")
+	}
+
+	return nil
+}
+
+// escape, control frame length, control type and optionally the content type field
+func fstrmControl(controlType uint32, withContentType bool) []byte {
+	var (
+		control []byte = binary.BigEndian.AppendUint32(nil, controlType)
+		frame   []byte
+	)
+	if withContentType {
+		control = binary.BigEndian.AppendUint32(control, FSTRM_FIELD_CONTENT_TYPE)
+		control = binary.BigEndian.AppendUint32(control, uint32(len(DNSTAP_CONTENT_TYPE)))
+		control = append(control, DNSTAP_CONTENT_TYPE...)
+	}
+
+	frame = binary.BigEndian.AppendUint32(frame, 0)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(control)))
+	return append(frame, control...)
+}
+
+func (d *DnstapLogger) LogQuery(entry QueryLogEntry) {
+	var frames []byte
+	frames = appendDataFrame(frames, d.encode(entry, DNSTAP_CLIENT_QUERY))
+	frames = appendDataFrame(frames, d.encode(entry, DNSTAP_CLIENT_RESPONSE))
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return
+	}
+
+	select {
+	case d.queue <- frames:
+	default:
+		logger.ErrorLimited("dnstap queue", "dnstap: the collector is falling behind, dropping queries")
+	}
+}
+
+// writes the queued frames, sends STOP and closes the output
+func (d *DnstapLogger) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	close(d.queue)
+	d.mu.Unlock()
+
+	<-d.done
+
+	var (
+		err      error
+		closeErr error
+	)
+	_, err = d.writer.Write(fstrmControl(FSTRM_CONTROL_STOP, false))
+	if closeErr = d.writer.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func appendDataFrame(frames []byte, payload []byte) []byte {
+	frames = binary.BigEndian.AppendUint32(frames, uint32(len(payload)))
+	return append(frames, payload...)
+}
+
+// Dnstap protobuf message wrapping a Message of the given type
+func (d *DnstapLogger) encode(entry QueryLogEntry, messageType uint64) []byte {
+	var (
+		message []byte
+		dnstap  []byte
+	)
+	message = protoVarint(message, 1, messageType)
+	message = appendAddresses(message, entry)
+	message = protoVarint(message, 8, uint64(entry.ReceivedAt.Unix()))
+	message = protoFixed32(message, 9, uint32(entry.ReceivedAt.Nanosecond()))
+	message = protoBytes(message, 10, entry.Query)
+	if messageType == DNSTAP_CLIENT_RESPONSE {
+		message = protoVarint(message, 12, uint64(entry.SentAt.Unix()))
+		message = protoFixed32(message, 13, uint32(entry.SentAt.Nanosecond()))
+		message = protoBytes(message, 14, entry.Response)
+	}
+
+	if len(d.identity) > 0 {
+		dnstap = protoBytes(dnstap, 1, d.identity)
+	}
+	dnstap = protoBytes(dnstap, 14, message)
+	dnstap = protoVarint(dnstap, 15, DNSTAP_TYPE_MESSAGE)
+
+	return dnstap
+}
+
+func appendAddresses(message []byte, entry QueryLogEntry) []byte {
+	var (
+		client     net.IP
+		server     net.IP
+		clientPort int
+		serverPort int
+		protocol   uint64
+		family     uint64 = DNSTAP_SOCKET_FAMILY_INET6
+	)
+	if client, clientPort, protocol = splitAddr(entry.ClientAddr); client == nil {
+		return message
+	}
+	server, serverPort, _ = splitAddr(entry.ServerAddr)
+
+	if client.To4() != nil {
+		family = DNSTAP_SOCKET_FAMILY_INET
+		client = client.To4()
+		if server != nil {
+			server = server.To4()
+		}
+	} else if server != nil {
+		server = server.To16()
+	}
+
+	message = protoVarint(message, 2, family)
+	message = protoVarint(message, 3, protocol)
+	message = protoBytes(message, 4, client)
+	if server != nil {
+		message = protoBytes(message, 5, server)
+	}
+	message = protoVarint(message, 6, uint64(clientPort))
+	if server != nil {
+		message = protoVarint(message, 7, uint64(serverPort))
+	}
+
+	return message
+}
+
+// ip, port and dnstap protocol of a socket address, nil ip for anything else
+func splitAddr(addr net.Addr) (net.IP, int, uint64) {
+	var (
+		udpAddr *net.UDPAddr
+		tcpAddr *net.TCPAddr
+		ok      bool
+	)
+	if udpAddr, ok = addr.(*net.UDPAddr); ok {
+		return udpAddr.IP, udpAddr.Port, DNSTAP_PROTOCOL_UDP
+	}
+	if tcpAddr, ok = addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP, tcpAddr.Port, DNSTAP_PROTOCOL_TCP
+	}
+
+	return nil, 0, 0
+}
+
+// minimal protobuf encoding, enough for the dnstap fields
+func protoVarint(buffer []byte, field uint64, value uint64) []byte {
+	buffer = binary.AppendUvarint(buffer, field<<3)
+	return binary.AppendUvarint(buffer, value)
+}
+
+func protoFixed32(buffer []byte, field uint64, value uint32) []byte {
+	buffer = binary.AppendUvarint(buffer, field<<3|5)
+	return binary.LittleEndian.AppendUint32(buffer, value)
+}
+
+func protoBytes(buffer []byte, field uint64, value []byte) []byte {
+	buffer = binary.AppendUvarint(buffer, field<<3|2)
+	buffer = binary.AppendUvarint(buffer, uint64(len(value)))
+	return append(buffer, bytes.Clone(value)...)
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"flash-dns/internal/utils"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TEST 1: Dnstap frames decode back to the exchange
+// Tests that a logged exchange is written as a CLIENT_QUERY and a CLIENT_RESPONSE frame
+func TestDnstapLogger_LogQuery_Frames(t *testing.T) {
+	var (
+		filename string = filepath.Join(t.TempDir(), "queries.dnstap")
+		query    []byte = buildDNSQuery("example.com", utils.TYPE_A, 1)
+		response []byte = buildDNSResponse("example.com", utils.TYPE_A, 1, 300, []byte{1, 2, 3, 4})
+		dnstap   *DnstapLogger
+		frames   [][]byte
+		message  map[uint64][]byte
+		info     *utils.QueryInfo
+		data     []byte
+		types    []uint64
+		err      error
+	)
+
+	dnstap, err = NewDnstapFileLogger(filename)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	dnstap.LogQuery(QueryLogEntry{
+		ReceivedAt: time.Now(),
+		SentAt:     time.Now(),
+		ClientAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000},
+		ServerAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53},
+		Query:      query,
+		Response:   response,
+	})
+	if err = dnstap.Close(); err != nil {
+		t.Fatalf("Failed to close logger: %v", err)
+	}
+
+	data, err = os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	frames = readDataFrames(t, data)
+	if len(frames) != 2 {
+		t.Fatalf("Expected 2 data frames, got %d", len(frames))
+	}
+
+	for _, frame := range frames {
+		message = decodeProtoFields(t, decodeProtoFields(t, frame)[14])
+		types = append(types, decodeVarint(message[1]))
+
+		info, err = utils.ParseQuery(message[10])
+		if err != nil {
+			t.Fatalf("Failed to parse the query message: %v", err)
+		}
+		if info.Domain != "example.com" {
+			t.Errorf("Expected query name example.com, got %s", info.Domain)
+		}
+		if decodeVarint(message[6]) != 40000 {
+			t.Errorf("Expected query port 40000, got %d", decodeVarint(message[6]))
+		}
+	}
+
+	if types[0] != DNSTAP_CLIENT_QUERY || types[1] != DNSTAP_CLIENT_RESPONSE {
+		t.Errorf("Expected CLIENT_QUERY then CLIENT_RESPONSE, got %v", types)
+	}
+	if len(decodeProtoFields(t, decodeProtoFields(t, frames[1])[14])[14]) != len(response) {
+		t.Error("Expected the response message in the CLIENT_RESPONSE frame")
+	}
+}
+
+// TEST 2: The server hands answered queries to the logger
+// Tests that an answered query reaches the query logger with the response
+func TestDNSServer_HandleQuery_QueryLogger(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		resolver   *MockResolver         = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		recorder   *recordingQueryLogger = &recordingQueryLogger{}
+		server     *DNSServer
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		err        error
+	)
+
+	server = NewDNSServer(config, resolver, nil)
+	server.SetQueryLogger(recorder)
+	serverConn, clientConn, err = newUDPPair()
+	if err != nil {
+		t.Fatalf("Failed to create UDP connections: %v", err)
+	}
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	server.handleQuery(ctx, buildDNSQuery("example.com", utils.TYPE_A, 1), clientConn.LocalAddr().(*net.UDPAddr), serverConn)
+
+	if len(recorder.entries) != 1 {
+		t.Fatalf("Expected 1 logged query, got %d", len(recorder.entries))
+	}
+	if recorder.entries[0].ServerAddr == nil || recorder.entries[0].ServerAddr.String() != serverConn.LocalAddr().String() {
+		t.Error("Expected the server address in the log entry")
+	}
+	if recorder.entries[0].SentAt.Before(recorder.entries[0].ReceivedAt) {
+		t.Error("Expected the answer to be sent after the query was received")
+	}
+}
+
+// TEST 3: A stalled collector doesn't hold up queries
+// Tests that LogQuery returns while the writer is blocked, drops what doesn't fit
+// in the queue and that Close still writes the queued frames
+func TestDnstapLogger_LogQuery_StalledWriter(t *testing.T) {
+	var (
+		writer   *stalledWriter = &stalledWriter{release: make(chan struct{})}
+		dnstap   *DnstapLogger
+		finished chan struct{} = make(chan struct{})
+		entry    QueryLogEntry = QueryLogEntry{
+			ReceivedAt: time.Now(),
+			SentAt:     time.Now(),
+			Query:      buildDNSQuery("example.com", utils.TYPE_A, 1),
+			Response:   buildDNSResponse("example.com", utils.TYPE_A, 1, 300, []byte{1, 2, 3, 4}),
+		}
+		err error
+	)
+
+	dnstap, err = newDnstapLogger(writer)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	go func() {
+		for range DNSTAP_QUEUE_SIZE * 2 {
+			dnstap.LogQuery(entry)
+		}
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("LogQuery blocked on the stalled writer")
+	}
+
+	close(writer.release)
+	if err = dnstap.Close(); err != nil {
+		t.Fatalf("Failed to close logger: %v", err)
+	}
+	// START, the frames the queue held plus the one stuck in the writer, STOP
+	if writer.writes.Load() > int64(DNSTAP_QUEUE_SIZE)+3 || writer.writes.Load() < int64(DNSTAP_QUEUE_SIZE)+2 {
+		t.Errorf("Expected the queued frames to be written and the rest dropped, got %d writes", writer.writes.Load())
+	}
+}
+
+// ============================================================================
+// HELPER FUNCTIONS
+// ============================================================================
+
+type recordingQueryLogger struct {
+	entries []QueryLogEntry
+}
+
+func (r *recordingQueryLogger) LogQuery(entry QueryLogEntry) {
+	r.entries = append(r.entries, entry)
+}
+
+// blocks every write after the START frame until release is closed
+type stalledWriter struct {
+	release chan struct{}
+	writes  atomic.Int64
+}
+
+func (w *stalledWriter) Write(data []byte) (int, error) {
+	if w.writes.Add(1) > 1 {
+		<-w.release
+	}
+	return len(data), nil
+}
+
+func (w *stalledWriter) Close() error {
+	return nil
+}
+
+// data frames of a frame streams file, checking the START and STOP control frames
+func readDataFrames(t *testing.T, data []byte) [][]byte {
+	var (
+		frames   [][]byte
+		length   uint32
+		controls []uint32
+	)
+	for len(data) >= 4 {
+		length = binary.BigEndian.Uint32(data[0:4])
+		data = data[4:]
+		if length == 0 {
+			length = binary.BigEndian.Uint32(data[0:4])
+			controls = append(controls, binary.BigEndian.Uint32(data[4:8]))
+			data = data[4+length:]
+			continue
+		}
+		frames = append(frames, data[:length])
+		data = data[length:]
+	}
+
+	if len(controls) != 2 || controls[0] != FSTRM_CONTROL_START || controls[1] != FSTRM_CONTROL_STOP {
+		t.Errorf("Expected START and STOP control frames, got %v", controls)
+	}
+	return frames
+}
+
+// protobuf fields by number, varints are kept encoded
+func decodeProtoFields(t *testing.T, data []byte) map[uint64][]byte {
+	var (
+		fields map[uint64][]byte = map[uint64][]byte{}
+		key    uint64
+		length uint64
+		size   int
+	)
+	for len(data) > 0 {
+		key, size = binary.Uvarint(data)
+		data = data[size:]
+		switch key & 7 {
+		case 0:
+			_, size = binary.Uvarint(data)
+			fields[key>>3] = data[:size]
+			data = data[size:]
+		case 2:
+			length, size = binary.Uvarint(data)
+			fields[key>>3] = data[size : size+int(length)]
+			data = data[size+int(length):]
+		case 5:
+			fields[key>>3] = data[:4]
+			data = data[4:]
+		default:
+			t.Fatalf("Unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+func decodeVarint(data []byte) uint64 {
+	var value uint64
+	value, _ = binary.Uvarint(data)
+	return value
+}
+
+// TEST 4: Oversized control frames are rejected
+// Tests that the handshake refuses a collector announcing a huge control frame
+// instead of allocating it
+func TestFstrmHandshake_OversizedControl(t *testing.T) {
+	var (
+		client    net.Conn
+		collector net.Conn
+		header    []byte     = make([]byte, 8)
+		done      chan error = make(chan error, 1)
+		err       error
+	)
+	client, collector = net.Pipe()
+	defer client.Close()
+	defer collector.Close()
+
+	go func() {
+		done <- fstrmHandshake(client)
+	}()
+
+	if _, err = collector.Read(make([]byte, 512)); err != nil { // READY
+		t.Fatalf("Failed to read READY: %v", err)
+	}
+	binary.BigEndian.PutUint32(header[4:8], 1<<31)
+	if _, err = collector.Write(header); err != nil {
+		t.Fatalf("Failed to write the control header: %v", err)
+	}
+
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Error("Expected the oversized control frame to be rejected")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The handshake waited for the oversized frame")
+	}
+}
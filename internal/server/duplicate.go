@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flash-dns/internal/logger"
+	"flash-dns/internal/utils"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// a query being handled, resends of it wait for its answer instead of resolving again
+type pendingQuery struct {
+	done     chan struct{} // closed once the first query is handled
+	response []byte        // what was sent for it, nil if nothing was
+}
+
+// keeps track of the queries in flight per client, transaction id and question
+// narrower than sharing upstream lookups, it only catches a client resending
+// the same query (e.g. after a lost packet) before the first one was answered
+type duplicateTracker struct {
+	mu      sync.Mutex
+	pending map[string]*pendingQuery
+}
+
+func newDuplicateTracker() *duplicateTracker {
+	return &duplicateTracker{pending: make(map[string]*pendingQuery)}
+}
+
+// registers the query, false with the first one's entry if it is already in flight
+func (d *duplicateTracker) begin(key string) (*pendingQuery, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var (
+		pending *pendingQuery
+		found   bool
+	)
+	if pending, found = d.pending[key]; found {
+		return pending, false
+	}
+
+	pending = &pendingQuery{done: make(chan struct{})}
+	d.pending[key] = pending
+	return pending, true
+}
+
+// releases the waiting duplicates, the response is set by then
+func (d *duplicateTracker) end(key string, pending *pendingQuery) {
+	d.mu.Lock()
+	delete(d.pending, key)
+	d.mu.Unlock()
+
+	close(pending.done)
+}
+
+// client address, transaction id and cache key, empty without a client address
+func duplicateKey(addr net.Addr, query []byte, queryInfo *utils.QueryInfo) string {
+	if addr == nil || len(query) < 2 {
+		return ""
+	}
+	return fmt.Sprintf("%s|%d|%s", addr.String(), binary.BigEndian.Uint16(query[0:2]), queryInfo.CacheKey)
+}
+
+// remembers the answer of the first query for the duplicates waiting on it
+type sharedWriter struct {
+	responseWriter
+	pending *pendingQuery
+}
+
+// the response can be a pooled buffer reused once the query is handled, so it's copied
+func (w *sharedWriter) write(response []byte) error {
+	w.pending.response = bytes.Clone(response)
+	return w.responseWriter.write(response)
+}
+
+// the writer send checks, without the sharedWriter around it
+func unwrapWriter(w responseWriter) responseWriter {
+	var (
+		shared *sharedWriter
+		ok     bool
+	)
+	if shared, ok = w.(*sharedWriter); ok {
+		return shared.responseWriter
+	}
+	return w
+}
+
+// waits for the query in flight and sends its answer again, the duplicate
+// has the same id and question so the bytes are the same
+// nothing is sent if the first query got no answer either
+func (s *DNSServer) answerDuplicate(ctx context.Context, pending *pendingQuery, query []byte, queryInfo *utils.QueryInfo, w responseWriter) {
+	select {
+	case <-pending.done:
+	case <-ctx.Done():
+		return
+	}
+
+	s.statistics.incrementDuplicates()
+	logger.Info(fmt.Sprintf("DUPLICATE: %s - answered with the query in flight", queryInfo.Domain))
+	if pending.response == nil {
+		return
+	}
+	s.send(w, query, pending.response, time.Now())
+}
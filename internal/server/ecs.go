@@ -0,0 +1,71 @@
+package server
+
+import (
+	"flash-dns/internal/utils"
+	"fmt"
+	"net"
+)
+
+const (
+	ECS_PREFIX_IPV4 int = 24 // client subnet sent upstream, enough for geo routing
+	ECS_PREFIX_IPV6 int = 56 // without giving away the client address
+)
+
+// with Config.ForwardClientSubnet the query goes upstream with the subnet of the
+// client and the answer is cached per subnet, CDNs answer by location so one
+// entry per name would serve one region's answer to everybody
+// a subnet the client sent itself goes upstream as it is, keyed the same way
+// returns the query to forward, the query itself when the option is off
+func (s *DNSServer) clientSubnetQuery(query []byte, queryInfo *utils.QueryInfo, client net.Addr) []byte {
+	if !s.config.ForwardClientSubnet {
+		return query
+	}
+	if queryInfo.ClientSubnet != "" {
+		queryInfo.CacheKey = fmt.Sprintf("%s:%s", queryInfo.CacheKey, queryInfo.ClientSubnet)
+		return query
+	}
+
+	var (
+		ip     net.IP = addrIP(client)
+		prefix int    = ECS_PREFIX_IPV4
+		bits   int    = 32
+	)
+
+	if ip.To4() != nil {
+		ip = ip.To4()
+	} else if ip.To16() != nil {
+		prefix, bits = ECS_PREFIX_IPV6, 128
+	} else {
+		return query
+	}
+
+	queryInfo.CacheKey = fmt.Sprintf("%s:%s/%d", queryInfo.CacheKey, ip.Mask(net.CIDRMask(prefix, bits)), prefix)
+
+	return utils.SetClientSubnet(query, ip, prefix)
+}
+
+// the upstream echoes the subnet we added, the client never asked for it
+// the echo of a subnet the client sent is its answer and stays
+func (s *DNSServer) stripClientSubnet(response []byte, queryInfo *utils.QueryInfo) []byte {
+	if !s.config.ForwardClientSubnet || queryInfo.ClientSubnet != "" {
+		return response
+	}
+	return utils.RemoveClientSubnet(response)
+}
+
+// the OPT record added for the subnet is dropped from the answers to clients that
+// didn't use EDNS, the cached answer keeps it for the ones that did
+func (s *DNSServer) withoutAddedOPT(query []byte, response []byte) []byte {
+	var (
+		queryInfo *utils.QueryInfo
+		err       error
+	)
+	if !s.config.ForwardClientSubnet {
+		return response
+	}
+	if queryInfo, err = utils.ParseQuery(query); err != nil || queryInfo.EDNS {
+		return response
+	}
+
+	return utils.RemoveOPT(response)
+}
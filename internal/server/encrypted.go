@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const DNS_MESSAGE_MEDIA_TYPE string = "application/dns-message" // rfc 8484
+
+// dns over tls (rfc 7858), one connection per query
+type DoTResolver struct {
+	address          string
+	timeout          time.Duration
+	maxResponseBytes atomic.Int64 // zero means MAX_RESPONSE_BYTES
+	tlsConfig        *tls.Config
+	dialer           proxy.ContextDialer // nil dials directly
+}
+
+// address is host:port, the certificate is checked against the host
+func NewDoTResolver(address string) *DoTResolver {
+	var host string
+	host, _, _ = net.SplitHostPort(address)
+
+	return &DoTResolver{
+		address:   address,
+		timeout:   5 * time.Second,
+		tlsConfig: &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12},
+	}
+}
+
+// answers bigger than n bytes are rejected, values <= 0 reset to MAX_RESPONSE_BYTES
+func (d *DoTResolver) SetMaxResponseBytes(n int) {
+	d.maxResponseBytes.Store(int64(clampResponseBytes(n)))
+}
+
+// sends the upstream connections through a socks5:// proxy
+func (d *DoTResolver) SetProxy(rawURL string) error {
+	var (
+		dialer proxy.ContextDialer
+		err    error
+	)
+	if dialer, err = newProxyDialer(rawURL, d.timeout); err != nil {
+		return err
+	}
+
+	d.dialer = dialer
+	return nil
+}
+
+func (d *DoTResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var (
+		response []byte
+		err      error
+	)
+	response, _, err = d.ResolveWithSource(ctx, query)
+	return response, err
+}
+
+func (d *DoTResolver) ResolveWithSource(ctx context.Context, query []byte) ([]byte, string, error) {
+	var (
+		conn        net.Conn
+		response    []byte
+		err         error
+		deadline    time.Time = time.Now().Add(d.timeout)
+		ctxDeadline time.Time
+		ok          bool
+	)
+	conn, err = d.dial(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+
+	if ctxDeadline, ok = ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	response, err = exchangeTCP(conn, query, clampResponseBytes(int(d.maxResponseBytes.Load())))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return response, "tls://" + d.address, nil
+}
+
+// tls connection to the upstream, through the proxy when there is one
+func (d *DoTResolver) dial(ctx context.Context) (net.Conn, error) {
+	var (
+		conn    net.Conn
+		tlsConn *tls.Conn
+		err     error
+	)
+	if d.dialer == nil {
+		return (&tls.Dialer{NetDialer: &net.Dialer{Timeout: d.timeout}, Config: d.tlsConfig}).DialContext(ctx, "tcp", d.address)
+	}
+
+	if conn, err = d.dialer.DialContext(ctx, "tcp", d.address); err != nil {
+		return nil, err
+	}
+	tlsConn = tls.Client(conn, d.tlsConfig)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// dns over https (rfc 8484), queries are POSTed as wire format messages
+type DoHResolver struct {
+	url              string
+	client           *http.Client
+	maxResponseBytes atomic.Int64 // zero means MAX_RESPONSE_BYTES
+}
+
+func NewDoHResolver(url string) *DoHResolver {
+	return &DoHResolver{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// answers bigger than n bytes are rejected, values <= 0 reset to MAX_RESPONSE_BYTES
+func (d *DoHResolver) SetMaxResponseBytes(n int) {
+	d.maxResponseBytes.Store(int64(clampResponseBytes(n)))
+}
+
+// sends the upstream connections through a socks5:// proxy, the tls config of
+// the current transport is kept
+func (d *DoHResolver) SetProxy(rawURL string) error {
+	var (
+		dialer    proxy.ContextDialer
+		transport *http.Transport
+		current   *http.Transport
+		ok        bool
+		err       error
+	)
+	if dialer, err = newProxyDialer(rawURL, d.client.Timeout); err != nil {
+		return err
+	}
+
+	if current, ok = d.client.Transport.(*http.Transport); ok {
+		transport = current.Clone()
+	} else {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	d.client = &http.Client{Timeout: d.client.Timeout, Transport: transport}
+	return nil
+}
+
+func (d *DoHResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var (
+		response []byte
+		err      error
+	)
+	response, _, err = d.ResolveWithSource(ctx, query)
+	return response, err
+}
+
+func (d *DoHResolver) ResolveWithSource(ctx context.Context, query []byte) ([]byte, string, error) {
+	var (
+		request  *http.Request
+		answer   *http.Response
+		response []byte
+		limit    int = clampResponseBytes(int(d.maxResponseBytes.Load()))
+		err      error
+	)
+	request, err = http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, "", err
+	}
+	request.Header.Set("Content-Type", DNS_MESSAGE_MEDIA_TYPE)
+	request.Header.Set("Accept", DNS_MESSAGE_MEDIA_TYPE)
+
+	answer, err = d.client.Do(request)
+	if err != nil {
+		return nil, "", err
+	}
+	defer answer.Body.Close()
+
+	if answer.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("doh upstream %s answered with status %d", d.url, answer.StatusCode)
+	}
+
+	// one extra byte to spot oversized answers
+	response, err = io.ReadAll(io.LimitReader(answer.Body, int64(limit)+1))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(response) > limit {
+		return nil, "", fmt.Errorf("response from %s is bigger than %d bytes", d.url, limit)
+	}
+
+	return response, d.url, nil
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TEST 1: DoH resolver POSTs wire format queries
+// Tests that the query is sent as application/dns-message and the body comes back as the answer
+func TestDoHResolver_Resolve(t *testing.T) {
+	var (
+		query    []byte = buildDNSQuery("example.com", 1, 1)
+		answer   []byte = buildDNSResponse("example.com", 1, 1, 300, []byte{93, 184, 216, 34})
+		received []byte
+		response []byte
+		source   string
+		err      error
+		upstream *httptest.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.Header.Get("Content-Type") != DNS_MESSAGE_MEDIA_TYPE {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			received, _ = io.ReadAll(r.Body)
+			w.Header().Set("Content-Type", DNS_MESSAGE_MEDIA_TYPE)
+			w.Write(answer)
+		}))
+		resolver *DoHResolver
+	)
+	defer upstream.Close()
+
+	resolver = NewDoHResolver(upstream.URL + "/dns-query")
+	resolver.client = upstream.Client()
+
+	response, source, err = resolver.ResolveWithSource(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !bytes.Equal(received, query) {
+		t.Error("Expected the upstream to receive the query unchanged")
+	}
+	if !bytes.Equal(response, answer) {
+		t.Error("Expected the upstream answer back")
+	}
+	if source != upstream.URL+"/dns-query" {
+		t.Errorf("Expected the url as source, got '%s'", source)
+	}
+
+	// oversized answers are rejected
+	resolver.SetMaxResponseBytes(len(answer) - 1)
+	if _, err = resolver.Resolve(context.Background(), query); err == nil {
+		t.Error("Expected an error for an answer over the size limit")
+	}
+}
+
+// TEST 2: DoT resolver exchanges length prefixed messages over tls
+// Tests that the query reaches the tls upstream and its answer is returned
+func TestDoTResolver_Resolve(t *testing.T) {
+	var (
+		query    []byte           = buildDNSQuery("example.com", 1, 1)
+		answer   []byte           = buildDNSResponse("example.com", 1, 1, 300, []byte{93, 184, 216, 34})
+		received chan []byte      = make(chan []byte, 1)
+		certs    *httptest.Server = httptest.NewTLSServer(http.NotFoundHandler())
+		roots    *x509.CertPool   = x509.NewCertPool()
+		listener net.Listener
+		resolver *DoTResolver
+		response []byte
+		source   string
+		err      error
+	)
+	defer certs.Close()
+
+	listener, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certs.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		var (
+			conn    net.Conn
+			length  []byte = make([]byte, 2)
+			message []byte
+			err     error
+		)
+		if conn, err = listener.Accept(); err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return
+		}
+		message = make([]byte, binary.BigEndian.Uint16(length))
+		if _, err = io.ReadFull(conn, message); err != nil {
+			return
+		}
+		received <- message
+
+		binary.BigEndian.PutUint16(length, uint16(len(answer)))
+		conn.Write(append(length, answer...))
+	}()
+
+	resolver = NewDoTResolver(listener.Addr().String())
+	roots.AddCert(certs.Certificate())
+	resolver.tlsConfig = &tls.Config{RootCAs: roots, ServerName: "example.com"} // httptest certificates cover example.com
+
+	response, source, err = resolver.ResolveWithSource(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !bytes.Equal(<-received, query) {
+		t.Error("Expected the upstream to receive the query unchanged")
+	}
+	if !bytes.Equal(response, answer) {
+		t.Error("Expected the upstream answer back")
+	}
+	if source != "tls://"+listener.Addr().String() {
+		t.Errorf("Expected tls:// source, got '%s'", source)
+	}
+}
+
+// TEST 3: DoH resolver connects through a SOCKS5 proxy
+// Tests that SetProxy sends the https connections through the proxy and keeps the tls config
+func TestDoHResolver_Resolve_ThroughSOCKS5(t *testing.T) {
+	var (
+		answer   []byte           = buildDNSResponse("example.com", 1, 1, 300, []byte{93, 184, 216, 34})
+		upstream *httptest.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", DNS_MESSAGE_MEDIA_TYPE)
+			w.Write(answer)
+		}))
+		socks    *fakeSOCKS5Server
+		resolver *DoHResolver
+		response []byte
+		err      error
+	)
+	defer upstream.Close()
+	if socks, err = startFakeSOCKS5Server(); err != nil {
+		t.Fatalf("Failed to start socks5 server: %v", err)
+	}
+	defer socks.close()
+
+	resolver = NewDoHResolver(upstream.URL + "/dns-query")
+	resolver.client = upstream.Client() // trusts the test certificate
+	if err = resolver.SetProxy("socks5://" + socks.addr); err != nil {
+		t.Fatalf("SetProxy failed: %v", err)
+	}
+
+	if response, err = resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1)); err != nil {
+		t.Fatalf("Resolve through the proxy failed: %v", err)
+	}
+	if !bytes.Equal(response, answer) {
+		t.Error("Expected the upstream answer back")
+	}
+	if socks.connects.Load() != 1 {
+		t.Errorf("Expected 1 connection through the proxy, got %d", socks.connects.Load())
+	}
+}
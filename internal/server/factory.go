@@ -0,0 +1,328 @@
+package server
+
+import (
+	"context"
+	"flash-dns/internal/logger"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// one entry of the upstream list
+type upstreamSpec struct {
+	scheme  string // udp, tcp, tls or https
+	address string // host:port, the full url for https
+}
+
+// parses entries like 1.1.1.1, udp://1.1.1.1:53, tcp://9.9.9.9,
+// tls://dns.quad9.net or https://dns.google/dns-query
+func parseUpstream(raw string) (upstreamSpec, error) {
+	var (
+		parsed *url.URL
+		err    error
+	)
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return upstreamSpec{}, fmt.Errorf("empty upstream")
+	}
+
+	if !strings.Contains(raw, "://") {
+		return upstreamSpec{scheme: "udp", address: withDefaultPort(raw, "53")}, nil
+	}
+
+	parsed, err = url.Parse(raw)
+	if err != nil {
+		return upstreamSpec{}, fmt.Errorf("invalid upstream %q: %w", raw, err)
+	}
+	if parsed.Host == "" {
+		return upstreamSpec{}, fmt.Errorf("upstream %q has no host", raw)
+	}
+
+	switch parsed.Scheme {
+	case "udp", "tcp":
+		return upstreamSpec{scheme: parsed.Scheme, address: withDefaultPort(parsed.Host, "53")}, nil
+	case "tls":
+		return upstreamSpec{scheme: "tls", address: withDefaultPort(parsed.Host, "853")}, nil
+	case "https":
+		return upstreamSpec{scheme: "https", address: raw}, nil
+	}
+
+	return upstreamSpec{}, fmt.Errorf("unsupported upstream scheme %q", parsed.Scheme)
+}
+
+// adds the port unless the address has one, bare ipv6 addresses get their brackets
+func withDefaultPort(address string, port string) string {
+	var err error
+	if _, _, err = net.SplitHostPort(address); err == nil {
+		return address
+	}
+
+	return net.JoinHostPort(strings.Trim(address, "[]"), port)
+}
+
+func parseUpstreamList(upstream string) ([]upstreamSpec, error) {
+	var (
+		specs []upstreamSpec
+		spec  upstreamSpec
+		err   error
+	)
+	for _, raw := range strings.Split(upstream, ",") {
+		if spec, err = parseUpstream(raw); err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+
+	return specs, nil
+}
+
+// builds the resolver for Config.UpstreamDns following Config.UpstreamStrategy
+//
+// plain udp lists keep racing every upstream (or the weighted pick), a single
+// upstream gets its transport's resolver, anything else is wrapped in a
+// FailoverResolver or RoundRobinResolver
+//
+// tcp, tls and https upstreams connect through Config.UpstreamProxy when it's set
+func NewResolver(config Config) (Resolver, error) {
+	return newResolverFor(config.UpstreamDns, config.UpstreamStrategy, config.UpstreamProxy)
+}
+
+// resolvers that can dial their upstreams through a socks5 proxy
+type proxySetter interface {
+	SetProxy(rawURL string) error
+}
+
+func newResolverFor(upstream string, strategy string, proxyURL string) (Resolver, error) {
+	var (
+		specs     []upstreamSpec
+		addresses []string
+		resolvers []Resolver
+		resolver  Resolver
+		allUDP    bool = true
+		err       error
+	)
+	specs, err = parseUpstreamList(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, spec := range specs {
+		allUDP = allUDP && spec.scheme == "udp"
+		addresses = append(addresses, spec.address)
+		if resolver, err = newTransportResolver(spec, proxyURL); err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, resolver)
+	}
+
+	switch strategy {
+	case "", "race":
+		if allUDP {
+			return newUpstreamResolverAddrs(addresses), nil
+		}
+		if strategy == "race" {
+			return nil, fmt.Errorf("the race strategy only supports udp upstreams")
+		}
+		if len(resolvers) == 1 {
+			return resolvers[0], nil
+		}
+		return NewFailoverResolver(resolvers...), nil
+
+	case "weighted":
+		if !allUDP {
+			return nil, fmt.Errorf("the weighted strategy only supports udp upstreams")
+		}
+		return newWeightedResolverAddrs(addresses), nil
+
+	case "failover":
+		return NewFailoverResolver(resolvers...), nil
+
+	case "roundrobin":
+		return NewRoundRobinResolver(resolvers...), nil
+	}
+
+	return nil, fmt.Errorf("unknown upstream strategy %q", strategy)
+}
+
+// plain udp can't go through socks5, the other transports use the proxy when set
+func newTransportResolver(spec upstreamSpec, proxyURL string) (Resolver, error) {
+	var (
+		resolver Resolver
+		setter   proxySetter
+		ok       bool
+		err      error
+	)
+	switch spec.scheme {
+	case "tcp":
+		resolver = newTCPResolverAddrs([]string{spec.address})
+	case "tls":
+		resolver = NewDoTResolver(spec.address)
+	case "https":
+		resolver = NewDoHResolver(spec.address)
+	default:
+		return newUpstreamResolverAddrs([]string{spec.address}), nil
+	}
+
+	if setter, ok = resolver.(proxySetter); ok && proxyURL != "" {
+		if err = setter.SetProxy(proxyURL); err != nil {
+			return nil, fmt.Errorf("invalid upstream proxy: %w", err)
+		}
+	}
+
+	return resolver, nil
+}
+
+// addresses of the plain udp upstreams, the ones worth retrying over tcp when they truncate
+func udpUpstreamAddrs(upstream string) []string {
+	var (
+		addresses []string
+		spec      upstreamSpec
+		err       error
+	)
+	for _, raw := range strings.Split(upstream, ",") {
+		if spec, err = parseUpstream(raw); err == nil && spec.scheme == "udp" {
+			addresses = append(addresses, spec.address)
+		}
+	}
+
+	return addresses
+}
+
+// tries the resolvers in order, the next one only runs when the previous failed
+type FailoverResolver struct {
+	resolvers     []Resolver
+	retryServfail atomic.Bool
+}
+
+func NewFailoverResolver(resolvers ...Resolver) *FailoverResolver {
+	return &FailoverResolver{resolvers: resolvers}
+}
+
+// passed on to every resolver that supports it
+func (f *FailoverResolver) SetMaxResponseBytes(n int) {
+	setMaxResponseBytes(f.resolvers, n)
+}
+
+// a SERVFAIL moves on to the next resolver, it's returned if they all give it
+func (f *FailoverResolver) SetRetryOnServfail(retry bool) {
+	f.retryServfail.Store(retry)
+	setRetryOnServfail(f.resolvers, retry)
+}
+
+func (f *FailoverResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var (
+		response []byte
+		err      error
+	)
+	response, _, err = f.ResolveWithSource(ctx, query)
+	return response, err
+}
+
+func (f *FailoverResolver) ResolveWithSource(ctx context.Context, query []byte) ([]byte, string, error) {
+	return resolveInOrder(ctx, f.resolvers, 0, query, f.retryServfail.Load())
+}
+
+// spreads queries across the resolvers in turn, a failure moves on to the next one
+type RoundRobinResolver struct {
+	resolvers     []Resolver
+	next          atomic.Uint64
+	retryServfail atomic.Bool
+}
+
+func NewRoundRobinResolver(resolvers ...Resolver) *RoundRobinResolver {
+	return &RoundRobinResolver{resolvers: resolvers}
+}
+
+// passed on to every resolver that supports it
+func (r *RoundRobinResolver) SetMaxResponseBytes(n int) {
+	setMaxResponseBytes(r.resolvers, n)
+}
+
+// a SERVFAIL moves on to the next resolver, it's returned if they all give it
+func (r *RoundRobinResolver) SetRetryOnServfail(retry bool) {
+	r.retryServfail.Store(retry)
+	setRetryOnServfail(r.resolvers, retry)
+}
+
+func (r *RoundRobinResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var (
+		response []byte
+		err      error
+	)
+	response, _, err = r.ResolveWithSource(ctx, query)
+	return response, err
+}
+
+func (r *RoundRobinResolver) ResolveWithSource(ctx context.Context, query []byte) ([]byte, string, error) {
+	var start int = int((r.next.Add(1) - 1) % uint64(len(r.resolvers)))
+	return resolveInOrder(ctx, r.resolvers, start, query, r.retryServfail.Load())
+}
+
+// asks every resolver once starting at start, wrapping around the list
+// with retryServfail a SERVFAIL answer counts as a failure, the last one is
+// returned when no resolver does better
+func resolveInOrder(ctx context.Context, resolvers []Resolver, start int, query []byte, retryServfail bool) ([]byte, string, error) {
+	var (
+		response       []byte
+		source         string
+		servfail       []byte
+		servfailSource string
+		err            error
+		i              int
+	)
+	for i = 0; i < len(resolvers); i++ {
+		select {
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		default:
+		}
+
+		response, source, err = resolveWithSource(ctx, resolvers[(start+i)%len(resolvers)], query)
+		if err == nil && retryServfail && isServfail(response) {
+			logger.Info(fmt.Sprintf("upstream %s answered SERVFAIL, trying the next one", source))
+			servfail, servfailSource = response, source
+			continue
+		}
+		if err == nil {
+			return response, source, nil
+		}
+		logger.Error(fmt.Sprintf("upstream resolver failed, trying the next one: %v", err))
+	}
+
+	if servfail != nil {
+		return servfail, servfailSource, nil
+	}
+
+	return nil, "", fmt.Errorf("all upstream resolvers failed")
+}
+
+func isServfail(response []byte) bool {
+	return len(response) >= 4 && response[3]&0x0F == RCODE_SERVFAIL
+}
+
+// every resolver that supports it gets Config.MaxUpstreamResponseBytes
+func setMaxResponseBytes(resolvers []Resolver, n int) {
+	var (
+		limiter responseLimiter
+		ok      bool
+	)
+	for _, resolver := range resolvers {
+		if limiter, ok = resolver.(responseLimiter); ok {
+			limiter.SetMaxResponseBytes(n)
+		}
+	}
+}
+
+func setRetryOnServfail(resolvers []Resolver, retry bool) {
+	var (
+		retrier servfailRetrier
+		ok      bool
+	)
+	for _, resolver := range resolvers {
+		if retrier, ok = resolver.(servfailRetrier); ok {
+			retrier.SetRetryOnServfail(retry)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// TEST 1: Factory picks the resolver for each config shape
+// Tests that NewResolver returns the concrete type matching the schemes and strategy
+func TestNewResolver_ConfigShapes(t *testing.T) {
+	var tests = []struct {
+		name       string
+		upstream   string
+		strategy   string
+		expected   string
+		components []string
+	}{
+		{"plain udp list races", "1.1.1.1,8.8.8.8", "", "*server.UpstreamResolver", nil},
+		{"udp scheme races", "udp://1.1.1.1:5353", "", "*server.UpstreamResolver", nil},
+		{"single tcp", "tcp://9.9.9.9", "", "*server.TCPResolver", nil},
+		{"single dot", "tls://dns.quad9.net", "", "*server.DoTResolver", nil},
+		{"single doh", "https://dns.google/dns-query", "", "*server.DoHResolver", nil},
+		{"mixed transports fail over", "1.1.1.1,tls://1.1.1.1,https://dns.google/dns-query", "", "*server.FailoverResolver",
+			[]string{"*server.UpstreamResolver", "*server.DoTResolver", "*server.DoHResolver"}},
+		{"explicit failover", "1.1.1.1,8.8.8.8", "failover", "*server.FailoverResolver",
+			[]string{"*server.UpstreamResolver", "*server.UpstreamResolver"}},
+		{"round robin", "tcp://9.9.9.9,tls://1.1.1.1", "roundrobin", "*server.RoundRobinResolver",
+			[]string{"*server.TCPResolver", "*server.DoTResolver"}},
+		{"weighted", "1.1.1.1,8.8.8.8", "weighted", "*server.WeightedResolver", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				resolver   Resolver
+				components []Resolver
+				err        error
+				i          int
+			)
+			resolver, err = NewResolver(Config{UpstreamDns: test.upstream, UpstreamStrategy: test.strategy})
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if reflect.TypeOf(resolver).String() != test.expected {
+				t.Fatalf("Expected %s, got %T", test.expected, resolver)
+			}
+
+			if test.components == nil {
+				return
+			}
+
+			components = resolverComponents(resolver)
+			if len(components) != len(test.components) {
+				t.Fatalf("Expected %d components, got %d", len(test.components), len(components))
+			}
+			for i = range components {
+				if reflect.TypeOf(components[i]).String() != test.components[i] {
+					t.Errorf("Expected component %d to be %s, got %T", i, test.components[i], components[i])
+				}
+			}
+		})
+	}
+}
+
+// TEST 2: Factory normalizes upstream addresses
+// Tests that default ports are added per scheme and existing ports are kept
+func TestNewResolver_Addresses(t *testing.T) {
+	var (
+		resolver Resolver
+		dot      *DoTResolver
+		udp      *UpstreamResolver
+		err      error
+		ok       bool
+	)
+	resolver, err = NewResolver(Config{UpstreamDns: "1.1.1.1, 127.0.0.1:5353, 2606:4700::1111"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if udp, ok = resolver.(*UpstreamResolver); !ok {
+		t.Fatalf("Expected *UpstreamResolver, got %T", resolver)
+	}
+	if !reflect.DeepEqual(udp.upstreamAddrs, []string{"1.1.1.1:53", "127.0.0.1:5353", "[2606:4700::1111]:53"}) {
+		t.Errorf("Unexpected udp addresses %v", udp.upstreamAddrs)
+	}
+
+	resolver, err = NewResolver(Config{UpstreamDns: "tls://dns.quad9.net"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if dot, ok = resolver.(*DoTResolver); !ok {
+		t.Fatalf("Expected *DoTResolver, got %T", resolver)
+	}
+	if dot.address != "dns.quad9.net:853" {
+		t.Errorf("Expected 'dns.quad9.net:853', got '%s'", dot.address)
+	}
+	if dot.tlsConfig.ServerName != "dns.quad9.net" {
+		t.Errorf("Expected server name 'dns.quad9.net', got '%s'", dot.tlsConfig.ServerName)
+	}
+}
+
+// TEST 3: Factory rejects invalid configs
+// Tests that unknown schemes, empty entries and mismatched strategies are errors
+func TestNewResolver_InvalidConfigs(t *testing.T) {
+	var tests = []struct {
+		name     string
+		upstream string
+		strategy string
+	}{
+		{"empty list", "", ""},
+		{"empty entry", "1.1.1.1,,8.8.8.8", ""},
+		{"unknown scheme", "quic://dns.adguard.com", ""},
+		{"missing host", "tls://", ""},
+		{"unknown strategy", "1.1.1.1", "random"},
+		{"weighted over dot", "tls://1.1.1.1,8.8.8.8", "weighted"},
+		{"race over doh", "https://dns.google/dns-query", "race"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var err error
+			if _, err = NewResolver(Config{UpstreamDns: test.upstream, UpstreamStrategy: test.strategy}); err == nil {
+				t.Errorf("Expected an error for %q with strategy %q", test.upstream, test.strategy)
+			}
+		})
+	}
+}
+
+// TEST 4: Failover moves on to the next resolver
+// Tests that a failing resolver is skipped and later ones aren't asked once one answers
+func TestFailoverResolver_Resolve(t *testing.T) {
+	var (
+		failing  *MockResolver     = &MockResolver{err: errors.New("timeout")}
+		working  *MockResolver     = &MockResolver{response: []byte("answer")}
+		spare    *MockResolver     = &MockResolver{response: []byte("spare")}
+		resolver *FailoverResolver = NewFailoverResolver(failing, working, spare)
+		response []byte
+		err      error
+	)
+	response, err = resolver.Resolve(context.Background(), []byte("query"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if string(response) != "answer" {
+		t.Errorf("Expected the second resolver's answer, got %q", response)
+	}
+	if failing.callCount != 1 || working.callCount != 1 || spare.callCount != 0 {
+		t.Errorf("Expected calls 1/1/0, got %d/%d/%d", failing.callCount, working.callCount, spare.callCount)
+	}
+
+	working.err = errors.New("refused")
+	spare.err = errors.New("refused")
+	if _, err = resolver.Resolve(context.Background(), []byte("query")); err == nil {
+		t.Error("Expected an error when every resolver fails")
+	}
+}
+
+// TEST 5: Round robin rotates the first resolver asked
+// Tests that consecutive queries start at successive resolvers and skip failing ones
+func TestRoundRobinResolver_Resolve(t *testing.T) {
+	var (
+		resolvers []*MockResolver = []*MockResolver{
+			{response: []byte("0")},
+			{response: []byte("1")},
+			{response: []byte("2")},
+		}
+		resolver *RoundRobinResolver = NewRoundRobinResolver(resolvers[0], resolvers[1], resolvers[2])
+		response []byte
+		answers  string
+		err      error
+		i        int
+	)
+	for i = 0; i < 4; i++ {
+		if response, err = resolver.Resolve(context.Background(), []byte("query")); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		answers += string(response)
+	}
+	if answers != "0120" {
+		t.Errorf("Expected rotation '0120', got '%s'", answers)
+	}
+
+	// the turn of resolver 1 falls through to resolver 2
+	resolvers[1].err = errors.New("timeout")
+	if response, err = resolver.Resolve(context.Background(), []byte("query")); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if string(response) != "2" {
+		t.Errorf("Expected resolver 2 to cover for resolver 1, got %q", response)
+	}
+}
+
+// TEST 6: Server builds its resolver from the config
+// Tests that NewDNSServer uses NewResolver when no resolver is given and only retries udp upstreams over tcp
+func TestNewDNSServer_BuildsResolver(t *testing.T) {
+	var (
+		server *DNSServer = NewDNSServer(Config{UpstreamDns: "8.8.8.8,https://dns.google/dns-query"}, nil, nil)
+		tcp    *TCPResolver
+		ok     bool
+	)
+	if _, ok = server.resolver.(*FailoverResolver); !ok {
+		t.Errorf("Expected *FailoverResolver, got %T", server.resolver)
+	}
+	if tcp, ok = server.tcpResolver.(*TCPResolver); !ok {
+		t.Fatalf("Expected *TCPResolver for truncation retries, got %T", server.tcpResolver)
+	}
+	if fmt.Sprint(tcp.upstreamAddrs) != "[8.8.8.8:53]" {
+		t.Errorf("Expected only the udp upstream to be retried over tcp, got %v", tcp.upstreamAddrs)
+	}
+
+	server = NewDNSServer(Config{UpstreamDns: "tls://1.1.1.1"}, nil, nil)
+	if server.tcpResolver != nil {
+		t.Errorf("Expected no tcp retries without udp upstreams, got %T", server.tcpResolver)
+	}
+}
+
+// ============================================================================
+// HELPER FUNCTIONS
+// ============================================================================
+
+// TEST 7: SERVFAIL moves on to the next resolver when configured
+// Tests that with Config.RetryOnServfail the NOERROR answer of the second resolver wins over the first's SERVFAIL
+func TestFailoverResolver_RetryOnServfail(t *testing.T) {
+	var tests = []struct {
+		name     string
+		retry    bool
+		second   []byte
+		expected uint8 // rcode of the answer
+	}{
+		{"retry gets the good answer", true, buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}), 0},
+		{"servfail answered without retry", false, buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}), RCODE_SERVFAIL},
+		{"servfail from every upstream", true, servfailResponse(), RCODE_SERVFAIL},
+	}
+
+	for _, test := range tests {
+		var (
+			first    *MockResolver     = &MockResolver{response: servfailResponse()}
+			second   *MockResolver     = &MockResolver{response: test.second}
+			config   Config            = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", RetryOnServfail: test.retry}
+			resolver *FailoverResolver = NewFailoverResolver(first, second)
+			server   *DNSServer        = NewDNSServer(config, resolver, nil)
+			response []byte
+			err      error
+		)
+
+		if response, err = server.resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1)); err != nil {
+			t.Fatalf("%s: expected no error, got %v", test.name, err)
+		}
+		if response[3]&0x0F != test.expected {
+			t.Errorf("%s: expected rcode %d, got %d", test.name, test.expected, response[3]&0x0F)
+		}
+	}
+}
+
+func resolverComponents(resolver Resolver) []Resolver {
+	var (
+		failover   *FailoverResolver
+		roundRobin *RoundRobinResolver
+		ok         bool
+	)
+	if failover, ok = resolver.(*FailoverResolver); ok {
+		return failover.resolvers
+	}
+	if roundRobin, ok = resolver.(*RoundRobinResolver); ok {
+		return roundRobin.resolvers
+	}
+
+	return nil
+}
+
+// TEST 8: Every proxyable transport goes through Config.UpstreamProxy
+// Tests that NewResolver gives the tcp, tls and https upstreams the proxy, that tcp
+// queries reach the upstream through it and that an invalid proxy is an error
+func TestNewResolver_UpstreamProxy(t *testing.T) {
+	var (
+		mockResponse []byte = buildDNSResponse("example.com", 1, 1, 3600, []byte{1, 2, 3, 4})
+		upstream     *mockTCPDNSServer
+		socks        *fakeSOCKS5Server
+		resolver     Resolver
+		failover     *FailoverResolver
+		err          error
+	)
+	if upstream, err = startMockTCPDNSServer(mockResponse); err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer upstream.close()
+	if socks, err = startFakeSOCKS5Server(); err != nil {
+		t.Fatalf("Failed to start socks5 server: %v", err)
+	}
+	defer socks.close()
+
+	resolver, err = NewResolver(Config{
+		UpstreamDns:      "tcp://" + upstream.addr + ",tls://1.1.1.1,https://dns.google/dns-query",
+		UpstreamStrategy: "failover",
+		UpstreamProxy:    "socks5://" + socks.addr,
+	})
+	if err != nil {
+		t.Fatalf("NewResolver failed: %v", err)
+	}
+	failover = resolver.(*FailoverResolver)
+	if failover.resolvers[0].(*TCPResolver).dialer == nil || failover.resolvers[1].(*DoTResolver).dialer == nil {
+		t.Error("Expected the tcp and tls upstreams to dial through the proxy")
+	}
+	if failover.resolvers[2].(*DoHResolver).client.Transport.(*http.Transport).DialContext == nil {
+		t.Error("Expected the https upstream to dial through the proxy")
+	}
+
+	if _, err = resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1)); err != nil {
+		t.Fatalf("Resolve through the proxy failed: %v", err)
+	}
+	if socks.connects.Load() != 1 {
+		t.Errorf("Expected 1 connection through the proxy, got %d", socks.connects.Load())
+	}
+
+	if _, err = NewResolver(Config{UpstreamDns: "tls://1.1.1.1", UpstreamProxy: "http://127.0.0.1:8080"}); err == nil {
+		t.Error("Expected an error for a proxy that isn't socks5")
+	}
+}
+
+func servfailResponse() []byte {
+	var response []byte = buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+	response[3] = 0x80 | RCODE_SERVFAIL
+	return response
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"flash-dns/internal/filter"
+	"flash-dns/internal/logger"
+	"flash-dns/internal/utils"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// values of FaultRule.Action
+const (
+	FAULT_SERVFAIL string = "servfail" // answered with SERVFAIL
+	FAULT_DELAY    string = "delay"    // handled as usual after FaultRule.Delay
+	FAULT_DROP     string = "drop"     // never answered
+)
+
+// a fault injected into the queries for a domain, to test how clients cope
+// with a failing resolver. not meant for production
+type FaultRule struct {
+	Domain  string        // exact match, "*." prefix matches the domain and its subdomains
+	Action  string        // servfail, delay or drop
+	Percent float64       // share of the matching queries that get the fault, 0 to 100
+	Delay   time.Duration // for delay
+}
+
+func (r FaultRule) valid() bool {
+	switch strings.ToLower(r.Action) {
+	case FAULT_SERVFAIL, FAULT_DROP:
+		return true
+	case FAULT_DELAY:
+		return r.Delay > 0
+	}
+	return false
+}
+
+// logs that faults are on and the rules that are ignored
+func checkFaultRules(rules []FaultRule) {
+	if len(rules) == 0 {
+		return
+	}
+
+	logger.Warn(fmt.Sprintf("fault injection is on with %d rules, queries will fail on purpose", len(rules)))
+	for _, rule := range rules {
+		if !rule.valid() {
+			logger.Error(fmt.Sprintf("invalid fault rule for %s (action %q, delay %v), ignoring it", rule.Domain, rule.Action, rule.Delay))
+		}
+	}
+}
+
+// the first valid rule matching the domain decides, false when the query gets no fault
+func (s *DNSServer) pickFault(domain string) (FaultRule, bool) {
+	for _, rule := range s.config.FaultInjection {
+		if !rule.valid() || !matchesDomainPattern(rule.Domain, domain) {
+			continue
+		}
+		return rule, rand.Float64()*100 < rule.Percent
+	}
+
+	return FaultRule{}, false
+}
+
+// false when the fault answered or dropped the query, true to handle it as usual
+func (s *DNSServer) applyFault(ctx context.Context, rule FaultRule, query []byte, queryInfo *utils.QueryInfo, w responseWriter, started time.Time) bool {
+	logger.Info(fmt.Sprintf("FAULT %s: %s", strings.ToUpper(rule.Action), queryInfo.Domain))
+
+	switch strings.ToLower(rule.Action) {
+	case FAULT_SERVFAIL:
+		s.send(w, query, filter.CreateErrorResponse(query, RCODE_SERVFAIL), started)
+		return false
+	case FAULT_DROP:
+		return false
+	}
+
+	var timer *time.Timer = time.NewTimer(rule.Delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
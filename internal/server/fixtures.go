@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"flash-dns/internal/utils"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// answers from wire format responses on disk, for offline labs and demos
+// the file of a query is named after its cache key, e.g. example.com:1 or
+// example.com:28:do, and queries without a file get NXDOMAIN
+type FileResolver struct {
+	dir string
+}
+
+func NewFileResolver(dir string) (*FileResolver, error) {
+	var (
+		info os.FileInfo
+		err  error
+	)
+	if info, err = os.Stat(dir); err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	return &FileResolver{dir: dir}, nil
+}
+
+func (r *FileResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var (
+		info     *utils.QueryInfo
+		response []byte
+		err      error
+	)
+	if info, err = utils.ParseQuery(query); err != nil {
+		return nil, err
+	}
+
+	// names come from the network, a label with a slash must not leave the directory
+	if strings.ContainsAny(info.CacheKey, `/\`) {
+		return utils.CreateSectionsResponse(query, RCODE_NXDOMAIN, nil, nil), nil
+	}
+
+	response, err = os.ReadFile(filepath.Join(r.dir, strings.ToLower(info.CacheKey)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return utils.CreateSectionsResponse(query, RCODE_NXDOMAIN, nil, nil), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 12 {
+		return nil, fmt.Errorf("fixture for %s is too short", info.CacheKey)
+	}
+
+	copy(response[0:2], query[0:2]) // answer with the id of this query
+	return response, nil
+}
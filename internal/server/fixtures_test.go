@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TEST 1: Fixtures answer their name and type, anything else is NXDOMAIN
+// Tests that the file named after the cache key is served with the query id and missing files give NXDOMAIN
+func TestFileResolver_Fixtures(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		dir      string          = t.TempDir()
+		fixture  []byte          = buildDNSResponse("example.com", 1, 1, 300, []byte{10, 0, 0, 1})
+		resolver *FileResolver
+		query    []byte = buildDNSQuery("Example.com", 1, 1)
+		response []byte
+		err      error
+	)
+	if err = os.WriteFile(filepath.Join(dir, "example.com:1"), fixture, 0o644); err != nil {
+		t.Fatalf("Failed to write fixture: %v", err)
+	}
+	if resolver, err = NewFileResolver(dir); err != nil {
+		t.Fatalf("NewFileResolver failed: %v", err)
+	}
+
+	binary.BigEndian.PutUint16(query[0:2], 0x4242)
+	if response, err = resolver.Resolve(ctx, query); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if binary.BigEndian.Uint16(response[0:2]) != 0x4242 || !bytes.Equal(response[2:], fixture[2:]) {
+		t.Error("Expected the fixture with the id of the query")
+	}
+
+	var tests = []struct {
+		name  string
+		qtype uint16
+	}{
+		{"example.com", 28}, // same name, no AAAA fixture
+		{"missing.com", 1},
+		{"a/b.example.com", 1}, // slashes never reach the filesystem
+	}
+	for _, test := range tests {
+		if response, err = resolver.Resolve(ctx, buildDNSQuery(test.name, test.qtype, 1)); err != nil {
+			t.Fatalf("%s: Resolve failed: %v", test.name, err)
+		}
+		if response[3]&0x0F != RCODE_NXDOMAIN {
+			t.Errorf("%s/%d: expected NXDOMAIN, got rcode %d", test.name, test.qtype, response[3]&0x0F)
+		}
+	}
+
+	if _, err = NewFileResolver(filepath.Join(dir, "example.com:1")); err == nil {
+		t.Error("Expected an error for a fixtures path that isn't a directory")
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"flash-dns/internal/cache"
+	"flash-dns/internal/logger"
+	"fmt"
+	"io/fs"
+)
+
+// caches that can be written to disk for the next process
+type snapshotCache interface {
+	SaveSnapshot(filename string) error
+}
+
+// warms the new cache with the entries the previous process saved,
+// a missing file is a normal first start
+func loadCacheHandoff(answers *cache.DNSCache, filename string) {
+	if filename == "" {
+		return
+	}
+
+	var (
+		loaded int
+		err    error
+	)
+	if loaded, err = answers.LoadSnapshot(filename); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logger.Error(fmt.Sprintf("failed to load the cache handoff: %v", err))
+		}
+		return
+	}
+	logger.Info(fmt.Sprintf("Cache handoff loaded: %d entries", loaded))
+}
+
+// saves the cache for the process replacing this one, see Config.CacheHandoffFile
+func (s *DNSServer) saveCacheHandoff() {
+	if s.config.CacheHandoffFile == "" {
+		return
+	}
+
+	var (
+		snapshotter snapshotCache
+		ok          bool
+		err         error
+	)
+	if snapshotter, ok = s.cache.(snapshotCache); !ok {
+		return
+	}
+	if err = snapshotter.SaveSnapshot(s.config.CacheHandoffFile); err != nil {
+		logger.Error(fmt.Sprintf("failed to save the cache handoff: %v", err))
+		return
+	}
+	logger.Info(fmt.Sprintf("Cache handed off to %s", s.config.CacheHandoffFile))
+}
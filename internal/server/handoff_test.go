@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TEST 1: The cache survives a restart through the handoff file
+// Tests that Start saves the cache when its context ends and the next NewDNSServer loads it
+func TestDNSServer_CacheHandoff(t *testing.T) {
+	var (
+		config Config = Config{
+			LocalAddr:        "127.0.0.1:0",
+			UpstreamDns:      "8.8.8.8:53",
+			CacheHandoffFile: filepath.Join(t.TempDir(), "handoff.json"),
+		}
+		response []byte     = buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+		outgoing *DNSServer = NewDNSServer(config, &MockResolver{}, nil)
+		incoming *DNSServer
+		ctx      context.Context
+		cancel   context.CancelFunc
+		done     chan error = make(chan error, 1)
+		cached   []byte
+		found    bool
+		err      error
+	)
+	outgoing.cache.Set("example.com:1", response, 300)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		done <- outgoing.Start(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel() // what SIGTERM does in main
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return after the context ended")
+	}
+	if _, err = os.Stat(config.CacheHandoffFile); err != nil {
+		t.Fatalf("Expected the handoff file, got %v", err)
+	}
+
+	incoming = NewDNSServer(config, &MockResolver{}, nil)
+	if cached, found, _ = incoming.cache.Get("example.com:1"); !found || string(cached) != string(response) {
+		t.Errorf("Expected the replacement to start with the cached answer, found=%v", found)
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	HEALTH_DECAY           float64       = 0.2                   // weight of the newest sample in the moving averages
+	HEALTH_INITIAL_LATENCY time.Duration = 50 * time.Millisecond // assumed until an upstream answers
+	HEALTH_MIN_LATENCY     time.Duration = time.Millisecond      // keeps a local upstream from taking every query
+)
+
+// recent latency and success rate of one upstream, as moving averages
+type upstreamHealth struct {
+	mu          sync.Mutex
+	latency     time.Duration // of successful queries only, timeouts would skew it
+	successRate float64
+}
+
+func newUpstreamHealth() *upstreamHealth {
+	return &upstreamHealth{latency: HEALTH_INITIAL_LATENCY, successRate: 1}
+}
+
+func (h *upstreamHealth) record(latency time.Duration, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var success float64
+	if ok {
+		success = 1
+		h.latency = time.Duration((1-HEALTH_DECAY)*float64(h.latency) + HEALTH_DECAY*float64(latency))
+	}
+	h.successRate = (1-HEALTH_DECAY)*h.successRate + HEALTH_DECAY*success
+}
+
+// higher for upstreams that answer often and fast: success rate per second of latency
+func (h *upstreamHealth) weight() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var latency time.Duration = max(h.latency, HEALTH_MIN_LATENCY)
+	return h.successRate / latency.Seconds()
+}
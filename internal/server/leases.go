@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bufio"
+	"flash-dns/internal/filter"
+	"flash-dns/internal/logger"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// a client of the DHCP server, from Config.DHCPLeasesFile
+type dhcpLease struct {
+	mac      string // or the IAID for DHCPv6 leases
+	hostname string // lowercased
+}
+
+// leases by client ip, swapped as a whole by ReloadLeases
+type leaseTable map[string]dhcpLease
+
+// filtering for one device, picked by the hostname its DHCP lease gives
+// it replaces the filtering of the listener the query came in on
+type DevicePolicy struct {
+	FilterMode string             // nxdomain, null or cname, empty keeps the listener's
+	Filter     *filter.FilterList // nil only applies the server wide rules
+}
+
+// reads a dnsmasq leases file, one "<expiry> <mac> <ip> <hostname> <client id>" per line
+// leases without a hostname ("*") are skipped, like the DHCPv6 "duid" line
+func loadLeases(filename string) (leaseTable, error) {
+	var (
+		file    *os.File
+		scanner *bufio.Scanner
+		leases  leaseTable = make(leaseTable)
+		fields  []string
+		ip      net.IP
+		err     error
+	)
+	if file, err = os.Open(filename); err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner = bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields = strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] == "duid" || fields[3] == "*" {
+			continue
+		}
+		if ip = net.ParseIP(fields[2]); ip == nil {
+			continue
+		}
+		leases[ip.String()] = dhcpLease{mac: strings.ToLower(fields[1]), hostname: strings.ToLower(fields[3])}
+	}
+
+	return leases, scanner.Err()
+}
+
+// reads Config.DHCPLeasesFile again, e.g. on SIGHUP since the leases change often
+// a file that can't be read keeps the current leases
+func (s *DNSServer) ReloadLeases() error {
+	var (
+		leases leaseTable
+		err    error
+	)
+	if s.config.DHCPLeasesFile == "" {
+		return nil
+	}
+	if leases, err = loadLeases(s.config.DHCPLeasesFile); err != nil {
+		return fmt.Errorf("failed to load DHCP leases: %w", err)
+	}
+
+	s.leases.Store(&leases)
+	logger.Info(fmt.Sprintf("Loaded %d DHCP leases from %s", len(leases), s.config.DHCPLeasesFile))
+	return nil
+}
+
+// hostname of the client from its DHCP lease, empty when unknown
+func (s *DNSServer) clientName(addr net.Addr) string {
+	var (
+		leases *leaseTable = s.leases.Load()
+		ip     net.IP
+	)
+	if leases == nil {
+		return ""
+	}
+	if ip = addrIP(addr); ip == nil {
+		return ""
+	}
+
+	return (*leases)[ip.String()].hostname
+}
+
+// the listener filtering with the policy of the client's device applied
+func (s *DNSServer) devicePolicy(l listener, client net.Addr) listener {
+	var (
+		policy DevicePolicy
+		name   string
+		found  bool
+	)
+	if len(s.config.DevicePolicies) == 0 {
+		return l
+	}
+	if name = s.clientName(client); name == "" {
+		return l
+	}
+	if policy, found = s.config.DevicePolicies[name]; !found {
+		return l
+	}
+
+	l.filter = nil
+	if policy.Filter != nil {
+		l.filter = policy.Filter
+	}
+	if policy.FilterMode != "" {
+		l.filterMode = policy.FilterMode
+	}
+	return l
+}
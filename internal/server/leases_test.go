@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"flash-dns/internal/filter"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const SAMPLE_LEASES string = `1700000000 aa:bb:cc:dd:ee:01 192.168.1.23 Kids-Tablet 01:aa:bb:cc:dd:ee:01
+1700000000 aa:bb:cc:dd:ee:02 192.168.1.24 * 01:aa:bb:cc:dd:ee:02
+duid 00:01:00:01:2c:3e:5a:10:aa:bb:cc:dd:ee:ff
+1700000000 1234567 fd00::23 laptop 00:01:00:01:aa:bb
+`
+
+// TEST 1: DHCP leases name the clients in the query log
+// Tests that a dnsmasq leases file is parsed into ip -> hostname, that unnamed leases
+// and unknown ips have no name, and that the query log gets the hostname
+func TestDNSServer_DHCPLeases(t *testing.T) {
+	var (
+		filename string = filepath.Join(t.TempDir(), "dnsmasq.leases")
+		server   *DNSServer
+		log      *recordingQueryLogger = &recordingQueryLogger{}
+		leases   leaseTable
+		name     string
+		err      error
+	)
+	if err = os.WriteFile(filename, []byte(SAMPLE_LEASES), 0o644); err != nil {
+		t.Fatalf("Failed to write leases: %v", err)
+	}
+	if leases, err = loadLeases(filename); err != nil {
+		t.Fatalf("loadLeases failed: %v", err)
+	}
+	if len(leases) != 2 || leases["192.168.1.23"] != (dhcpLease{mac: "aa:bb:cc:dd:ee:01", hostname: "kids-tablet"}) {
+		t.Errorf("Expected the two named leases, got %v", leases)
+	}
+
+	server = NewDNSServer(Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", AnswerLocalhost: true, DHCPLeasesFile: filename}, &MockResolver{}, nil)
+	var tests = []struct {
+		ip   net.IP
+		name string
+	}{
+		{net.ParseIP("192.168.1.23"), "kids-tablet"},
+		{net.ParseIP("fd00::23"), "laptop"},
+		{net.ParseIP("192.168.1.24"), ""},
+		{net.ParseIP("192.168.1.99"), ""},
+	}
+	for _, test := range tests {
+		if name = server.clientName(&net.UDPAddr{IP: test.ip, Port: 5000}); name != test.name {
+			t.Errorf("%s: expected %q, got %q", test.ip, test.name, name)
+		}
+	}
+
+	server.SetQueryLogger(log)
+	server.handleListenerQuery(context.Background(), server.mainListener(), buildDNSQuery("localhost", 1, 1), &recordingWriter{addr: &net.UDPAddr{IP: net.ParseIP("192.168.1.23"), Port: 5000}})
+	if len(log.entries) != 1 || log.entries[0].ClientName != "kids-tablet" {
+		t.Errorf("Expected the query log entry labelled kids-tablet, got %+v", log.entries)
+	}
+}
+
+// TEST 2: Device policies follow the hostname
+// Tests that the policy of a device applies to its queries whatever ip it has, and
+// that other clients keep the listener's filtering
+func TestDNSServer_HandleQuery_DevicePolicy(t *testing.T) {
+	var (
+		ctx      context.Context    = context.Background()
+		filename string             = filepath.Join(t.TempDir(), "dnsmasq.leases")
+		strict   *filter.FilterList = filter.NewFilterList()
+		resolver *MockResolver      = &MockResolver{response: buildDNSResponse("games.com", 1, 1, 300, []byte{1, 1, 1, 1})}
+		server   *DNSServer
+		writer   *recordingWriter
+		rcode    uint8
+		err      error
+	)
+	strict.Add("games.com")
+	if err = os.WriteFile(filename, []byte(SAMPLE_LEASES), 0o644); err != nil {
+		t.Fatalf("Failed to write leases: %v", err)
+	}
+	server = NewDNSServer(Config{
+		LocalAddr:      "127.0.0.1:5353",
+		UpstreamDns:    "8.8.8.8:53",
+		DHCPLeasesFile: filename,
+		DevicePolicies: map[string]DevicePolicy{"kids-tablet": {Filter: strict}},
+	}, resolver, nil)
+
+	var ask = func(ip string) uint8 {
+		writer = &recordingWriter{addr: &net.UDPAddr{IP: net.ParseIP(ip), Port: 5000}}
+		server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("games.com", 1, 1), writer)
+		if len(writer.responses) != 1 {
+			t.Fatalf("%s: expected one answer, got %d", ip, len(writer.responses))
+		}
+		return writer.responses[0][3] & 0x0F
+	}
+
+	if rcode = ask("192.168.1.23"); rcode != RCODE_NXDOMAIN {
+		t.Errorf("Expected the tablet to be blocked, got rcode %d", rcode)
+	}
+	if rcode = ask("192.168.1.50"); rcode != 0 {
+		t.Errorf("Expected other clients to resolve, got rcode %d", rcode)
+	}
+
+	// the tablet got a new address
+	if err = os.WriteFile(filename, []byte("1700000000 aa:bb:cc:dd:ee:01 192.168.1.77 kids-tablet *\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write leases: %v", err)
+	}
+	if err = server.ReloadLeases(); err != nil {
+		t.Fatalf("ReloadLeases failed: %v", err)
+	}
+	if rcode = ask("192.168.1.77"); rcode != RCODE_NXDOMAIN {
+		t.Errorf("Expected the policy to follow the new address, got rcode %d", rcode)
+	}
+	if rcode = ask("192.168.1.23"); rcode != 0 {
+		t.Errorf("Expected the old address to lose the policy, got rcode %d", rcode)
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"flash-dns/internal/filter"
+	"flash-dns/internal/utils"
+	"strings"
+)
+
+// answers single label names and names under Config.LocalDomain from the zone,
+// a single label name is looked up as is and with the local domain appended
+// names the zone doesn't have get NXDOMAIN, they never go upstream
+// returns false when the query isn't local or no local domain is set
+func (s *DNSServer) localDomainResponse(query []byte, queryInfo *utils.QueryInfo) ([]byte, bool) {
+	var (
+		suffix    string = strings.Trim(strings.ToLower(s.config.LocalDomain), ".")
+		domain    string = strings.TrimSuffix(strings.ToLower(queryInfo.Domain), ".")
+		candidate utils.QueryInfo
+		response  []byte
+		found     bool
+	)
+	if suffix == "" || domain == "" {
+		return nil, false
+	}
+	if strings.Contains(domain, ".") && domain != suffix && !strings.HasSuffix(domain, "."+suffix) {
+		return nil, false
+	}
+
+	if s.zone != nil {
+		if response, found = s.zone.Answer(query, queryInfo); found {
+			return response, true
+		}
+
+		// the answer keeps the question as asked, printer answered from printer.home
+		if !strings.Contains(domain, ".") {
+			candidate = *queryInfo
+			candidate.Domain = domain + "." + suffix
+			if response, found = s.zone.Answer(query, &candidate); found {
+				return response, true
+			}
+		}
+	}
+
+	return filter.CreateErrorResponse(query, RCODE_NXDOMAIN), true
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"flash-dns/internal/utils"
+	"flash-dns/internal/zone"
+	"net"
+	"testing"
+)
+
+// TEST 1: Names of the local domain are answered from the zone
+// Tests that printer.home and the single label printer both get the zone address without asking upstream
+func TestDNSServer_LocalDomain_ZoneHit(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		config   Config          = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", LocalDomain: "home."}
+		resolver *MockResolver   = &MockResolver{response: buildDNSResponse("printer", 1, 1, 300, []byte{9, 9, 9, 9})}
+		server   *DNSServer      = NewDNSServer(config, resolver, nil)
+		writer   *recordingWriter
+		ips      []net.IP
+	)
+	server.zone = zone.NewZone()
+	server.zone.AddAddress("printer.home", net.IPv4(192, 168, 1, 20))
+
+	for _, name := range []string{"printer.home", "Printer.HOME", "printer"} {
+		writer = &recordingWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}}
+		server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery(name, utils.TYPE_A, 1), writer)
+
+		if len(writer.responses) != 1 {
+			t.Fatalf("%s: expected one answer, got %d", name, len(writer.responses))
+		}
+		if ips = utils.ExtractAnswers(writer.responses[0]); len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 168, 1, 20)) {
+			t.Errorf("%s: expected 192.168.1.20, got %v", name, ips)
+		}
+	}
+
+	if resolver.callCount != 0 {
+		t.Errorf("Expected local names to never reach upstream, got %d calls", resolver.callCount)
+	}
+}
+
+// TEST 2: Unknown local names get NXDOMAIN without going upstream
+// Tests that names missing from the zone are answered NXDOMAIN locally, with and without a zone,
+// while names outside the local domain are still forwarded
+func TestDNSServer_LocalDomain_Miss(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		config   Config          = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", LocalDomain: "home"}
+		resolver *MockResolver   = &MockResolver{response: buildDNSResponse("nothome.com", 1, 1, 300, []byte{9, 9, 9, 9})}
+		server   *DNSServer      = NewDNSServer(config, resolver, nil)
+		writer   *recordingWriter
+	)
+	for _, name := range []string{"laptop.home", "laptop", "home"} {
+		writer = &recordingWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}}
+		server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery(name, utils.TYPE_A, 1), writer)
+
+		if len(writer.responses) != 1 || writer.responses[0][3]&0x0F != RCODE_NXDOMAIN {
+			t.Errorf("%s: expected a local NXDOMAIN, got %v", name, writer.responses)
+		}
+	}
+	if resolver.callCount != 0 {
+		t.Errorf("Expected no upstream calls for the local domain, got %d", resolver.callCount)
+	}
+
+	writer = &recordingWriter{addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}}
+	server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("nothome.com", utils.TYPE_A, 1), writer)
+	if resolver.callCount != 1 {
+		t.Errorf("Expected names outside the local domain to go upstream, got %d calls", resolver.callCount)
+	}
+}
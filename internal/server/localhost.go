@@ -0,0 +1,44 @@
+package server
+
+import (
+	"flash-dns/internal/utils"
+	"net"
+	"strings"
+)
+
+const LOCALHOST_TTL uint32 = 86400 // these answers never change
+
+// answers localhost names and their reverse lookups without asking upstream
+// returns false when the query isn't about localhost
+func localhostResponse(query []byte, queryInfo *utils.QueryInfo) ([]byte, bool) {
+	var domain string = strings.TrimSuffix(strings.ToLower(queryInfo.Domain), ".")
+
+	switch {
+	case domain == "localhost" || strings.HasSuffix(domain, ".localhost"):
+		switch queryInfo.QType {
+		case utils.TYPE_A:
+			return utils.CreateAnswerResponse(query, utils.TYPE_A, LOCALHOST_TTL, net.IPv4(127, 0, 0, 1).To4()), true
+		case utils.TYPE_AAAA:
+			return utils.CreateAnswerResponse(query, utils.TYPE_AAAA, LOCALHOST_TTL, net.IPv6loopback), true
+		default:
+			return utils.CreateAnswerResponse(query, queryInfo.QType, LOCALHOST_TTL, nil), true
+		}
+
+	case isLoopbackReverse(domain):
+		if queryInfo.QType != utils.TYPE_PTR {
+			return utils.CreateAnswerResponse(query, queryInfo.QType, LOCALHOST_TTL, nil), true
+		}
+		return utils.CreateAnswerResponse(query, utils.TYPE_PTR, LOCALHOST_TTL, utils.EncodeName("localhost")), true
+	}
+
+	return nil, false
+}
+
+// 127.0.0.0/8 in in-addr.arpa and ::1 in ip6.arpa
+func isLoopbackReverse(domain string) bool {
+	if strings.HasSuffix(domain, ".127.in-addr.arpa") {
+		return strings.Count(domain, ".") == 5 // all four octets
+	}
+
+	return domain == "1"+strings.Repeat(".0", 31)+".ip6.arpa"
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flash-dns/internal/utils"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TEST 1: localhost A and AAAA are answered locally
+// Tests that the loopback addresses come back without asking upstream
+func TestDNSServer_HandleQuery_LocalhostAddresses(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:       "127.0.0.1:5353",
+			UpstreamDns:     "8.8.8.8:53",
+			AnswerLocalhost: true,
+		}
+		resolver   *MockResolver = &MockResolver{response: buildDNSResponse("localhost", 1, 1, 300, []byte{9, 9, 9, 9})}
+		server     *DNSServer
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		clientAddr *net.UDPAddr
+		ips        []net.IP
+		err        error
+	)
+
+	server = NewDNSServer(config, resolver, nil)
+	serverConn, clientConn, err = newUDPPair()
+	if err != nil {
+		t.Fatalf("Failed to create UDP connections: %v", err)
+	}
+	defer serverConn.Close()
+	defer clientConn.Close()
+	clientAddr = clientConn.LocalAddr().(*net.UDPAddr)
+
+	server.handleQuery(ctx, buildDNSQuery("localhost", utils.TYPE_A, 1), clientAddr, serverConn)
+	ips, err = readAnswerIPs(clientConn)
+	if err != nil {
+		t.Fatalf("Failed to read answer: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Expected 127.0.0.1, got %v", ips)
+	}
+
+	server.handleQuery(ctx, buildDNSQuery("localhost", utils.TYPE_AAAA, 1), clientAddr, serverConn)
+	ips, err = readAnswerIPs(clientConn)
+	if err != nil {
+		t.Fatalf("Failed to read answer: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv6loopback) {
+		t.Errorf("Expected ::1, got %v", ips)
+	}
+
+	if resolver.callCount != 0 {
+		t.Errorf("localhost should never reach upstream, got %d calls", resolver.callCount)
+	}
+}
+
+// TEST 2: Loopback PTR lookups point at localhost
+// Tests that the reverse names of 127.0.0.1 and ::1 answer with localhost
+func TestDNSServer_HandleQuery_LocalhostPTR(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:       "127.0.0.1:5353",
+			UpstreamDns:     "8.8.8.8:53",
+			AnswerLocalhost: true,
+		}
+		resolver   *MockResolver = &MockResolver{}
+		server     *DNSServer
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		clientAddr *net.UDPAddr
+		names      []string = []string{
+			"1.0.0.127.in-addr.arpa",
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa",
+		}
+		response []byte
+		err      error
+	)
+
+	server = NewDNSServer(config, resolver, nil)
+	serverConn, clientConn, err = newUDPPair()
+	if err != nil {
+		t.Fatalf("Failed to create UDP connections: %v", err)
+	}
+	defer serverConn.Close()
+	defer clientConn.Close()
+	clientAddr = clientConn.LocalAddr().(*net.UDPAddr)
+
+	for _, name := range names {
+		server.handleQuery(ctx, buildDNSQuery(name, utils.TYPE_PTR, 1), clientAddr, serverConn)
+		response, err = readAnswer(clientConn)
+		if err != nil {
+			t.Fatalf("Failed to read answer: %v", err)
+		}
+
+		if binary.BigEndian.Uint16(response[6:8]) != 1 {
+			t.Errorf("%s: expected 1 answer, got %d", name, binary.BigEndian.Uint16(response[6:8]))
+		}
+		if !bytes.Contains(response, utils.EncodeName("localhost")) {
+			t.Errorf("%s: expected the answer to point at localhost", name)
+		}
+	}
+
+	if resolver.callCount != 0 {
+		t.Errorf("Loopback PTR should never reach upstream, got %d calls", resolver.callCount)
+	}
+}
+
+// TEST 3: Disabled localhost handling forwards the query
+// Tests that AnswerLocalhost=false leaves localhost to the upstream
+func TestDNSServer_HandleQuery_LocalhostDisabled(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+		}
+		resolver   *MockResolver = &MockResolver{response: buildDNSResponse("localhost", 1, 1, 300, []byte{127, 0, 0, 1})}
+		server     *DNSServer
+		serverConn *net.UDPConn
+		clientConn *net.UDPConn
+		clientAddr *net.UDPAddr
+		err        error
+	)
+
+	server = NewDNSServer(config, resolver, nil)
+	serverConn, clientConn, err = newUDPPair()
+	if err != nil {
+		t.Fatalf("Failed to create UDP connections: %v", err)
+	}
+	defer serverConn.Close()
+	defer clientConn.Close()
+	clientAddr = clientConn.LocalAddr().(*net.UDPAddr)
+
+	server.handleQuery(ctx, buildDNSQuery("localhost", utils.TYPE_A, 1), clientAddr, serverConn)
+
+	if resolver.callCount != 1 {
+		t.Errorf("Expected the query to be forwarded, got %d calls", resolver.callCount)
+	}
+}
+
+// TEST 4: Special-use names are answered locally
+// Tests that with HandleSpecialUseDomains .invalid, .test and .example get NXDOMAIN,
+// .localhost names get the loopback address and none of them go upstream
+func TestDNSServer_HandleQuery_SpecialUseDomains(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		resolver *MockResolver   = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{9, 9, 9, 9})}
+		server   *DNSServer      = NewDNSServer(Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", HandleSpecialUseDomains: true}, resolver, nil)
+		writer   *recordingWriter
+		ips      []net.IP
+		rcode    uint8
+	)
+
+	var tests = []struct {
+		domain string
+		rcode  uint8
+		ip     net.IP
+	}{
+		{"foo.invalid", RCODE_NXDOMAIN, nil},
+		{"invalid", RCODE_NXDOMAIN, nil},
+		{"my.site.test", RCODE_NXDOMAIN, nil},
+		{"www.example", RCODE_NXDOMAIN, nil},
+		{"app.localhost", 0, net.IPv4(127, 0, 0, 1)},
+	}
+	for _, test := range tests {
+		writer = &recordingWriter{}
+		server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery(test.domain, utils.TYPE_A, 1), writer)
+		if len(writer.responses) != 1 {
+			t.Fatalf("%s: expected one answer, got %d", test.domain, len(writer.responses))
+		}
+		if rcode = writer.responses[0][3] & 0x0F; rcode != test.rcode {
+			t.Errorf("%s: expected rcode %d, got %d", test.domain, test.rcode, rcode)
+		}
+		if ips = utils.ExtractAnswers(writer.responses[0]); test.ip != nil && (len(ips) != 1 || !ips[0].Equal(test.ip)) {
+			t.Errorf("%s: expected %v, got %v", test.domain, test.ip, ips)
+		}
+	}
+	if resolver.callCount != 0 {
+		t.Errorf("Expected no special-use name to go upstream, got %d calls", resolver.callCount)
+	}
+
+	// example.com is a real domain, only the .example TLD is special
+	writer = &recordingWriter{}
+	server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("example.com", utils.TYPE_A, 1), writer)
+	if resolver.callCount != 1 {
+		t.Errorf("Expected example.com to be forwarded, got %d calls", resolver.callCount)
+	}
+}
+
+// TEST 5: Local names under a special-use TLD are still answered
+// Tests that a hosts entry under .test is answered from the hosts file while other
+// .test names keep getting NXDOMAIN
+func TestDNSServer_HandleQuery_SpecialUseAfterLocal(t *testing.T) {
+	var (
+		ctx      context.Context = context.Background()
+		filename string          = filepath.Join(t.TempDir(), "hosts")
+		resolver *MockResolver   = &MockResolver{}
+		server   *DNSServer
+		writer   *recordingWriter
+		ips      []net.IP
+		err      error
+	)
+
+	if err = os.WriteFile(filename, []byte("10.0.0.5 printer.test\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write hosts file: %v", err)
+	}
+	server = NewDNSServer(Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53", HostsFile: filename, HandleSpecialUseDomains: true}, resolver, nil)
+
+	writer = &recordingWriter{}
+	server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("printer.test", utils.TYPE_A, 1), writer)
+	if len(writer.responses) != 1 {
+		t.Fatalf("Expected one answer, got %d", len(writer.responses))
+	}
+	if ips = utils.ExtractAnswers(writer.responses[0]); len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 5)) {
+		t.Errorf("Expected the hosts address for printer.test, got %v (rcode %d)", ips, writer.responses[0][3]&0x0F)
+	}
+
+	writer = &recordingWriter{}
+	server.handleListenerQuery(ctx, server.mainListener(), buildDNSQuery("scanner.test", utils.TYPE_A, 1), writer)
+	if len(writer.responses) != 1 || writer.responses[0][3]&0x0F != RCODE_NXDOMAIN {
+		t.Errorf("Expected NXDOMAIN for scanner.test, got %v", writer.responses)
+	}
+	if resolver.callCount != 0 {
+		t.Errorf("Expected nothing to go upstream, got %d calls", resolver.callCount)
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"flash-dns/internal/utils"
+	"time"
+)
+
+// raises the answer TTLs of the wrapped resolver to a floor, so the cache and
+// the clients all see the same minimum, whatever resolver is underneath
+type MinTTLResolver struct {
+	resolver Resolver
+	floor    uint32 // seconds
+}
+
+func NewMinTTLResolver(resolver Resolver, floor time.Duration) *MinTTLResolver {
+	return &MinTTLResolver{resolver: resolver, floor: uint32(floor / time.Second)}
+}
+
+// passed on to the wrapped resolver when it supports it
+func (m *MinTTLResolver) SetMaxResponseBytes(n int) {
+	setMaxResponseBytes([]Resolver{m.resolver}, n)
+}
+
+// passed on to the wrapped resolver when it supports it
+func (m *MinTTLResolver) SetRetryOnServfail(retry bool) {
+	setRetryOnServfail([]Resolver{m.resolver}, retry)
+}
+
+func (m *MinTTLResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var (
+		response []byte
+		err      error
+	)
+	response, _, err = m.ResolveWithSource(ctx, query)
+	return response, err
+}
+
+func (m *MinTTLResolver) ResolveWithSource(ctx context.Context, query []byte) ([]byte, string, error) {
+	var (
+		response []byte
+		source   string
+		err      error
+	)
+	if response, source, err = resolveWithSource(ctx, m.resolver, query); err != nil {
+		return response, source, err
+	}
+
+	return utils.FloorTTLs(response, m.floor), source, nil
+}
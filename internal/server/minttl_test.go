@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"flash-dns/internal/utils"
+	"testing"
+	"time"
+)
+
+// TEST 1: Answer TTLs are raised to the floor
+// Tests that a 10s answer comes out of MinTTLResolver with the floor and longer ones are untouched
+func TestMinTTLResolver_Resolve(t *testing.T) {
+	var tests = []struct {
+		name     string
+		ttl      uint32
+		expected uint32
+	}{
+		{"below the floor", 10, 60},
+		{"above the floor", 300, 300},
+	}
+
+	for _, test := range tests {
+		var (
+			failing  *MockResolver   = &MockResolver{err: errors.New("timeout")}
+			working  *MockResolver   = &MockResolver{response: buildDNSResponse("example.com", 1, 1, test.ttl, []byte{1, 2, 3, 4})}
+			resolver *MinTTLResolver = NewMinTTLResolver(NewFailoverResolver(failing, working), time.Minute)
+			response []byte
+			err      error
+		)
+		if response, err = resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1)); err != nil {
+			t.Fatalf("%s: expected no error, got %v", test.name, err)
+		}
+
+		if utils.ExtractTTL(response) != test.expected {
+			t.Errorf("%s: expected TTL %d, got %d", test.name, test.expected, utils.ExtractTTL(response))
+		}
+		if len(utils.ExtractAnswers(response)) != 1 || utils.ExtractAnswers(response)[0].String() != "1.2.3.4" {
+			t.Errorf("%s: expected the answer to be kept, got %v", test.name, utils.ExtractAnswers(response))
+		}
+	}
+}
+
+// TEST 2: Server applies the floor before caching
+// Tests that Config.MinTTL wraps the resolver so the answer that gets cached has the raised TTL
+func TestNewDNSServer_MinTTL(t *testing.T) {
+	var (
+		config Config = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+			MinTTL:      time.Minute,
+		}
+		resolver  *MockResolver = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 10, []byte{1, 2, 3, 4})}
+		server    *DNSServer    = NewDNSServer(config, resolver, nil)
+		queryInfo *utils.QueryInfo
+		response  []byte
+		err       error
+	)
+	if queryInfo, err = utils.ParseQuery(buildDNSQuery("example.com", 1, 1)); err != nil {
+		t.Fatalf("Failed to parse query: %v", err)
+	}
+
+	if response, err = server.queryUpstream(context.Background(), buildDNSQuery("example.com", 1, 1), queryInfo); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if utils.ExtractTTL(response) != 60 {
+		t.Errorf("Expected the floored TTL 60, got %d", utils.ExtractTTL(response))
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"container/list"
+	"flash-dns/internal/logger"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	NXDOMAIN_WINDOW      time.Duration = 1 * time.Second
+	NXDOMAIN_THROTTLE    time.Duration = 10 * time.Second // how long a client over the limit is refused uncached names
+	NXDOMAIN_MAX_CLIENTS int           = 4096             // clients tracked, the least recently seen is forgotten past it
+)
+
+// counts the upstream NXDOMAIN answers per client, a client over the limit
+// (e.g. a compromised device asking for random subdomains) is refused the names
+// that aren't cached for NXDOMAIN_THROTTLE, sparing the upstream and the cache
+type nxdomainLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	clients map[string]*nxdomainClient
+	order   *list.List // keys of clients, the most recently seen first
+}
+
+type nxdomainClient struct {
+	limiter        *rollingLimiter
+	throttledUntil time.Time
+	element        *list.Element // in order
+}
+
+func newNxdomainLimiter(limit int) *nxdomainLimiter {
+	return &nxdomainLimiter{limit: limit, clients: make(map[string]*nxdomainClient), order: list.New()}
+}
+
+// counts an NXDOMAIN for the client, starting the throttle once it's over the limit
+// true when this one started it
+func (n *nxdomainLimiter) record(ip net.IP, now time.Time) bool {
+	var (
+		key    string = ip.String()
+		client *nxdomainClient
+		ok     bool
+	)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if client, ok = n.clients[key]; ok {
+		n.order.MoveToFront(client.element)
+	} else {
+		if len(n.clients) >= NXDOMAIN_MAX_CLIENTS {
+			delete(n.clients, n.order.Remove(n.order.Back()).(string))
+		}
+		client = &nxdomainClient{limiter: newRollingLimiter(n.limit, NXDOMAIN_WINDOW), element: n.order.PushFront(key)}
+		n.clients[key] = client
+	}
+
+	if client.limiter.Allow(now) {
+		return false
+	}
+
+	var started bool = !now.Before(client.throttledUntil)
+	client.throttledUntil = now.Add(NXDOMAIN_THROTTLE)
+	return started
+}
+
+// true while the client is refused the uncached names
+func (n *nxdomainLimiter) throttled(ip net.IP, now time.Time) bool {
+	var (
+		client *nxdomainClient
+		ok     bool
+	)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if client, ok = n.clients[ip.String()]; !ok {
+		return false
+	}
+
+	return now.Before(client.throttledUntil)
+}
+
+// ip of a udp or tcp client, nil for other addresses
+func addrIP(addr net.Addr) net.IP {
+	var (
+		udpAddr *net.UDPAddr
+		tcpAddr *net.TCPAddr
+		ok      bool
+	)
+	if udpAddr, ok = addr.(*net.UDPAddr); ok {
+		return udpAddr.IP
+	}
+	if tcpAddr, ok = addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+
+	return nil
+}
+
+// false when the client is throttled for too many NXDOMAIN answers,
+// always true without Config.MaxNxdomainPerSecond
+func (s *DNSServer) allowUncached(client net.Addr) bool {
+	var ip net.IP
+	if s.nxdomains == nil {
+		return true
+	}
+	if ip = addrIP(client); ip == nil {
+		return true
+	}
+
+	return !s.nxdomains.throttled(ip, s.now())
+}
+
+// counts the upstream answer against the client when it's an NXDOMAIN
+func (s *DNSServer) recordNxdomain(client net.Addr, response []byte) {
+	var ip net.IP
+	if s.nxdomains == nil || len(response) < 4 || response[3]&0x0F != RCODE_NXDOMAIN {
+		return
+	}
+	if ip = addrIP(client); ip == nil {
+		return
+	}
+
+	if s.nxdomains.record(ip, s.now()) {
+		logger.Warn(fmt.Sprintf("THROTTLED: %s caused over %d NXDOMAIN answers per second, refusing its uncached names for %v", ip, s.config.MaxNxdomainPerSecond, NXDOMAIN_THROTTLE))
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"flash-dns/internal/logger"
+	"fmt"
+	"time"
+)
+
+// stops filtering until the deadline, like "disable blocking for 5 minutes"
+// blocking resumes on its own, a zero or negative duration resumes right away
+func (s *DNSServer) PauseBlocking(d time.Duration) {
+	if d <= 0 {
+		s.pausedUntil.Store(0)
+		logger.Info("Blocking resumed")
+		return
+	}
+
+	s.pausedUntil.Store(s.now().Add(d).UnixNano())
+	logger.Info(fmt.Sprintf("Blocking paused for %s", d))
+}
+
+// time left before blocking resumes, zero when it isn't paused
+func (s *DNSServer) PauseRemaining() time.Duration {
+	var until int64 = s.pausedUntil.Load()
+	if until == 0 {
+		return 0
+	}
+
+	return max(time.Unix(0, until).Sub(s.now()), 0)
+}
+
+func (s *DNSServer) blockingPaused() bool {
+	return s.PauseRemaining() > 0
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"flash-dns/internal/logger"
+	"fmt"
+	"net"
+	"time"
+)
+
+// receives every answered query, e.g. to export it to dnstap
+// the slices are only valid during the call, copy them to keep them
+type QueryLogger interface {
+	LogQuery(entry QueryLogEntry)
+}
+
+type QueryLogEntry struct {
+	ReceivedAt time.Time
+	SentAt     time.Time
+	ClientAddr net.Addr // *net.UDPAddr or *net.TCPAddr
+	ClientName string   // hostname from Config.DHCPLeasesFile, empty when unknown
+	ServerAddr net.Addr // nil when unknown
+	Query      []byte
+	Response   []byte
+}
+
+// where an answer goes back to, a udp socket or a tcp connection
+type responseWriter interface {
+	write(response []byte) error
+	clientAddr() net.Addr
+	localAddr() net.Addr
+}
+
+type udpResponseWriter struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+}
+
+func (u *udpResponseWriter) write(response []byte) error {
+	var err error
+	_, err = u.conn.WriteToUDP(response, u.addr)
+	return err
+}
+
+func (u *udpResponseWriter) clientAddr() net.Addr { return u.addr }
+func (u *udpResponseWriter) localAddr() net.Addr  { return u.conn.LocalAddr() }
+
+// writes the answer to the client and hands the exchange to the query logger
+func (s *DNSServer) send(w responseWriter, query []byte, response []byte, received time.Time) {
+	var (
+		udp   *udpResponseWriter
+		isUDP bool
+		err   error
+	)
+	response = s.preferAddressFamily(response)
+	response = s.withoutAddedOPT(query, response)
+	if udp, isUDP = unwrapWriter(w).(*udpResponseWriter); isUDP {
+		response = s.fitUDPResponse(query, response)
+		if !s.allowAmplification(udp, query, response) {
+			s.statistics.incrementAmplificationLimited()
+			return
+		}
+	}
+	if err = w.write(response); err != nil {
+		// the client went away or the socket buffer is full, nothing to retry
+		s.statistics.incrementWriteErrors()
+		logger.Debug(fmt.Sprintf("failed to write the answer to %v: %v", w.clientAddr(), err))
+		return
+	}
+	s.statistics.recordResponseSize(len(response))
+
+	if s.queryLogger == nil {
+		return
+	}
+
+	s.queryLogger.LogQuery(QueryLogEntry{
+		ReceivedAt: received,
+		SentAt:     time.Now(),
+		ClientAddr: w.clientAddr(),
+		ClientName: s.clientName(w.clientAddr()),
+		ServerAddr: w.localAddr(),
+		Query:      query,
+		Response:   response,
+	})
+}
+
+// only udp is checked, tcp clients can't spoof their address
+func (s *DNSServer) allowAmplification(udp *udpResponseWriter, query []byte, response []byte) bool {
+	if s.amplification == nil {
+		return true
+	}
+
+	return s.amplification.Allow(udp.addr.IP, len(query), len(response), s.now())
+}
+
+// every answered query is passed to the logger, nil turns it off
+func (s *DNSServer) SetQueryLogger(queryLogger QueryLogger) {
+	s.queryLogger = queryLogger
+}
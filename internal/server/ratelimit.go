@@ -0,0 +1,53 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const RATE_WINDOW_BUCKETS int = 10 // the window is split in this many slots
+
+// counts events over the last window, sliding one bucket at a time
+type rollingLimiter struct {
+	mu         sync.Mutex
+	limit      int
+	window     time.Duration
+	buckets    [RATE_WINDOW_BUCKETS]int
+	bucketTime [RATE_WINDOW_BUCKETS]int64 // slot number each bucket was counting for
+}
+
+func newRollingLimiter(limit int, window time.Duration) *rollingLimiter {
+	return &rollingLimiter{limit: limit, window: window}
+}
+
+// records the event and returns false when the window is already full
+func (r *rollingLimiter) Allow(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var (
+		bucketSize time.Duration = r.window / time.Duration(RATE_WINDOW_BUCKETS)
+		slot       int64         = now.UnixNano() / int64(bucketSize)
+		index      int           = int(slot % int64(RATE_WINDOW_BUCKETS))
+		total      int
+		i          int
+	)
+
+	if r.bucketTime[index] != slot { // bucket left over from an older window
+		r.buckets[index] = 0
+		r.bucketTime[index] = slot
+	}
+
+	for i = 0; i < RATE_WINDOW_BUCKETS; i++ {
+		if slot-r.bucketTime[i] < int64(RATE_WINDOW_BUCKETS) {
+			total += r.buckets[i]
+		}
+	}
+
+	if total >= r.limit {
+		return false
+	}
+
+	r.buckets[index]++
+	return true
+}
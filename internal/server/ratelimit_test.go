@@ -0,0 +1,30 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// TEST 1: Rolling window frees up slots as it moves
+// Tests that old events stop counting once they fall out of the window
+func TestRollingLimiter_Window(t *testing.T) {
+	var (
+		limiter *rollingLimiter = newRollingLimiter(2, time.Second)
+		start   time.Time       = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	)
+
+	if !limiter.Allow(start) || !limiter.Allow(start.Add(500*time.Millisecond)) {
+		t.Fatal("Expected the first two events to be allowed")
+	}
+	if limiter.Allow(start.Add(900 * time.Millisecond)) {
+		t.Error("Expected a third event inside the window to be rejected")
+	}
+
+	// the first event is out of the window, the second one still counts
+	if !limiter.Allow(start.Add(1100 * time.Millisecond)) {
+		t.Error("Expected a slot to free up once the first event left the window")
+	}
+	if limiter.Allow(start.Add(1200 * time.Millisecond)) {
+		t.Error("Expected the window to be full again")
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flash-dns/internal/logger"
+	"flash-dns/internal/utils"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// one query/response pair, one json object per line in the recording file
+type recordedExchange struct {
+	Key      string `json:"key"`
+	Query    []byte `json:"query"`
+	Response []byte `json:"response"`
+}
+
+// wraps a resolver and appends every answered query to a file, for replay tests
+type RecordingResolver struct {
+	next    Resolver
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func NewRecordingResolver(next Resolver, filename string) (*RecordingResolver, error) {
+	var (
+		file *os.File
+		err  error
+	)
+	file, err = os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RecordingResolver{next: next, file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (r *RecordingResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var (
+		response []byte
+		err      error
+	)
+	response, _, err = r.ResolveWithSource(ctx, query)
+	return response, err
+}
+
+func (r *RecordingResolver) ResolveWithSource(ctx context.Context, query []byte) ([]byte, string, error) {
+	var (
+		response []byte
+		source   string
+		err      error
+	)
+	response, source, err = resolveWithSource(ctx, r.next, query)
+	if err != nil {
+		return response, source, err
+	}
+
+	r.record(query, response)
+	return response, source, nil
+}
+
+func (r *RecordingResolver) record(query []byte, response []byte) {
+	var (
+		info *utils.QueryInfo
+		err  error
+	)
+	if info, err = utils.ParseQuery(query); err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err = r.encoder.Encode(recordedExchange{Key: info.CacheKey, Query: query, Response: response}); err != nil {
+		logger.Error(fmt.Sprintf("failed to record exchange for %s: %v", info.Domain, err))
+	}
+}
+
+func (r *RecordingResolver) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// serves the answers of a recording file, in the order they were recorded
+// the last answer for a key keeps being served once the others are used up
+type ReplayResolver struct {
+	mu        sync.Mutex
+	responses map[string][][]byte
+	served    map[string]int
+}
+
+func NewReplayResolver(filename string) (*ReplayResolver, error) {
+	var (
+		file     *os.File
+		scanner  *bufio.Scanner
+		exchange recordedExchange
+		replay   *ReplayResolver = &ReplayResolver{
+			responses: make(map[string][][]byte),
+			served:    make(map[string]int),
+		}
+		err error
+	)
+	file, err = os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner = bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		exchange = recordedExchange{}
+		if err = json.Unmarshal(scanner.Bytes(), &exchange); err != nil {
+			return nil, fmt.Errorf("invalid recording: %w", err)
+		}
+		replay.responses[exchange.Key] = append(replay.responses[exchange.Key], exchange.Response)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return replay, nil
+}
+
+func (r *ReplayResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var (
+		info      *utils.QueryInfo
+		responses [][]byte
+		response  []byte
+		index     int
+		err       error
+	)
+	if info, err = utils.ParseQuery(query); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	responses = r.responses[info.CacheKey]
+	if len(responses) == 0 {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("no recorded response for %s", info.CacheKey)
+	}
+
+	index = min(r.served[info.CacheKey], len(responses)-1)
+	r.served[info.CacheKey]++
+	r.mu.Unlock()
+
+	response = bytes.Clone(responses[index])
+	if len(response) >= 2 {
+		copy(response[0:2], query[0:2]) // answer with the id of this query
+	}
+
+	return response, nil
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+)
+
+// TEST 1: Recorded traffic replays identically
+// Tests that responses recorded through a mock come back the same from the replay
+func TestRecordingResolver_Replay(t *testing.T) {
+	var (
+		ctx       context.Context = context.Background()
+		filename  string          = filepath.Join(t.TempDir(), "traffic.jsonl")
+		upstream  *MockResolver   = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		recording *RecordingResolver
+		replay    *ReplayResolver
+		query     []byte = buildDNSQuery("example.com", 1, 1)
+		recorded  []byte
+		replayed  []byte
+		err       error
+	)
+
+	recording, err = NewRecordingResolver(upstream, filename)
+	if err != nil {
+		t.Fatalf("Failed to create recording resolver: %v", err)
+	}
+
+	recorded, err = recording.Resolve(ctx, query)
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if err = recording.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	replay, err = NewReplayResolver(filename)
+	if err != nil {
+		t.Fatalf("Failed to load recording: %v", err)
+	}
+
+	replayed, err = replay.Resolve(ctx, query)
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if !bytes.Equal(recorded, replayed) {
+		t.Error("Replayed response differs from the recorded one")
+	}
+
+	// a new query gets its own id back
+	binary.BigEndian.PutUint16(query[0:2], 0x9999)
+	replayed, _ = replay.Resolve(ctx, query)
+	if binary.BigEndian.Uint16(replayed[0:2]) != 0x9999 || !bytes.Equal(recorded[2:], replayed[2:]) {
+		t.Error("Replay should only change the transaction id")
+	}
+
+	if _, err = replay.Resolve(ctx, buildDNSQuery("unknown.com", 1, 1)); err == nil {
+		t.Error("Expected an error for a query that was never recorded")
+	}
+}
@@ -0,0 +1,441 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flash-dns/internal/utils"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RECURSION_MAX_REFERRALS   int           = 16              // delegations followed while resolving one name
+	RECURSION_MAX_DEPTH       int           = 6               // nested lookups for glueless nameservers and CNAME targets
+	RECURSION_MAX_DELEGATIONS int           = 4096            // cached zones before expired ones are pruned
+	RECURSIVE_SERVER_TIME     time.Duration = 2 * time.Second // how long one authoritative server gets to answer
+)
+
+// a.root-servers.net to m.root-servers.net
+var ROOT_HINTS []string = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13",
+	"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+	"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+	"202.12.27.33",
+}
+
+// nameservers of a zone learned from a referral
+type delegation struct {
+	servers   []string // addresses with the dns port
+	expiresAt time.Time
+}
+
+// resolves from the root servers by following delegations, no upstream forwarder
+// NS records and their glue are cached per zone so later names skip the root
+type RecursiveResolver struct {
+	roots       []string
+	timeout     time.Duration
+	mu          sync.Mutex
+	delegations map[string]delegation
+	exchange    func(ctx context.Context, server string, query []byte) ([]byte, error) // swapped in tests
+	now         func() time.Time
+}
+
+func NewRecursiveResolver() *RecursiveResolver {
+	var (
+		resolver *RecursiveResolver = &RecursiveResolver{
+			timeout:     RECURSIVE_SERVER_TIME,
+			delegations: make(map[string]delegation),
+			now:         time.Now,
+		}
+	)
+	for _, root := range ROOT_HINTS {
+		resolver.roots = append(resolver.roots, net.JoinHostPort(root, "53"))
+	}
+	resolver.exchange = resolver.exchangeServer
+
+	return resolver
+}
+
+func (r *RecursiveResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var (
+		queryInfo *utils.QueryInfo
+		answer    []utils.ResourceRecord
+		authority []utils.ResourceRecord
+		rcode     uint8
+		err       error
+	)
+	queryInfo, err = utils.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	answer, authority, rcode, err = r.resolveName(ctx, strings.ToLower(queryInfo.Domain), queryInfo.QType, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return utils.CreateSectionsResponse(query, rcode, answer, authority), nil
+}
+
+// answer and authority records for the name, following CNAMEs to the asked type
+// records outside the zone of the server that answered are dropped, a CNAME
+// leaving the zone is followed with a lookup of its own
+func (r *RecursiveResolver) resolveName(ctx context.Context, name string, qtype uint16, depth int) ([]utils.ResourceRecord, []utils.ResourceRecord, uint8, error) {
+	if depth > RECURSION_MAX_DEPTH {
+		return nil, nil, 0, fmt.Errorf("recursion too deep resolving %s", name)
+	}
+
+	var (
+		response  []byte
+		answer    []utils.ResourceRecord
+		authority []utils.ResourceRecord
+		chased    []utils.ResourceRecord
+		zone      string
+		target    string
+		rcode     uint8
+		err       error
+	)
+	response, zone, err = r.iterate(ctx, name, qtype, depth)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	answer, authority, _, err = utils.ParseRecords(response)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	answer, authority = inBailiwick(answer, zone), inBailiwick(authority, zone)
+	rcode = response[3] & 0x0F
+
+	if target = cnameTarget(answer, name, qtype); target == "" {
+		return answer, authority, rcode, nil
+	}
+
+	chased, authority, rcode, err = r.resolveName(ctx, target, qtype, depth+1)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return append(answer, chased...), authority, rcode, nil
+}
+
+// walks down from the closest known zone until a server answers the name,
+// returns the answer with the zone of the server that gave it
+func (r *RecursiveResolver) iterate(ctx context.Context, name string, qtype uint16, depth int) ([]byte, string, error) {
+	var (
+		zone        string
+		servers     []string
+		query       []byte = newRecursiveQuery(name, qtype)
+		response    []byte
+		authority   []utils.ResourceRecord
+		additional  []utils.ResourceRecord
+		child       string
+		nameservers []string
+		ttl         uint32
+		referrals   int
+		err         error
+	)
+	zone, servers = r.closestDelegation(name)
+
+	for referrals = 0; referrals < RECURSION_MAX_REFERRALS; referrals++ {
+		if err = ctx.Err(); err != nil {
+			return nil, "", err
+		}
+
+		response, err = r.ask(ctx, servers, query)
+		if err != nil {
+			return nil, "", fmt.Errorf("resolving %s in %q: %w", name, zone, err)
+		}
+
+		if response[3]&0x0F != 0 || binary.BigEndian.Uint16(response[6:8]) > 0 {
+			return response, zone, nil
+		}
+
+		_, authority, additional, err = utils.ParseRecords(response)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if child, nameservers, ttl = referral(authority, zone, name); child == "" {
+			return response, zone, nil // NODATA, or the server is authoritative for the name
+		}
+
+		servers = r.nameserverAddresses(ctx, nameservers, inBailiwick(additional, zone), depth)
+		if len(servers) == 0 {
+			return nil, "", fmt.Errorf("no address for the nameservers of %s", child)
+		}
+		r.remember(child, servers, ttl)
+		zone = child
+	}
+
+	return nil, "", fmt.Errorf("too many referrals resolving %s", name)
+}
+
+// closest zone above the name with cached nameservers, the root when none is known
+func (r *RecursiveResolver) closestDelegation(name string) (string, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var (
+		zone   string = name
+		cached delegation
+		found  bool
+		now    time.Time = r.now()
+		dot    int
+	)
+	for zone != "" {
+		if cached, found = r.delegations[zone]; found && now.Before(cached.expiresAt) {
+			return zone, cached.servers
+		}
+
+		if dot = strings.IndexByte(zone, '.'); dot < 0 {
+			break
+		}
+		zone = zone[dot+1:]
+	}
+
+	return "", r.roots
+}
+
+func (r *RecursiveResolver) remember(zone string, servers []string, ttl uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var now time.Time = r.now()
+	if len(r.delegations) >= RECURSION_MAX_DELEGATIONS {
+		for cachedZone, cached := range r.delegations {
+			if !now.Before(cached.expiresAt) {
+				delete(r.delegations, cachedZone)
+			}
+		}
+	}
+
+	r.delegations[zone] = delegation{servers: servers, expiresAt: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// addresses of the nameservers from the glue, resolving them when the referral has none
+// the glue is expected to be in the bailiwick of the server that sent it already
+func (r *RecursiveResolver) nameserverAddresses(ctx context.Context, nameservers []string, additional []utils.ResourceRecord, depth int) []string {
+	var (
+		servers []string
+		answer  []utils.ResourceRecord
+		err     error
+	)
+	for _, record := range additional {
+		if record.Type == utils.TYPE_A && len(record.Data) == net.IPv4len && containsName(nameservers, record.Name) {
+			servers = append(servers, net.JoinHostPort(net.IP(record.Data).String(), "53"))
+		}
+	}
+	if len(servers) > 0 {
+		return servers
+	}
+
+	for _, nameserver := range nameservers {
+		answer, _, _, err = r.resolveName(ctx, nameserver, utils.TYPE_A, depth+1)
+		if err != nil {
+			continue
+		}
+		for _, record := range answer {
+			if record.Type == utils.TYPE_A && len(record.Data) == net.IPv4len {
+				servers = append(servers, net.JoinHostPort(net.IP(record.Data).String(), "53"))
+			}
+		}
+		if len(servers) > 0 {
+			return servers
+		}
+	}
+
+	return nil
+}
+
+// servers are tried in order until one gives a usable answer
+func (r *RecursiveResolver) ask(ctx context.Context, servers []string, query []byte) ([]byte, error) {
+	var (
+		response []byte
+		rcode    uint8
+		err      error = fmt.Errorf("no servers to ask")
+	)
+	for _, server := range servers {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		response, err = r.exchange(ctx, server, query)
+		if err != nil {
+			continue
+		}
+
+		if len(response) < 12 || !bytes.Equal(response[0:2], query[0:2]) || response[2]&0x80 == 0 {
+			err = fmt.Errorf("bad answer from %s", server)
+			continue
+		}
+		if rcode = response[3] & 0x0F; rcode == 2 || rcode == 4 || rcode == 5 { // SERVFAIL, NOTIMP, REFUSED
+			err = fmt.Errorf("%s answered with rcode %d", server, rcode)
+			continue
+		}
+
+		return response, nil
+	}
+
+	return nil, err
+}
+
+// udp exchange with one server, retried over tcp when truncated
+// the query has no EDNS so the udp answer fits in 512 bytes
+func (r *RecursiveResolver) exchangeServer(ctx context.Context, server string, query []byte) ([]byte, error) {
+	var (
+		dialer      net.Dialer
+		conn        net.Conn
+		response    []byte = make([]byte, UDP_PLAIN_MAX_SIZE)
+		bytesRead   int
+		deadline    time.Time = time.Now().Add(r.timeout)
+		ctxDeadline time.Time
+		ok          bool
+		err         error
+	)
+	if ctxDeadline, ok = ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	conn, err = dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	if bytesRead, err = conn.Read(response); err != nil {
+		return nil, err
+	}
+	response = response[:bytesRead]
+
+	if !utils.IsTruncated(response) {
+		return response, nil
+	}
+
+	var tcpConn net.Conn
+	tcpConn, err = dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer tcpConn.Close()
+	tcpConn.SetDeadline(deadline)
+
+	return exchangeTCP(tcpConn, query, MAX_RESPONSE_BYTES)
+}
+
+// the zone a referral hands the name to, with its nameserver names and the NS ttl
+// only zones below the current one count, so a lame server can't send us back up
+func referral(authority []utils.ResourceRecord, zone string, name string) (string, []string, uint32) {
+	var (
+		child       string
+		nameservers []string
+		ttl         uint32
+		owner       string
+	)
+	for _, record := range authority {
+		if record.Type != utils.TYPE_NS {
+			continue
+		}
+
+		owner = strings.ToLower(record.Name)
+		if owner == zone || !isSubdomain(owner, zone) || !isSubdomain(name, owner) {
+			continue
+		}
+		if child != "" && owner != child {
+			continue
+		}
+
+		if child == "" || record.TTL < ttl {
+			ttl = record.TTL
+		}
+		child = owner
+		nameservers = append(nameservers, strings.ToLower(record.Target()))
+	}
+
+	return child, nameservers, ttl
+}
+
+// end of the CNAME chain when the answer doesn't hold the asked type yet, empty otherwise
+func cnameTarget(answer []utils.ResourceRecord, name string, qtype uint16) string {
+	if qtype == utils.TYPE_CNAME {
+		return ""
+	}
+
+	var (
+		current string = name
+		next    string
+		i       int
+	)
+	for i = 0; i <= len(answer); i++ {
+		next = ""
+		for _, record := range answer {
+			if !strings.EqualFold(record.Name, current) {
+				continue
+			}
+			if record.Type == qtype {
+				return ""
+			}
+			if record.Type == utils.TYPE_CNAME {
+				next = strings.ToLower(record.Target())
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		current = next
+	}
+
+	if current == name {
+		return ""
+	}
+	return current
+}
+
+// the records a server for the zone can speak for, the ones owned by the zone or
+// names below it. anything else could plant records for other names in the cache
+func inBailiwick(records []utils.ResourceRecord, zone string) []utils.ResourceRecord {
+	var kept []utils.ResourceRecord
+	for _, record := range records {
+		if isSubdomain(strings.ToLower(record.Name), zone) {
+			kept = append(kept, record)
+		}
+	}
+
+	return kept
+}
+
+// name is the zone itself or below it, the root zone is ""
+func isSubdomain(name string, zone string) bool {
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+func containsName(names []string, name string) bool {
+	for _, candidate := range names {
+		if strings.EqualFold(candidate, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// non recursive query for the name with a random id
+func newRecursiveQuery(name string, qtype uint16) []byte {
+	var query []byte = make([]byte, 12)
+	binary.BigEndian.PutUint16(query[0:2], uint16(rand.Uint32()))
+	binary.BigEndian.PutUint16(query[4:6], 1)
+
+	query = append(query, utils.EncodeName(name)...)
+	query = binary.BigEndian.AppendUint16(query, qtype)
+	return binary.BigEndian.AppendUint16(query, 1) // IN
+}
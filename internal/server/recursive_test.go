@@ -0,0 +1,338 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flash-dns/internal/utils"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TEST 1: Delegations are followed from the root
+// Tests that the resolver walks root -> com -> example.com and answers with the client id
+func TestRecursiveResolver_Resolve_FollowsDelegations(t *testing.T) {
+	var (
+		authorities *mockAuthorities   = newExampleAuthorities()
+		resolver    *RecursiveResolver = newMockRecursiveResolver(authorities)
+		query       []byte             = buildDNSQuery("www.example.com", utils.TYPE_A, 1)
+		response    []byte
+		ips         []net.IP
+		err         error
+	)
+	binary.BigEndian.PutUint16(query[0:2], 0x1234)
+
+	response, err = resolver.Resolve(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+
+	if binary.BigEndian.Uint16(response[0:2]) != 0x1234 {
+		t.Error("Transaction ID should be the client one")
+	}
+	if ips = utils.ExtractAnswers(response); len(ips) != 1 || ips[0].String() != "93.184.216.34" {
+		t.Errorf("Expected 93.184.216.34, got %v", ips)
+	}
+	if !slices.Equal(authorities.asked(), []string{"root:53", "192.0.2.1:53", "192.0.2.2:53"}) {
+		t.Errorf("Expected root, com and example.com to be asked, got %v", authorities.asked())
+	}
+}
+
+// TEST 2: Learned delegations skip the root
+// Tests that a second name in a known zone goes straight to its nameserver
+func TestRecursiveResolver_Resolve_CachesDelegations(t *testing.T) {
+	var (
+		authorities *mockAuthorities   = newExampleAuthorities()
+		resolver    *RecursiveResolver = newMockRecursiveResolver(authorities)
+		err         error
+	)
+
+	if _, err = resolver.Resolve(context.Background(), buildDNSQuery("www.example.com", utils.TYPE_A, 1)); err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	authorities.reset()
+
+	if _, err = resolver.Resolve(context.Background(), buildDNSQuery("mail.example.com", utils.TYPE_A, 1)); err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if !slices.Equal(authorities.asked(), []string{"192.0.2.2:53"}) {
+		t.Errorf("Expected only the example.com nameserver to be asked, got %v", authorities.asked())
+	}
+
+	resolver.now = func() time.Time { return time.Now().Add(2 * time.Hour) } // past the NS ttl
+	authorities.reset()
+	if _, err = resolver.Resolve(context.Background(), buildDNSQuery("mail.example.com", utils.TYPE_A, 1)); err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if len(authorities.asked()) == 0 || authorities.asked()[0] != "root:53" {
+		t.Errorf("Expected expired delegations to start from the root again, got %v", authorities.asked())
+	}
+}
+
+// TEST 3: Glueless nameservers are resolved first
+// Tests that a referral without glue resolves the nameserver name before continuing
+func TestRecursiveResolver_Resolve_Glueless(t *testing.T) {
+	var (
+		authorities *mockAuthorities   = newExampleAuthorities()
+		resolver    *RecursiveResolver = newMockRecursiveResolver(authorities)
+		response    []byte
+		ips         []net.IP
+		err         error
+	)
+	authorities.handle("192.0.2.1:53", func(query []byte, name string, qtype uint16) []byte {
+		if isSubdomain(name, "example.org") {
+			return referralResponse(query, "example.org", "ns.example.com", nil)
+		}
+		return referralResponse(query, "example.com", "ns1.example.com", net.IPv4(192, 0, 2, 2))
+	})
+	authorities.handle("root:53", func(query []byte, name string, qtype uint16) []byte {
+		if isSubdomain(name, "org") {
+			return referralResponse(query, "org", "a0.org-servers.net", net.IPv4(192, 0, 2, 1))
+		}
+		return referralResponse(query, "com", "a.gtld-servers.net", net.IPv4(192, 0, 2, 1))
+	})
+	authorities.handle("192.0.2.2:53", func(query []byte, name string, qtype uint16) []byte {
+		if name == "ns.example.com" {
+			return answerResponse(query, utils.ResourceRecord{Name: name, Type: utils.TYPE_A, Class: 1, TTL: 300, Data: []byte{192, 0, 2, 3}})
+		}
+		return answerResponse(query, utils.ResourceRecord{Name: name, Type: utils.TYPE_A, Class: 1, TTL: 300, Data: []byte{93, 184, 216, 34}})
+	})
+	authorities.handle("192.0.2.3:53", func(query []byte, name string, qtype uint16) []byte {
+		return answerResponse(query, utils.ResourceRecord{Name: name, Type: utils.TYPE_A, Class: 1, TTL: 300, Data: []byte{203, 0, 113, 7}})
+	})
+
+	response, err = resolver.Resolve(context.Background(), buildDNSQuery("www.example.org", utils.TYPE_A, 1))
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if ips = utils.ExtractAnswers(response); len(ips) != 1 || ips[0].String() != "203.0.113.7" {
+		t.Errorf("Expected 203.0.113.7 from the glueless nameserver, got %v", ips)
+	}
+}
+
+// TEST 4: CNAMEs are chased to the asked type
+// Tests that the answer holds the CNAME and the address of its target
+func TestRecursiveResolver_Resolve_ChasesCNAME(t *testing.T) {
+	var (
+		authorities *mockAuthorities   = newExampleAuthorities()
+		resolver    *RecursiveResolver = newMockRecursiveResolver(authorities)
+		response    []byte
+		answer      []utils.ResourceRecord
+		err         error
+	)
+	authorities.handle("192.0.2.2:53", func(query []byte, name string, qtype uint16) []byte {
+		if name == "www.example.com" {
+			return answerResponse(query, utils.ResourceRecord{Name: name, Type: utils.TYPE_CNAME, Class: 1, TTL: 300, Data: utils.EncodeName("cdn.example.com")})
+		}
+		return answerResponse(query, utils.ResourceRecord{Name: name, Type: utils.TYPE_A, Class: 1, TTL: 300, Data: []byte{198, 51, 100, 1}})
+	})
+
+	response, err = resolver.Resolve(context.Background(), buildDNSQuery("www.example.com", utils.TYPE_A, 1))
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+
+	answer, _, _, err = utils.ParseRecords(response)
+	if err != nil {
+		t.Fatalf("Failed to parse the answer: %v", err)
+	}
+	if len(answer) != 2 || answer[0].Target() != "cdn.example.com" || answer[1].Name != "cdn.example.com" {
+		t.Errorf("Expected the CNAME followed by the target address, got %+v", answer)
+	}
+}
+
+// TEST 5: The context deadline bounds the recursion
+// Tests that a silent server doesn't hold Resolve past the deadline
+func TestRecursiveResolver_Resolve_Deadline(t *testing.T) {
+	var (
+		resolver *RecursiveResolver = NewRecursiveResolver()
+		ctx      context.Context
+		cancel   context.CancelFunc
+		started  time.Time = time.Now()
+		err      error
+	)
+	resolver.exchange = func(ctx context.Context, server string, query []byte) ([]byte, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = resolver.Resolve(ctx, buildDNSQuery("example.com", utils.TYPE_A, 1))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a deadline error, got %v", err)
+	}
+	if time.Since(started) > time.Second {
+		t.Errorf("Resolve took %v, past the deadline", time.Since(started))
+	}
+}
+
+// TEST 6: Records outside the answering zone are dropped
+// Tests that an address planted for a CNAME target in another zone is ignored and the
+// target is looked up from its own nameservers
+func TestRecursiveResolver_Resolve_DropsOutOfBailiwick(t *testing.T) {
+	var (
+		authorities *mockAuthorities   = newExampleAuthorities()
+		resolver    *RecursiveResolver = newMockRecursiveResolver(authorities)
+		response    []byte
+		ips         []net.IP
+		err         error
+	)
+	authorities.handle("root:53", func(query []byte, name string, qtype uint16) []byte {
+		if isSubdomain(name, "net") {
+			return referralResponse(query, "net", "a.gtld-servers.net", net.IPv4(192, 0, 2, 4))
+		}
+		return referralResponse(query, "com", "a.gtld-servers.net", net.IPv4(192, 0, 2, 1))
+	})
+	authorities.handle("192.0.2.2:53", func(query []byte, name string, qtype uint16) []byte {
+		return answerResponse(query,
+			utils.ResourceRecord{Name: name, Type: utils.TYPE_CNAME, Class: 1, TTL: 300, Data: utils.EncodeName("cdn.other.net")},
+			utils.ResourceRecord{Name: "cdn.other.net", Type: utils.TYPE_A, Class: 1, TTL: 86400, Data: []byte{6, 6, 6, 6}})
+	})
+	authorities.handle("192.0.2.4:53", func(query []byte, name string, qtype uint16) []byte {
+		return answerResponse(query, utils.ResourceRecord{Name: name, Type: utils.TYPE_A, Class: 1, TTL: 300, Data: []byte{198, 51, 100, 9}})
+	})
+
+	response, err = resolver.Resolve(context.Background(), buildDNSQuery("www.example.com", utils.TYPE_A, 1))
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if ips = utils.ExtractAnswers(response); len(ips) != 1 || ips[0].String() != "198.51.100.9" {
+		t.Errorf("Expected only the address from the net nameserver, got %v", ips)
+	}
+}
+
+// TEST 7: Glue outside the delegating zone is ignored
+// Tests that a com server can't point example.com at an address for a nameserver
+// under net, the nameserver is resolved instead
+func TestRecursiveResolver_Resolve_IgnoresOutOfBailiwickGlue(t *testing.T) {
+	var (
+		authorities *mockAuthorities   = newExampleAuthorities()
+		resolver    *RecursiveResolver = newMockRecursiveResolver(authorities)
+		response    []byte
+		ips         []net.IP
+		err         error
+	)
+	authorities.handle("root:53", func(query []byte, name string, qtype uint16) []byte {
+		if isSubdomain(name, "net") {
+			return referralResponse(query, "net", "a.gtld-servers.net", net.IPv4(192, 0, 2, 4))
+		}
+		return referralResponse(query, "com", "a.gtld-servers.net", net.IPv4(192, 0, 2, 1))
+	})
+	authorities.handle("192.0.2.1:53", func(query []byte, name string, qtype uint16) []byte {
+		return referralResponse(query, "example.com", "ns1.example.net", net.IPv4(192, 0, 2, 2))
+	})
+	authorities.handle("192.0.2.4:53", func(query []byte, name string, qtype uint16) []byte {
+		return answerResponse(query, utils.ResourceRecord{Name: name, Type: utils.TYPE_A, Class: 1, TTL: 300, Data: []byte{192, 0, 2, 5}})
+	})
+	authorities.handle("192.0.2.5:53", func(query []byte, name string, qtype uint16) []byte {
+		return answerResponse(query, utils.ResourceRecord{Name: name, Type: utils.TYPE_A, Class: 1, TTL: 300, Data: []byte{203, 0, 113, 5}})
+	})
+
+	response, err = resolver.Resolve(context.Background(), buildDNSQuery("www.example.com", utils.TYPE_A, 1))
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if ips = utils.ExtractAnswers(response); len(ips) != 1 || ips[0].String() != "203.0.113.5" {
+		t.Errorf("Expected the answer of the resolved nameserver, got %v", ips)
+	}
+	if slices.Contains(authorities.asked(), "192.0.2.2:53") {
+		t.Errorf("Expected the out of zone glue to be ignored, asked %v", authorities.asked())
+	}
+}
+
+// ============================================================================
+// HELPER FUNCTIONS
+// ============================================================================
+
+// fake authoritative servers keyed by address
+type mockAuthorities struct {
+	mu       sync.Mutex
+	handlers map[string]func(query []byte, name string, qtype uint16) []byte
+	queries  []string
+}
+
+func (m *mockAuthorities) handle(server string, handler func(query []byte, name string, qtype uint16) []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[server] = handler
+}
+
+func (m *mockAuthorities) exchange(ctx context.Context, server string, query []byte) ([]byte, error) {
+	var (
+		handler   func(query []byte, name string, qtype uint16) []byte
+		queryInfo *utils.QueryInfo
+		found     bool
+		err       error
+	)
+	m.mu.Lock()
+	handler, found = m.handlers[server]
+	m.queries = append(m.queries, server)
+	m.mu.Unlock()
+
+	if !found {
+		return nil, errors.New("unknown server " + server)
+	}
+	if queryInfo, err = utils.ParseQuery(query); err != nil {
+		return nil, err
+	}
+
+	return handler(query, queryInfo.Domain, queryInfo.QType), nil
+}
+
+func (m *mockAuthorities) asked() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.queries...)
+}
+
+func (m *mockAuthorities) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries = nil
+}
+
+// root -> com (192.0.2.1) -> example.com (192.0.2.2)
+func newExampleAuthorities() *mockAuthorities {
+	var authorities *mockAuthorities = &mockAuthorities{handlers: make(map[string]func([]byte, string, uint16) []byte)}
+	authorities.handle("root:53", func(query []byte, name string, qtype uint16) []byte {
+		return referralResponse(query, "com", "a.gtld-servers.net", net.IPv4(192, 0, 2, 1))
+	})
+	authorities.handle("192.0.2.1:53", func(query []byte, name string, qtype uint16) []byte {
+		return referralResponse(query, "example.com", "ns1.example.com", net.IPv4(192, 0, 2, 2))
+	})
+	authorities.handle("192.0.2.2:53", func(query []byte, name string, qtype uint16) []byte {
+		return answerResponse(query, utils.ResourceRecord{Name: name, Type: utils.TYPE_A, Class: 1, TTL: 300, Data: []byte{93, 184, 216, 34}})
+	})
+	return authorities
+}
+
+func newMockRecursiveResolver(authorities *mockAuthorities) *RecursiveResolver {
+	var resolver *RecursiveResolver = NewRecursiveResolver()
+	resolver.roots = []string{"root:53"}
+	resolver.exchange = authorities.exchange
+	return resolver
+}
+
+// referral to zone with one nameserver, with an A glue record unless glue is nil
+func referralResponse(query []byte, zone string, nameserver string, glue net.IP) []byte {
+	var (
+		ns       utils.ResourceRecord = utils.ResourceRecord{Name: zone, Type: utils.TYPE_NS, Class: 1, TTL: 3600, Data: utils.EncodeName(nameserver)}
+		response []byte               = utils.CreateSectionsResponse(query, 0, nil, []utils.ResourceRecord{ns})
+	)
+	if glue == nil {
+		return response
+	}
+
+	binary.BigEndian.PutUint16(response[10:12], 1)
+	return utils.AppendRecord(response, utils.ResourceRecord{Name: nameserver, Type: utils.TYPE_A, Class: 1, TTL: 3600, Data: glue.To4()})
+}
+
+func answerResponse(query []byte, records ...utils.ResourceRecord) []byte {
+	var response []byte = utils.CreateSectionsResponse(query, 0, records, nil)
+	response[2] |= 0x04 // AA
+	return response
+}
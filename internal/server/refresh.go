@@ -0,0 +1,84 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// keeps track of the cache refreshes running or done per cache key
+// so concurrent queries don't refresh the same entry twice
+type refreshTracker struct {
+	mu       sync.Mutex
+	window   time.Duration // how long a finished refresh is remembered, zero forgets it right away
+	running  map[string]bool
+	finished map[string]time.Time
+}
+
+func newRefreshTracker(window time.Duration) *refreshTracker {
+	return &refreshTracker{
+		window:   window,
+		running:  make(map[string]bool),
+		finished: make(map[string]time.Time),
+	}
+}
+
+// marks the key as being refreshed, false if a refresh is already running
+func (r *refreshTracker) begin(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.running[key] {
+		return false
+	}
+
+	r.running[key] = true
+	return true
+}
+
+func (r *refreshTracker) end(key string, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.running, key)
+	if r.window > 0 {
+		r.finished[key] = now
+	}
+}
+
+// true when a refresh of the key is running or finished less than the window ago
+func (r *refreshTracker) isRecent(key string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.running[key] {
+		return true
+	}
+
+	var (
+		finished time.Time
+		found    bool
+	)
+	if finished, found = r.finished[key]; !found {
+		return false
+	}
+
+	if now.Sub(finished) >= r.window {
+		delete(r.finished, key)
+		return false
+	}
+
+	return true
+}
+
+// forgets the refreshes that finished more than the window ago, keys that
+// are never asked again would otherwise stay forever
+func (r *refreshTracker) prune(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, finished := range r.finished {
+		if now.Sub(finished) >= r.window {
+			delete(r.finished, key)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"flash-dns/internal/logger"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// the resolvers built from the upstream fields of the config, ReloadConfig swaps them together
+type upstreamSet struct {
+	resolver  Resolver
+	byType    map[uint16]Resolver // replaced as a whole, never modified once built
+	tcp       Resolver            // retries truncated udp answers, nil without udp upstreams
+	tcpByType map[uint16]Resolver // the same for the byType upstreams, missing without udp ones
+}
+
+// a nil resolver is built from the config with NewResolver, invalid upstreams
+// are logged and raced over udp
+func newUpstreams(config Config, resolver Resolver) upstreamSet {
+	var (
+		set upstreamSet = upstreamSet{
+			resolver:  resolver,
+			byType:    make(map[uint16]Resolver, len(config.UpstreamByType)),
+			tcp:       newTCPRetry(config.UpstreamDns, config.UpstreamProxy),
+			tcpByType: make(map[uint16]Resolver),
+		}
+		tcp Resolver
+		err error
+	)
+	if set.resolver == nil {
+		if set.resolver, err = NewResolver(config); err != nil {
+			logger.Error(fmt.Sprintf("invalid upstream config, racing the list over udp: %v", err))
+			set.resolver = NewUpstreamResolver(config.UpstreamDns)
+		}
+	}
+
+	for qtype, upstream := range config.UpstreamByType {
+		if set.byType[qtype], err = newResolverFor(upstream, config.UpstreamStrategy, config.UpstreamProxy); err != nil {
+			logger.Error(fmt.Sprintf("invalid upstream for type %d, racing it over udp: %v", qtype, err))
+			set.byType[qtype] = NewUpstreamResolver(upstream)
+		}
+		if tcp = newTCPRetry(upstream, config.UpstreamProxy); tcp != nil {
+			set.tcpByType[qtype] = tcp
+		}
+	}
+	setMaxResponseBytes(set.all(), config.MaxUpstreamResponseBytes)
+	setRetryOnServfail(set.all(), config.RetryOnServfail)
+
+	if config.MinTTL > 0 {
+		set.resolver = NewMinTTLResolver(set.resolver, config.MinTTL)
+		if set.tcp != nil {
+			set.tcp = NewMinTTLResolver(set.tcp, config.MinTTL)
+		}
+		for qtype, resolver := range set.byType {
+			set.byType[qtype] = NewMinTTLResolver(resolver, config.MinTTL)
+		}
+		for qtype, resolver := range set.tcpByType {
+			set.tcpByType[qtype] = NewMinTTLResolver(resolver, config.MinTTL)
+		}
+	}
+
+	return set
+}
+
+// tcp resolver for the plain udp upstreams of the list, nil when there are none
+// only they truncate, the other transports already carry full answers
+func newTCPRetry(upstream string, proxyURL string) Resolver {
+	var (
+		addresses []string = udpUpstreamAddrs(upstream)
+		resolver  *TCPResolver
+		err       error
+	)
+	if len(addresses) == 0 {
+		return nil
+	}
+
+	resolver = newTCPResolverAddrs(addresses)
+	if proxyURL != "" {
+		if err = resolver.SetProxy(proxyURL); err != nil {
+			logger.Error(fmt.Sprintf("failed to set upstream proxy, connecting directly: %v", err))
+		}
+	}
+
+	return resolver
+}
+
+// picks the upstream for the query type, falling back to the default one
+func (u upstreamSet) forType(qtype uint16) Resolver {
+	var (
+		resolver Resolver
+		found    bool
+	)
+	if resolver, found = u.byType[qtype]; found {
+		return resolver
+	}
+
+	return u.resolver
+}
+
+// the tcp retry for the upstream forType picks, nil when it has no udp upstreams
+func (u upstreamSet) tcpFor(qtype uint16) Resolver {
+	var found bool
+	if _, found = u.byType[qtype]; found {
+		return u.tcpByType[qtype]
+	}
+
+	return u.tcp
+}
+
+func (u upstreamSet) all() []Resolver {
+	var resolvers []Resolver = []Resolver{u.resolver, u.tcp}
+	for _, resolver := range u.byType {
+		resolvers = append(resolvers, resolver)
+	}
+	for _, resolver := range u.tcpByType {
+		resolvers = append(resolvers, resolver)
+	}
+
+	return resolvers
+}
+
+func (s *DNSServer) filterMode() string {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.config.FilterMode
+}
+
+func (s *DNSServer) sinkholeHost() string {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.config.SinkholeHost
+}
+
+func (s *DNSServer) allowlistFile() string {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.config.AllowlistFile
+}
+
+// applies a changed config while serving, e.g. one read again with LoadConfig on SIGHUP
+// the upstreams (with MinTTL, proxy, servfail retries and the response limit),
+// FilterMode, SinkholeHost and AllowlistFile are swapped, the allowlist is read on
+// the next ReloadFilter. fields that only take effect on a restart are logged
+// a nil resolver is built from the config like in NewDNSServer, an invalid
+// config returns an error and changes nothing
+func (s *DNSServer) ReloadConfig(config Config, resolver Resolver) error {
+	var (
+		upstreams upstreamSet
+		oldHost   string
+		err       error
+	)
+	if err = validateReloadable(config); err != nil {
+		return err
+	}
+	if resolver == nil {
+		if resolver, err = NewResolver(config); err != nil {
+			return fmt.Errorf("invalid upstream config: %w", err)
+		}
+	}
+	upstreams = newUpstreams(config, resolver)
+
+	for _, field := range s.restartOnlyChanges(config) {
+		logger.Warn(fmt.Sprintf("config field %s changed, it only takes effect after a restart", field))
+	}
+
+	s.configMu.Lock()
+	oldHost = s.config.SinkholeHost
+	s.resolver, s.resolversByType, s.tcpResolver, s.tcpByType = upstreams.resolver, upstreams.byType, upstreams.tcp, upstreams.tcpByType
+	s.config.UpstreamDns = config.UpstreamDns
+	s.config.UpstreamStrategy = config.UpstreamStrategy
+	s.config.UpstreamByType = config.UpstreamByType
+	s.config.UpstreamProxy = config.UpstreamProxy
+	s.config.MinTTL = config.MinTTL
+	s.config.RetryOnServfail = config.RetryOnServfail
+	s.config.MaxUpstreamResponseBytes = config.MaxUpstreamResponseBytes
+	s.config.FilterMode = config.FilterMode
+	s.config.SinkholeHost = config.SinkholeHost
+	s.config.AllowlistFile = config.AllowlistFile
+	s.configMu.Unlock()
+
+	if config.SinkholeHost == "" {
+		s.sinkhole.Store(nil)
+	} else if config.SinkholeHost != oldHost {
+		s.resolveSinkhole(context.Background())
+	}
+
+	logger.Info("Config reloaded, upstream DNS: " + config.UpstreamDns)
+	return nil
+}
+
+// the checks NewDNSServer only logs, a reload refuses the config instead
+func validateReloadable(config Config) error {
+	var err error
+	switch strings.ToLower(config.FilterMode) {
+	case "", "nxdomain", "null", "cname":
+	default:
+		return fmt.Errorf("unknown filter mode %q", config.FilterMode)
+	}
+
+	for qtype, upstream := range config.UpstreamByType {
+		if _, err = newResolverFor(upstream, config.UpstreamStrategy, config.UpstreamProxy); err != nil {
+			return fmt.Errorf("invalid upstream for type %d: %w", qtype, err)
+		}
+	}
+
+	return nil
+}
+
+// the Config fields ReloadConfig applies, a change to any other is only
+// picked up by a restart
+var reloadedFields map[string]bool = map[string]bool{
+	"UpstreamDns":              true,
+	"UpstreamStrategy":         true,
+	"UpstreamByType":           true,
+	"UpstreamProxy":            true,
+	"MinTTL":                   true,
+	"RetryOnServfail":          true,
+	"MaxUpstreamResponseBytes": true,
+	"FilterMode":               true,
+	"SinkholeHost":             true,
+	"AllowlistFile":            true,
+}
+
+// names of the changed fields that are only read when the server starts,
+// every field not in reloadedFields
+func (s *DNSServer) restartOnlyChanges(config Config) []string {
+	var (
+		current Config
+		old     reflect.Value
+		new     reflect.Value
+		name    string
+		changed []string
+		i       int
+	)
+	s.configMu.RLock()
+	current = s.config
+	s.configMu.RUnlock()
+
+	old, new = reflect.ValueOf(current), reflect.ValueOf(config)
+	for i = 0; i < old.NumField(); i++ {
+		if name = old.Type().Field(i).Name; reloadedFields[name] {
+			continue
+		}
+		if !reflect.DeepEqual(old.Field(i).Interface(), new.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+
+	return changed
+}
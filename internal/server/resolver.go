@@ -3,41 +3,101 @@ package server
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"flash-dns/internal/logger"
 	"fmt"
+	"io"
 	"net"
+	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/proxy"
 )
 
+const MAX_RESPONSE_BYTES int = 65535 // biggest message dns allows
+
+// the limits can be changed while queries are running, zero means MAX_RESPONSE_BYTES
 type UpstreamResolver struct {
-	upstreamAddrs []string
-	timeout       time.Duration
+	upstreamAddrs    []string
+	timeout          time.Duration
+	maxResponseBytes atomic.Int64
+	retryServfail    atomic.Bool
 }
 
 func NewUpstreamResolver(upstream string) *UpstreamResolver {
-	var addresses []string = strings.Split(upstream, ",")
-	for i, v := range addresses {
-		addresses[i] = strings.TrimSpace(v) + ":53"
-	}
+	return newUpstreamResolverAddrs(parseUpstreams(upstream))
+}
 
+func newUpstreamResolverAddrs(addresses []string) *UpstreamResolver {
 	return &UpstreamResolver{
 		upstreamAddrs: addresses,
 		timeout:       5 * time.Second,
 	}
 }
 
+// answers bigger than n bytes are dropped, values <= 0 reset to MAX_RESPONSE_BYTES
+func (u *UpstreamResolver) SetMaxResponseBytes(n int) {
+	u.maxResponseBytes.Store(int64(clampResponseBytes(n)))
+}
+
+// a SERVFAIL doesn't win the race, it's returned only if every upstream gives it
+func (u *UpstreamResolver) SetRetryOnServfail(retry bool) {
+	u.retryServfail.Store(retry)
+}
+
+func clampResponseBytes(n int) int {
+	if n <= 0 || n > MAX_RESPONSE_BYTES {
+		return MAX_RESPONSE_BYTES
+	}
+
+	return n
+}
+
+// splits the comma separated upstream list and adds the dns port
+func parseUpstreams(upstream string) []string {
+	var addresses []string = strings.Split(upstream, ",")
+	for i, v := range addresses {
+		addresses[i] = strings.TrimSpace(v) + ":53"
+	}
+
+	return addresses
+}
+
+// answer from one of the raced upstreams, err is set when it failed
+type upstreamAnswer struct {
+	response []byte
+	address  string
+	err      error
+}
+
 func (u *UpstreamResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var (
+		response []byte
+		err      error
+	)
+	response, _, err = u.ResolveWithSource(ctx, query)
+	return response, err
+}
+
+// same as Resolve but also says which upstream won the race
+func (u *UpstreamResolver) ResolveWithSource(ctx context.Context, query []byte) ([]byte, string, error) {
 	select {
 	case <-ctx.Done():
-		return nil, ctx.Err()
+		return nil, "", ctx.Err()
 	default:
 	}
 	var (
-		queryCtx     context.Context
-		cancel       context.CancelFunc
-		response     []byte      = make([]byte, 512)
-		responseChan chan []byte = make(chan []byte, len(u.upstreamAddrs))
+		queryCtx       context.Context
+		cancel         context.CancelFunc
+		answer         upstreamAnswer
+		servfail       []byte
+		servfailSource string
+		pending        int                 = len(u.upstreamAddrs)
+		timeout        <-chan time.Time    = time.After(u.timeout)
+		responseChan   chan upstreamAnswer = make(chan upstreamAnswer, len(u.upstreamAddrs))
 	)
 	queryCtx, cancel = context.WithCancel(ctx)
 	defer cancel()
@@ -45,31 +105,59 @@ func (u *UpstreamResolver) Resolve(ctx context.Context, query []byte) ([]byte, e
 		go u.resolveUpstream(queryCtx, address, query, responseChan)
 	}
 
-	select {
-	case response = <-responseChan:
-		return response, nil
+	for pending > 0 {
+		select {
+		case answer = <-responseChan:
+			pending--
+			if answer.err != nil {
+				continue
+			}
+			if u.retryServfail.Load() && isServfail(answer.response) {
+				logger.Info(fmt.Sprintf("upstream %s answered SERVFAIL, waiting for the others", answer.address))
+				servfail, servfailSource = answer.response, answer.address
+				continue
+			}
+			return answer.response, answer.address, nil
 
-	case <-ctx.Done():
-		return nil, ctx.Err()
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+
+		case <-timeout:
+			pending = 0
+		}
+	}
 
-	case <-time.After(u.timeout):
-		return nil, fmt.Errorf("all upstream dns failed")
+	if servfail != nil {
+		return servfail, servfailSource, nil
 	}
 
+	return nil, "", fmt.Errorf("all upstream dns failed")
 }
 
-func (u *UpstreamResolver) resolveUpstream(ctx context.Context, address string, query []byte, responseChan chan []byte) {
+func (u *UpstreamResolver) resolveUpstream(ctx context.Context, address string, query []byte, responseChan chan upstreamAnswer) {
+	var answer upstreamAnswer = upstreamAnswer{address: address}
+	if answer.response, answer.err = u.exchange(address, query); answer.err != nil {
+		logger.ErrorLimited("upstream "+address, answer.err.Error())
+	}
+
+	select {
+	case responseChan <- answer:
+		// do nothing :)
+	case <-ctx.Done():
+		return
+	}
+}
+
+func (u *UpstreamResolver) exchange(address string, query []byte) ([]byte, error) {
 	var (
-		conn      net.Conn
-		err       error
-		deadline  time.Time
-		response  []byte = make([]byte, 512)
-		bytesRead int
+		conn     net.Conn
+		err      error
+		deadline time.Time
+		response []byte
 	)
 	conn, err = net.Dial("udp", address)
 	if err != nil {
-		logger.Error(fmt.Sprintf("failed to connect to upstream %s: %v", address, err))
-		return
+		return nil, fmt.Errorf("failed to connect to upstream %s: %v", address, err)
 	}
 	defer conn.Close()
 
@@ -77,20 +165,201 @@ func (u *UpstreamResolver) resolveUpstream(ctx context.Context, address string,
 	conn.SetDeadline(deadline)
 
 	if _, err = conn.Write(query); err != nil {
-		logger.Error(fmt.Sprintf("failed to write query to %s: %v", address, err))
-		return
+		return nil, fmt.Errorf("failed to write query to %s: %v", address, err)
 	}
 
-	bytesRead, err = conn.Read(response)
+	response, err = readUDPResponse(conn, clampResponseBytes(int(u.maxResponseBytes.Load())))
 	if err != nil {
-		logger.Error(fmt.Sprintf("failed to read response from %s: %v", address, err))
-		return
+		return nil, fmt.Errorf("failed to read response from %s: %v", address, err)
 	}
 
-	select {
-	case responseChan <- bytes.Clone(response[:bytesRead]):
-		// do nothing :)
-	case <-ctx.Done():
-		return
+	return response, nil
+}
+
+// read buffers of the udp exchanges, big enough for any answer and the byte spotting
+// oversized ones. pooled so a query doesn't allocate 64KB
+var udpResponsePool = sync.Pool{
+	New: func() interface{} {
+		var buffer []byte = make([]byte, MAX_RESPONSE_BYTES+1)
+		return &buffer
+	},
+}
+
+// reads one answer of at most limit bytes, the result is a copy of the pooled buffer
+func readUDPResponse(conn net.Conn, limit int) ([]byte, error) {
+	var (
+		buffer    *[]byte = udpResponsePool.Get().(*[]byte)
+		bytesRead int
+		err       error
+	)
+	defer udpResponsePool.Put(buffer)
+
+	if bytesRead, err = conn.Read((*buffer)[:limit+1]); err != nil {
+		return nil, err
+	}
+	if bytesRead > limit {
+		return nil, fmt.Errorf("response is bigger than %d bytes, dropping it", limit)
+	}
+
+	return bytes.Clone((*buffer)[:bytesRead]), nil
+}
+
+// TCP resolver, used when the udp answer comes back truncated
+// upstreams are tried in order until one answers
+type TCPResolver struct {
+	upstreamAddrs    []string
+	timeout          time.Duration
+	maxResponseBytes atomic.Int64        // zero means MAX_RESPONSE_BYTES
+	dialer           proxy.ContextDialer // nil dials directly
+}
+
+func NewTCPResolver(upstream string) *TCPResolver {
+	return newTCPResolverAddrs(parseUpstreams(upstream))
+}
+
+func newTCPResolverAddrs(addresses []string) *TCPResolver {
+	return &TCPResolver{
+		upstreamAddrs: addresses,
+		timeout:       5 * time.Second,
 	}
 }
+
+// answers bigger than n bytes are rejected, values <= 0 reset to MAX_RESPONSE_BYTES
+func (t *TCPResolver) SetMaxResponseBytes(n int) {
+	t.maxResponseBytes.Store(int64(clampResponseBytes(n)))
+}
+
+// sends the upstream connections through a socks5:// proxy
+func (t *TCPResolver) SetProxy(rawURL string) error {
+	var (
+		dialer proxy.ContextDialer
+		err    error
+	)
+	if dialer, err = newProxyDialer(rawURL, t.timeout); err != nil {
+		return err
+	}
+
+	t.dialer = dialer
+	return nil
+}
+
+// dialer going through the socks5:// proxy, shared by the tcp, tls and https resolvers
+func newProxyDialer(rawURL string, timeout time.Duration) (proxy.ContextDialer, error) {
+	var (
+		proxyURL      *url.URL
+		dialer        proxy.Dialer
+		contextDialer proxy.ContextDialer
+		err           error
+		ok            bool
+	)
+	proxyURL, err = url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %w", err)
+	}
+
+	if proxyURL.Scheme != "socks5" && proxyURL.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q, only socks5 is supported", proxyURL.Scheme)
+	}
+
+	dialer, err = proxy.FromURL(proxyURL, &net.Dialer{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+
+	if contextDialer, ok = dialer.(proxy.ContextDialer); !ok {
+		return nil, fmt.Errorf("proxy dialer doesn't support contexts")
+	}
+
+	return contextDialer, nil
+}
+
+func (t *TCPResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var (
+		response []byte
+		err      error
+	)
+	response, _, err = t.ResolveWithSource(ctx, query)
+	return response, err
+}
+
+// same as Resolve but also says which upstream answered
+func (t *TCPResolver) ResolveWithSource(ctx context.Context, query []byte) ([]byte, string, error) {
+	var (
+		response []byte
+		err      error
+	)
+
+	for _, address := range t.upstreamAddrs {
+		select {
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		default:
+		}
+
+		response, err = t.resolveUpstream(ctx, address, query)
+		if err == nil {
+			return response, "tcp://" + address, nil
+		}
+		logger.ErrorLimited("tcp upstream "+address, fmt.Sprintf("tcp query to upstream %s failed: %v", address, err))
+	}
+
+	return nil, "", fmt.Errorf("all tcp upstream dns failed")
+}
+
+func (t *TCPResolver) resolveUpstream(ctx context.Context, address string, query []byte) ([]byte, error) {
+	var (
+		dialer      proxy.ContextDialer = t.dialer
+		conn        net.Conn
+		err         error
+		deadline    time.Time = time.Now().Add(t.timeout)
+		ctxDeadline time.Time
+		ok          bool
+	)
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: t.timeout}
+	}
+
+	conn, err = dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if ctxDeadline, ok = ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	return exchangeTCP(conn, query, clampResponseBytes(int(t.maxResponseBytes.Load())))
+}
+
+// writes the query with its 2 byte length prefix and reads the answer back
+func exchangeTCP(conn net.Conn, query []byte, maxResponseBytes int) ([]byte, error) {
+	var (
+		message  []byte = make([]byte, 2+len(query))
+		length   []byte = make([]byte, 2)
+		response []byte
+		err      error
+	)
+	binary.BigEndian.PutUint16(message[0:2], uint16(len(query)))
+	copy(message[2:], query)
+
+	if _, err = conn.Write(message); err != nil {
+		return nil, err
+	}
+
+	if _, err = io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+
+	if int(binary.BigEndian.Uint16(length)) > maxResponseBytes {
+		return nil, fmt.Errorf("response of %d bytes is bigger than the %d bytes limit", binary.BigEndian.Uint16(length), maxResponseBytes)
+	}
+
+	response = make([]byte, binary.BigEndian.Uint16(length))
+	if _, err = io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
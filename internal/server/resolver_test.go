@@ -1,10 +1,15 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"io"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -86,6 +91,171 @@ func (m *mockDNSServer) close() {
 	}
 }
 
+// mockTCPDNSServer answers DNS over TCP (2 byte length prefix)
+type mockTCPDNSServer struct {
+	addr     string
+	listener net.Listener
+	response []byte
+}
+
+func startMockTCPDNSServer(response []byte) (*mockTCPDNSServer, error) {
+	var (
+		listener net.Listener
+		err      error
+		server   *mockTCPDNSServer
+	)
+
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	server = &mockTCPDNSServer{
+		addr:     listener.Addr().String(),
+		listener: listener,
+		response: response,
+	}
+
+	go server.serve()
+
+	return server, nil
+}
+
+func (m *mockTCPDNSServer) serve() {
+	for {
+		var (
+			conn net.Conn
+			err  error
+		)
+		conn, err = m.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			var (
+				length   []byte = make([]byte, 2)
+				query    []byte
+				response []byte = make([]byte, 2+len(m.response))
+				readErr  error  // the accept loop keeps using err
+			)
+			if _, readErr = io.ReadFull(conn, length); readErr != nil {
+				return
+			}
+			query = make([]byte, binary.BigEndian.Uint16(length))
+			if _, readErr = io.ReadFull(conn, query); readErr != nil {
+				return
+			}
+
+			binary.BigEndian.PutUint16(response[0:2], uint16(len(m.response)))
+			copy(response[2:], m.response)
+			copy(response[2:4], query[0:2])
+			conn.Write(response)
+		}()
+	}
+}
+
+func (m *mockTCPDNSServer) close() {
+	m.listener.Close()
+}
+
+// fakeSOCKS5Server is a no-auth socks5 proxy that counts the CONNECTs it relays
+type fakeSOCKS5Server struct {
+	addr     string
+	listener net.Listener
+	connects atomic.Int32
+}
+
+func startFakeSOCKS5Server() (*fakeSOCKS5Server, error) {
+	var (
+		listener net.Listener
+		err      error
+		server   *fakeSOCKS5Server
+	)
+
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	server = &fakeSOCKS5Server{addr: listener.Addr().String(), listener: listener}
+	go server.serve()
+
+	return server, nil
+}
+
+func (f *fakeSOCKS5Server) serve() {
+	for {
+		var (
+			conn net.Conn
+			err  error
+		)
+		conn, err = f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeSOCKS5Server) handle(conn net.Conn) {
+	defer conn.Close()
+	var (
+		header  []byte = make([]byte, 2)
+		request []byte = make([]byte, 4)
+		host    string
+		port    []byte = make([]byte, 2)
+		target  net.Conn
+		err     error
+	)
+
+	// greeting: version, number of methods, methods
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return
+	}
+	conn.Write([]byte{0x05, 0x00}) // no authentication
+
+	// request: version, CONNECT, reserved, address type
+	if _, err = io.ReadFull(conn, request); err != nil || request[1] != 0x01 {
+		return
+	}
+	switch request[3] {
+	case 0x01:
+		var ip []byte = make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 0x03:
+		var length []byte = make([]byte, 1)
+		io.ReadFull(conn, length)
+		var name []byte = make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	io.ReadFull(conn, port)
+
+	target, err = net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	f.connects.Add(1)
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func (f *fakeSOCKS5Server) close() {
+	f.listener.Close()
+}
+
 // ============================================================================
 // TESTS
 // ============================================================================
@@ -383,30 +553,30 @@ func TestUpstreamResolver_Resolve_AllUpstreamsFail(t *testing.T) {
 }
 
 // TEST 10: resolveUpstream handles connection errors gracefully
-// Tests that individual upstream failures don't crash the resolver
+// Tests that individual upstream failures don't crash the resolver and are reported as errors
 func TestUpstreamResolver_ResolveUpstream_ConnectionError(t *testing.T) {
 	var (
-		ctx          context.Context   = context.Background()
-		query        []byte            = buildDNSQuery("example.com", 1, 1)
-		responseChan chan []byte       = make(chan []byte, 1)
-		resolver     *UpstreamResolver = &UpstreamResolver{
+		ctx          context.Context     = context.Background()
+		query        []byte              = buildDNSQuery("example.com", 1, 1)
+		responseChan chan upstreamAnswer = make(chan upstreamAnswer, 1)
+		resolver     *UpstreamResolver   = &UpstreamResolver{
 			upstreamAddrs: []string{"invalid-address:53"},
 			timeout:       1 * time.Second,
 		}
+		answer upstreamAnswer
 	)
 
 	// This should not panic, just log error and return
 	go resolver.resolveUpstream(ctx, "invalid-address:53", query, responseChan)
 
-	// Wait a bit to ensure goroutine completes
-	time.Sleep(100 * time.Millisecond)
-
-	// Channel should be empty (no response sent)
+	// the failure is reported so the race doesn't wait for it
 	select {
-	case <-responseChan:
-		t.Error("Should not receive response from invalid address")
-	default:
-		// Expected: no response
+	case answer = <-responseChan:
+		if answer.err == nil || answer.response != nil {
+			t.Errorf("Expected an error without a response, got %v and %d bytes", answer.err, len(answer.response))
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the failure to be reported")
 	}
 }
 
@@ -497,5 +667,329 @@ func TestUpstreamResolver_Resolve_ContextTimeout(t *testing.T) {
 	}
 }
 
+// TEST 13: TCP resolver reads length-prefixed answers
+// Tests that the TCP resolver talks DNS over TCP and keeps the transaction ID
+func TestTCPResolver_Resolve_Success(t *testing.T) {
+	var (
+		ctx          context.Context = context.Background()
+		query        []byte          = buildDNSQuery("example.com", 1, 1)
+		mockResponse []byte          = buildDNSResponse("example.com", 1, 1, 3600, []byte{1, 2, 3, 4})
+		server       *mockTCPDNSServer
+		resolver     *TCPResolver
+		response     []byte
+		err          error
+	)
+
+	binary.BigEndian.PutUint16(query[0:2], 0xBEEF)
+
+	server, err = startMockTCPDNSServer(mockResponse)
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer server.close()
+
+	resolver = &TCPResolver{
+		upstreamAddrs: []string{"127.0.0.1:1", server.addr}, // first one fails over
+		timeout:       2 * time.Second,
+	}
+
+	response, err = resolver.Resolve(ctx, query)
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	if len(response) != len(mockResponse) {
+		t.Errorf("Expected %d bytes, got %d", len(mockResponse), len(response))
+	}
+	if binary.BigEndian.Uint16(response[0:2]) != 0xBEEF {
+		t.Error("Transaction ID should be preserved")
+	}
+}
+
+// TEST 14: Oversized UDP answers are dropped
+// Tests that a response bigger than the configured limit is rejected
+func TestUpstreamResolver_Resolve_OversizedResponse(t *testing.T) {
+	var (
+		ctx          context.Context = context.Background()
+		query        []byte          = buildDNSQuery("example.com", 16, 1)
+		mockResponse []byte          = buildDNSResponse("example.com", 16, 1, 300, make([]byte, 2000))
+		server       *mockDNSServer
+		resolver     *UpstreamResolver
+		response     []byte
+		err          error
+	)
+
+	server, err = startMockDNSServer(mockResponse, 0)
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer server.close()
+
+	resolver = &UpstreamResolver{
+		upstreamAddrs: []string{server.addr},
+		timeout:       300 * time.Millisecond,
+	}
+	resolver.SetMaxResponseBytes(1024)
+
+	response, err = resolver.Resolve(ctx, query)
+	if err == nil {
+		t.Errorf("Expected oversized response to be rejected, got %d bytes", len(response))
+	}
+
+	resolver = &UpstreamResolver{ // default limit is the dns max
+		upstreamAddrs: []string{server.addr},
+		timeout:       300 * time.Millisecond,
+	}
+	response, err = resolver.Resolve(ctx, query)
+	if err != nil {
+		t.Fatalf("Resolve failed under the default limit: %v", err)
+	}
+	if len(response) != len(mockResponse) {
+		t.Errorf("Expected %d bytes, got %d", len(mockResponse), len(response))
+	}
+}
+
+// TEST 15: Oversized TCP answers are rejected
+// Tests that the TCP length prefix is checked against the limit before reading
+func TestTCPResolver_Resolve_OversizedResponse(t *testing.T) {
+	var (
+		ctx          context.Context = context.Background()
+		mockResponse []byte          = buildDNSResponse("example.com", 16, 1, 300, make([]byte, 2000))
+		server       *mockTCPDNSServer
+		resolver     *TCPResolver
+		err          error
+	)
+
+	server, err = startMockTCPDNSServer(mockResponse)
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer server.close()
+
+	resolver = NewTCPResolver("127.0.0.1")
+	resolver.upstreamAddrs = []string{server.addr}
+	resolver.SetMaxResponseBytes(1024)
+
+	if _, err = resolver.Resolve(ctx, buildDNSQuery("example.com", 16, 1)); err == nil {
+		t.Error("Expected oversized TCP response to be rejected")
+	}
+}
+
+// TEST 16: Server applies the configured response limit
+// Tests that NewDNSServer passes MaxUpstreamResponseBytes to its resolvers
+func TestNewDNSServer_MaxUpstreamResponseBytes(t *testing.T) {
+	var (
+		config Config = Config{
+			LocalAddr:                "127.0.0.1:5353",
+			UpstreamDns:              "8.8.8.8",
+			MaxUpstreamResponseBytes: 4096,
+		}
+		resolver *UpstreamResolver = NewUpstreamResolver("8.8.8.8")
+		server   *DNSServer
+	)
+
+	server = NewDNSServer(config, resolver, nil)
+
+	if resolver.maxResponseBytes.Load() != 4096 {
+		t.Errorf("Expected UDP limit 4096, got %d", resolver.maxResponseBytes.Load())
+	}
+	if server.tcpResolver.(*TCPResolver).maxResponseBytes.Load() != 4096 {
+		t.Errorf("Expected TCP limit 4096, got %d", server.tcpResolver.(*TCPResolver).maxResponseBytes.Load())
+	}
+}
+
+// TEST 17: TCP resolver connects through a SOCKS5 proxy
+// Tests that upstream connections go through the configured proxy
+func TestTCPResolver_Resolve_ThroughSOCKS5(t *testing.T) {
+	var (
+		ctx          context.Context = context.Background()
+		mockResponse []byte          = buildDNSResponse("example.com", 1, 1, 3600, []byte{1, 2, 3, 4})
+		upstream     *mockTCPDNSServer
+		socks        *fakeSOCKS5Server
+		resolver     *TCPResolver
+		response     []byte
+		err          error
+	)
+
+	upstream, err = startMockTCPDNSServer(mockResponse)
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer upstream.close()
+
+	socks, err = startFakeSOCKS5Server()
+	if err != nil {
+		t.Fatalf("Failed to start socks5 server: %v", err)
+	}
+	defer socks.close()
+
+	resolver = NewTCPResolver("127.0.0.1")
+	resolver.upstreamAddrs = []string{upstream.addr}
+	if err = resolver.SetProxy("socks5://" + socks.addr); err != nil {
+		t.Fatalf("SetProxy failed: %v", err)
+	}
+
+	response, err = resolver.Resolve(ctx, buildDNSQuery("example.com", 1, 1))
+	if err != nil {
+		t.Fatalf("Resolve through proxy failed: %v", err)
+	}
+
+	if len(response) != len(mockResponse) {
+		t.Errorf("Expected %d bytes, got %d", len(mockResponse), len(response))
+	}
+	if socks.connects.Load() != 1 {
+		t.Errorf("Expected 1 connection through the proxy, got %d", socks.connects.Load())
+	}
+}
+
+// TEST 18: Only socks5 proxies are accepted
+// Tests that other proxy schemes are rejected
+func TestTCPResolver_SetProxy_InvalidScheme(t *testing.T) {
+	var resolver *TCPResolver = NewTCPResolver("127.0.0.1")
+
+	var err error
+	if err = resolver.SetProxy("http://127.0.0.1:8080"); err == nil {
+		t.Error("Expected http proxy to be rejected")
+	}
+	if resolver.dialer != nil {
+		t.Error("Dialer should stay unset after a rejected proxy")
+	}
+}
+
+// TEST 19: Racing upstreams skip a SERVFAIL when configured
+// Tests that the fast SERVFAIL doesn't win the race with RetryOnServfail and the slower NOERROR answer does
+func TestUpstreamResolver_Resolve_RetryOnServfail(t *testing.T) {
+	var (
+		ctx            context.Context = context.Background()
+		query          []byte          = buildDNSQuery("example.com", 1, 1)
+		servfailServer *mockDNSServer
+		goodServer     *mockDNSServer
+		resolver       *UpstreamResolver
+		response       []byte
+		err            error
+	)
+
+	servfailServer, err = startMockDNSServer(servfailResponse(), 0)
+	if err != nil {
+		t.Fatalf("Failed to start servfail server: %v", err)
+	}
+	defer servfailServer.close()
+
+	goodServer, err = startMockDNSServer(buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4}), 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to start good server: %v", err)
+	}
+	defer goodServer.close()
+
+	resolver = &UpstreamResolver{
+		upstreamAddrs: []string{servfailServer.addr, goodServer.addr},
+		timeout:       2 * time.Second,
+	}
+	resolver.SetRetryOnServfail(true)
+
+	if response, err = resolver.Resolve(ctx, query); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if response[3]&0x0F != 0 {
+		t.Errorf("Expected the NOERROR answer, got rcode %d", response[3]&0x0F)
+	}
+
+	// a SERVFAIL from every upstream is still answered
+	resolver.upstreamAddrs = []string{servfailServer.addr}
+	if response, err = resolver.Resolve(ctx, query); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if response[3]&0x0F != RCODE_SERVFAIL {
+		t.Errorf("Expected the SERVFAIL answer, got rcode %d", response[3]&0x0F)
+	}
+}
+
 // Note: Helper functions buildDNSQuery, buildDNSResponse, and splitDomain
 // are defined in dnsServer_test.go and shared across test files in this package
+
+// TEST 20: Limits can change while queries run
+// Tests that SetMaxResponseBytes and SetRetryOnServfail are safe during Resolve and
+// that the pooled read buffers give every query its own answer (run with -race)
+func TestUpstreamResolver_Resolve_ConcurrentSettings(t *testing.T) {
+	var (
+		mockResponse []byte = buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})
+		server       *mockDNSServer
+		resolver     *UpstreamResolver
+		wg           sync.WaitGroup
+		i            int
+		err          error
+	)
+	if server, err = startMockDNSServer(mockResponse, 0); err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer server.close()
+
+	resolver = NewUpstreamResolver("127.0.0.1")
+	resolver.upstreamAddrs = []string{server.addr}
+
+	for i = 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			var (
+				response []byte
+				err      error
+			)
+			if response, err = resolver.Resolve(context.Background(), buildDNSQuery("example.com", 1, 1)); err != nil {
+				t.Errorf("Resolve failed: %v", err)
+				return
+			}
+			if !bytes.Equal(response[2:], mockResponse[2:]) {
+				t.Error("Expected the upstream answer back")
+			}
+		}()
+		go func(n int) {
+			defer wg.Done()
+			resolver.SetMaxResponseBytes(4096 + n)
+			resolver.SetRetryOnServfail(n%2 == 0)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TEST 21: A kept SERVFAIL survives a later failing upstream
+// Tests that with RetryOnServfail the SERVFAIL is answered when the other upstream
+// fails after it, instead of a nil response without an error
+func TestUpstreamResolver_Resolve_ServfailThenError(t *testing.T) {
+	var (
+		ctx            context.Context = context.Background()
+		query          []byte          = buildDNSQuery("example.com", 1, 1)
+		servfailServer *mockDNSServer
+		brokenServer   *mockDNSServer
+		resolver       *UpstreamResolver
+		response       []byte
+		err            error
+	)
+
+	servfailServer, err = startMockDNSServer(servfailResponse(), 0)
+	if err != nil {
+		t.Fatalf("Failed to start servfail server: %v", err)
+	}
+	defer servfailServer.close()
+
+	// the oversized answer makes this upstream fail, after the SERVFAIL came in
+	brokenServer, err = startMockDNSServer(buildDNSResponse("example.com", 16, 1, 300, make([]byte, 200)), 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to start broken server: %v", err)
+	}
+	defer brokenServer.close()
+
+	resolver = &UpstreamResolver{
+		upstreamAddrs: []string{servfailServer.addr, brokenServer.addr},
+		timeout:       2 * time.Second,
+	}
+	resolver.SetRetryOnServfail(true)
+	resolver.SetMaxResponseBytes(100)
+
+	if response, err = resolver.Resolve(ctx, query); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if len(response) < 4 || response[3]&0x0F != RCODE_SERVFAIL {
+		t.Errorf("Expected the SERVFAIL answer, got %v", response)
+	}
+}
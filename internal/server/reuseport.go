@@ -0,0 +1,24 @@
+//go:build (linux && !mips && !mipsle && !mips64 && !mips64le) || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package server
+
+import "syscall"
+
+const REUSE_PORT_SUPPORTED bool = true
+
+// sets SO_REUSEPORT before bind, so several processes can share the port and
+// the kernel spreads the packets between them
+func reusePortControl(network string, address string, c syscall.RawConn) error {
+	var (
+		sockErr error
+		err     error
+	)
+	err = c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
@@ -0,0 +1,7 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package server
+
+import "syscall"
+
+const soReusePort int = syscall.SO_REUSEPORT
@@ -0,0 +1,6 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package server
+
+// the frozen syscall package has no SO_REUSEPORT on linux, it's 15 on every arch but mips
+const soReusePort int = 0xf
@@ -0,0 +1,15 @@
+//go:build (!linux || mips || mipsle || mips64 || mips64le) && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package server
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// no SO_REUSEPORT here, Start warns and listens without it
+const REUSE_PORT_SUPPORTED bool = false
+
+func reusePortControl(network string, address string, c syscall.RawConn) error {
+	return fmt.Errorf("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,47 @@
+//go:build (linux && !mips && !mipsle && !mips64 && !mips64le) || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+// TEST 1: Two sockets share a port with ReusePort
+// Tests that a second udp and tcp listener can bind the address of the first only when the option is set
+func TestListen_ReusePort(t *testing.T) {
+	var (
+		first     *net.UDPConn
+		second    *net.UDPConn
+		tcpFirst  net.Listener
+		tcpSecond net.Listener
+		address   string
+		err       error
+	)
+	if first, err = listenUDP("127.0.0.1:0", true); err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer first.Close()
+	address = first.LocalAddr().String()
+
+	if second, err = listenUDP(address, true); err != nil {
+		t.Fatalf("Expected a second udp socket on %s, got %v", address, err)
+	}
+	second.Close()
+
+	if second, err = listenUDP(address, false); err == nil {
+		second.Close()
+		t.Errorf("Expected the udp bind without ReusePort to fail")
+	}
+
+	if tcpFirst, err = listenTCP("127.0.0.1:0", true); err != nil {
+		t.Fatalf("Failed to listen on tcp: %v", err)
+	}
+	defer tcpFirst.Close()
+	address = tcpFirst.Addr().String()
+
+	if tcpSecond, err = listenTCP(address, true); err != nil {
+		t.Fatalf("Expected a second tcp listener on %s, got %v", address, err)
+	}
+	tcpSecond.Close()
+}
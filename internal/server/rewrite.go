@@ -0,0 +1,89 @@
+package server
+
+import (
+	"flash-dns/internal/utils"
+	"net"
+	"strings"
+)
+
+// changes the A or AAAA records of the upstream answer for a domain
+// e.g. force example.com to 10.0.0.5, or strip AAAA from a v4 only service
+type RewriteRule struct {
+	Domain string // exact match, "*." prefix matches the domain and its subdomains
+	QType  uint16 // utils.TYPE_A or utils.TYPE_AAAA
+	Answer net.IP // replaces the address, nil drops the records
+}
+
+func (r RewriteRule) matches(domain string) bool {
+	return matchesDomainPattern(r.Domain, domain)
+}
+
+// exact match, "*." prefix matches the domain and its subdomains
+func matchesDomainPattern(pattern string, domain string) bool {
+	var ruleDomain string = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(pattern), "."))
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	if strings.HasPrefix(ruleDomain, "*.") {
+		ruleDomain = ruleDomain[2:]
+		return domain == ruleDomain || strings.HasSuffix(domain, "."+ruleDomain)
+	}
+
+	return domain == ruleDomain
+}
+
+// address in the wire size of the record type, nil when it doesn't fit
+func (r RewriteRule) rdata() []byte {
+	if r.QType == utils.TYPE_A {
+		return r.Answer.To4()
+	}
+
+	if r.Answer.To4() != nil { // an IPv4 can't replace an AAAA
+		return nil
+	}
+
+	return r.Answer.To16()
+}
+
+// applies the first matching rule per record type to the upstream answer
+func (s *DNSServer) applyRewrites(domain string, response []byte) []byte {
+	var (
+		rules  map[uint16]RewriteRule
+		exists bool
+	)
+	for _, rule := range s.config.RewriteRules {
+		if !rule.matches(domain) {
+			continue
+		}
+
+		if rules == nil {
+			rules = make(map[uint16]RewriteRule)
+		}
+		if _, exists = rules[rule.QType]; !exists {
+			rules[rule.QType] = rule
+		}
+	}
+
+	if rules == nil {
+		return response
+	}
+
+	return utils.RewriteAddresses(response, func(rtype uint16, rdata []byte) ([]byte, bool) {
+		var (
+			rule  RewriteRule
+			found bool
+		)
+		if rule, found = rules[rtype]; !found {
+			return rdata, true
+		}
+
+		if rule.Answer == nil {
+			return nil, false
+		}
+
+		if rule.rdata() == nil {
+			return rdata, true
+		}
+
+		return rule.rdata(), true
+	})
+}
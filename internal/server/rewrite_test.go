@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"flash-dns/internal/utils"
+	"net"
+	"testing"
+)
+
+// TEST 1: Forced IP rewrite
+// Tests that a matching A answer is replaced before it is returned and cached
+func TestDNSServer_QueryUpstream_RewriteForcedIP(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:    "127.0.0.1:5353",
+			UpstreamDns:  "8.8.8.8:53",
+			RewriteRules: []RewriteRule{{Domain: "example.com", QType: utils.TYPE_A, Answer: net.ParseIP("10.0.0.5")}},
+		}
+		resolver  *MockResolver = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{93, 184, 216, 34})}
+		server    *DNSServer    = NewDNSServer(config, resolver, nil)
+		queryInfo *utils.QueryInfo
+		response  []byte
+		cached    []byte
+		ips       []net.IP
+		err       error
+	)
+
+	queryInfo, err = utils.ParseQuery(buildDNSQuery("example.com", 1, 1))
+	if err != nil {
+		t.Fatalf("Failed to parse query: %v", err)
+	}
+
+	response, err = server.queryUpstream(ctx, buildDNSQuery("example.com", 1, 1), queryInfo)
+	if err != nil {
+		t.Fatalf("queryUpstream failed: %v", err)
+	}
+
+	ips = utils.ExtractAnswers(response)
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 5)) {
+		t.Errorf("Expected the forced 10.0.0.5, got %v", ips)
+	}
+
+	cached, _, _ = server.cache.Get(queryInfo.CacheKey)
+	ips = utils.ExtractAnswers(cached)
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 5)) {
+		t.Errorf("Expected the rewritten answer in the cache, got %v", ips)
+	}
+
+	// other domains are untouched
+	queryInfo, _ = utils.ParseQuery(buildDNSQuery("www.example.com", 1, 1))
+	response, _ = server.queryUpstream(ctx, buildDNSQuery("www.example.com", 1, 1), queryInfo)
+	ips = utils.ExtractAnswers(response)
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(93, 184, 216, 34)) {
+		t.Errorf("Exact rule should not match subdomains, got %v", ips)
+	}
+}
+
+// TEST 2: AAAA strip rewrite
+// Tests that a wildcard rule removes AAAA answers for the domain and its subdomains
+func TestDNSServer_QueryUpstream_RewriteStripAAAA(t *testing.T) {
+	var (
+		ctx    context.Context = context.Background()
+		config Config          = Config{
+			LocalAddr:    "127.0.0.1:5353",
+			UpstreamDns:  "8.8.8.8:53",
+			RewriteRules: []RewriteRule{{Domain: "*.v4only.com", QType: utils.TYPE_AAAA}},
+		}
+		resolver  *MockResolver = &MockResolver{response: buildDNSResponse("api.v4only.com", 28, 1, 300, net.ParseIP("2001:db8::1"))}
+		server    *DNSServer    = NewDNSServer(config, resolver, nil)
+		queryInfo *utils.QueryInfo
+		response  []byte
+		err       error
+	)
+
+	queryInfo, err = utils.ParseQuery(buildDNSQuery("api.v4only.com", 28, 1))
+	if err != nil {
+		t.Fatalf("Failed to parse query: %v", err)
+	}
+
+	response, err = server.queryUpstream(ctx, buildDNSQuery("api.v4only.com", 28, 1), queryInfo)
+	if err != nil {
+		t.Fatalf("queryUpstream failed: %v", err)
+	}
+
+	if binary.BigEndian.Uint16(response[6:8]) != 0 {
+		t.Errorf("Expected the AAAA answer to be stripped, got %d answers", binary.BigEndian.Uint16(response[6:8]))
+	}
+	if binary.BigEndian.Uint16(response[2:4])&0x000F != 0 {
+		t.Error("Stripped answer should stay NOERROR")
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"flash-dns/internal/logger"
+	"flash-dns/internal/utils"
+	"fmt"
+	"net"
+	"time"
+)
+
+const SINKHOLE_LOOKUP_TIME time.Duration = 5 * time.Second // how long resolving Config.SinkholeHost may take
+
+// addresses null mode answers point to, resolved from Config.SinkholeHost
+type sinkholeAddrs struct {
+	v4 net.IP // nil answers 0.0.0.0
+	v6 net.IP // nil answers AAAA queries with v4, like the plain null answer
+}
+
+// address for a blocked answer to a qtype query, nil falls back to 0.0.0.0
+func (s *DNSServer) sinkholeIP(qtype uint16) net.IP {
+	var addrs *sinkholeAddrs = s.sinkhole.Load()
+	if addrs == nil {
+		return nil
+	}
+
+	if qtype == utils.TYPE_AAAA && addrs.v6 != nil {
+		return addrs.v6
+	}
+	return addrs.v4
+}
+
+// looks the sinkhole host up through our own upstream, the system resolver
+// may well be this server which isn't answering yet
+// a failed lookup keeps the previous addresses, 0.0.0.0 if there were none
+func (s *DNSServer) resolveSinkhole(ctx context.Context) {
+	var (
+		addrs  sinkholeAddrs
+		host   string = s.sinkholeHost()
+		cancel context.CancelFunc
+		err    error
+	)
+	ctx, cancel = context.WithTimeout(ctx, SINKHOLE_LOOKUP_TIME)
+	defer cancel()
+
+	if addrs, err = s.lookupSinkhole(ctx, host); err != nil {
+		logger.Error(fmt.Sprintf("failed to resolve sinkhole host %s: %v", host, err))
+		return
+	}
+
+	logger.Info(fmt.Sprintf("Sinkhole %s resolved to %v %v", host, addrs.v4, addrs.v6))
+	s.sinkhole.Store(&addrs)
+}
+
+func (s *DNSServer) lookupSinkhole(ctx context.Context, host string) (sinkholeAddrs, error) {
+	var (
+		addrs    sinkholeAddrs
+		ip       net.IP   = net.ParseIP(host)
+		resolver Resolver = s.currentUpstreams().resolver
+		query    []byte
+		response []byte
+		err      error
+	)
+	if ip != nil {
+		return splitSinkholeIPs([]net.IP{ip}), nil
+	}
+
+	for _, qtype := range []uint16{utils.TYPE_A, utils.TYPE_AAAA} {
+		query = newRecursiveQuery(host, qtype)
+		query[2] |= 0x01 // RD, upstreams are recursive resolvers
+
+		if response, err = resolver.Resolve(ctx, query); err != nil {
+			return sinkholeAddrs{}, err
+		}
+		addrs = mergeSinkholeAddrs(addrs, splitSinkholeIPs(utils.ExtractAnswers(response)))
+	}
+
+	if addrs.v4 == nil && addrs.v6 == nil {
+		return sinkholeAddrs{}, fmt.Errorf("no A or AAAA records")
+	}
+	return addrs, nil
+}
+
+// first ipv4 and first ipv6 address of the list
+func splitSinkholeIPs(ips []net.IP) sinkholeAddrs {
+	var addrs sinkholeAddrs
+	for _, ip := range ips {
+		if ip.To4() != nil && addrs.v4 == nil {
+			addrs.v4 = ip.To4()
+		} else if ip.To4() == nil && addrs.v6 == nil {
+			addrs.v6 = ip
+		}
+	}
+
+	return addrs
+}
+
+func mergeSinkholeAddrs(addrs sinkholeAddrs, found sinkholeAddrs) sinkholeAddrs {
+	if addrs.v4 == nil {
+		addrs.v4 = found.v4
+	}
+	if addrs.v6 == nil {
+		addrs.v6 = found.v6
+	}
+
+	return addrs
+}
+
+// resolves the sinkhole host again every Config.SinkholeRefreshInterval
+func (s *DNSServer) sinkholeRefresher(ctx context.Context) {
+	var ticker *time.Ticker = time.NewTicker(s.config.SinkholeRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.resolveSinkhole(ctx)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"flash-dns/internal/filter"
+	"flash-dns/internal/utils"
+	"strings"
+)
+
+// answers the RFC 6761 special-use names without asking upstream:
+// localhost names get the loopback addresses, .invalid, .test and .example get NXDOMAIN
+// returns false for every other name. checked after the local answers, so a zone
+// or hosts file can still define names under them
+func specialUseResponse(query []byte, queryInfo *utils.QueryInfo) ([]byte, bool) {
+	var domain string = strings.TrimSuffix(strings.ToLower(queryInfo.Domain), ".")
+	if domain == "localhost" || strings.HasSuffix(domain, ".localhost") {
+		return localhostResponse(query, queryInfo)
+	}
+
+	if specialUseNXDomain(domain) {
+		return filter.CreateErrorResponse(query, RCODE_NXDOMAIN), true
+	}
+
+	return nil, false
+}
+
+// true under the special-use TLDs of RFC 6761 that never exist in the global DNS
+func specialUseNXDomain(domain string) bool {
+	switch domain[strings.LastIndex(domain, ".")+1:] {
+	case "invalid", "test", "example":
+		return true
+	}
+
+	return false
+}
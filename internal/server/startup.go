@@ -0,0 +1,30 @@
+package server
+
+import (
+	"flash-dns/internal/logger"
+	"strings"
+)
+
+// values of Config.StartupBehavior
+const (
+	STARTUP_REFUSE  string = "refuse"  // REFUSED for everything that would be filtered
+	STARTUP_FORWARD string = "forward" // resolved without filtering
+)
+
+// true once the blocklist is in place, right away without Config.StartupBehavior
+func (s *DNSServer) Ready() bool {
+	return s.ready.Load()
+}
+
+// called when the blocklist finished loading, e.g. after ReloadFilter with the list
+// queries are filtered from then on
+func (s *DNSServer) MarkReady() {
+	if !s.ready.Swap(true) {
+		logger.Info("Blocklist loaded, filtering queries")
+	}
+}
+
+// true when queries that aren't ready to be filtered are refused
+func (s *DNSServer) refuseUntilReady() bool {
+	return strings.EqualFold(s.config.StartupBehavior, STARTUP_REFUSE)
+}
@@ -3,20 +3,50 @@ package server
 import (
 	"flash-dns/internal/logger"
 	"fmt"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+const STATS_LOG_MAX_INTERVAL time.Duration = time.Hour // log even without changes after this long
+
+// buckets of the response size histogram: up to 512 bytes (plain udp), up to 1232
+// (the EDNS size that avoids fragmentation), up to 4096 and anything larger
+const RESPONSE_SIZE_BUCKETS int = 4
+
 type Statistics struct {
-	blockedCount atomic.Uint64
-	allowedCount atomic.Uint64
-	cacheHits    atomic.Uint64
-	cacheMisses  atomic.Uint64
+	blockedCount    atomic.Uint64 // blocked by a blocklist rule
+	blockedByPolicy atomic.Uint64 // blocked because default deny and not allowlisted
+	allowedCount    atomic.Uint64
+	cacheHits       atomic.Uint64
+	cacheMisses     atomic.Uint64
+	inFlight        atomic.Int64 // queries being handled right now, refreshes included
+	rateLimited     atomic.Uint64
+	nonRecursive    atomic.Uint64 // queries with RD clear, refused or not
+	amplified       atomic.Uint64 // answers dropped by the amplification limit
+	writeErrors     atomic.Uint64 // answers that couldn't be written back to the client
+	notImplemented  atomic.Uint64 // queries with an opcode other than QUERY, answered NOTIMP
+	servedExpired   atomic.Uint64 // answers past the grace period served during an upstream outage
+	duplicates      atomic.Uint64 // resent queries answered with the one still in flight
+	responseSizes   [RESPONSE_SIZE_BUCKETS]atomic.Uint64
+	nxdomainLimited atomic.Uint64 // queries refused because the client caused too many NXDOMAIN answers
+
+	// Log skips the line when nothing changed since the last one
+	logMu          sync.Mutex
+	lastLogged     [4]uint64
+	lastLogTime    time.Time
+	maxLogInterval time.Duration    // zero means STATS_LOG_MAX_INTERVAL
+	logf           func(msg string) // zero means logger.Info
 }
 
 func (s *Statistics) incrementBlocked() {
 	_ = s.blockedCount.Add(1)
 }
 
+func (s *Statistics) incrementBlockedByPolicy() {
+	_ = s.blockedByPolicy.Add(1)
+}
+
 func (s *Statistics) incrementAllowed() {
 	_ = s.allowedCount.Add(1)
 }
@@ -29,8 +59,129 @@ func (s *Statistics) incrementCacheMisses() {
 	_ = s.cacheMisses.Add(1)
 }
 
+func (s *Statistics) incrementInFlight() {
+	_ = s.inFlight.Add(1)
+}
+
+func (s *Statistics) decrementInFlight() {
+	_ = s.inFlight.Add(-1)
+}
+
+func (s *Statistics) incrementRateLimited() {
+	_ = s.rateLimited.Add(1)
+}
+
+func (s *Statistics) incrementNonRecursive() {
+	_ = s.nonRecursive.Add(1)
+}
+
+func (s *Statistics) incrementAmplificationLimited() {
+	_ = s.amplified.Add(1)
+}
+
+func (s *Statistics) incrementWriteErrors() {
+	_ = s.writeErrors.Add(1)
+}
+
+func (s *Statistics) incrementNotImplemented() {
+	_ = s.notImplemented.Add(1)
+}
+
+func (s *Statistics) incrementServedExpired() {
+	_ = s.servedExpired.Add(1)
+}
+
+func (s *Statistics) recordResponseSize(size int) {
+	_ = s.responseSizes[responseSizeBucket(size)].Add(1)
+}
+
+func responseSizeBucket(size int) int {
+	switch {
+	case size <= 512:
+		return 0
+	case size <= 1232:
+		return 1
+	case size <= 4096:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// answers sent per size bucket, see RESPONSE_SIZE_BUCKETS
+func (s *Statistics) ResponseSizes() [RESPONSE_SIZE_BUCKETS]uint64 {
+	var (
+		sizes [RESPONSE_SIZE_BUCKETS]uint64
+		i     int
+	)
+	for i = 0; i < RESPONSE_SIZE_BUCKETS; i++ {
+		sizes[i] = s.responseSizes[i].Load()
+	}
+
+	return sizes
+}
+
+func (s *Statistics) incrementNxdomainThrottled() {
+	_ = s.nxdomainLimited.Add(1)
+}
+
+// uncached queries refused by Config.MaxNxdomainPerSecond
+func (s *Statistics) NxdomainThrottled() uint64 {
+	return s.nxdomainLimited.Load()
+}
+
+func (s *Statistics) incrementDuplicates() {
+	_ = s.duplicates.Add(1)
+}
+
+// client resends that waited for the same query in flight instead of resolving again
+func (s *Statistics) Duplicates() uint64 {
+	return s.duplicates.Load()
+}
+
+// last resort answers of Config.ServeExpiredOnOutage
+func (s *Statistics) ServedExpired() uint64 {
+	return s.servedExpired.Load()
+}
+
+// NOTIFY, UPDATE and the other opcodes we don't handle
+func (s *Statistics) NotImplemented() uint64 {
+	return s.notImplemented.Load()
+}
+
+// answers lost because writing them to the client failed, e.g. the client went
+// away or the socket buffer was full
+func (s *Statistics) WriteErrors() uint64 {
+	return s.writeErrors.Load()
+}
+
+// udp answers dropped because the client got too many amplified ones
+func (s *Statistics) AmplificationLimited() uint64 {
+	return s.amplified.Load()
+}
+
+// queries that came with the RD bit clear
+func (s *Statistics) NonRecursive() uint64 {
+	return s.nonRecursive.Load()
+}
+
+// queries dropped by the global qps limit
+func (s *Statistics) RateLimited() uint64 {
+	return s.rateLimited.Load()
+}
+
+// number of queries currently being processed or waiting on upstream
+func (s *Statistics) InFlight() int64 {
+	return s.inFlight.Load()
+}
+
+// blocked is the sum of both reasons, see GetBlockedStats for the split
 func (s *Statistics) GetStats() (blocked, allowed, cacheHits, cacheMisses uint64) {
-	return s.blockedCount.Load(), s.allowedCount.Load(), s.cacheHits.Load(), s.cacheMisses.Load()
+	return s.blockedCount.Load() + s.blockedByPolicy.Load(), s.allowedCount.Load(), s.cacheHits.Load(), s.cacheMisses.Load()
+}
+
+func (s *Statistics) GetBlockedStats() (byList, byPolicy uint64) {
+	return s.blockedCount.Load(), s.blockedByPolicy.Load()
 }
 
 func (s *Statistics) Log() {
@@ -39,16 +190,71 @@ func (s *Statistics) Log() {
 		allowed      uint64
 		cacheHits    uint64
 		cacheMisses  uint64
+		byList       uint64
+		byPolicy     uint64
 		total        uint64
 		blockRate    float64
 		CacheHitRate float64
 	)
 
 	blocked, allowed, cacheHits, cacheMisses = s.GetStats()
+	if !s.shouldLog([4]uint64{blocked, allowed, cacheHits, cacheMisses}, time.Now()) {
+		return
+	}
 	total = blocked + allowed
 
 	blockRate = float64(blocked) / float64(total) * 100
 	CacheHitRate = float64(cacheHits) / float64(cacheHits+cacheMisses) * 100
 
-	logger.Info(fmt.Sprintf("Status - Total: %d | Blocked: %d (%.1f%%) | Cache Hit Rate: %.1f%%", total, blocked, blockRate, CacheHitRate))
+	byList, byPolicy = s.GetBlockedStats()
+	s.log(fmt.Sprintf("Status - Total: %d | Blocked: %d (%.1f%%) [list: %d, policy: %d] | Cache Hit Rate: %.1f%% | In Flight: %d", total, blocked, blockRate, byList, byPolicy, CacheHitRate, s.InFlight()))
+}
+
+// zeroes the counters, e.g. after Log for per interval reports
+// InFlight isn't a counter and is left alone
+func (s *Statistics) Reset() {
+	s.blockedCount.Store(0)
+	s.blockedByPolicy.Store(0)
+	s.allowedCount.Store(0)
+	s.cacheHits.Store(0)
+	s.cacheMisses.Store(0)
+	s.rateLimited.Store(0)
+	s.nonRecursive.Store(0)
+	s.amplified.Store(0)
+	s.writeErrors.Store(0)
+	s.notImplemented.Store(0)
+	s.servedExpired.Store(0)
+	s.duplicates.Store(0)
+	s.nxdomainLimited.Store(0)
+	for i := range s.responseSizes {
+		s.responseSizes[i].Store(0)
+	}
+}
+
+// true when the counters changed or the last line is older than the max interval
+func (s *Statistics) shouldLog(counters [4]uint64, now time.Time) bool {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+
+	var maxInterval time.Duration = s.maxLogInterval
+	if maxInterval <= 0 {
+		maxInterval = STATS_LOG_MAX_INTERVAL
+	}
+
+	if !s.lastLogTime.IsZero() && counters == s.lastLogged && now.Sub(s.lastLogTime) < maxInterval {
+		return false
+	}
+
+	s.lastLogged = counters
+	s.lastLogTime = now
+	return true
+}
+
+func (s *Statistics) log(msg string) {
+	if s.logf != nil {
+		s.logf(msg)
+		return
+	}
+
+	logger.Info(msg)
 }
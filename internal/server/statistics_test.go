@@ -1,8 +1,11 @@
 package server
 
 import (
+	"context"
+	"flash-dns/internal/filter"
 	"sync"
 	"testing"
+	"time"
 )
 
 // TEST 1: Initialize statistics with zero values
@@ -564,3 +567,142 @@ func TestStatistics_RealisticScenario(t *testing.T) {
 	// Log shouldn't panic
 	stats.Log()
 }
+
+// TEST 19: Log suppresses unchanged counters
+// Tests that a second Log with no changes is skipped and a change logs again
+func TestStatistics_Log_SuppressesDuplicates(t *testing.T) {
+	var (
+		lines []string
+		stats *Statistics = &Statistics{
+			logf: func(msg string) { lines = append(lines, msg) },
+		}
+	)
+
+	stats.incrementAllowed()
+	stats.Log()
+	stats.Log()
+
+	if len(lines) != 1 {
+		t.Fatalf("Expected the unchanged second Log to be suppressed, got %d lines", len(lines))
+	}
+
+	stats.incrementBlocked()
+	stats.Log()
+
+	if len(lines) != 2 {
+		t.Errorf("Expected a new line after counters changed, got %d lines", len(lines))
+	}
+}
+
+// TEST 20: Log still writes after the max interval
+// Tests that unchanged counters are logged again once the interval passes
+func TestStatistics_Log_MaxInterval(t *testing.T) {
+	var (
+		lines []string
+		stats *Statistics = &Statistics{
+			logf:           func(msg string) { lines = append(lines, msg) },
+			maxLogInterval: 10 * time.Millisecond,
+		}
+	)
+
+	stats.Log()
+	time.Sleep(20 * time.Millisecond)
+	stats.Log()
+
+	if len(lines) != 2 {
+		t.Errorf("Expected unchanged stats to be logged after the max interval, got %d lines", len(lines))
+	}
+}
+
+// TEST 21: The stats reporter logs on every tick and can reset the counters
+// Tests that StartStatsReporter logs periodically, resets after logging and stops with the context
+func TestDNSServer_StartStatsReporter(t *testing.T) {
+	var tests = []struct {
+		name    string
+		reset   bool
+		allowed uint64
+	}{
+		{"keeps the counters", false, 3},
+		{"resets the counters", true, 0},
+	}
+
+	for _, test := range tests {
+		var (
+			mu    sync.Mutex
+			lines []string
+			stats *Statistics = &Statistics{
+				maxLogInterval: time.Nanosecond, // log every tick even if nothing changed
+				logf: func(msg string) {
+					mu.Lock()
+					lines = append(lines, msg)
+					mu.Unlock()
+				},
+			}
+			server  *DNSServer = NewDNSServer(Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}, &MockResolver{}, filter.NewFilterList())
+			ctx     context.Context
+			cancel  context.CancelFunc
+			count   int
+			allowed uint64
+			i       int
+		)
+		server.statistics = stats
+		for i = 0; i < 3; i++ {
+			stats.incrementAllowed()
+		}
+
+		ctx, cancel = context.WithCancel(context.Background())
+		server.StartStatsReporter(ctx, 10*time.Millisecond, test.reset)
+		time.Sleep(55 * time.Millisecond)
+
+		mu.Lock()
+		count = len(lines)
+		mu.Unlock()
+		if count < 2 {
+			t.Errorf("%s: expected periodic lines, got %d", test.name, count)
+		}
+		if _, allowed, _, _ = stats.GetStats(); allowed != test.allowed {
+			t.Errorf("%s: expected %d allowed after the reports, got %d", test.name, test.allowed, allowed)
+		}
+
+		// the last line is written on cancel, nothing after it
+		cancel()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		count = len(lines)
+		mu.Unlock()
+		time.Sleep(30 * time.Millisecond)
+		mu.Lock()
+		if len(lines) != count {
+			t.Errorf("%s: expected the reporter to stop, got %d more lines", test.name, len(lines)-count)
+		}
+		mu.Unlock()
+	}
+}
+
+// TEST 22: Sent answers are counted by size
+// Tests that send files each answer into its size bucket, with the bounds counted
+// in the lower bucket, and that Reset clears the histogram
+func TestStatistics_ResponseSizes(t *testing.T) {
+	var (
+		stats    *Statistics                   = &Statistics{}
+		server   *DNSServer                    = NewDNSServer(Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}, &MockResolver{}, nil)
+		writer   *recordingWriter              = &recordingWriter{}
+		query    []byte                        = buildDNSQuery("example.com", 1, 1)
+		expected [RESPONSE_SIZE_BUCKETS]uint64 = [RESPONSE_SIZE_BUCKETS]uint64{2, 2, 2, 1}
+		sizes    []int                         = []int{100, 512, 513, 1232, 1233, 4096, 4097}
+		size     int
+	)
+	server.statistics = stats
+	for _, size = range sizes {
+		server.send(writer, query, make([]byte, size), time.Now())
+	}
+
+	if stats.ResponseSizes() != expected {
+		t.Errorf("Expected %v, got %v", expected, stats.ResponseSizes())
+	}
+
+	stats.Reset()
+	if stats.ResponseSizes() != [RESPONSE_SIZE_BUCKETS]uint64{} {
+		t.Errorf("Expected an empty histogram after Reset, got %v", stats.ResponseSizes())
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flash-dns/internal/logger"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const TCP_IDLE_TIMEOUT time.Duration = 10 * time.Second // quiet tcp connections are closed after this
+
+type tcpResponseWriter struct {
+	conn net.Conn
+}
+
+// tcp messages carry a 2 byte length prefix
+func (t *tcpResponseWriter) write(response []byte) error {
+	var (
+		message []byte = make([]byte, 2, 2+len(response))
+		err     error
+	)
+	binary.BigEndian.PutUint16(message, uint16(len(response)))
+	message = append(message, response...)
+
+	_, err = t.conn.Write(message)
+	return err
+}
+
+func (t *tcpResponseWriter) clientAddr() net.Addr { return t.conn.RemoteAddr() }
+func (t *tcpResponseWriter) localAddr() net.Addr  { return t.conn.LocalAddr() }
+
+// accepts tcp connections until the listener is closed
+// beyond Config.MaxTCPConns open connections new ones are closed right away
+func (s *DNSServer) serveTCP(ctx context.Context, tcpListener net.Listener, l listener) {
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	for {
+		conn, err = tcpListener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				logger.Info(fmt.Sprintf("TCP Server Stopping: %s", l.addr))
+				return
+			}
+			logger.Error(fmt.Sprintf("Error accepting: %v", err))
+			continue
+		}
+
+		if s.tcpSlots != nil {
+			select {
+			case s.tcpSlots <- struct{}{}:
+			default:
+				logger.Info(fmt.Sprintf("TCP REFUSED: %s - too many open connections", conn.RemoteAddr()))
+				conn.Close()
+				continue
+			}
+		}
+
+		go func(conn net.Conn) {
+			if s.tcpSlots != nil {
+				defer func() { <-s.tcpSlots }()
+			}
+			s.handleTCPConn(ctx, conn, l)
+		}(conn)
+	}
+}
+
+// answers queries from the connection one after the other until it goes quiet
+func (s *DNSServer) handleTCPConn(ctx context.Context, conn net.Conn, l listener) {
+	defer conn.Close()
+
+	var (
+		stop        func() bool        = context.AfterFunc(ctx, func() { conn.Close() })
+		idleTimeout time.Duration      = s.config.TCPIdleTimeout
+		header      []byte             = make([]byte, 2)
+		writer      *tcpResponseWriter = &tcpResponseWriter{conn: conn}
+		err         error
+	)
+	defer stop()
+
+	if idleTimeout <= 0 {
+		idleTimeout = TCP_IDLE_TIMEOUT
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if _, err = io.ReadFull(conn, header); err != nil {
+			return
+		}
+
+		var query []byte = make([]byte, binary.BigEndian.Uint16(header))
+		if _, err = io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		s.handleListenerQuery(ctx, l, query, writer)
+	}
+}
+
+func listenTCP(address string, reusePort bool) (net.Listener, error) {
+	var (
+		config      net.ListenConfig = listenConfig(reusePort)
+		tcpListener net.Listener
+		err         error
+	)
+	tcpListener, err = config.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on tcp: %s", err.Error())
+	}
+
+	return tcpListener, nil
+}
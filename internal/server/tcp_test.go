@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flash-dns/internal/utils"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TEST 1: Queries over tcp are answered
+// Tests that a length prefixed query gets a length prefixed answer
+func TestDNSServer_ServeTCP_Answers(t *testing.T) {
+	var (
+		ctx         context.Context
+		cancel      context.CancelFunc
+		config      Config        = Config{LocalAddr: "127.0.0.1:5353", UpstreamDns: "8.8.8.8:53"}
+		resolver    *MockResolver = &MockResolver{response: buildDNSResponse("example.com", 1, 1, 300, []byte{1, 2, 3, 4})}
+		server      *DNSServer
+		tcpListener net.Listener
+		conn        net.Conn
+		answer      []byte
+		err         error
+	)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	server = NewDNSServer(config, resolver, nil)
+	tcpListener, err = listenTCP("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer tcpListener.Close()
+	go server.serveTCP(ctx, tcpListener, server.mainListener())
+
+	conn, err = net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	if err = writeTCPQuery(conn, buildDNSQuery("example.com", utils.TYPE_A, 1)); err != nil {
+		t.Fatalf("Failed to send query: %v", err)
+	}
+	answer, err = readTCPAnswer(conn, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to read answer: %v", err)
+	}
+
+	if len(utils.ExtractAnswers(answer)) != 1 {
+		t.Errorf("Expected 1 answer, got %d", len(utils.ExtractAnswers(answer)))
+	}
+}
+
+// TEST 2: Connections over MaxTCPConns are refused
+// Tests that the connection past the cap is closed while the others stay open
+func TestDNSServer_ServeTCP_MaxTCPConns(t *testing.T) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+		config Config = Config{
+			LocalAddr:   "127.0.0.1:5353",
+			UpstreamDns: "8.8.8.8:53",
+			MaxTCPConns: 2,
+		}
+		server      *DNSServer
+		tcpListener net.Listener
+		conns       []net.Conn
+		i           int
+		err         error
+	)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	server = NewDNSServer(config, &MockResolver{}, nil)
+	tcpListener, err = listenTCP("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer tcpListener.Close()
+	go server.serveTCP(ctx, tcpListener, server.mainListener())
+
+	for i = 0; i < 3; i++ {
+		var conn net.Conn
+		conn, err = net.Dial("tcp", tcpListener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	if _, err = readTCPAnswer(conns[2], time.Second); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected the third connection to be closed, got %v", err)
+	}
+	for i, conn := range conns[:2] {
+		if _, err = readTCPAnswer(conn, 100*time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Expected connection %d to stay open, got %v", i, err)
+		}
+	}
+}
+
+// TEST 3: Idle tcp connections are closed
+// Tests that a connection without queries is closed after TCPIdleTimeout
+func TestDNSServer_ServeTCP_IdleTimeout(t *testing.T) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+		config Config = Config{
+			LocalAddr:      "127.0.0.1:5353",
+			UpstreamDns:    "8.8.8.8:53",
+			TCPIdleTimeout: 50 * time.Millisecond,
+		}
+		server      *DNSServer
+		tcpListener net.Listener
+		conn        net.Conn
+		err         error
+	)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	server = NewDNSServer(config, &MockResolver{}, nil)
+	tcpListener, err = listenTCP("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer tcpListener.Close()
+	go server.serveTCP(ctx, tcpListener, server.mainListener())
+
+	conn, err = net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err = readTCPAnswer(conn, time.Second); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected the idle connection to be closed, got %v", err)
+	}
+}
+
+// ============================================================================
+// HELPER FUNCTIONS
+// ============================================================================
+
+func writeTCPQuery(conn net.Conn, query []byte) error {
+	var (
+		message []byte = binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+		err     error
+	)
+	_, err = conn.Write(append(message, query...))
+	return err
+}
+
+func readTCPAnswer(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	var (
+		header []byte = make([]byte, 2)
+		answer []byte
+		err    error
+	)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+
+	answer = make([]byte, binary.BigEndian.Uint16(header))
+	_, err = io.ReadFull(conn, answer)
+	return answer, err
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"flash-dns/internal/utils"
+	"strings"
+)
+
+const TXT_RECORD_TTL uint32 = 300
+
+// encodes Config.TxtRecords once, keyed by the lowercased name without the trailing dot
+func newTXTRecords(records map[string][]string) map[string][]byte {
+	if len(records) == 0 {
+		return nil
+	}
+
+	var encoded map[string][]byte = make(map[string][]byte, len(records))
+	for name, values := range records {
+		encoded[strings.TrimSuffix(strings.ToLower(name), ".")] = utils.EncodeTXT(values)
+	}
+
+	return encoded
+}
+
+// answers TXT queries for the names of Config.TxtRecords
+// returns false for the other names and types
+func (s *DNSServer) txtResponse(query []byte, queryInfo *utils.QueryInfo) ([]byte, bool) {
+	if s.txtRecords == nil || queryInfo.QType != utils.TYPE_TXT {
+		return nil, false
+	}
+
+	var (
+		rdata []byte
+		ok    bool
+	)
+	if rdata, ok = s.txtRecords[strings.TrimSuffix(strings.ToLower(queryInfo.Domain), ".")]; !ok {
+		return nil, false
+	}
+
+	return utils.CreateAnswerResponse(query, utils.TYPE_TXT, TXT_RECORD_TTL, rdata), true
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"flash-dns/internal/utils"
+)
+
+const (
+	UDP_DEFAULT_MAX_SIZE int = 1232 // fits the 1280 byte ipv6 minimum mtu, so answers aren't fragmented
+	UDP_PLAIN_MAX_SIZE   int = 512  // clients without EDNS
+)
+
+// our own udp buffer, Config.MaxUDPSize or UDP_DEFAULT_MAX_SIZE
+func (s *DNSServer) maxUDPSize() int {
+	if s.config.MaxUDPSize < UDP_PLAIN_MAX_SIZE {
+		return UDP_DEFAULT_MAX_SIZE
+	}
+	return s.config.MaxUDPSize
+}
+
+// min of what the client advertised and our own buffer, 512 without EDNS
+func (s *DNSServer) negotiatedUDPSize(query []byte) int {
+	var (
+		queryInfo *utils.QueryInfo
+		size      int
+		err       error
+	)
+	if queryInfo, err = utils.ParseQuery(query); err != nil || queryInfo.EDNSSize == 0 {
+		return UDP_PLAIN_MAX_SIZE
+	}
+
+	size = max(int(queryInfo.EDNSSize), UDP_PLAIN_MAX_SIZE) // smaller values mean 512
+	return min(size, s.maxUDPSize())
+}
+
+// truncates the answer with TC when it doesn't fit the negotiated size
+func (s *DNSServer) fitUDPResponse(query []byte, response []byte) []byte {
+	return utils.FitUDPSize(response, s.negotiatedUDPSize(query), uint16(s.maxUDPSize()))
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"flash-dns/internal/utils"
+	"fmt"
+	"strings"
+)
+
+// checks an upstream answer under Config.StrictAnswerValidation: the question
+// section must be the one we asked, and every answer record must belong to the
+// question name or to a name its CNAME chain leads to
+// catches the off-name records some hijacking middleboxes inject
+func validateAnswer(query []byte, response []byte) error {
+	var (
+		queryInfo *utils.QueryInfo
+		message   *utils.Message
+		question  utils.Question
+		owners    map[string]bool
+		err       error
+	)
+	if queryInfo, err = utils.ParseQuery(query); err != nil {
+		return err
+	}
+	if message, err = utils.ParseResponse(response); err != nil {
+		return fmt.Errorf("malformed answer: %w", err)
+	}
+
+	if len(message.Questions) != 1 {
+		return fmt.Errorf("answer has %d questions", len(message.Questions))
+	}
+	question = message.Questions[0]
+	if !strings.EqualFold(question.Name, queryInfo.Domain) || question.Type != queryInfo.QType || question.Class != queryInfo.QClass {
+		return fmt.Errorf("answer is for %s type %d, asked %s type %d", question.Name, question.Type, queryInfo.Domain, queryInfo.QType)
+	}
+
+	owners = chainOwners(question.Name, message.Answers)
+	for _, record := range message.Answers {
+		if owners[strings.ToLower(record.Name)] {
+			continue
+		}
+		if record.Type == utils.TYPE_DNAME && isSubdomain(strings.ToLower(question.Name), strings.ToLower(record.Name)) {
+			continue
+		}
+		return fmt.Errorf("answer record for %s doesn't belong to %s", record.Name, question.Name)
+	}
+
+	return nil
+}
+
+// the question name and every name reached from it through the CNAME records, lowercased
+func chainOwners(name string, answers []utils.ResourceRecord) map[string]bool {
+	var (
+		owners map[string]bool = map[string]bool{strings.ToLower(name): true}
+		added  bool            = true
+		target string
+	)
+	// the records may come in any order, go over them until the chain stops growing
+	for added {
+		added = false
+		for _, record := range answers {
+			if record.Type != utils.TYPE_CNAME || !owners[strings.ToLower(record.Name)] {
+				continue
+			}
+			if target = strings.ToLower(record.Target()); target != "" && !owners[target] {
+				owners[target] = true
+				added = true
+			}
+		}
+	}
+
+	return owners
+}
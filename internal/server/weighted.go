@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"flash-dns/internal/logger"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const WEIGHT_FLOOR float64 = 0.05 // share of the queries spread evenly, so slow upstreams stay warm
+
+// picks one upstream per query at random, weighted by its recent health
+// healthier and faster upstreams get more queries, every upstream gets some
+type WeightedResolver struct {
+	upstreamAddrs    []string
+	health           []*upstreamHealth
+	timeout          time.Duration
+	maxResponseBytes atomic.Int64 // zero means MAX_RESPONSE_BYTES
+	retryServfail    atomic.Bool
+	random           func() float64                                                          // swapped in tests
+	exchange         func(ctx context.Context, address string, query []byte) ([]byte, error) // swapped in tests
+}
+
+func NewWeightedResolver(upstream string) *WeightedResolver {
+	return newWeightedResolverAddrs(parseUpstreams(upstream))
+}
+
+func newWeightedResolverAddrs(addresses []string) *WeightedResolver {
+	var resolver *WeightedResolver = &WeightedResolver{
+		upstreamAddrs: addresses,
+		timeout:       5 * time.Second,
+		random:        rand.Float64,
+	}
+	for range resolver.upstreamAddrs {
+		resolver.health = append(resolver.health, newUpstreamHealth())
+	}
+	resolver.exchange = resolver.exchangeUDP
+
+	return resolver
+}
+
+// answers bigger than n bytes are dropped, values <= 0 reset to MAX_RESPONSE_BYTES
+func (w *WeightedResolver) SetMaxResponseBytes(n int) {
+	w.maxResponseBytes.Store(int64(clampResponseBytes(n)))
+}
+
+// a SERVFAIL is followed by another pick, it's returned if every upstream gives it
+func (w *WeightedResolver) SetRetryOnServfail(retry bool) {
+	w.retryServfail.Store(retry)
+}
+
+func (w *WeightedResolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	var (
+		response []byte
+		err      error
+	)
+	response, _, err = w.ResolveWithSource(ctx, query)
+	return response, err
+}
+
+// a failed upstream is followed by another weighted pick among the untried ones
+func (w *WeightedResolver) ResolveWithSource(ctx context.Context, query []byte) ([]byte, string, error) {
+	var (
+		tried          []bool = make([]bool, len(w.upstreamAddrs))
+		index          int
+		started        time.Time
+		response       []byte
+		servfail       []byte
+		servfailSource string
+		err            error
+	)
+	for range w.upstreamAddrs {
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+
+		index = w.pick(tried)
+		started = time.Now()
+		response, err = w.exchange(ctx, w.upstreamAddrs[index], query)
+		w.health[index].record(time.Since(started), err == nil)
+		tried[index] = true
+		if err == nil && w.retryServfail.Load() && isServfail(response) {
+			logger.Info(fmt.Sprintf("upstream %s answered SERVFAIL, trying another one", w.upstreamAddrs[index]))
+			servfail, servfailSource = response, w.upstreamAddrs[index]
+			continue
+		}
+		if err == nil {
+			return response, w.upstreamAddrs[index], nil
+		}
+
+		logger.Error(fmt.Sprintf("query to upstream %s failed: %v", w.upstreamAddrs[index], err))
+	}
+
+	if servfail != nil {
+		return servfail, servfailSource, nil
+	}
+
+	return nil, "", fmt.Errorf("all upstream dns failed")
+}
+
+// selection probability of each upstream, skipping the tried ones
+// WEIGHT_FLOOR is shared evenly, the rest follows the health weights
+func (w *WeightedResolver) probabilities(tried []bool) []float64 {
+	var (
+		weights       []float64 = make([]float64, len(w.health))
+		probabilities []float64 = make([]float64, len(w.health))
+		total         float64
+		candidates    int
+	)
+	for i, health := range w.health {
+		if tried[i] {
+			continue
+		}
+		weights[i] = health.weight()
+		total += weights[i]
+		candidates++
+	}
+
+	for i := range weights {
+		if tried[i] {
+			continue
+		}
+		probabilities[i] = WEIGHT_FLOOR / float64(candidates)
+		if total > 0 {
+			probabilities[i] += (1 - WEIGHT_FLOOR) * weights[i] / total
+		} else {
+			probabilities[i] += (1 - WEIGHT_FLOOR) / float64(candidates)
+		}
+	}
+
+	return probabilities
+}
+
+func (w *WeightedResolver) pick(tried []bool) int {
+	var (
+		probabilities []float64 = w.probabilities(tried)
+		target        float64   = w.random()
+		last          int
+	)
+	for i, probability := range probabilities {
+		if tried[i] {
+			continue
+		}
+		last = i
+		if target < probability {
+			return i
+		}
+		target -= probability
+	}
+
+	return last // rounding left a sliver at the end
+}
+
+func (w *WeightedResolver) exchangeUDP(ctx context.Context, address string, query []byte) ([]byte, error) {
+	var (
+		dialer      net.Dialer
+		conn        net.Conn
+		deadline    time.Time = time.Now().Add(w.timeout)
+		ctxDeadline time.Time
+		ok          bool
+		err         error
+	)
+	conn, err = dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if ctxDeadline, ok = ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	return readUDPResponse(conn, clampResponseBytes(int(w.maxResponseBytes.Load())))
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+// TEST 1: Picks follow the health weights
+// Tests that over many queries each upstream's share matches its latency and success rate
+func TestWeightedResolver_Pick_Distribution(t *testing.T) {
+	var (
+		resolver *WeightedResolver = NewWeightedResolver("10.0.0.1,10.0.0.2,10.0.0.3")
+		random   *rand.Rand        = rand.New(rand.NewPCG(1, 2))
+		counts   []int             = make([]int, 3)
+		expected []float64         = make([]float64, 3)
+		weights  []float64         = []float64{
+			1 / 0.010,                // fast and healthy
+			1 / 0.040,                // healthy but 4x slower
+			math.Pow(0.8, 3) / 0.010, // fast but failed the last 3 queries
+		}
+		total float64
+		draws int = 20000
+		share float64
+		i     int
+	)
+	resolver.random = random.Float64
+
+	for i = 0; i < 60; i++ {
+		resolver.health[0].record(10*time.Millisecond, true)
+		resolver.health[1].record(40*time.Millisecond, true)
+		resolver.health[2].record(10*time.Millisecond, true)
+	}
+	for i = 0; i < 3; i++ {
+		resolver.health[2].record(time.Second, false)
+	}
+
+	for _, weight := range weights {
+		total += weight
+	}
+	for i = range weights {
+		expected[i] = WEIGHT_FLOOR/3 + (1-WEIGHT_FLOOR)*weights[i]/total
+	}
+
+	for i = 0; i < draws; i++ {
+		counts[resolver.pick(make([]bool, 3))]++
+	}
+
+	for i = range counts {
+		share = float64(counts[i]) / float64(draws)
+		if math.Abs(share-expected[i]) > 0.02 {
+			t.Errorf("Upstream %d: expected a share of %.3f, got %.3f", i, expected[i], share)
+		}
+	}
+	if counts[1] == 0 {
+		t.Error("Expected the slow upstream to stay warm")
+	}
+}
+
+// TEST 2: A failed upstream is followed by another
+// Tests that Resolve retries on a different upstream and lowers the failed one's weight
+func TestWeightedResolver_Resolve_Failover(t *testing.T) {
+	var (
+		resolver *WeightedResolver = NewWeightedResolver("10.0.0.1,10.0.0.2")
+		asked    []string
+		before   float64
+		source   string
+		err      error
+	)
+	resolver.random = func() float64 { return 0 } // always the first untried upstream
+	resolver.exchange = func(ctx context.Context, address string, query []byte) ([]byte, error) {
+		asked = append(asked, address)
+		if address == "10.0.0.1:53" {
+			return nil, errors.New("timeout")
+		}
+		return []byte{1, 2}, nil
+	}
+	before = resolver.health[0].weight()
+
+	_, source, err = resolver.ResolveWithSource(context.Background(), buildDNSQuery("example.com", 1, 1))
+	if err != nil {
+		t.Fatalf("Expected the second upstream to answer, got %v", err)
+	}
+	if source != "10.0.0.2:53" || len(asked) != 2 {
+		t.Errorf("Expected 10.0.0.1 then 10.0.0.2, asked %v and answered by %s", asked, source)
+	}
+	if resolver.health[0].weight() >= before {
+		t.Error("Expected the failure to lower the weight of 10.0.0.1")
+	}
+}
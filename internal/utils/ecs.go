@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	EDNS_OPTION_ECS       uint16 = 8    // EDNS Client Subnet, RFC 7871
+	EDNS_DEFAULT_UDP_SIZE uint16 = 1232 // advertised by the OPT records we add
+)
+
+// adds an EDNS Client Subnet option with the first prefix bits of ip to the query,
+// queries without OPT get one. the option the client may have sent is never
+// replaced, a /0 one asks that no subnet goes upstream
+// malformed queries and invalid ips leave the query unchanged
+func SetClientSubnet(query []byte, ip net.IP, prefix int) []byte {
+	var (
+		message *Message
+		option  []byte
+		found   bool
+		err     error
+		i       int
+	)
+	if ip.To16() == nil {
+		return query
+	}
+	if message, err = ParseResponse(query); err != nil {
+		return query
+	}
+	option = clientSubnetOption(ip, prefix)
+
+	for i = range message.Additional {
+		if message.Additional[i].Type != TYPE_OPT {
+			continue
+		}
+		if clientSubnetOf(message.Additional[i].Data) != "" {
+			return query
+		}
+		message.Additional[i].Data = append(message.Additional[i].Data, option...)
+		found = true
+	}
+	if !found {
+		message.Additional = append(message.Additional, ResourceRecord{Type: TYPE_OPT, Class: EDNS_DEFAULT_UDP_SIZE, Data: option})
+	}
+
+	return message.Pack()
+}
+
+// drops the ECS option from the OPT record, e.g. the upstream echo of the one we
+// added, which the client never asked for; messages without it come back unchanged
+func RemoveClientSubnet(response []byte) []byte {
+	var (
+		message *Message
+		data    []byte
+		changed bool
+		err     error
+		i       int
+	)
+	if message, err = ParseResponse(response); err != nil {
+		return response
+	}
+
+	for i = range message.Additional {
+		if message.Additional[i].Type != TYPE_OPT {
+			continue
+		}
+		if data = withoutOption(message.Additional[i].Data, EDNS_OPTION_ECS); len(data) != len(message.Additional[i].Data) {
+			message.Additional[i].Data = data
+			changed = true
+		}
+	}
+	if !changed {
+		return response
+	}
+
+	return message.Pack()
+}
+
+// drops the OPT record, e.g. the one added to the query of a client that didn't
+// use EDNS, which must not get one back (RFC 6891); messages without it come back unchanged
+func RemoveOPT(response []byte) []byte {
+	var (
+		message    *Message
+		additional []ResourceRecord
+		err        error
+	)
+	if message, err = ParseResponse(response); err != nil {
+		return response
+	}
+
+	for _, record := range message.Additional {
+		if record.Type != TYPE_OPT {
+			additional = append(additional, record)
+		}
+	}
+	if len(additional) == len(message.Additional) {
+		return response
+	}
+
+	message.Additional = additional
+	return message.Pack()
+}
+
+// the client subnet of the ECS option in the OPT rdata as address/prefix, empty
+// without one; an option that doesn't decode comes back in hex so it still counts
+func clientSubnetOf(rdata []byte) string {
+	var (
+		position int
+		length   int
+		option   []byte
+		address  net.IP
+	)
+	for position+4 <= len(rdata) {
+		length = int(binary.BigEndian.Uint16(rdata[position+2 : position+4]))
+		if position+4+length > len(rdata) {
+			return ""
+		}
+		if binary.BigEndian.Uint16(rdata[position:position+2]) != EDNS_OPTION_ECS {
+			position += 4 + length
+			continue
+		}
+
+		option = rdata[position+4 : position+4+length]
+		if len(option) < 4 {
+			return fmt.Sprintf("%x", option)
+		}
+		switch binary.BigEndian.Uint16(option[0:2]) {
+		case 1:
+			address = make(net.IP, net.IPv4len)
+		case 2:
+			address = make(net.IP, net.IPv6len)
+		default:
+			return fmt.Sprintf("%x", option)
+		}
+		if len(option)-4 > len(address) {
+			return fmt.Sprintf("%x", option)
+		}
+		copy(address, option[4:])
+		return fmt.Sprintf("%s/%d", address, option[2])
+	}
+
+	return ""
+}
+
+// family, source prefix, scope prefix (zero in queries) and the address cut to
+// the prefix, with the bits after it cleared
+func clientSubnetOption(ip net.IP, prefix int) []byte {
+	var (
+		family  uint16 = 1
+		address net.IP = ip.To4()
+		bits    int    = 32
+		option  []byte
+	)
+	if address == nil {
+		family, address, bits = 2, ip.To16(), 128
+	}
+	prefix = max(0, min(prefix, bits))
+	address = address.Mask(net.CIDRMask(prefix, bits))[:(prefix+7)/8]
+
+	option = binary.BigEndian.AppendUint16(option, EDNS_OPTION_ECS)
+	option = binary.BigEndian.AppendUint16(option, uint16(4+len(address)))
+	option = binary.BigEndian.AppendUint16(option, family)
+	option = append(option, byte(prefix), 0)
+
+	return append(option, address...)
+}
+
+// the OPT rdata without the options of the given code, a truncated option ends the list
+func withoutOption(rdata []byte, code uint16) []byte {
+	var (
+		kept     []byte = make([]byte, 0, len(rdata))
+		position int
+		length   int
+	)
+	for position+4 <= len(rdata) {
+		length = int(binary.BigEndian.Uint16(rdata[position+2 : position+4]))
+		if position+4+length > len(rdata) {
+			break
+		}
+		if binary.BigEndian.Uint16(rdata[position:position+2]) != code {
+			kept = append(kept, rdata[position:position+4+length]...)
+		}
+		position += 4 + length
+	}
+
+	return kept
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// TEST 1: The client subnet option is added to queries
+// Tests that queries with and without OPT get a single ECS option with the address cut to the prefix
+func TestSetClientSubnet(t *testing.T) {
+	var tests = []struct {
+		name     string
+		query    []byte
+		ip       net.IP
+		prefix   int
+		expected []byte // the OPT rdata
+	}{
+		{"ipv4 without OPT", buildDNSQuery("example.com", 1, 1), net.ParseIP("192.0.2.77"), 24,
+			[]byte{0, 8, 0, 7, 0, 1, 24, 0, 192, 0, 2}},
+		{"ipv4 with OPT", appendOPT(buildDNSQuery("example.com", 1, 1), 4096, true), net.ParseIP("192.0.2.77"), 20,
+			[]byte{0, 8, 0, 7, 0, 1, 20, 0, 192, 0, 0}},
+		{"ipv6", buildDNSQuery("example.com", 1, 1), net.ParseIP("2001:db8:1234:5678::1"), 56,
+			[]byte{0, 8, 0, 11, 0, 2, 56, 0, 0x20, 0x01, 0x0d, 0xb8, 0x12, 0x34, 0x56}},
+	}
+
+	for _, test := range tests {
+		var (
+			message *Message
+			opt     []ResourceRecord
+			err     error
+		)
+		if message, err = ParseResponse(SetClientSubnet(test.query, test.ip, test.prefix)); err != nil {
+			t.Fatalf("%s: failed to parse the query: %v", test.name, err)
+		}
+		for _, record := range message.Additional {
+			if record.Type == TYPE_OPT {
+				opt = append(opt, record)
+			}
+		}
+
+		if len(opt) != 1 {
+			t.Fatalf("%s: expected one OPT record, got %d", test.name, len(opt))
+		}
+		if !bytes.Equal(opt[0].Data, test.expected) {
+			t.Errorf("%s: expected OPT rdata %v, got %v", test.name, test.expected, opt[0].Data)
+		}
+	}
+}
+
+// TEST 2: The client subnet option is removed from answers
+// Tests that RemoveClientSubnet keeps the other options and leaves messages without ECS untouched
+func TestRemoveClientSubnet(t *testing.T) {
+	var (
+		plain    []byte = appendOPT(buildDNSQuery("example.com", 1, 1), 1232, false)
+		query    []byte = SetClientSubnet(plain, net.ParseIP("192.0.2.1"), 24)
+		message  *Message
+		cookie   []byte = []byte{0, 10, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+		stripped []byte
+		err      error
+	)
+
+	if stripped = RemoveClientSubnet(plain); !bytes.Equal(stripped, plain) {
+		t.Errorf("Expected a message without ECS to be unchanged")
+	}
+
+	// a cookie option (code 10) next to the subnet
+	message, _ = ParseResponse(query)
+	message.Additional[0].Data = append(bytes.Clone(cookie), message.Additional[0].Data...)
+
+	if message, err = ParseResponse(RemoveClientSubnet(message.Pack())); err != nil {
+		t.Fatalf("Failed to parse the message: %v", err)
+	}
+	if len(message.Additional) != 1 || !bytes.Equal(message.Additional[0].Data, cookie) {
+		t.Errorf("Expected only the cookie option to be left, got %+v", message.Additional)
+	}
+}
+
+// TEST 3: The subnet a client sent is kept and reported
+// Tests that SetClientSubnet leaves a client ECS option alone, /0 included, and that
+// ParseQuery reports it along with whether the query used EDNS
+func TestSetClientSubnet_ClientOption(t *testing.T) {
+	var tests = []struct {
+		name     string
+		query    []byte
+		edns     bool
+		expected string
+	}{
+		{"without EDNS", buildDNSQuery("example.com", 1, 1), false, ""},
+		{"EDNS without ECS", appendOPT(buildDNSQuery("example.com", 1, 1), 1232, false), true, ""},
+		{"ECS /0", SetClientSubnet(appendOPT(buildDNSQuery("example.com", 1, 1), 1232, false), net.IPv4zero, 0), true, "0.0.0.0/0"},
+		{"ECS /24", SetClientSubnet(buildDNSQuery("example.com", 1, 1), net.ParseIP("198.51.100.9"), 24), true, "198.51.100.0/24"},
+		{"ipv6 ECS", SetClientSubnet(buildDNSQuery("example.com", 1, 1), net.ParseIP("2001:db8::1"), 48), true, "2001:db8::/48"},
+	}
+
+	for _, test := range tests {
+		var (
+			info *QueryInfo
+			err  error
+		)
+		if info, err = ParseQuery(test.query); err != nil {
+			t.Fatalf("%s: failed to parse the query: %v", test.name, err)
+		}
+		if info.EDNS != test.edns || info.ClientSubnet != test.expected {
+			t.Errorf("%s: expected EDNS %v and subnet %q, got %v and %q", test.name, test.edns, test.expected, info.EDNS, info.ClientSubnet)
+		}
+		if test.expected != "" && !bytes.Equal(SetClientSubnet(test.query, net.ParseIP("192.0.2.1"), 24), test.query) {
+			t.Errorf("%s: expected the client option to be kept", test.name)
+		}
+	}
+}
+
+// TEST 4: The OPT record is removed from answers
+// Tests that RemoveOPT drops the OPT record, keeps the other sections and leaves
+// messages without one untouched
+func TestRemoveOPT(t *testing.T) {
+	var (
+		plain    []byte = buildDNSQuery("example.com", 1, 1)
+		message  *Message
+		stripped []byte
+		err      error
+	)
+	if stripped = RemoveOPT(plain); !bytes.Equal(stripped, plain) {
+		t.Error("Expected a message without OPT to come back unchanged")
+	}
+
+	if message, err = ParseResponse(SetClientSubnet(plain, net.ParseIP("192.0.2.1"), 24)); err != nil {
+		t.Fatalf("Failed to parse the query: %v", err)
+	}
+	message.Additional = append([]ResourceRecord{{Name: "ns.example.com", Type: TYPE_A, Class: 1, TTL: 60, Data: []byte{192, 0, 2, 53}}}, message.Additional...)
+	if message, err = ParseResponse(RemoveOPT(message.Pack())); err != nil {
+		t.Fatalf("Failed to parse the stripped message: %v", err)
+	}
+	if len(message.Additional) != 1 || message.Additional[0].Type != TYPE_A {
+		t.Errorf("Expected only the glue record left, got %+v", message.Additional)
+	}
+}
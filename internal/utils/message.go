@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// header fields other than the section counts, Pack takes those from the sections
+type Header struct {
+	ID    uint16
+	Flags uint16 // QR, opcode, AA, TC, RD, RA, AD, CD and the RCODE
+}
+
+func (h Header) Rcode() uint8 {
+	return uint8(h.Flags & 0x0F)
+}
+
+func (h Header) Truncated() bool {
+	return h.Flags&0x0200 != 0
+}
+
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// parsed dns message, names are spelled out so records can be edited,
+// moved between messages and packed again
+type Message struct {
+	Header     Header
+	Questions  []Question
+	Answers    []ResourceRecord
+	Authority  []ResourceRecord
+	Additional []ResourceRecord
+}
+
+// parses the whole message, bytes after the last record are ignored
+// (some callers hand in oversized buffers)
+func ParseResponse(response []byte) (*Message, error) {
+	return parseSections(response, 3)
+}
+
+// parses the header, questions and answers only, for the helpers that just read
+// the answers, so a broken authority or additional section doesn't hide them
+func parseAnswers(response []byte) (*Message, error) {
+	return parseSections(response, 1)
+}
+
+// parses the first n of the answer, authority and additional sections
+func parseSections(response []byte, n int) (*Message, error) {
+	if len(response) < 12 {
+		return nil, fmt.Errorf("response too short: %d bytes", len(response))
+	}
+
+	var (
+		message  *Message = &Message{}
+		position int      = 12
+		nameEnd  int
+		sections [3]*[]ResourceRecord
+		counts   [3]uint16
+		record   ResourceRecord
+		err      error
+		i        int
+	)
+	message.Header.ID = binary.BigEndian.Uint16(response[0:2])
+	message.Header.Flags = binary.BigEndian.Uint16(response[2:4])
+
+	for i = 0; i < int(binary.BigEndian.Uint16(response[4:6])); i++ {
+		nameEnd = skipName(response, position)
+		if nameEnd+4 > len(response) {
+			return nil, fmt.Errorf("question at %d is truncated", position)
+		}
+
+		message.Questions = append(message.Questions, Question{
+			Name:  readName(response, position),
+			Type:  binary.BigEndian.Uint16(response[nameEnd : nameEnd+2]),
+			Class: binary.BigEndian.Uint16(response[nameEnd+2 : nameEnd+4]),
+		})
+		position = nameEnd + 4
+	}
+
+	sections = [3]*[]ResourceRecord{&message.Answers, &message.Authority, &message.Additional}
+	counts = [3]uint16{
+		binary.BigEndian.Uint16(response[6:8]),
+		binary.BigEndian.Uint16(response[8:10]),
+		binary.BigEndian.Uint16(response[10:12]),
+	}
+	for section, count := range counts[:n] {
+		for i = 0; i < int(count); i++ {
+			if record, position, err = readRecord(response, position); err != nil {
+				return nil, err
+			}
+			*sections[section] = append(*sections[section], record)
+		}
+	}
+
+	return message, nil
+}
+
+// serializes the message, compressing repeated names (rdata names included
+// for the types that allow it) the way most servers do, so a message parsed
+// from a typical response packs back to the same bytes
+func (m *Message) Pack() []byte {
+	var (
+		packed []byte         = make([]byte, 12, 512)
+		names  map[string]int = make(map[string]int)
+	)
+	binary.BigEndian.PutUint16(packed[0:2], m.Header.ID)
+	binary.BigEndian.PutUint16(packed[2:4], m.Header.Flags)
+	binary.BigEndian.PutUint16(packed[4:6], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(packed[6:8], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(packed[8:10], uint16(len(m.Authority)))
+	binary.BigEndian.PutUint16(packed[10:12], uint16(len(m.Additional)))
+
+	for _, question := range m.Questions {
+		packed = appendCompressedName(packed, question.Name, names)
+		packed = binary.BigEndian.AppendUint16(packed, question.Type)
+		packed = binary.BigEndian.AppendUint16(packed, question.Class)
+	}
+
+	for _, section := range [][]ResourceRecord{m.Answers, m.Authority, m.Additional} {
+		for _, record := range section {
+			packed = appendCompressedRecord(packed, record, names)
+		}
+	}
+
+	return packed
+}
+
+// lowest TTL of the answer section, false without answers
+func (m *Message) MinAnswerTTL() (uint32, bool) {
+	var (
+		minTTL uint32
+		found  bool
+	)
+	for _, record := range m.Answers {
+		if !found || record.TTL < minTTL {
+			minTTL, found = record.TTL, true
+		}
+	}
+
+	return minTTL, found
+}
+
+func appendCompressedRecord(dst []byte, record ResourceRecord, names map[string]int) []byte {
+	var (
+		lengthAt int
+		next     int
+	)
+	dst = appendCompressedName(dst, record.Name, names)
+	dst = binary.BigEndian.AppendUint16(dst, record.Type)
+	dst = binary.BigEndian.AppendUint16(dst, record.Class)
+	dst = binary.BigEndian.AppendUint32(dst, record.TTL)
+	lengthAt = len(dst)
+	dst = append(dst, 0, 0) // rdlength, set once the rdata is written
+
+	switch {
+	case record.Type == TYPE_NS || record.Type == TYPE_CNAME || record.Type == TYPE_PTR:
+		dst = appendCompressedName(dst, readName(record.Data, 0), names)
+
+	case record.Type == TYPE_MX && len(record.Data) >= 3:
+		dst = append(dst, record.Data[:2]...) // preference
+		dst = appendCompressedName(dst, readName(record.Data, 2), names)
+
+	case record.Type == TYPE_SOA && skipName(record.Data, skipName(record.Data, 0))+20 <= len(record.Data):
+		next = skipName(record.Data, 0)
+		dst = appendCompressedName(dst, readName(record.Data, 0), names)
+		dst = appendCompressedName(dst, readName(record.Data, next), names)
+		next = skipName(record.Data, next)
+		dst = append(dst, record.Data[next:next+20]...) // serial, refresh, retry, expire, minimum
+
+	default:
+		dst = append(dst, record.Data...)
+	}
+
+	binary.BigEndian.PutUint16(dst[lengthAt:lengthAt+2], uint16(len(dst)-lengthAt-2))
+	return dst
+}
+
+// writes the name, pointing at an earlier copy of its longest known suffix
+// names are matched case sensitively so repacking never changes a name
+func appendCompressedName(dst []byte, name string, names map[string]int) []byte {
+	var (
+		suffix string = name
+		label  string
+		offset int
+		dot    int
+		ok     bool
+	)
+	for suffix != "" {
+		if offset, ok = names[suffix]; ok {
+			return binary.BigEndian.AppendUint16(dst, 0xC000|uint16(offset))
+		}
+		if len(dst) < 0x4000 { // pointers only have 14 bits
+			names[suffix] = len(dst)
+		}
+
+		if dot = strings.IndexByte(suffix, '.'); dot < 0 {
+			label, suffix = suffix, ""
+		} else {
+			label, suffix = suffix[:dot], suffix[dot+1:]
+		}
+		dst = append(dst, byte(len(label)))
+		dst = append(dst, label...)
+	}
+
+	return append(dst, 0)
+}
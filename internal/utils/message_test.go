@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// TEST 1: Parsed responses pack back to the same bytes
+// Tests that a compressed response with CNAME, A, SOA and OPT records round trips unchanged
+func TestMessage_PackRoundTrip(t *testing.T) {
+	var (
+		response []byte = buildCompressedResponse()
+		message  *Message
+		err      error
+	)
+	message, err = ParseResponse(response)
+	if err != nil {
+		t.Fatalf("ParseResponse failed: %v", err)
+	}
+
+	if !bytes.Equal(message.Pack(), response) {
+		t.Errorf("Expected the repacked message to match the original\nwant % x\ngot  % x", response, message.Pack())
+	}
+
+	// trailing bytes of an oversized buffer are ignored
+	message, err = ParseResponse(append(bytes.Clone(response), make([]byte, 64)...))
+	if err != nil {
+		t.Fatalf("ParseResponse failed on a padded buffer: %v", err)
+	}
+	if !bytes.Equal(message.Pack(), response) {
+		t.Error("Expected the padding to be dropped when repacking")
+	}
+}
+
+// TEST 2: Parsed responses expose their sections
+// Tests the header, question and records decoded from a compressed response
+func TestParseResponse_Sections(t *testing.T) {
+	var (
+		message *Message
+		minTTL  uint32
+		found   bool
+		err     error
+	)
+	message, err = ParseResponse(buildCompressedResponse())
+	if err != nil {
+		t.Fatalf("ParseResponse failed: %v", err)
+	}
+
+	if message.Header.ID != 0xBEEF || message.Header.Rcode() != 0 || message.Header.Truncated() {
+		t.Errorf("Unexpected header %+v", message.Header)
+	}
+	if len(message.Questions) != 1 || message.Questions[0] != (Question{Name: "www.example.com", Type: TYPE_A, Class: 1}) {
+		t.Fatalf("Unexpected questions %+v", message.Questions)
+	}
+	if len(message.Answers) != 2 || len(message.Authority) != 1 || len(message.Additional) != 1 {
+		t.Fatalf("Expected 2/1/1 records, got %d/%d/%d", len(message.Answers), len(message.Authority), len(message.Additional))
+	}
+
+	if message.Answers[0].Target() != "cdn.example.net" {
+		t.Errorf("Expected CNAME target cdn.example.net, got %q", message.Answers[0].Target())
+	}
+	if message.Answers[1].Name != "cdn.example.net" || !bytes.Equal(message.Answers[1].Data, []byte{93, 184, 216, 34}) {
+		t.Errorf("Unexpected A record %+v", message.Answers[1])
+	}
+	if message.Additional[0].Type != 41 || message.Additional[0].Class != 1232 {
+		t.Errorf("Expected an OPT record advertising 1232 bytes, got %+v", message.Additional[0])
+	}
+
+	if minTTL, found = message.MinAnswerTTL(); !found || minTTL != 60 {
+		t.Errorf("Expected min answer TTL 60, got %d (%v)", minTTL, found)
+	}
+}
+
+// TEST 3: Edited messages stay valid
+// Tests that changing a TTL and dropping a record packs into a message that parses back the same
+func TestMessage_PackEdited(t *testing.T) {
+	var (
+		message  *Message
+		reparsed *Message
+		err      error
+	)
+	message, err = ParseResponse(buildCompressedResponse())
+	if err != nil {
+		t.Fatalf("ParseResponse failed: %v", err)
+	}
+
+	message.Answers[1].TTL = 30
+	message.Authority = nil
+
+	reparsed, err = ParseResponse(message.Pack())
+	if err != nil {
+		t.Fatalf("ParseResponse of the edited message failed: %v", err)
+	}
+	if len(reparsed.Authority) != 0 || len(reparsed.Additional) != 1 {
+		t.Errorf("Expected no authority and the OPT record, got %d/%d", len(reparsed.Authority), len(reparsed.Additional))
+	}
+	if reparsed.Answers[1].TTL != 30 || reparsed.Answers[0].Target() != "cdn.example.net" {
+		t.Errorf("Unexpected answers after the edit %+v", reparsed.Answers)
+	}
+}
+
+// TEST 4: Truncated messages are rejected
+// Tests that ParseResponse errors instead of returning half a message
+func TestParseResponse_Truncated(t *testing.T) {
+	var (
+		response []byte = buildCompressedResponse()
+		err      error
+	)
+	for _, length := range []int{8, 20, 40, 70} {
+		if _, err = ParseResponse(response[:length]); err == nil {
+			t.Errorf("Expected an error for a response cut at %d bytes", length)
+		}
+	}
+}
+
+// ============================================================================
+// HELPER FUNCTIONS
+// ============================================================================
+
+// response compressed like most servers do it: the answer names point at the
+// question or the CNAME target, the SOA names reuse the zone name
+func buildCompressedResponse() []byte {
+	var response []byte = []byte{
+		0xBE, 0xEF, 0x81, 0x80, // id, flags
+		0x00, 0x01, 0x00, 0x02, 0x00, 0x01, 0x00, 0x01, // 1 question, 2 answers, 1 authority, 1 additional
+	}
+
+	// offset 12: www.example.com A IN
+	response = append(response, EncodeName("www.example.com")...)
+	response = append(response, 0x00, 0x01, 0x00, 0x01)
+
+	// offset 33: www.example.com CNAME cdn.example.net, the target at offset 45
+	response = append(response, 0xC0, 0x0C, 0x00, 0x05, 0x00, 0x01)
+	response = binary.BigEndian.AppendUint32(response, 300)
+	response = append(response, 0x00, 17)
+	response = append(response, EncodeName("cdn.example.net")...)
+
+	// cdn.example.net A 93.184.216.34
+	response = append(response, 0xC0, 0x2D, 0x00, 0x01, 0x00, 0x01)
+	response = binary.BigEndian.AppendUint32(response, 60)
+	response = append(response, 0x00, 0x04, 93, 184, 216, 34)
+
+	// example.com SOA ns.example.com hostmaster.example.com
+	response = append(response, 0xC0, 0x10, 0x00, 0x06, 0x00, 0x01)
+	response = binary.BigEndian.AppendUint32(response, 3600)
+	response = append(response, 0x00, 38)
+	response = append(response, 2, 'n', 's', 0xC0, 0x10)
+	response = append(response, 10, 'h', 'o', 's', 't', 'm', 'a', 's', 't', 'e', 'r', 0xC0, 0x10)
+	for _, value := range []uint32{2024010101, 7200, 3600, 1209600, 300} {
+		response = binary.BigEndian.AppendUint32(response, value)
+	}
+
+	// OPT advertising 1232 bytes
+	return append(response, 0x00, 0x00, 0x29, 0x04, 0xD0, 0, 0, 0, 0, 0x00, 0x00)
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	MAX_LABEL_LENGTH    int = 63
+	MAX_NAME_LENGTH     int = 255 // in wire format, length bytes and the root included
+	MAX_NAME_POINTERS   int = 16  // compression pointers followed before giving up, stops loops
+	COMPRESSION_POINTER int = 0xC0
+)
+
+// the errors of ParseQuery and the name functions wrap one of these, so callers
+// can tell a packet cut short (e.g. a lost udp fragment) from a corrupt one
+var (
+	ErrQueryTooShort = errors.New("message too short")
+	ErrInvalidLabel  = errors.New("invalid label")
+	ErrNameTooLong   = errors.New("name too long")
+	ErrNoQuestion    = errors.New("no question") // QDCOUNT 0, e.g. a keepalive probe
+)
+
+// reads the wire format name at offset, following compression pointers, and
+// returns it in presentation format without the trailing dot ("" for the root)
+// plus the offset right after the name where it started
+func WireToName(data []byte, offset int) (string, int, error) {
+	var (
+		builder  *strings.Builder = builderPool.Get().(*strings.Builder)
+		position int              = offset
+		next     int              = -1 // set at the first pointer, the name continues elsewhere
+		length   int
+		wireLen  int = 1 // the root
+		pointers int
+	)
+	builder.Reset()
+	defer builderPool.Put(builder)
+
+	for {
+		if position >= len(data) {
+			return "", 0, fmt.Errorf("%w: name at %d runs past the message", ErrQueryTooShort, offset)
+		}
+		length = int(data[position])
+
+		if length == 0 {
+			position++
+			break
+		}
+
+		if length&COMPRESSION_POINTER == COMPRESSION_POINTER {
+			if position+1 >= len(data) {
+				return "", 0, fmt.Errorf("%w: truncated compression pointer at %d", ErrQueryTooShort, position)
+			}
+			if pointers++; pointers > MAX_NAME_POINTERS {
+				return "", 0, fmt.Errorf("%w: too many compression pointers in name at %d", ErrInvalidLabel, offset)
+			}
+			if next == -1 {
+				next = position + 2
+			}
+			position = int(binary.BigEndian.Uint16(data[position:position+2]) & 0x3FFF)
+			continue
+		}
+
+		if length > MAX_LABEL_LENGTH {
+			return "", 0, fmt.Errorf("%w: length %d at %d", ErrInvalidLabel, length, position)
+		}
+		if position+1+length > len(data) {
+			return "", 0, fmt.Errorf("%w: label at %d runs past the message", ErrQueryTooShort, position)
+		}
+		if wireLen += length + 1; wireLen > MAX_NAME_LENGTH {
+			return "", 0, fmt.Errorf("%w: name at %d is longer than %d bytes", ErrNameTooLong, offset, MAX_NAME_LENGTH)
+		}
+
+		if builder.Len() > 0 {
+			builder.WriteByte('.')
+		}
+		builder.Write(data[position+1 : position+1+length])
+		position += 1 + length
+	}
+
+	if next == -1 {
+		next = position
+	}
+
+	return builder.String(), next, nil
+}
+
+// encodes a presentation format name like www.example.com (trailing dot optional,
+// "" or "." for the root) in wire format, without compression
+func NameToWire(name string) ([]byte, error) {
+	var wire []byte
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return []byte{0}, nil
+	}
+
+	wire = make([]byte, 0, len(name)+2)
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return nil, fmt.Errorf("%w: empty label in %q", ErrInvalidLabel, name)
+		}
+		if len(label) > MAX_LABEL_LENGTH {
+			return nil, fmt.Errorf("%w: %q is longer than %d bytes", ErrInvalidLabel, label, MAX_LABEL_LENGTH)
+		}
+		wire = append(wire, byte(len(label)))
+		wire = append(wire, label...)
+	}
+	wire = append(wire, 0)
+
+	if len(wire) > MAX_NAME_LENGTH {
+		return nil, fmt.Errorf("%w: %q is longer than %d bytes", ErrNameTooLong, name, MAX_NAME_LENGTH)
+	}
+
+	return wire, nil
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TEST 1: Read names in wire format
+// Tests plain, compressed and root names, and the offset returned after each
+func TestWireToName(t *testing.T) {
+	var (
+		// example.com at 12, www.<pointer to 12> at 25, root at 31
+		data []byte = append(make([]byte, 12),
+			7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+			3, 'w', 'w', 'w', 0xC0, 0x0C,
+			0)
+		name  string
+		next  int
+		err   error
+		tests = []struct {
+			offset int
+			name   string
+			next   int
+		}{
+			{12, "example.com", 25},
+			{25, "www.example.com", 31},
+			{29, "example.com", 31},
+			{31, "", 32},
+		}
+	)
+
+	for _, test := range tests {
+		if name, next, err = WireToName(data, test.offset); err != nil {
+			t.Errorf("offset %d: unexpected error: %v", test.offset, err)
+			continue
+		}
+		if name != test.name || next != test.next {
+			t.Errorf("offset %d: expected %q ending at %d, got %q ending at %d", test.offset, test.name, test.next, name, next)
+		}
+	}
+}
+
+// TEST 2: Reject invalid wire names
+// Tests pointer loops, truncated names, reserved label bits and oversized names
+func TestWireToName_Invalid(t *testing.T) {
+	var (
+		long  []byte
+		err   error
+		i     int
+		tests = []struct {
+			title string
+			data  []byte
+		}{
+			{"pointer loop", []byte{0xC0, 0x02, 0xC0, 0x00}},
+			{"truncated label", []byte{7, 'e', 'x', 'a'}},
+			{"missing root", []byte{3, 'c', 'o', 'm'}},
+			{"truncated pointer", []byte{3, 'c', 'o', 'm', 0xC0}},
+			{"reserved label bits", []byte{0x40, 'a', 0}},
+			{"empty message", []byte{}},
+		}
+	)
+	// 5 labels of 63 bytes, over 255 in total
+	for i = 0; i < 5; i++ {
+		long = append(long, 63)
+		long = append(long, bytes.Repeat([]byte{'a'}, 63)...)
+	}
+	long = append(long, 0)
+	tests = append(tests, struct {
+		title string
+		data  []byte
+	}{"name too long", long})
+
+	for _, test := range tests {
+		if _, _, err = WireToName(test.data, 0); err == nil {
+			t.Errorf("%s: expected an error", test.title)
+		}
+	}
+}
+
+// TEST 3: Encode names in wire format
+// Tests the root, trailing dots, the round trip and the invalid names
+func TestNameToWire(t *testing.T) {
+	var (
+		wire    []byte
+		name    string
+		err     error
+		invalid = []string{"a..b", ".example.com", string(bytes.Repeat([]byte{'a'}, 64)) + ".com"}
+	)
+
+	for _, root := range []string{"", "."} {
+		if wire, err = NameToWire(root); err != nil || !bytes.Equal(wire, []byte{0}) {
+			t.Errorf("root %q: expected [0], got %v (%v)", root, wire, err)
+		}
+	}
+
+	for _, domain := range []string{"www.example.com", "www.example.com."} {
+		if wire, err = NameToWire(domain); err != nil {
+			t.Fatalf("%s: unexpected error: %v", domain, err)
+		}
+		if !bytes.Equal(wire, EncodeName("www.example.com")) {
+			t.Errorf("%s: expected %v, got %v", domain, EncodeName("www.example.com"), wire)
+		}
+		if name, _, err = WireToName(wire, 0); err != nil || name != "www.example.com" {
+			t.Errorf("%s: round trip gave %q (%v)", domain, name, err)
+		}
+	}
+
+	for _, domain := range invalid {
+		if _, err = NameToWire(domain); err == nil {
+			t.Errorf("%q: expected an error", domain)
+		}
+	}
+}
@@ -3,10 +3,36 @@ package utils
 import (
 	"encoding/binary"
 	"fmt"
+	"net"
 	"strings"
 	"sync"
 )
 
+// record types used across the server
+const (
+	TYPE_A      uint16 = 1
+	TYPE_NS     uint16 = 2
+	TYPE_CNAME  uint16 = 5
+	TYPE_SOA    uint16 = 6
+	TYPE_PTR    uint16 = 12
+	TYPE_MX     uint16 = 15
+	TYPE_TXT    uint16 = 16
+	TYPE_AAAA   uint16 = 28
+	TYPE_DNAME  uint16 = 39
+	TYPE_OPT    uint16 = 41
+	TYPE_DS     uint16 = 43
+	TYPE_RRSIG  uint16 = 46
+	TYPE_NSEC   uint16 = 47
+	TYPE_DNSKEY uint16 = 48
+	TYPE_NSEC3  uint16 = 50
+	TYPE_SVCB   uint16 = 64
+	TYPE_HTTPS  uint16 = 65
+)
+
+const EDNS_FLAG_DO uint16 = 0x8000 // DNSSEC OK, in the OPT record ttl
+
+const FLAG_AD uint16 = 0x0020 // authenticated data, the upstream validated the answer
+
 var builderPool = sync.Pool{
 	New: func() interface{} {
 		return &strings.Builder{}
@@ -18,134 +44,178 @@ type QueryInfo struct {
 	CacheKey string
 	QType    uint16
 	QClass   uint16
+	EDNSSize uint16 // udp size advertised in the OPT record, 0 without EDNS
+	DNSSECOk bool   // DO bit, the answer carries RRSIGs so it gets its own cache key
+	EDNS     bool   // the query has an OPT record, answers to one without mustn't carry one
+	// EDNS Client Subnet the client sent as address/prefix, e.g. 192.0.2.0/24 or 0.0.0.0/0
+	// for "don't send my subnet", empty without
+	ClientSubnet string
 }
 
 func ParseQuery(query []byte) (*QueryInfo, error) {
 	var queryLength int = len(query)
 	if queryLength < 12 {
-		return nil, fmt.Errorf("query too short: %d bytes", len(query))
+		return nil, fmt.Errorf("%w: %d bytes", ErrQueryTooShort, len(query))
+	}
+	if binary.BigEndian.Uint16(query[4:6]) == 0 {
+		return nil, ErrNoQuestion
 	}
 
 	var (
-		builder  *strings.Builder = builderPool.Get().(*strings.Builder)
-		position int              = 12
-		length   int              = 0
+		position int
 		domain   string
 		qtype    uint16
 		qclass   uint16
 		cacheKey string
+		err      error
 	)
-	builder.Reset()
-	defer builderPool.Put(builder)
-
-	for position < queryLength {
-		length = int(query[position])
-
-		if length == 0 {
-			position++
-			break
-		}
-
-		if length >= 192 {
-			position += 2
-			continue
-		}
-
-		if builder.Len() > 0 {
-			builder.WriteRune('.')
-		}
-		position++
-
-		if position+length > queryLength {
-			return nil, fmt.Errorf("invalid domain name length")
-		}
-
-		builder.Write(query[position : position+length])
-		position += length
+	if domain, position, err = WireToName(query, 12); err != nil {
+		return nil, err
 	}
-	domain = builder.String()
 
 	if position+4 > queryLength {
-		return nil, fmt.Errorf("query too short for QTYPE/QCLASS")
+		return nil, fmt.Errorf("%w: no room for QTYPE/QCLASS", ErrQueryTooShort)
 	}
 
 	qtype = binary.BigEndian.Uint16(query[position : position+2])
 	qclass = binary.BigEndian.Uint16(query[position+2 : position+4])
 
+	var info *QueryInfo = &QueryInfo{Domain: domain, QType: qtype, QClass: qclass}
+	parseEDNS(query, position+4, info)
+
 	cacheKey = fmt.Sprintf("%s:%d", domain, qtype)
+	if info.DNSSECOk {
+		cacheKey += ":do"
+	}
+	info.CacheKey = cacheKey
 
-	return &QueryInfo{Domain: domain, QType: qtype, QClass: qclass, CacheKey: cacheKey}, nil
+	return info, nil
 }
 
-func ExtractTTL(response []byte) uint32 {
-	if len(response) < 12 {
-		return 300 // 5 minutes -> 60 * 5 = 300
-	}
-
+// looks for the OPT record in the sections after the question and fills the
+// EDNS fields of info: the advertised udp size, DO and the client subnet
+func parseEDNS(query []byte, position int, info *QueryInfo) {
 	var (
-		position int    = 12
-		qdcount  uint16 = binary.BigEndian.Uint16(response[4:6])
-		ancount  uint16 = binary.BigEndian.Uint16(response[6:8])
-		minTTL   uint32 = uint32(3600) // default 1 hour
+		records int = int(binary.BigEndian.Uint16(query[6:8])) +
+			int(binary.BigEndian.Uint16(query[8:10])) +
+			int(binary.BigEndian.Uint16(query[10:12]))
+		rtype    uint16
+		rdlength int
 		i        int
-		length   int
-		ttl      uint32
-		rdlength uint16
 	)
 
-	// Skip question section
-	for i = 0; i < int(qdcount); i++ {
-		// Skip domain name
-		for position < len(response) && response[position] != 0 {
-			if response[position] >= 192 { // compression pointer
-				position += 2
-				goto skipQuestionTypeClass // Jump past the zero-check
-			}
-			length = int(response[position])
-			position += length + 1
+	for i = 0; i < records; i++ {
+		position = skipName(query, position)
+		if position+10 > len(query) {
+			return
 		}
 
-		// Only check for zero if we didn't hit a compression pointer
-		if position < len(response) && response[position] == 0 {
-			position++
+		rtype = binary.BigEndian.Uint16(query[position : position+2])
+		rdlength = int(binary.BigEndian.Uint16(query[position+8 : position+10]))
+		if rtype == TYPE_OPT {
+			// class is the udp size, ttl is extended rcode, version and flags
+			info.EDNS = true
+			info.EDNSSize = binary.BigEndian.Uint16(query[position+2 : position+4])
+			info.DNSSECOk = binary.BigEndian.Uint16(query[position+6:position+8])&EDNS_FLAG_DO != 0
+			if position+10+rdlength <= len(query) {
+				info.ClientSubnet = clientSubnetOf(query[position+10 : position+10+rdlength])
+			}
+			return
 		}
 
-	skipQuestionTypeClass:
-		position += 4 // skip QTYPE and QCLASS
+		position += 10 + rdlength
 	}
+}
 
-	// Read answer section to find TTL
-	for i = 0; i < int(ancount) && position+10 < len(response); i++ {
-		// Skip name
-		for position < len(response) && response[position] != 0 {
-			if response[position] >= 192 { // compression pointer
-				position += 2
-				goto readAnswerTTL // Jump past the zero-check
-			}
+// lowest answer TTL, capped at an hour
+// malformed responses get 5 minutes and responses without answers an hour
+func ExtractTTL(response []byte) uint32 {
+	var (
+		message *Message
+		minTTL  uint32
+		found   bool
+		err     error
+	)
+	if message, err = parseAnswers(response); err != nil {
+		return 300 // 5 minutes -> 60 * 5 = 300
+	}
 
-			length = int(response[position])
-			position += length + 1
-		}
+	if minTTL, found = message.MinAnswerTTL(); !found || minTTL > 3600 {
+		return 3600 // default 1 hour
+	}
+
+	return minTTL
+}
 
-		// Only check for zero if we didn't hit a compression pointer
-		if position < len(response) && response[position] == 0 {
-			position++
+// DS, RRSIG, NSEC, DNSKEY and NSEC3, the records DNSSEC validation asks for
+func IsDNSSECType(qtype uint16) bool {
+	switch qtype {
+	case TYPE_DS, TYPE_RRSIG, TYPE_NSEC, TYPE_DNSKEY, TYPE_NSEC3:
+		return true
+	}
+	return false
+}
+
+// OPCODE of the header, 0 QUERY, 4 NOTIFY, 5 UPDATE
+func Opcode(query []byte) uint8 {
+	if len(query) < 4 {
+		return 0
+	}
+	return (query[2] >> 3) & 0x0F
+}
+
+// RD flag, the client wants us to recurse for it
+func RecursionDesired(query []byte) bool {
+	return len(query) >= 4 && query[2]&0x01 != 0
+}
+
+// AD flag, the upstream validated the answer with DNSSEC
+func AuthenticatedData(response []byte) bool {
+	return len(response) >= 4 && response[3]&0x20 != 0
+}
+
+// TC flag, the answer didn't fit in the udp packet
+func IsTruncated(response []byte) bool {
+	return len(response) >= 4 && response[2]&0x02 != 0
+}
+
+// returns the IPs of the A and AAAA answers, every other type
+// (CNAME, SVCB, HTTPS...) is skipped
+func ExtractAnswers(response []byte) []net.IP {
+	var (
+		message *Message
+		ips     []net.IP
+		err     error
+	)
+	if message, err = parseAnswers(response); err != nil {
+		return nil
+	}
+
+	for _, record := range message.Answers {
+		switch {
+		case record.Type == TYPE_A && len(record.Data) == net.IPv4len:
+			ips = append(ips, net.IP(record.Data))
+		case record.Type == TYPE_AAAA && len(record.Data) == net.IPv6len:
+			ips = append(ips, net.IP(record.Data))
 		}
+	}
 
-	readAnswerTTL:
-		if position+10 > len(response) {
-			break
+	return ips
+}
+
+// returns the position right after the name starting at position
+func skipName(response []byte, position int) int {
+	for position < len(response) {
+		if response[position] == 0 {
+			return position + 1
 		}
 
-		ttl = binary.BigEndian.Uint32(response[position+4 : position+8])
-		if ttl < minTTL {
-			minTTL = ttl
+		if response[position] >= 192 { // compression pointer ends the name
+			return position + 2
 		}
 
-		// skip type, class, ttl and rdlength
-		rdlength = binary.BigEndian.Uint16(response[position+8 : position+10])
-		position += 10 + int(rdlength)
+		position += int(response[position]) + 1
 	}
 
-	return minTTL
+	return position
 }
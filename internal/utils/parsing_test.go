@@ -1,7 +1,10 @@
 package utils
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"net"
 	"testing"
 )
 
@@ -224,32 +227,26 @@ func TestExtractTTL_CompressionPointer(t *testing.T) {
 	}
 }
 
-// TEST 11: Parse query with compression pointer
-// Tests that compression pointers in queries are skipped
+// TEST 11: Parse query with a compression pointer loop
+// Tests that a pointer back to the name itself is rejected instead of skipped
 func TestParseQuery_WithCompressionPointer(t *testing.T) {
 	var (
 		query []byte = make([]byte, 12)
-		info  *QueryInfo
 		err   error
 	)
 
 	// Add domain with compression pointer
 	query = append(query, 7) // Length of "example"
 	query = append(query, []byte("example")...)
-	query = append(query, 0xC0, 0x0C) // Compression pointer
+	query = append(query, 0xC0, 0x0C) // Compression pointer back to the start of the name
 	query = append(query, 0)          // End of domain
 
 	// Add QTYPE and QCLASS
 	query = append(query, 0, 1) // QTYPE = 1
 	query = append(query, 0, 1) // QCLASS = 1
 
-	info, err = ParseQuery(query)
-
-	if err != nil {
-		t.Fatalf("ParseQuery failed: %v", err)
-	}
-	if info.Domain != "example" {
-		t.Errorf("Expected domain 'example', got '%s'", info.Domain)
+	if _, err = ParseQuery(query); err == nil {
+		t.Error("Expected an error for a compression pointer loop")
 	}
 }
 
@@ -313,6 +310,199 @@ func TestParseQuery_CacheKeyFormat(t *testing.T) {
 	}
 }
 
+// TEST 14: Extract TTL walks past HTTPS/SVCB answers
+// Tests that the variable length rdata of an HTTPS record doesn't break the min TTL
+func TestExtractTTL_HTTPSBeforeA(t *testing.T) {
+	var (
+		httpsRdata []byte = []byte{
+			0x00, 0x01, // SvcPriority 1
+			0x00,                   // TargetName "."
+			0x00, 0x01, 0x00, 0x06, // key alpn, length 6
+			0x02, 'h', '2', 0x02, 'h', '3',
+		}
+		response []byte = buildDNSResponseRecords("example.com", 65, []testRecord{
+			{rtype: 65, ttl: 120, rdata: httpsRdata},
+			{rtype: 1, ttl: 600, rdata: []byte{1, 2, 3, 4}},
+		})
+		ttl uint32
+	)
+
+	ttl = ExtractTTL(response)
+
+	if ttl != 120 {
+		t.Errorf("Expected min TTL 120, got %d", ttl)
+	}
+
+	response = buildDNSResponseRecords("example.com", 1, []testRecord{
+		{rtype: 64, ttl: 900, rdata: httpsRdata},
+		{rtype: 1, ttl: 60, rdata: []byte{1, 2, 3, 4}},
+	})
+	ttl = ExtractTTL(response)
+
+	if ttl != 60 {
+		t.Errorf("Expected min TTL 60 after an SVCB record, got %d", ttl)
+	}
+}
+
+// TEST 15: Extract answers ignores HTTPS/SVCB records
+// Tests that only address records are decoded
+func TestExtractAnswers_SkipsHTTPS(t *testing.T) {
+	var (
+		response []byte = buildDNSResponseRecords("example.com", 1, []testRecord{
+			{rtype: 65, ttl: 120, rdata: []byte{0x00, 0x01, 0x00, 0x00, 0x04, 0x00, 0x04, 9, 9, 9, 9}},
+			{rtype: 1, ttl: 600, rdata: []byte{1, 2, 3, 4}},
+			{rtype: 28, ttl: 600, rdata: []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}},
+		})
+		ips []net.IP
+	)
+
+	ips = ExtractAnswers(response)
+
+	if len(ips) != 2 {
+		t.Fatalf("Expected 2 address answers, got %d (%v)", len(ips), ips)
+	}
+	if !ips[0].Equal(net.IPv4(1, 2, 3, 4)) {
+		t.Errorf("Expected 1.2.3.4, got %s", ips[0])
+	}
+	if !ips[1].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("Expected 2001:db8::1, got %s", ips[1])
+	}
+}
+
+// TEST 16: DO bit gets its own cache key
+// Tests that DNSSEC and plain queries for the same name don't share a key
+func TestParseQuery_DNSSECOkCacheKey(t *testing.T) {
+	var (
+		plain    []byte = buildDNSQuery("example.com", 1, 1)
+		edns     []byte = appendOPT(buildDNSQuery("example.com", 1, 1), 1232, false)
+		dnssec   []byte = appendOPT(buildDNSQuery("example.com", 1, 1), 4096, true)
+		infos    [3]*QueryInfo
+		err      error
+		i        int
+		query    []byte
+		expected [3]string = [3]string{"example.com:1", "example.com:1", "example.com:1:do"}
+	)
+
+	for i, query = range [][]byte{plain, edns, dnssec} {
+		infos[i], err = ParseQuery(query)
+		if err != nil {
+			t.Fatalf("Query %d: ParseQuery failed: %v", i, err)
+		}
+		if infos[i].CacheKey != expected[i] {
+			t.Errorf("Query %d: Expected cache key %q, got %q", i, expected[i], infos[i].CacheKey)
+		}
+	}
+
+	if infos[0].EDNSSize != 0 || infos[1].EDNSSize != 1232 || infos[2].EDNSSize != 4096 {
+		t.Errorf("Unexpected EDNS sizes: %d, %d, %d", infos[0].EDNSSize, infos[1].EDNSSize, infos[2].EDNSSize)
+	}
+	if infos[1].DNSSECOk || !infos[2].DNSSECOk {
+		t.Error("DO bit should only be set on the DNSSEC query")
+	}
+}
+
+// TEST 17: Malformed queries report why
+// Tests that truncated, corrupt and oversized names and a missing question wrap the matching sentinel error
+func TestParseQuery_Errors(t *testing.T) {
+	var (
+		valid    []byte = buildDNSQuery("example.com", 1, 1)
+		badLabel []byte = append([]byte(nil), valid...)
+		longName []byte = make([]byte, 12)
+		err      error
+		i        int
+	)
+	badLabel[12] = 0x50 // length 80, over 63 but not a pointer
+	longName[5] = 1     // QDCOUNT
+	for i = 0; i < 5; i++ {
+		longName = append(longName, 63)
+		longName = append(longName, make([]byte, 63)...)
+	}
+	longName = append(longName, 0, 0, 1, 0, 1)
+
+	var tests = []struct {
+		name     string
+		query    []byte
+		expected error
+	}{
+		{"header only", valid[:8], ErrQueryTooShort},
+		{"name cut short", valid[:16], ErrQueryTooShort},
+		{"no qtype", valid[:len(valid)-2], ErrQueryTooShort},
+		{"label too long", badLabel, ErrInvalidLabel},
+		{"name too long", longName, ErrNameTooLong},
+		{"no question", append([]byte{0x12, 0x34, 0x01, 0x00}, make([]byte, 8)...), ErrNoQuestion},
+	}
+	for _, test := range tests {
+		if _, err = ParseQuery(test.query); !errors.Is(err, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+// TEST 18: DNSSEC answers keep their TTL and rdata
+// Tests that ExtractTTL reads the lowest TTL of a DNSKEY answer with its RRSIG and
+// that ParseRecords returns the large rdata unchanged
+func TestExtractTTL_DNSKEY(t *testing.T) {
+	var (
+		key      []byte = append([]byte{0x01, 0x01, 3, 8}, make([]byte, 260)...) // flags 257, protocol 3, RSASHA256
+		rrsig    []byte = append([]byte{0, 48, 8, 2, 0, 0, 0x0E, 0x10}, make([]byte, 280)...)
+		response []byte
+		answer   []ResourceRecord
+		ttl      uint32
+		err      error
+		i        int
+	)
+	for i = range key[4:] {
+		key[4+i] = byte(i)
+	}
+	response = buildDNSResponseRecords("example.com", TYPE_DNSKEY, []testRecord{
+		{rtype: TYPE_DNSKEY, ttl: 3600, rdata: key},
+		{rtype: TYPE_RRSIG, ttl: 1800, rdata: rrsig},
+	})
+
+	if ttl = ExtractTTL(response); ttl != 1800 {
+		t.Errorf("Expected TTL 1800, got %d", ttl)
+	}
+	if answer, _, _, err = ParseRecords(response); err != nil || len(answer) != 2 {
+		t.Fatalf("Expected 2 answers, got %d (%v)", len(answer), err)
+	}
+	if answer[0].Type != TYPE_DNSKEY || !bytes.Equal(answer[0].Data, key) {
+		t.Error("Expected the DNSKEY rdata unchanged")
+	}
+	if answer[1].Type != TYPE_RRSIG || !bytes.Equal(answer[1].Data, rrsig) {
+		t.Error("Expected the RRSIG rdata unchanged")
+	}
+	if !IsDNSSECType(TYPE_DS) || !IsDNSSECType(TYPE_DNSKEY) || IsDNSSECType(TYPE_A) {
+		t.Error("Expected DS and DNSKEY to be DNSSEC types and A not")
+	}
+}
+
+// TEST 19: A broken additional section doesn't hide the answers
+// Tests that ExtractTTL and ExtractAnswers still read the answers when the additional
+// section is truncated or its count is wrong
+func TestExtractAnswers_CorruptAdditional(t *testing.T) {
+	var (
+		response  []byte = buildDNSResponse("example.com", TYPE_A, 1, 120, []byte{1, 2, 3, 4})
+		truncated []byte
+		ips       []net.IP
+		ttl       uint32
+	)
+	// cut the OPT record in half
+	truncated = appendOPT(append([]byte(nil), response...), 1232, false)
+	truncated = truncated[:len(truncated)-5]
+	// claims an additional record that isn't there
+	response = append([]byte(nil), response...)
+	binary.BigEndian.PutUint16(response[10:12], 2)
+
+	for _, message := range [][]byte{truncated, response} {
+		if ttl = ExtractTTL(message); ttl != 120 {
+			t.Errorf("Expected TTL 120, got %d", ttl)
+		}
+		if ips = ExtractAnswers(message); len(ips) != 1 || !ips[0].Equal(net.IPv4(1, 2, 3, 4)) {
+			t.Errorf("Expected the A answer, got %v", ips)
+		}
+	}
+}
+
 // ============================================================================
 // HELPER FUNCTIONS FOR BUILDING DNS PACKETS
 // ============================================================================
@@ -329,6 +519,7 @@ func buildDNSQuery(domain string, qtype uint16, qclass uint16) []byte {
 
 	// DNS Header (12 bytes) - already zero-initialized
 	binary.BigEndian.PutUint16(query[0:2], 0x1234) // Transaction ID
+	binary.BigEndian.PutUint16(query[2:4], 0x0100) // RD
 	binary.BigEndian.PutUint16(query[4:6], 1)      // QDCOUNT = 1
 
 	// Question section - domain name
@@ -477,3 +668,48 @@ func splitDomain(domain string) []string {
 
 	return labels
 }
+
+type testRecord struct {
+	rtype uint16
+	ttl   uint32
+	rdata []byte
+}
+
+// buildDNSResponseRecords creates a response with answers of any type
+func buildDNSResponseRecords(domain string, qtype uint16, records []testRecord) []byte {
+	var (
+		response []byte = buildDNSQuery(domain, qtype, 1)
+		record   testRecord
+	)
+
+	binary.BigEndian.PutUint16(response[2:4], 0x8180)
+	binary.BigEndian.PutUint16(response[6:8], uint16(len(records)))
+
+	for _, record = range records {
+		response = append(response, 0xC0, 0x0C)
+
+		var answerData []byte = make([]byte, 10)
+		binary.BigEndian.PutUint16(answerData[0:2], record.rtype)
+		binary.BigEndian.PutUint16(answerData[2:4], 1)
+		binary.BigEndian.PutUint32(answerData[4:8], record.ttl)
+		binary.BigEndian.PutUint16(answerData[8:10], uint16(len(record.rdata)))
+		response = append(response, answerData...)
+		response = append(response, record.rdata...)
+	}
+
+	return response
+}
+
+// appendOPT adds an EDNS OPT record to the additional section
+func appendOPT(query []byte, udpSize uint16, dnssecOk bool) []byte {
+	var opt []byte = make([]byte, 11) // root name, type, class, ttl, rdlength
+
+	binary.BigEndian.PutUint16(opt[1:3], 41)
+	binary.BigEndian.PutUint16(opt[3:5], udpSize)
+	if dnssecOk {
+		binary.BigEndian.PutUint16(opt[7:9], 0x8000)
+	}
+
+	binary.BigEndian.PutUint16(query[10:12], binary.BigEndian.Uint16(query[10:12])+1)
+	return append(query, opt...)
+}
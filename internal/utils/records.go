@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// resource record read from a message
+// Data holds the rdata with its names spelled out, so it can be copied into another message
+type ResourceRecord struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// name in the rdata of NS, CNAME and PTR records, empty for other types
+func (r ResourceRecord) Target() string {
+	if r.Type != TYPE_NS && r.Type != TYPE_CNAME && r.Type != TYPE_PTR {
+		return ""
+	}
+
+	return readName(r.Data, 0)
+}
+
+// reads the answer, authority and additional sections of a response
+func ParseRecords(response []byte) ([]ResourceRecord, []ResourceRecord, []ResourceRecord, error) {
+	var (
+		message *Message
+		err     error
+	)
+	if message, err = ParseResponse(response); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return message.Answers, message.Authority, message.Additional, nil
+}
+
+func readRecord(message []byte, position int) (ResourceRecord, int, error) {
+	var (
+		record     ResourceRecord
+		nameEnd    int = skipName(message, position)
+		rdataStart int
+		rdataEnd   int
+	)
+	if nameEnd+10 > len(message) {
+		return record, 0, fmt.Errorf("record at %d is truncated", position)
+	}
+
+	record.Name = readName(message, position)
+	record.Type = binary.BigEndian.Uint16(message[nameEnd : nameEnd+2])
+	record.Class = binary.BigEndian.Uint16(message[nameEnd+2 : nameEnd+4])
+	record.TTL = binary.BigEndian.Uint32(message[nameEnd+4 : nameEnd+8])
+	rdataStart = nameEnd + 10
+	rdataEnd = rdataStart + int(binary.BigEndian.Uint16(message[nameEnd+8:nameEnd+10]))
+	if rdataEnd > len(message) {
+		return record, 0, fmt.Errorf("rdata at %d is truncated", rdataStart)
+	}
+
+	record.Data = expandRdata(message, record.Type, rdataStart, rdataEnd)
+	return record, rdataEnd, nil
+}
+
+// copies the rdata, spelling out the compressed names of the types that carry them
+func expandRdata(message []byte, rtype uint16, start int, end int) []byte {
+	var (
+		rdata []byte
+		next  int
+	)
+	switch rtype {
+	case TYPE_NS, TYPE_CNAME, TYPE_PTR:
+		return EncodeName(readName(message, start))
+
+	case TYPE_MX:
+		if end-start < 3 {
+			break
+		}
+		rdata = append(rdata, message[start:start+2]...) // preference
+		return append(rdata, EncodeName(readName(message, start+2))...)
+
+	case TYPE_SOA:
+		next = skipName(message, start)
+		rdata = append(rdata, EncodeName(readName(message, start))...)
+		rdata = append(rdata, EncodeName(readName(message, next))...)
+		next = skipName(message, next)
+		if next+20 > end {
+			break
+		}
+		return append(rdata, message[next:next+20]...) // serial, refresh, retry, expire, minimum
+	}
+
+	return append([]byte(nil), message[start:end]...)
+}
+
+// appends the record with its name spelled out
+func AppendRecord(dst []byte, record ResourceRecord) []byte {
+	dst = append(dst, EncodeName(record.Name)...)
+	dst = binary.BigEndian.AppendUint16(dst, record.Type)
+	dst = binary.BigEndian.AppendUint16(dst, record.Class)
+	dst = binary.BigEndian.AppendUint32(dst, record.TTL)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(record.Data)))
+	return append(dst, record.Data...)
+}
+
+// answer to the query built from parsed records, additional records are left out
+// the RD bit is copied from the query and RA is set
+func CreateSectionsResponse(query []byte, rcode uint8, answer []ResourceRecord, authority []ResourceRecord) []byte {
+	if !hasQuestion(query) {
+		return query
+	}
+
+	var (
+		questionEnd int    = skipName(query, 12) + 4
+		response    []byte = append([]byte(nil), query[:questionEnd]...)
+	)
+	binary.BigEndian.PutUint16(response[2:4], 0x8080|(binary.BigEndian.Uint16(query[2:4])&0x0100)|uint16(rcode&0x0F))
+	binary.BigEndian.PutUint16(response[6:8], uint16(len(answer)))
+	binary.BigEndian.PutUint16(response[8:10], uint16(len(authority)))
+	binary.BigEndian.PutUint16(response[10:12], 0)
+
+	for _, record := range answer {
+		response = AppendRecord(response, record)
+	}
+	for _, record := range authority {
+		response = AppendRecord(response, record)
+	}
+
+	return response
+}
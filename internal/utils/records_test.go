@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// TEST 1: Compressed names in rdata are spelled out
+// Tests that ParseRecords expands a CNAME pointing back into the question
+func TestParseRecords_ExpandsNames(t *testing.T) {
+	var (
+		response []byte = buildDNSResponseRecords("www.example.com", TYPE_A, []testRecord{
+			{rtype: TYPE_CNAME, ttl: 300, rdata: []byte{3, 'c', 'd', 'n', 0xC0, 0x10}}, // cdn + pointer to example.com
+			{rtype: TYPE_MX, ttl: 300, rdata: []byte{0, 10, 4, 'm', 'a', 'i', 'l', 0xC0, 0x10}},
+		})
+		answer []ResourceRecord
+		err    error
+	)
+
+	answer, _, _, err = ParseRecords(response)
+	if err != nil {
+		t.Fatalf("Failed to parse records: %v", err)
+	}
+	if len(answer) != 2 {
+		t.Fatalf("Expected 2 answers, got %d", len(answer))
+	}
+
+	if answer[0].Name != "www.example.com" || answer[0].Target() != "cdn.example.com" {
+		t.Errorf("Expected www.example.com -> cdn.example.com, got %s -> %s", answer[0].Name, answer[0].Target())
+	}
+	if !bytes.Equal(answer[1].Data, append([]byte{0, 10}, EncodeName("mail.example.com")...)) {
+		t.Errorf("Expected the MX exchange spelled out, got %v", answer[1].Data)
+	}
+	if answer[1].Target() != "" {
+		t.Error("Expected no target for an MX record")
+	}
+}
+
+// TEST 2: Parsed records rebuild an equivalent answer
+// Tests that CreateSectionsResponse keeps the id, RD bit and records
+func TestCreateSectionsResponse(t *testing.T) {
+	var (
+		query     []byte = buildDNSQuery("example.com", TYPE_A, 1)
+		answer    []ResourceRecord
+		authority []ResourceRecord = []ResourceRecord{{Name: "example.com", Type: TYPE_NS, Class: 1, TTL: 60, Data: EncodeName("ns1.example.com")}}
+		response  []byte
+		parsed    []ResourceRecord
+		parsedNS  []ResourceRecord
+		err       error
+	)
+	binary.BigEndian.PutUint16(query[0:2], 0xBEEF)
+	binary.BigEndian.PutUint16(query[2:4], 0x0100) // RD
+	answer = []ResourceRecord{{Name: "example.com", Type: TYPE_A, Class: 1, TTL: 120, Data: []byte{1, 2, 3, 4}}}
+
+	response = CreateSectionsResponse(query, 0, answer, authority)
+
+	if binary.BigEndian.Uint16(response[0:2]) != 0xBEEF {
+		t.Error("Transaction ID should be preserved")
+	}
+	if binary.BigEndian.Uint16(response[2:4]) != 0x8180 {
+		t.Errorf("Expected flags 0x8180, got %#04x", binary.BigEndian.Uint16(response[2:4]))
+	}
+
+	parsed, parsedNS, _, err = ParseRecords(response)
+	if err != nil {
+		t.Fatalf("Failed to parse the rebuilt response: %v", err)
+	}
+	if len(parsed) != 1 || parsed[0].TTL != 120 || !bytes.Equal(parsed[0].Data, []byte{1, 2, 3, 4}) {
+		t.Errorf("Expected the A record back, got %+v", parsed)
+	}
+	if len(parsedNS) != 1 || parsedNS[0].Target() != "ns1.example.com" {
+		t.Errorf("Expected the NS record back, got %+v", parsedNS)
+	}
+}
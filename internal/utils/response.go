@@ -0,0 +1,352 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand/v2"
+	"strings"
+)
+
+// resource record of a synthesized answer, always for the question name
+type Record struct {
+	Type uint16
+	TTL  uint32
+	Data []byte
+}
+
+// builds a NOERROR answer to the query with a single record for the question name
+// a nil rdata gives an answer with no records (NODATA)
+// anything after the question, like an OPT record, is dropped
+func CreateAnswerResponse(query []byte, rtype uint16, ttl uint32, rdata []byte) []byte {
+	if rdata == nil {
+		return CreateRecordsResponse(query, nil)
+	}
+
+	return CreateRecordsResponse(query, []Record{{Type: rtype, TTL: ttl, Data: rdata}})
+}
+
+// same as CreateAnswerResponse with any number of records, in the given order
+// RA is set and RD copied from the query
+func CreateRecordsResponse(query []byte, records []Record) []byte {
+	if !hasQuestion(query) {
+		return query
+	}
+
+	var (
+		questionEnd int = skipName(query, 12) + 4
+		size        int = questionEnd
+		response    []byte
+		position    int
+	)
+	for _, record := range records {
+		size += 12 + len(record.Data)
+	}
+
+	response = make([]byte, questionEnd, size)
+	copy(response, query[:questionEnd])
+
+	binary.BigEndian.PutUint16(response[2:4], 0x8080|(binary.BigEndian.Uint16(query[2:4])&0x0100)) // QR, RA and the client RD
+	binary.BigEndian.PutUint16(response[6:8], uint16(len(records)))
+	binary.BigEndian.PutUint16(response[8:10], 0)  // authority
+	binary.BigEndian.PutUint16(response[10:12], 0) // additional
+
+	for _, record := range records {
+		position = len(response)
+		response = response[:position+12+len(record.Data)]
+
+		// pointer to the name in the question
+		response[position] = 0xC0
+		response[position+1] = 0x0C
+		binary.BigEndian.PutUint16(response[position+2:position+4], record.Type)
+		binary.BigEndian.PutUint16(response[position+4:position+6], 1) // IN
+		binary.BigEndian.PutUint32(response[position+6:position+10], record.TTL)
+		binary.BigEndian.PutUint16(response[position+10:position+12], uint16(len(record.Data)))
+		copy(response[position+12:], record.Data)
+	}
+
+	return response
+}
+
+// NOERROR with no answers and a made up SOA in the authority section,
+// so clients cache the "no records of this type" for negativeTTL seconds
+func CreateNoDataResponse(query []byte, negativeTTL uint32) []byte {
+	if !hasQuestion(query) {
+		return query
+	}
+
+	var (
+		response []byte = CreateAnswerResponse(query, 0, 0, nil)
+		mname    []byte = EncodeName("localhost")
+		rname    []byte = EncodeName("nobody.invalid")
+		rdata    []byte = make([]byte, 0, len(mname)+len(rname)+20)
+		soa      []byte = make([]byte, 12)
+	)
+	rdata = append(rdata, mname...)
+	rdata = append(rdata, rname...)
+	rdata = binary.BigEndian.AppendUint32(rdata, 1)           // serial
+	rdata = binary.BigEndian.AppendUint32(rdata, 3600)        // refresh
+	rdata = binary.BigEndian.AppendUint32(rdata, 600)         // retry
+	rdata = binary.BigEndian.AppendUint32(rdata, 86400)       // expire
+	rdata = binary.BigEndian.AppendUint32(rdata, negativeTTL) // minimum, the negative caching ttl
+
+	soa[0] = 0xC0
+	soa[1] = 0x0C
+	binary.BigEndian.PutUint16(soa[2:4], TYPE_SOA)
+	binary.BigEndian.PutUint16(soa[4:6], 1)
+	binary.BigEndian.PutUint32(soa[6:10], negativeTTL)
+	binary.BigEndian.PutUint16(soa[10:12], uint16(len(rdata)))
+
+	binary.BigEndian.PutUint16(response[8:10], 1)
+	response = append(response, soa...)
+	return append(response, rdata...)
+}
+
+// true when the query is long enough to hold its header and question
+func hasQuestion(query []byte) bool {
+	return len(query) >= 12 && skipName(query, 12)+4 <= len(query)
+}
+
+// encodes a domain in the wire format used inside rdata, e.g. for PTR records
+func EncodeName(domain string) []byte {
+	var (
+		name  []byte = make([]byte, 0, len(domain)+2)
+		start int
+		i     int
+	)
+	for i = 0; i <= len(domain); i++ {
+		if i == len(domain) || domain[i] == '.' {
+			if i > start {
+				name = append(name, byte(i-start))
+				name = append(name, domain[start:i]...)
+			}
+			start = i + 1
+		}
+	}
+
+	return append(name, 0)
+}
+
+// TXT rdata with one character-string per value, values over 255 bytes are
+// split in several strings; no values gives a single empty string
+func EncodeTXT(values []string) []byte {
+	var (
+		rdata []byte
+		chunk string
+	)
+	if len(values) == 0 {
+		return []byte{0}
+	}
+
+	for _, value := range values {
+		if value == "" {
+			rdata = append(rdata, 0)
+			continue
+		}
+		for value != "" {
+			chunk = value[:min(len(value), 255)]
+			value = value[len(chunk):]
+			rdata = append(rdata, byte(len(chunk)))
+			rdata = append(rdata, chunk...)
+		}
+	}
+
+	return rdata
+}
+
+// calls rewrite for every A and AAAA record in the answer section
+// rewrite returns the new rdata, used when its length matches, or false to drop the record
+// the result is a new message, malformed responses come back as an unchanged copy
+// AD is cleared when a record changed, the upstream didn't validate what we send
+func RewriteAddresses(response []byte, rewrite func(rtype uint16, rdata []byte) ([]byte, bool)) []byte {
+	var (
+		message *Message
+		kept    []ResourceRecord
+		rdata   []byte
+		keep    bool
+		changed bool
+		err     error
+	)
+	if message, err = ParseResponse(response); err != nil {
+		return bytes.Clone(response)
+	}
+
+	for _, record := range message.Answers {
+		if record.Type == TYPE_A || record.Type == TYPE_AAAA {
+			if rdata, keep = rewrite(record.Type, record.Data); !keep {
+				changed = true
+				continue
+			}
+			if len(rdata) == len(record.Data) && !bytes.Equal(rdata, record.Data) {
+				record.Data = rdata
+				changed = true
+			}
+		}
+		kept = append(kept, record)
+	}
+	message.Answers = kept
+
+	if changed {
+		message.Header.Flags &^= FLAG_AD
+	}
+
+	return message.Pack()
+}
+
+// shuffles the A and AAAA records of the answer section among the places they
+// already take, other records (e.g. the CNAMEs leading to them) keep their position
+// the response is returned as is with less than two addresses or when malformed
+func ShuffleAddresses(response []byte) []byte {
+	var (
+		message   *Message
+		positions []int
+		i         int
+		err       error
+	)
+	if message, err = ParseResponse(response); err != nil {
+		return response
+	}
+
+	for i = range message.Answers {
+		if message.Answers[i].Type == TYPE_A || message.Answers[i].Type == TYPE_AAAA {
+			positions = append(positions, i)
+		}
+	}
+	if len(positions) < 2 {
+		return response
+	}
+
+	rand.Shuffle(len(positions), func(a, b int) {
+		message.Answers[positions[a]], message.Answers[positions[b]] = message.Answers[positions[b]], message.Answers[positions[a]]
+	})
+
+	return message.Pack()
+}
+
+// raises the TTLs of the answer records below floor to floor
+// the response is returned as is when nothing changed or it's malformed
+func FloorTTLs(response []byte, floor uint32) []byte {
+	var (
+		message *Message
+		changed bool
+		err     error
+		i       int
+	)
+	if message, err = ParseResponse(response); err != nil {
+		return response
+	}
+
+	for i = range message.Answers {
+		if message.Answers[i].TTL < floor {
+			message.Answers[i].TTL = floor
+			changed = true
+		}
+	}
+	if !changed {
+		return response
+	}
+
+	return message.Pack()
+}
+
+// lowers the TTLs of the answer records above ceiling to ceiling
+// the response is returned as is when nothing changed or it's malformed
+func CapTTLs(response []byte, ceiling uint32) []byte {
+	var (
+		message *Message
+		changed bool
+		err     error
+		i       int
+	)
+	if message, err = ParseResponse(response); err != nil {
+		return response
+	}
+
+	for i = range message.Answers {
+		if message.Answers[i].TTL > ceiling {
+			message.Answers[i].TTL = ceiling
+			changed = true
+		}
+	}
+	if !changed {
+		return response
+	}
+
+	return message.Pack()
+}
+
+// fits an answer in the udp size negotiated with the client, the OPT record
+// (if any) advertises our own buffer size
+// answers that don't fit keep only the question and OPT with TC set, so the
+// client retries over tcp; malformed ones that don't fit keep only the header
+func FitUDPSize(response []byte, size int, advertised uint16) []byte {
+	var (
+		message *Message
+		opt     []ResourceRecord
+		packed  []byte
+		err     error
+		i       int
+	)
+	if message, err = ParseResponse(response); err != nil {
+		if len(response) <= size || len(response) < 12 {
+			return response
+		}
+		packed = bytes.Clone(response[:12])
+		packed[2] |= 0x02 // TC
+		clear(packed[4:12])
+		return packed
+	}
+
+	for i = range message.Additional {
+		if message.Additional[i].Type == TYPE_OPT {
+			message.Additional[i].Class = advertised
+			opt = append(opt, message.Additional[i])
+		}
+	}
+
+	if len(opt) == 0 && len(response) <= size {
+		return response
+	}
+	if packed = message.Pack(); len(packed) <= size {
+		return packed
+	}
+
+	message.Header.Flags |= 0x0200 // TC
+	message.Answers = nil
+	message.Authority = nil
+	message.Additional = opt
+
+	return message.Pack()
+}
+
+// reads a possibly compressed name, gives up after too many pointers
+func readName(message []byte, position int) string {
+	var (
+		labels   []string
+		length   int
+		pointers int
+	)
+
+	for position < len(message) && pointers < 16 {
+		length = int(message[position])
+		if length == 0 {
+			break
+		}
+
+		if length >= 192 {
+			if position+1 >= len(message) {
+				break
+			}
+			position = int(binary.BigEndian.Uint16(message[position:position+2]) & 0x3FFF)
+			pointers++
+			continue
+		}
+
+		if position+1+length > len(message) {
+			break
+		}
+		labels = append(labels, string(message[position+1:position+1+length]))
+		position += 1 + length
+	}
+
+	return strings.Join(labels, ".")
+}
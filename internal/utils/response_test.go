@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// TEST 1: Answer drops the OPT record and points at the question
+// Tests that CreateAnswerResponse builds a single record answer
+func TestCreateAnswerResponse(t *testing.T) {
+	var (
+		query    []byte = appendOPT(buildDNSQuery("example.com", TYPE_A, 1), 4096, false)
+		response []byte
+	)
+	binary.BigEndian.PutUint16(query[0:2], 0xABCD)
+
+	response = CreateAnswerResponse(query, TYPE_A, 60, []byte{10, 0, 0, 1})
+
+	if binary.BigEndian.Uint16(response[0:2]) != 0xABCD {
+		t.Error("Transaction ID should be preserved")
+	}
+	if binary.BigEndian.Uint16(response[6:8]) != 1 || binary.BigEndian.Uint16(response[10:12]) != 0 {
+		t.Errorf("Expected 1 answer and no additional records, got %d and %d",
+			binary.BigEndian.Uint16(response[6:8]), binary.BigEndian.Uint16(response[10:12]))
+	}
+	if ExtractTTL(response) != 60 {
+		t.Errorf("Expected TTL 60, got %d", ExtractTTL(response))
+	}
+	if len(ExtractAnswers(response)) != 1 || ExtractAnswers(response)[0].String() != "10.0.0.1" {
+		t.Errorf("Expected 10.0.0.1, got %v", ExtractAnswers(response))
+	}
+
+	response = CreateAnswerResponse(query, TYPE_A, 60, nil)
+	if binary.BigEndian.Uint16(response[6:8]) != 0 {
+		t.Error("Expected no answers for a nil rdata")
+	}
+}
+
+// TEST 2: Rewrite replaces and drops address records
+// Tests that RewriteAddresses patches A rdata and removes AAAA, keeping the CNAME valid
+func TestRewriteAddresses(t *testing.T) {
+	var (
+		response []byte = buildDNSResponseRecords("www.example.com", TYPE_A, []testRecord{
+			{rtype: TYPE_CNAME, ttl: 300, rdata: EncodeName("cdn.example.net")},
+			{rtype: TYPE_AAAA, ttl: 300, rdata: make([]byte, 16)},
+			{rtype: TYPE_A, ttl: 300, rdata: []byte{1, 2, 3, 4}},
+		})
+		rewritten []byte
+		ips       []net.IP
+		position  int
+	)
+
+	rewritten = RewriteAddresses(response, func(rtype uint16, rdata []byte) ([]byte, bool) {
+		if rtype == TYPE_AAAA {
+			return nil, false
+		}
+		return []byte{10, 0, 0, 9}, true
+	})
+
+	if binary.BigEndian.Uint16(rewritten[6:8]) != 2 {
+		t.Fatalf("Expected 2 answers left, got %d", binary.BigEndian.Uint16(rewritten[6:8]))
+	}
+
+	ips = ExtractAnswers(rewritten)
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 9)) {
+		t.Errorf("Expected only 10.0.0.9, got %v", ips)
+	}
+
+	// CNAME target is still readable
+	position = skipName(rewritten, 12) + 4
+	position = skipName(rewritten, position) + 10
+	if readName(rewritten, position) != "cdn.example.net" {
+		t.Errorf("Expected the CNAME target to survive, got %q", readName(rewritten, position))
+	}
+
+	if ExtractAnswers(response)[1].String() != "1.2.3.4" {
+		t.Error("The original response should not be modified")
+	}
+}
+
+// TEST 3: Rewrite clears AD only when something changed
+// Tests that a validated answer keeps AD when the rewrite leaves it alone and loses it otherwise
+func TestRewriteAddresses_AuthenticatedData(t *testing.T) {
+	var (
+		response []byte = buildDNSResponseRecords("example.com", TYPE_A, []testRecord{
+			{rtype: TYPE_A, ttl: 300, rdata: []byte{1, 2, 3, 4}},
+		})
+		rewritten []byte
+	)
+	response[3] |= 0x20
+
+	rewritten = RewriteAddresses(response, func(rtype uint16, rdata []byte) ([]byte, bool) {
+		return rdata, true
+	})
+	if !AuthenticatedData(rewritten) {
+		t.Error("Expected AD to be kept when nothing was rewritten")
+	}
+
+	rewritten = RewriteAddresses(response, func(rtype uint16, rdata []byte) ([]byte, bool) {
+		return []byte{10, 0, 0, 9}, true
+	})
+	if AuthenticatedData(rewritten) {
+		t.Error("Expected AD to be cleared on a rewritten answer")
+	}
+}
+
+// TEST 4: Answers are fitted in the udp size
+// Tests that FitUDPSize advertises our buffer in the OPT record and truncates what doesn't fit
+func TestFitUDPSize(t *testing.T) {
+	var (
+		response []byte = appendOPT(buildDNSResponseRecords("example.com", TYPE_TXT, []testRecord{
+			{rtype: TYPE_TXT, ttl: 300, rdata: make([]byte, 600)},
+		}), 4096, false)
+		fitted  []byte
+		message *Message
+		err     error
+	)
+
+	fitted = FitUDPSize(response, 1232, 1232)
+	if message, err = ParseResponse(fitted); err != nil {
+		t.Fatalf("Failed to parse the fitted answer: %v", err)
+	}
+	if message.Header.Truncated() || len(message.Answers) != 1 {
+		t.Errorf("Expected the full answer, got TC %v and %d answers", message.Header.Truncated(), len(message.Answers))
+	}
+	if len(message.Additional) != 1 || message.Additional[0].Class != 1232 {
+		t.Errorf("Expected the OPT record to advertise 1232, got %v", message.Additional)
+	}
+
+	fitted = FitUDPSize(response, 512, 1232)
+	if len(fitted) > 512 {
+		t.Fatalf("Expected at most 512 bytes, got %d", len(fitted))
+	}
+	if message, err = ParseResponse(fitted); err != nil {
+		t.Fatalf("Failed to parse the truncated answer: %v", err)
+	}
+	if !message.Header.Truncated() || len(message.Answers) != 0 || len(message.Questions) != 1 {
+		t.Errorf("Expected TC with the question and no answers, got TC %v, %d questions and %d answers",
+			message.Header.Truncated(), len(message.Questions), len(message.Answers))
+	}
+	if len(message.Additional) != 1 || message.Additional[0].Type != TYPE_OPT {
+		t.Errorf("Expected the OPT record to be kept, got %v", message.Additional)
+	}
+}
+
+// TEST 5: TXT rdata is split in character-strings
+// Tests that each value becomes a string and long values are cut every 255 bytes
+func TestEncodeTXT(t *testing.T) {
+	var (
+		long     []byte = bytes.Repeat([]byte{'x'}, 300)
+		expected []byte
+		rdata    []byte
+	)
+	expected = append(expected, 2, 'h', 'i', 0, 255)
+	expected = append(expected, long[:255]...)
+	expected = append(expected, 45)
+	expected = append(expected, long[255:]...)
+
+	if rdata = EncodeTXT([]string{"hi", "", string(long)}); !bytes.Equal(rdata, expected) {
+		t.Errorf("Unexpected rdata %v", rdata)
+	}
+	if rdata = EncodeTXT(nil); !bytes.Equal(rdata, []byte{0}) {
+		t.Errorf("Expected a single empty string without values, got %v", rdata)
+	}
+}
+
+// TEST 6: Rewrite keeps the authority and additional sections
+// Tests that dropping an answer keeps the NS authority record and the OPT record,
+// with NSCOUNT and ARCOUNT matching what's left
+func TestRewriteAddresses_KeepsOtherSections(t *testing.T) {
+	var (
+		response []byte = buildDNSResponseRecords("example.com", TYPE_A, []testRecord{
+			{rtype: TYPE_A, ttl: 300, rdata: []byte{1, 2, 3, 4}},
+			{rtype: TYPE_AAAA, ttl: 300, rdata: make([]byte, 16)},
+		})
+		nameserver []byte = EncodeName("ns1.example.com")
+		rewritten  []byte
+		authority  []ResourceRecord
+		additional []ResourceRecord
+		err        error
+	)
+	// NS authority record pointing back at the question name
+	response = append(response, 0xC0, 0x0C, 0, byte(TYPE_NS), 0, 1, 0, 0, 0x0E, 0x10, 0, byte(len(nameserver)))
+	response = append(response, nameserver...)
+	binary.BigEndian.PutUint16(response[8:10], 1)
+	response = appendOPT(response, 1232, true)
+
+	rewritten = RewriteAddresses(response, func(rtype uint16, rdata []byte) ([]byte, bool) {
+		return rdata, rtype != TYPE_AAAA
+	})
+
+	if binary.BigEndian.Uint16(rewritten[6:8]) != 1 || binary.BigEndian.Uint16(rewritten[8:10]) != 1 || binary.BigEndian.Uint16(rewritten[10:12]) != 1 {
+		t.Fatalf("Expected 1 answer, 1 authority and 1 additional record, got %d, %d and %d",
+			binary.BigEndian.Uint16(rewritten[6:8]), binary.BigEndian.Uint16(rewritten[8:10]), binary.BigEndian.Uint16(rewritten[10:12]))
+	}
+	if _, authority, additional, err = ParseRecords(rewritten); err != nil {
+		t.Fatalf("Failed to parse the rewritten response: %v", err)
+	}
+	if len(authority) != 1 || authority[0].Type != TYPE_NS || authority[0].Target() != "ns1.example.com" {
+		t.Errorf("Expected the NS authority record to survive, got %+v", authority)
+	}
+	if len(additional) != 1 || additional[0].Type != TYPE_OPT || additional[0].Class != 1232 || additional[0].TTL&0x8000 == 0 {
+		t.Errorf("Expected the OPT record with its size and DO bit to survive, got %+v", additional)
+	}
+}
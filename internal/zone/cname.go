@@ -0,0 +1,48 @@
+package zone
+
+import (
+	"flash-dns/internal/logger"
+	"flash-dns/internal/utils"
+	"fmt"
+)
+
+const MAX_CNAME_HOPS int = 8 // local chains longer than this get SERVFAIL
+
+const RCODE_SERVFAIL uint8 = 2
+
+// answers a name that is an alias: the CNAMEs of the chain and the records of the
+// asked type at its end, a chain leaving the zone stops there for the client to follow
+// a loop or a chain longer than MAX_CNAME_HOPS is a broken zone and gets SERVFAIL
+// must be called with the read lock held
+func (z *Zone) cnameResponse(query []byte, name string, qtype uint16) []byte {
+	var (
+		visited map[string]bool = make(map[string]bool)
+		answer  []utils.ResourceRecord
+		types   map[uint16]*recordSet
+		set     *recordSet
+		record  utils.ResourceRecord
+		found   bool
+	)
+	for types, found = z.names[name]; found; types, found = z.names[name] {
+		if set, found = types[utils.TYPE_CNAME]; !found || len(set.data) == 0 {
+			if set, found = types[qtype]; found && len(set.data) > 0 {
+				for _, rotated := range set.rotated(set.answerTTL(), qtype) {
+					answer = append(answer, utils.ResourceRecord{Name: name, Type: qtype, Class: 1, TTL: rotated.TTL, Data: rotated.Data})
+				}
+			}
+			break
+		}
+
+		if visited[name] || len(visited) == MAX_CNAME_HOPS {
+			logger.ErrorLimited("cname loop "+name, fmt.Sprintf("local CNAME chain through %s loops or is longer than %d hops", name, MAX_CNAME_HOPS))
+			return utils.CreateSectionsResponse(query, RCODE_SERVFAIL, nil, nil)
+		}
+		visited[name] = true
+
+		record = utils.ResourceRecord{Name: name, Type: utils.TYPE_CNAME, Class: 1, TTL: set.answerTTL(), Data: set.data[0]}
+		answer = append(answer, record)
+		name = normalizeName(record.Target())
+	}
+
+	return utils.CreateSectionsResponse(query, 0, answer, nil)
+}
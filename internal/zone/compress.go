@@ -0,0 +1,91 @@
+package zone
+
+import (
+	"encoding/binary"
+	"flash-dns/internal/utils"
+	"strings"
+)
+
+// offset of every suffix of the question name in the query, by the suffix in
+// lowercase: www.home -> {"www.home": 12, "home": 16}
+func questionSuffixes(query []byte) map[string]int {
+	var (
+		suffixes map[string]int = make(map[string]int)
+		position int            = 12
+		name     string
+		err      error
+	)
+	for position < len(query) && query[position] != 0 {
+		if name, _, err = utils.WireToName(query, position); err != nil {
+			break
+		}
+		suffixes[strings.ToLower(name)] = position
+		position += 1 + int(query[position])
+	}
+
+	return suffixes
+}
+
+// wire form of the name ending in a pointer to the longest suffix it shares with
+// the question, spelled out when it shares none
+func compressName(name string, suffixes map[string]int) []byte {
+	var (
+		labels []string = strings.Split(strings.TrimSuffix(name, "."), ".")
+		wire   []byte
+		offset int
+		found  bool
+		i      int
+	)
+	if name == "" || name == "." {
+		return []byte{0}
+	}
+
+	for i = 0; i < len(labels); i++ {
+		if offset, found = suffixes[strings.ToLower(strings.Join(labels[i:], "."))]; found {
+			break
+		}
+		wire = append(wire, byte(len(labels[i])))
+		wire = append(wire, labels[i]...)
+	}
+	if !found {
+		return append(wire, 0)
+	}
+
+	return binary.BigEndian.AppendUint16(wire, uint16(utils.COMPRESSION_POINTER)<<8|uint16(offset))
+}
+
+// rdata of the types that carry names with those names compressed against the
+// question, the owner of every local answer; other types come back as they are
+func compressRdata(rtype uint16, rdata []byte, suffixes map[string]int) []byte {
+	var (
+		compressed []byte
+		name       string
+		next       int
+		err        error
+	)
+	switch rtype {
+	case utils.TYPE_NS:
+		if name, _, err = utils.WireToName(rdata, 0); err == nil {
+			return compressName(name, suffixes)
+		}
+
+	case utils.TYPE_MX:
+		if name, _, err = utils.WireToName(rdata, 2); err == nil {
+			compressed = append(compressed, rdata[:2]...) // preference
+			return append(compressed, compressName(name, suffixes)...)
+		}
+
+	case utils.TYPE_SOA:
+		if name, next, err = utils.WireToName(rdata, 0); err != nil {
+			break
+		}
+		compressed = compressName(name, suffixes)
+		if name, next, err = utils.WireToName(rdata, next); err != nil {
+			break
+		}
+		compressed = append(compressed, compressName(name, suffixes)...)
+		return append(compressed, rdata[next:]...) // serial, refresh, retry, expire, minimum
+	}
+
+	return rdata
+}
@@ -0,0 +1,80 @@
+package zone
+
+import (
+	"flash-dns/internal/utils"
+	"net"
+	"strings"
+)
+
+const IP6_ARPA_SUFFIX string = ".ip6.arpa"
+
+func (z *Zone) addReverse(ip net.IP, name string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	var found bool
+	if _, found = z.reverse[ip.String()]; !found {
+		z.reverse[ip.String()] = normalizeName(name)
+	}
+}
+
+// PTR answer for an ip6.arpa name of a local address, false for anything else so
+// it goes upstream; must be called with the read lock held
+func (z *Zone) reverseAnswer(query []byte, queryInfo *utils.QueryInfo) ([]byte, bool) {
+	var (
+		ip    net.IP
+		name  string
+		found bool
+	)
+	if queryInfo.QType != utils.TYPE_PTR {
+		return nil, false
+	}
+	if ip, found = parseIP6Arpa(normalizeName(queryInfo.Domain)); !found {
+		return nil, false
+	}
+	if name, found = z.reverse[ip.String()]; !found {
+		return nil, false
+	}
+
+	return utils.CreateRecordsResponse(query, []utils.Record{{Type: utils.TYPE_PTR, TTL: DEFAULT_TTL, Data: utils.EncodeName(name)}}), true
+}
+
+// address of a reverse name, 32 nibbles least significant first:
+// b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa is 4321:0:1:2:3:4:567:89ab
+func parseIP6Arpa(name string) (net.IP, bool) {
+	var (
+		nibbles []string
+		ip      net.IP = make(net.IP, net.IPv6len)
+		value   byte
+		i       int
+	)
+	if !strings.HasSuffix(name, IP6_ARPA_SUFFIX) {
+		return nil, false
+	}
+	if nibbles = strings.Split(strings.TrimSuffix(name, IP6_ARPA_SUFFIX), "."); len(nibbles) != 2*net.IPv6len {
+		return nil, false
+	}
+
+	for i = range nibbles {
+		if len(nibbles[i]) != 1 {
+			return nil, false
+		}
+		switch value = nibbles[i][0]; {
+		case value >= '0' && value <= '9':
+			value -= '0'
+		case value >= 'a' && value <= 'f':
+			value -= 'a' - 10
+		default:
+			return nil, false
+		}
+
+		// nibble i counts from the end of the address, odd ones are the high half of a byte
+		if i%2 == 0 {
+			ip[net.IPv6len-1-i/2] |= value
+		} else {
+			ip[net.IPv6len-1-i/2] |= value << 4
+		}
+	}
+
+	return ip, true
+}
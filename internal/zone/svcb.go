@@ -0,0 +1,165 @@
+package zone
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"flash-dns/internal/utils"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SvcParamKeys from RFC 9460
+var svcParamKeys map[string]uint16 = map[string]uint16{
+	"mandatory":       0,
+	"alpn":            1,
+	"no-default-alpn": 2,
+	"port":            3,
+	"ipv4hint":        4,
+	"ech":             5,
+	"ipv6hint":        6,
+}
+
+type svcParam struct {
+	key   uint16
+	value []byte
+}
+
+// encodes HTTPS/SVCB rdata from its presentation form:
+// <priority> <target> [key=value...], e.g. 1 . alpn=h2,h3 ech=AEX+...
+func encodeSVCB(fields []string) ([]byte, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected priority and target, got %q", strings.Join(fields, " "))
+	}
+
+	var (
+		priority uint64
+		params   []svcParam
+		param    svcParam
+		rdata    []byte
+		err      error
+	)
+	if priority, err = strconv.ParseUint(fields[0], 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid priority %q", fields[0])
+	}
+
+	for _, field := range fields[2:] {
+		if param, err = parseSvcParam(field); err != nil {
+			return nil, err
+		}
+		params = append(params, param)
+	}
+	if priority == 0 && len(params) > 0 {
+		return nil, fmt.Errorf("alias form (priority 0) can't have params")
+	}
+
+	// params go on the wire in increasing key order, each key once
+	sort.Slice(params, func(i, j int) bool { return params[i].key < params[j].key })
+
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(priority))
+	rdata = append(rdata, utils.EncodeName(fields[1])...)
+	for i, p := range params {
+		if i > 0 && params[i-1].key == p.key {
+			return nil, fmt.Errorf("duplicate svc param key%d", p.key)
+		}
+		rdata = binary.BigEndian.AppendUint16(rdata, p.key)
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(p.value)))
+		rdata = append(rdata, p.value...)
+	}
+
+	return rdata, nil
+}
+
+func parseSvcParam(field string) (svcParam, error) {
+	var (
+		param svcParam
+		name  string
+		value string
+		found bool
+		err   error
+	)
+	name, value, _ = strings.Cut(field, "=")
+	value = strings.Trim(value, "\"")
+	name = strings.ToLower(name)
+
+	if param.key, found = svcParamKeys[name]; !found {
+		if param.key, err = parseKeyNumber(name); err != nil {
+			return param, err
+		}
+	}
+
+	switch param.key {
+	case 0: // mandatory, list of keys
+		for _, key := range strings.Split(value, ",") {
+			var number uint16
+			if number, found = svcParamKeys[key]; !found {
+				if number, err = parseKeyNumber(key); err != nil {
+					return param, err
+				}
+			}
+			param.value = binary.BigEndian.AppendUint16(param.value, number)
+		}
+
+	case 1: // alpn, length prefixed protocol ids
+		for _, protocol := range strings.Split(value, ",") {
+			if protocol == "" || len(protocol) > 255 {
+				return param, fmt.Errorf("invalid alpn %q", value)
+			}
+			param.value = append(param.value, byte(len(protocol)))
+			param.value = append(param.value, protocol...)
+		}
+
+	case 2: // no-default-alpn, no value
+		if value != "" {
+			return param, fmt.Errorf("no-default-alpn takes no value")
+		}
+
+	case 3:
+		var port uint64
+		if port, err = strconv.ParseUint(value, 10, 16); err != nil {
+			return param, fmt.Errorf("invalid port %q", value)
+		}
+		param.value = binary.BigEndian.AppendUint16(nil, uint16(port))
+
+	case 4, 6: // ipv4hint, ipv6hint
+		for _, address := range strings.Split(value, ",") {
+			var ip net.IP = net.ParseIP(address)
+			if ip == nil || (param.key == 4) != (ip.To4() != nil) {
+				return param, fmt.Errorf("invalid %s address %q", name, address)
+			}
+			if param.key == 4 {
+				param.value = append(param.value, ip.To4()...)
+			} else {
+				param.value = append(param.value, ip.To16()...)
+			}
+		}
+
+	case 5: // ech config list, base64 in the presentation form
+		if param.value, err = base64.StdEncoding.DecodeString(value); err != nil {
+			return param, fmt.Errorf("invalid ech config: %v", err)
+		}
+
+	default:
+		param.value = []byte(value)
+	}
+
+	return param, nil
+}
+
+// generic keyNNNNN form for params without a name
+func parseKeyNumber(name string) (uint16, error) {
+	var (
+		number uint64
+		err    error
+	)
+	if !strings.HasPrefix(name, "key") {
+		return 0, fmt.Errorf("unknown svc param %q", name)
+	}
+	if number, err = strconv.ParseUint(strings.TrimPrefix(name, "key"), 10, 16); err != nil {
+		return 0, fmt.Errorf("unknown svc param %q", name)
+	}
+
+	return uint16(number), nil
+}
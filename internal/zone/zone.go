@@ -0,0 +1,173 @@
+package zone
+
+import (
+	"bufio"
+	"flash-dns/internal/logger"
+	"flash-dns/internal/utils"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const DEFAULT_TTL uint32 = 60 // short, so rotated answers don't stick in client caches
+
+// records of one type for one name, answered in rotated order
+type recordSet struct {
+	data [][]byte
+	ttl  uint32        // zero uses DEFAULT_TTL
+	next atomic.Uint64 // bumped on every answer, picks the first record
+}
+
+// rotated copy of the records, each call starts one further
+func (rs *recordSet) rotated(ttl uint32, rtype uint16) []utils.Record {
+	var (
+		count   int            = len(rs.data)
+		start   int            = int((rs.next.Add(1) - 1) % uint64(count))
+		records []utils.Record = make([]utils.Record, count)
+		i       int
+	)
+	for i = 0; i < count; i++ {
+		records[i] = utils.Record{Type: rtype, TTL: ttl, Data: rs.data[(start+i)%count]}
+	}
+
+	return records
+}
+
+func (rs *recordSet) answerTTL() uint32 {
+	if rs.ttl == 0 {
+		return DEFAULT_TTL
+	}
+	return rs.ttl
+}
+
+// local names answered without asking upstream, e.g. from a hosts file
+type Zone struct {
+	mu      sync.RWMutex
+	names   map[string]map[uint16]*recordSet
+	reverse map[string]string // first name added for each ipv6 address, for ip6.arpa PTR queries
+}
+
+func NewZone() *Zone {
+	return &Zone{names: make(map[string]map[uint16]*recordSet), reverse: make(map[string]string)}
+}
+
+// adds an A or AAAA record, a name can have several and they are rotated
+// the first name of an ipv6 address answers its reverse lookup
+func (z *Zone) AddAddress(name string, ip net.IP) {
+	if ip.To4() != nil {
+		z.add(name, utils.TYPE_A, 0, ip.To4())
+		return
+	}
+
+	z.add(name, utils.TYPE_AAAA, 0, ip.To16())
+	z.addReverse(ip, name)
+}
+
+// a non zero ttl replaces the one of the whole set
+func (z *Zone) add(name string, rtype uint16, ttl uint32, data []byte) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	name = normalizeName(name)
+	if z.names[name] == nil {
+		z.names[name] = make(map[uint16]*recordSet)
+	}
+	if z.names[name][rtype] == nil {
+		z.names[name][rtype] = &recordSet{}
+	}
+	z.names[name][rtype].data = append(z.names[name][rtype].data, data)
+	if ttl > 0 {
+		z.names[name][rtype].ttl = ttl
+	}
+}
+
+// loads a hosts file: "<ip> <name> [aliases...]", # starts a comment
+func (z *Zone) LoadHostsFile(filename string) error {
+	var (
+		file    *os.File
+		err     error
+		scanner *bufio.Scanner
+		fields  []string
+		ip      net.IP
+		count   int
+		line    string
+		index   int
+	)
+	file, err = os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner = bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line = scanner.Text()
+		if index = strings.IndexByte(line, '#'); index != -1 {
+			line = line[:index]
+		}
+
+		fields = strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		if ip = net.ParseIP(fields[0]); ip == nil {
+			continue
+		}
+
+		for _, name := range fields[1:] {
+			z.AddAddress(name, ip)
+			count++
+		}
+	}
+
+	logger.Info(fmt.Sprintf("Loaded %d local names from %s", count, filename))
+	return scanner.Err()
+}
+
+// answers the query when the name is local
+// a local name without records of the asked type gets NODATA, unknown names return false
+func (z *Zone) Answer(query []byte, queryInfo *utils.QueryInfo) ([]byte, bool) {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+
+	var (
+		types map[uint16]*recordSet
+		set   *recordSet
+		found bool
+	)
+	if types, found = z.names[normalizeName(queryInfo.Domain)]; !found {
+		return z.reverseAnswer(query, queryInfo)
+	}
+
+	if set, found = types[utils.TYPE_CNAME]; found && queryInfo.QType != utils.TYPE_CNAME {
+		return z.cnameResponse(query, normalizeName(queryInfo.Domain), queryInfo.QType), true
+	}
+
+	if set, found = types[queryInfo.QType]; !found || len(set.data) == 0 {
+		return utils.CreateRecordsResponse(query, nil), true
+	}
+
+	var (
+		records  []utils.Record = set.rotated(set.answerTTL(), queryInfo.QType)
+		suffixes map[string]int
+		i        int
+	)
+
+	// names in NS, MX and SOA rdata point into the question where they can
+	if queryInfo.QType == utils.TYPE_NS || queryInfo.QType == utils.TYPE_MX || queryInfo.QType == utils.TYPE_SOA {
+		suffixes = questionSuffixes(query)
+		for i = range records {
+			records[i].Data = compressRdata(queryInfo.QType, records[i].Data, suffixes)
+		}
+	}
+
+	return utils.CreateRecordsResponse(query, records), true
+}
+
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
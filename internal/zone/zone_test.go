@@ -0,0 +1,163 @@
+package zone
+
+import (
+	"encoding/binary"
+	"flash-dns/internal/utils"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TEST 1: Hosts file with repeated names
+// Tests that every address of a name is answered, rotating the first one per query
+func TestZone_LoadHostsFile_RoundRobin(t *testing.T) {
+	var (
+		zone     *Zone    = NewZone()
+		filename string   = filepath.Join(t.TempDir(), "hosts")
+		content  string   = "# lan\n10.0.0.1 app.home\n10.0.0.2 app.home\n10.0.0.3 app.home # third\n\nbad line\n10.0.0.9 nas.home nas\n"
+		expected []string = []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+		ips      []net.IP
+		i        int
+		j        int
+		err      error
+	)
+
+	if err = os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write hosts file: %v", err)
+	}
+	if err = zone.LoadHostsFile(filename); err != nil {
+		t.Fatalf("LoadHostsFile failed: %v", err)
+	}
+
+	for i = 0; i < 4; i++ {
+		ips = answerIPs(t, zone, "app.home", utils.TYPE_A)
+		if len(ips) != 3 {
+			t.Fatalf("Expected 3 addresses, got %v", ips)
+		}
+		for j = 0; j < 3; j++ {
+			if ips[j].String() != expected[(i+j)%3] {
+				t.Errorf("Query %d: expected %s at position %d, got %v", i, expected[(i+j)%3], j, ips)
+				break
+			}
+		}
+	}
+
+	if ips = answerIPs(t, zone, "NAS", utils.TYPE_A); len(ips) != 1 || ips[0].String() != "10.0.0.9" {
+		t.Errorf("Expected the alias to resolve case insensitively, got %v", ips)
+	}
+}
+
+// TEST 2: Local names without the asked type get NODATA
+// Tests that AAAA for an IPv4 only name is answered empty and unknown names fall through
+func TestZone_Answer_NoDataAndUnknown(t *testing.T) {
+	var (
+		zone     *Zone  = NewZone()
+		query    []byte = buildQuery("app.home", utils.TYPE_AAAA)
+		info     *utils.QueryInfo
+		response []byte
+		found    bool
+	)
+	zone.AddAddress("app.home", net.ParseIP("10.0.0.1"))
+
+	info, _ = utils.ParseQuery(query)
+	response, found = zone.Answer(query, info)
+	if !found || binary.BigEndian.Uint16(response[6:8]) != 0 || binary.BigEndian.Uint16(response[2:4])&0x000F != 0 {
+		t.Error("Expected NODATA for a local name without AAAA")
+	}
+
+	query = buildQuery("example.com", utils.TYPE_A)
+	info, _ = utils.ParseQuery(query)
+	if _, found = zone.Answer(query, info); found {
+		t.Error("Unknown names should not be answered locally")
+	}
+}
+
+// TEST 3: ip6.arpa PTR queries answer with the hosts name
+// Tests that the reversed nibbles of a hosts file ipv6 address give its first name
+// and that other addresses or malformed names aren't answered locally
+func TestZone_Answer_IP6ArpaPTR(t *testing.T) {
+	var (
+		zone     *Zone  = NewZone()
+		filename string = filepath.Join(t.TempDir(), "hosts")
+		content  string = "fd00::1:2 nas.home nas\nfd00::9 printer.home\n"
+		name     string = "2.0.0.0.1.0.0.0" + strings.Repeat(".0", 20) + ".0.0.d.f.ip6.arpa"
+		query    []byte = buildQuery(name, utils.TYPE_PTR)
+		info     *utils.QueryInfo
+		response []byte
+		answer   []utils.ResourceRecord
+		found    bool
+		err      error
+	)
+	if err = os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write hosts file: %v", err)
+	}
+	if err = zone.LoadHostsFile(filename); err != nil {
+		t.Fatalf("LoadHostsFile failed: %v", err)
+	}
+
+	info, _ = utils.ParseQuery(query)
+	if response, found = zone.Answer(query, info); !found {
+		t.Fatalf("Expected %s to be answered locally", name)
+	}
+	if answer, _, _, err = utils.ParseRecords(response); err != nil || len(answer) != 1 || answer[0].Target() != "nas.home" {
+		t.Errorf("Expected a PTR to nas.home, got %+v (%v)", answer, err)
+	}
+
+	var tests = []struct {
+		name  string
+		qtype uint16
+	}{
+		{strings.Replace(name, "2.0", "3.0", 1), utils.TYPE_PTR}, // fd00::1:3 isn't local
+		{name, utils.TYPE_A},
+		{"2.0.0.0.1.ip6.arpa", utils.TYPE_PTR},                   // too few nibbles
+		{strings.Replace(name, "2.0", "g.0", 1), utils.TYPE_PTR}, // not hex
+	}
+	for _, test := range tests {
+		query = buildQuery(test.name, test.qtype)
+		info, _ = utils.ParseQuery(query)
+		if _, found = zone.Answer(query, info); found {
+			t.Errorf("%s/%d: expected the query to go upstream", test.name, test.qtype)
+		}
+	}
+}
+
+// ============================================================================
+// HELPER FUNCTIONS
+// ============================================================================
+
+func buildQuery(domain string, qtype uint16) []byte {
+	var query []byte = make([]byte, 12)
+	binary.BigEndian.PutUint16(query[0:2], 0x1234)
+	binary.BigEndian.PutUint16(query[2:4], 0x0100) // RD
+	binary.BigEndian.PutUint16(query[4:6], 1)
+
+	for _, label := range strings.Split(domain, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0)
+	query = binary.BigEndian.AppendUint16(query, qtype)
+	return binary.BigEndian.AppendUint16(query, 1)
+}
+
+func answerIPs(t *testing.T, zone *Zone, domain string, qtype uint16) []net.IP {
+	var (
+		query    []byte = buildQuery(domain, qtype)
+		info     *utils.QueryInfo
+		response []byte
+		found    bool
+		err      error
+	)
+	info, err = utils.ParseQuery(query)
+	if err != nil {
+		t.Fatalf("Failed to parse query: %v", err)
+	}
+
+	if response, found = zone.Answer(query, info); !found {
+		t.Fatalf("Expected %s to be answered locally", domain)
+	}
+
+	return utils.ExtractAnswers(response)
+}
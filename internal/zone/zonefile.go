@@ -0,0 +1,193 @@
+package zone
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flash-dns/internal/logger"
+	"flash-dns/internal/utils"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// record types a zone file can hold
+var zoneFileTypes map[string]uint16 = map[string]uint16{
+	"A":     utils.TYPE_A,
+	"AAAA":  utils.TYPE_AAAA,
+	"SVCB":  utils.TYPE_SVCB,
+	"HTTPS": utils.TYPE_HTTPS,
+	"MX":    utils.TYPE_MX,
+	"NS":    utils.TYPE_NS,
+	"SOA":   utils.TYPE_SOA,
+	"CNAME": utils.TYPE_CNAME,
+}
+
+// loads records in a simplified master file format, one per line:
+// <name> [ttl] [IN] <type> <rdata...>, ; and # start a comment
+//
+//	app.home        A     10.0.0.5
+//	app.home  300   HTTPS 1 . alpn=h2,h3 ech=AEX+...
+//	home            MX    10 mail.home.
+//	home            NS    ns1.home.
+//	home            SOA   ns1.home. admin.home. 2024010101 3600 600 86400 60
+//	www.home        CNAME app.home.
+//
+// names in rdata are absolute, the trailing dot is optional
+func (z *Zone) LoadZoneFile(filename string) error {
+	var (
+		file    *os.File
+		scanner *bufio.Scanner
+		line    string
+		number  int
+		count   int
+		index   int
+		err     error
+	)
+	file, err = os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner = bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		number++
+		line = scanner.Text()
+		if index = strings.IndexAny(line, ";#"); index != -1 {
+			line = line[:index]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if err = z.addZoneLine(strings.Fields(line)); err != nil {
+			logger.Error(fmt.Sprintf("%s:%d: %v", filename, number, err))
+			continue
+		}
+		count++
+	}
+
+	logger.Info(fmt.Sprintf("Loaded %d local records from %s", count, filename))
+	return scanner.Err()
+}
+
+func (z *Zone) addZoneLine(fields []string) error {
+	var (
+		name     string
+		ttl      uint64
+		rtype    uint16
+		rdata    []byte
+		position int = 1
+		found    bool
+		err      error
+	)
+	if len(fields) < 3 {
+		return fmt.Errorf("expected <name> [ttl] [IN] <type> <rdata>")
+	}
+	name = fields[0]
+
+	if ttl, err = strconv.ParseUint(fields[position], 10, 32); err == nil {
+		position++
+	}
+	if position < len(fields) && strings.EqualFold(fields[position], "IN") {
+		position++
+	}
+	if position >= len(fields) {
+		return fmt.Errorf("missing record type")
+	}
+
+	if rtype, found = zoneFileTypes[strings.ToUpper(fields[position])]; !found {
+		return fmt.Errorf("unsupported record type %q", fields[position])
+	}
+
+	if rdata, err = encodeRdata(rtype, fields[position+1:]); err != nil {
+		return err
+	}
+
+	z.add(name, rtype, uint32(ttl), rdata)
+	return nil
+}
+
+func encodeRdata(rtype uint16, fields []string) ([]byte, error) {
+	var ip net.IP
+	switch rtype {
+	case utils.TYPE_A, utils.TYPE_AAAA:
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("expected one address")
+		}
+		if ip = net.ParseIP(fields[0]); ip == nil || (rtype == utils.TYPE_A) != (ip.To4() != nil) {
+			return nil, fmt.Errorf("invalid address %q", fields[0])
+		}
+		if rtype == utils.TYPE_A {
+			return ip.To4(), nil
+		}
+		return ip.To16(), nil
+
+	case utils.TYPE_SVCB, utils.TYPE_HTTPS:
+		return encodeSVCB(fields)
+
+	case utils.TYPE_NS, utils.TYPE_CNAME:
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("expected one name")
+		}
+		return utils.NameToWire(fields[0])
+
+	case utils.TYPE_MX:
+		return encodeMX(fields)
+
+	case utils.TYPE_SOA:
+		return encodeSOA(fields)
+	}
+
+	return nil, fmt.Errorf("unsupported record type %d", rtype)
+}
+
+// <preference> <exchange>, e.g. 10 mail.home
+func encodeMX(fields []string) ([]byte, error) {
+	var (
+		preference uint64
+		exchange   []byte
+		err        error
+	)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("expected preference and exchange")
+	}
+	if preference, err = strconv.ParseUint(fields[0], 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid preference %q", fields[0])
+	}
+	if exchange, err = utils.NameToWire(fields[1]); err != nil {
+		return nil, err
+	}
+
+	return append(binary.BigEndian.AppendUint16(nil, uint16(preference)), exchange...), nil
+}
+
+// <mname> <rname> <serial> <refresh> <retry> <expire> <minimum>, the times in seconds
+func encodeSOA(fields []string) ([]byte, error) {
+	var (
+		rdata []byte
+		name  []byte
+		value uint64
+		err   error
+	)
+	if len(fields) != 7 {
+		return nil, fmt.Errorf("expected mname, rname, serial, refresh, retry, expire and minimum")
+	}
+
+	for _, field := range fields[:2] {
+		if name, err = utils.NameToWire(field); err != nil {
+			return nil, err
+		}
+		rdata = append(rdata, name...)
+	}
+	for _, field := range fields[2:] {
+		if value, err = strconv.ParseUint(field, 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid SOA number %q", field)
+		}
+		rdata = binary.BigEndian.AppendUint32(rdata, uint32(value))
+	}
+
+	return rdata, nil
+}
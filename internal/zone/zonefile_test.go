@@ -0,0 +1,234 @@
+package zone
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flash-dns/internal/utils"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TEST 1: HTTPS records are answered from the zone file
+// Tests that priority, target and params come back encoded as in RFC 9460
+func TestZone_LoadZoneFile_HTTPS(t *testing.T) {
+	var (
+		zone     *Zone  = NewZone()
+		filename string = filepath.Join(t.TempDir(), "local.zone")
+		content  string = "; local services\n" +
+			"app.home        A     10.0.0.5\n" +
+			"app.home  300 IN HTTPS 1 svc.app.home. port=8443 alpn=h2,h3 ipv4hint=10.0.0.5\n" +
+			"alias.home      HTTPS 0 app.home.\n" +
+			"bad.home        HTTPS 0 . alpn=h2 # alias form can't have params\n"
+		query    []byte = buildQuery("app.home", utils.TYPE_HTTPS)
+		info     *utils.QueryInfo
+		response []byte
+		answer   []utils.ResourceRecord
+		rdata    []byte
+		target   []byte = utils.EncodeName("svc.app.home")
+		params   []byte
+		found    bool
+		err      error
+	)
+
+	if err = os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+	if err = zone.LoadZoneFile(filename); err != nil {
+		t.Fatalf("LoadZoneFile failed: %v", err)
+	}
+
+	info, _ = utils.ParseQuery(query)
+	if response, found = zone.Answer(query, info); !found {
+		t.Fatal("Expected app.home HTTPS to be answered locally")
+	}
+	if answer, _, _, err = utils.ParseRecords(response); err != nil || len(answer) != 1 {
+		t.Fatalf("Expected one HTTPS record, got %d (%v)", len(answer), err)
+	}
+	if answer[0].Type != utils.TYPE_HTTPS || answer[0].TTL != 300 {
+		t.Errorf("Expected HTTPS with ttl 300, got type %d ttl %d", answer[0].Type, answer[0].TTL)
+	}
+
+	rdata = answer[0].Data
+	if binary.BigEndian.Uint16(rdata[0:2]) != 1 {
+		t.Errorf("Expected priority 1, got %d", binary.BigEndian.Uint16(rdata[0:2]))
+	}
+	if !bytes.Equal(rdata[2:2+len(target)], target) {
+		t.Errorf("Expected target svc.app.home, got %v", rdata[2:2+len(target)])
+	}
+
+	// alpn (1) before port (3) before ipv4hint (4), whatever the file order
+	params = []byte{0, 1, 0, 6, 2, 'h', '2', 2, 'h', '3', 0, 3, 0, 2, 0x20, 0xFB, 0, 4, 0, 4, 10, 0, 0, 5}
+	if !bytes.Equal(rdata[2+len(target):], params) {
+		t.Errorf("Expected params %v, got %v", params, rdata[2+len(target):])
+	}
+
+	if len(answerIPs(t, zone, "app.home", utils.TYPE_A)) != 1 {
+		t.Error("Expected the A record next to the HTTPS one")
+	}
+
+	query = buildQuery("alias.home", utils.TYPE_HTTPS)
+	info, _ = utils.ParseQuery(query)
+	response, _ = zone.Answer(query, info)
+	answer, _, _, _ = utils.ParseRecords(response)
+	if len(answer) != 1 || binary.BigEndian.Uint16(answer[0].Data[0:2]) != 0 || !strings.HasSuffix(string(answer[0].Data), string(utils.EncodeName("app.home"))) {
+		t.Errorf("Expected the alias form pointing at app.home, got %+v", answer)
+	}
+
+	query = buildQuery("bad.home", utils.TYPE_HTTPS)
+	info, _ = utils.ParseQuery(query)
+	if _, found = zone.Answer(query, info); found {
+		t.Error("Expected the invalid record to be skipped")
+	}
+}
+
+// TEST 2: MX, NS and SOA records are answered from the zone file
+// Tests the rdata encoding and that names under the question are compressed against it
+func TestZone_LoadZoneFile_MailAndAuthority(t *testing.T) {
+	var (
+		zone     *Zone  = NewZone()
+		filename string = filepath.Join(t.TempDir(), "local.zone")
+		content  string = "home  MX  10 mail.home.\n" +
+			"home  MX  20 backup.example.net\n" +
+			"home  NS  ns1.home\n" +
+			"home  SOA ns1.home. admin.home. 2024010101 3600 600 86400 60\n" +
+			"home  MX  mail.home # missing preference\n"
+		query    []byte
+		info     *utils.QueryInfo
+		response []byte
+		answer   []utils.ResourceRecord
+		expected []byte
+		found    bool
+		err      error
+	)
+
+	if err = os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+	if err = zone.LoadZoneFile(filename); err != nil {
+		t.Fatalf("LoadZoneFile failed: %v", err)
+	}
+
+	query = buildQuery("home", utils.TYPE_MX)
+	info, _ = utils.ParseQuery(query)
+	if response, found = zone.Answer(query, info); !found {
+		t.Fatal("Expected home MX to be answered locally")
+	}
+	if answer, _, _, err = utils.ParseRecords(response); err != nil || len(answer) != 2 {
+		t.Fatalf("Expected two MX records, got %d (%v)", len(answer), err)
+	}
+	for _, record := range answer {
+		switch binary.BigEndian.Uint16(record.Data[0:2]) {
+		case 10:
+			expected = append([]byte{0, 10}, utils.EncodeName("mail.home")...)
+		case 20:
+			expected = append([]byte{0, 20}, utils.EncodeName("backup.example.net")...)
+		}
+		if !bytes.Equal(record.Data, expected) {
+			t.Errorf("Expected MX rdata %v, got %v", expected, record.Data)
+		}
+	}
+	// mail.home is the label mail and a pointer to the question
+	if !bytes.Contains(response, []byte{0, 10, 4, 'm', 'a', 'i', 'l', 0xC0, 0x0C}) {
+		t.Error("Expected mail.home to be compressed against the question name")
+	}
+
+	query = buildQuery("home", utils.TYPE_SOA)
+	info, _ = utils.ParseQuery(query)
+	response, _ = zone.Answer(query, info)
+	if answer, _, _, err = utils.ParseRecords(response); err != nil || len(answer) != 1 {
+		t.Fatalf("Expected one SOA record, got %d (%v)", len(answer), err)
+	}
+	expected = append(utils.EncodeName("ns1.home"), utils.EncodeName("admin.home")...)
+	expected = binary.BigEndian.AppendUint32(expected, 2024010101)
+	for _, value := range []uint32{3600, 600, 86400, 60} {
+		expected = binary.BigEndian.AppendUint32(expected, value)
+	}
+	if !bytes.Equal(answer[0].Data, expected) {
+		t.Errorf("Expected SOA rdata %v, got %v", expected, answer[0].Data)
+	}
+	if len(response) >= len(query)+12+len(expected) {
+		t.Error("Expected the SOA names to be compressed")
+	}
+
+	query = buildQuery("home", utils.TYPE_NS)
+	info, _ = utils.ParseQuery(query)
+	response, _ = zone.Answer(query, info)
+	if answer, _, _, _ = utils.ParseRecords(response); len(answer) != 1 || answer[0].Target() != "ns1.home" {
+		t.Errorf("Expected NS ns1.home, got %+v", answer)
+	}
+}
+
+// TEST 3: Local CNAME chains are followed and loops get SERVFAIL
+// Tests that an alias answers with its chain and the address at the end, while a loop
+// or a chain longer than MAX_CNAME_HOPS returns SERVFAIL instead of spinning
+func TestZone_LoadZoneFile_CNAME(t *testing.T) {
+	var (
+		zone     *Zone  = NewZone()
+		filename string = filepath.Join(t.TempDir(), "local.zone")
+		content  string = "app.home   A     10.0.0.5\n" +
+			"www.home   CNAME web.home.\n" +
+			"web.home   CNAME app.home.\n" +
+			"a.home     CNAME b.home.\n" +
+			"b.home     CNAME a.home.\n" +
+			"out.home   CNAME example.com.\n"
+		info     *utils.QueryInfo
+		response []byte
+		answer   []utils.ResourceRecord
+		found    bool
+		i        int
+		err      error
+	)
+	for i = 0; i <= MAX_CNAME_HOPS; i++ {
+		content += fmt.Sprintf("hop%d.home CNAME hop%d.home.\n", i, i+1)
+	}
+	content += fmt.Sprintf("hop%d.home A 10.0.0.9\n", MAX_CNAME_HOPS+1)
+
+	if err = os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write zone file: %v", err)
+	}
+	if err = zone.LoadZoneFile(filename); err != nil {
+		t.Fatalf("LoadZoneFile failed: %v", err)
+	}
+
+	info, _ = utils.ParseQuery(buildQuery("www.home", utils.TYPE_A))
+	if response, found = zone.Answer(buildQuery("www.home", utils.TYPE_A), info); !found {
+		t.Fatal("Expected www.home to be answered locally")
+	}
+	if answer, _, _, err = utils.ParseRecords(response); err != nil || len(answer) != 3 {
+		t.Fatalf("Expected two CNAMEs and an A record, got %d (%v)", len(answer), err)
+	}
+	if answer[0].Target() != "web.home" || answer[1].Target() != "app.home" || answer[2].Name != "app.home" || !bytes.Equal(answer[2].Data, []byte{10, 0, 0, 5}) {
+		t.Errorf("Expected www.home -> web.home -> app.home 10.0.0.5, got %+v", answer)
+	}
+
+	var tests = []struct {
+		name    string
+		rcode   uint8
+		records int
+	}{
+		{"a.home", RCODE_SERVFAIL, 0},
+		{"hop0.home", RCODE_SERVFAIL, 0},
+		{"hop1.home", 0, MAX_CNAME_HOPS + 1}, // MAX_CNAME_HOPS aliases and the address
+		{"out.home", 0, 1},                   // the client follows the chain out of the zone
+	}
+	for _, test := range tests {
+		info, _ = utils.ParseQuery(buildQuery(test.name, utils.TYPE_A))
+		if response, found = zone.Answer(buildQuery(test.name, utils.TYPE_A), info); !found {
+			t.Fatalf("%s: expected a local answer", test.name)
+		}
+		if answer, _, _, err = utils.ParseRecords(response); err != nil {
+			t.Fatalf("%s: failed to parse the answer: %v", test.name, err)
+		}
+		if response[3]&0x0F != test.rcode || len(answer) != test.records {
+			t.Errorf("%s: expected rcode %d with %d records, got rcode %d with %d", test.name, test.rcode, test.records, response[3]&0x0F, len(answer))
+		}
+	}
+
+	info, _ = utils.ParseQuery(buildQuery("a.home", utils.TYPE_CNAME))
+	if response, _ = zone.Answer(buildQuery("a.home", utils.TYPE_CNAME), info); response[3]&0x0F != 0 {
+		t.Errorf("Expected a CNAME query to get the record itself, got rcode %d", response[3]&0x0F)
+	}
+}